@@ -72,8 +72,11 @@ func NewPublicDataFromBlobs(publicDataBlobs *PublicDataBlobs) (*PublicData, erro
 		return nil, fmt.Errorf("Imported roots tree root (%v) doesn't match the expected root (%v)",
 			rootsTree.RootKey(), publicDataBlobs.RootsTreeRoot)
 	}
-	idenState := core.IdenState(&publicDataBlobs.ClaimsTreeRoot,
+	idenState, err := core.IdenStateSafe(&publicDataBlobs.ClaimsTreeRoot,
 		&publicDataBlobs.RevocationsTreeRoot, &publicDataBlobs.RootsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
 	if !idenState.Equals(&publicDataBlobs.IdenState) {
 		return nil, ErrCalculatedIdenStateDoesntMatch
 	}
@@ -86,3 +89,17 @@ func NewPublicDataFromBlobs(publicDataBlobs *PublicDataBlobs) (*PublicData, erro
 		RootsTree:           rootsTree,
 	}, nil
 }
+
+// IdenStateHash calculates the identity state from the tree roots of the
+// PublicData and returns it, or ErrCalculatedIdenStateDoesntMatch if it
+// doesn't match the IdenState of the PublicData.
+func (pd *PublicData) IdenStateHash() (*merkletree.Hash, error) {
+	idenState, err := core.IdenStateSafe(pd.ClaimsTreeRoot, pd.RevocationsTreeRoot, pd.RootsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !idenState.Equals(pd.IdenState) {
+		return nil, ErrCalculatedIdenStateDoesntMatch
+	}
+	return idenState, nil
+}
@@ -0,0 +1,30 @@
+package idenpuboffchain
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicDataIdenStateHash(t *testing.T) {
+	clr := merkletree.NewHashFromBigInt(big.NewInt(1))
+	rer := merkletree.NewHashFromBigInt(big.NewInt(2))
+	ror := merkletree.NewHashFromBigInt(big.NewInt(3))
+	publicData := PublicData{
+		IdenState:           core.IdenState(clr, rer, ror),
+		ClaimsTreeRoot:      clr,
+		RevocationsTreeRoot: rer,
+		RootsTreeRoot:       ror,
+	}
+	idenState, err := publicData.IdenStateHash()
+	require.Nil(t, err)
+	assert.Equal(t, publicData.IdenState, idenState)
+
+	publicData.RootsTreeRoot = rer
+	_, err = publicData.IdenStateHash()
+	assert.Equal(t, ErrCalculatedIdenStateDoesntMatch, err)
+}
@@ -3,7 +3,9 @@ package idenpubonchain
 import (
 	"fmt"
 	"math/big"
+	"strings"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -23,13 +25,45 @@ var (
 	ErrIdenNotOnChainOrTimeTooNew  = fmt.Errorf("Identity not found on chain or the queried time is not yet on chain")
 	ErrIdenByBlockNotFound         = fmt.Errorf("Identity not found by the queried block number")
 	ErrIdenByTimeNotFound          = fmt.Errorf("Identity not found by the queried block timestamp")
+	ErrIdenByStateNotFound         = fmt.Errorf("Identity not found by the queried identity state")
 )
 
-// IdenPubOnChainer is an interface that gives access to the IdenStates Smart Contract.
-type IdenPubOnChainer interface {
+// IdenStateReader is an interface that gives read access to the published
+// Identity States.
+type IdenStateReader interface {
 	GetState(id *core.ID) (*proof.IdenStateData, error)
 	GetStateByBlock(id *core.ID, blockN uint64) (*proof.IdenStateData, error)
 	GetStateByTime(id *core.ID, blockTimestamp int64) (*proof.IdenStateData, error)
+}
+
+// IdenStateByStateReader is implemented by the IdenStateReaders that can find
+// a published Identity State by its value.
+type IdenStateByStateReader interface {
+	// GetStateByState returns the Identity State Data of the given ID and
+	// idenState, which was published at block fromBlockN or later.
+	GetStateByState(id *core.ID, idenState *merkletree.Hash, fromBlockN uint64) (*proof.IdenStateData, error)
+}
+
+// IdenStateHistoryReader is implemented by the IdenStateReaders that can list
+// the last published Identity States of an identity.
+type IdenStateHistoryReader interface {
+	// GetStateHistory returns up to the last n Identity States of the
+	// given ID, the most recent one first.
+	GetStateHistory(id *core.ID, n uint32) ([]*proof.IdenStateData, error)
+}
+
+// IdenPubOnChainer is an interface that gives access to the IdenStates Smart Contract.
+//
+// SetState and InitState return a Transaction that the Issuer keeps to track
+// the update with TxConfirmBlocks.  Implementations that don't send one
+// ethereum transaction per update (like the l2 adapter) can return a
+// Transaction that only works as a handle of the update.  TxConfirmBlocks
+// must return eth.ErrReceiptNotReceived while the update is not yet
+// submitted, and afterwards the number of confirmations under the finality
+// of the chain where the state is published; the Issuer considers the update
+// final once it reaches Config.ConfirmBlocks.
+type IdenPubOnChainer interface {
+	IdenStateReader
 	SetState(id *core.ID, newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error)
 	InitState(id *core.ID, genesisState *merkletree.Hash,
 		newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error)
@@ -37,6 +71,33 @@ type IdenPubOnChainer interface {
 	// VerifyProofClaim(pc *proof.ProofClaim) (bool, error)
 }
 
+// GasEstimator is implemented by the IdenPubOnChainers that can estimate the
+// gas of the SetState and InitState transactions.
+type GasEstimator interface {
+	// EstimateGas returns the gas needed by the InitState call if
+	// genesisState is not nil, or by the SetState call otherwise, without
+	// sending it.
+	EstimateGas(id *core.ID, genesisState *merkletree.Hash,
+		newState *merkletree.Hash, proof *zktypes.Proof) (uint64, error)
+}
+
+// TxResender is implemented by the IdenPubOnChainers that can replace a sent
+// SetState or InitState transaction that is still pending with one with a
+// higher gas price, without generating a new proof.
+type TxResender interface {
+	ResendTx(tx *types.Transaction, gasPrice *big.Int) (*types.Transaction, error)
+}
+
+// IdenPubOnChainerOpts is implemented by the IdenPubOnChainers that allow
+// setting the gas limit and gas price of the SetState and InitState
+// transactions.  A nil opts keeps the default ones.
+type IdenPubOnChainerOpts interface {
+	SetStateOpts(id *core.ID, newState *merkletree.Hash, proof *zktypes.Proof,
+		opts *eth.TxOpts) (*types.Transaction, error)
+	InitStateOpts(id *core.ID, genesisState *merkletree.Hash, newState *merkletree.Hash,
+		proof *zktypes.Proof, opts *eth.TxOpts) (*types.Transaction, error)
+}
+
 // ContractAddresses are the list of Smart Contract addresses used for the on chain identity state data.
 type ContractAddresses struct {
 	IdenStates common.Address
@@ -124,6 +185,33 @@ func (ip *IdenPubOnChain) GetStateClosestToBlock(id *core.ID, queryBlockN uint64
 	}, nil
 }
 
+// GetStateHistory returns up to the last n Identity States of the given ID
+// from the IdenStates Smart Contract, the most recent one first.  Each state
+// is queried with GetStateClosestToBlock at the block before the previous
+// one, so n calls are made to the smart contract.
+func (ip *IdenPubOnChain) GetStateHistory(id *core.ID, n uint32) ([]*proof.IdenStateData, error) {
+	history := make([]*proof.IdenStateData, 0, n)
+	if n == 0 {
+		return history, nil
+	}
+	idenStateData, err := ip.GetState(id)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		history = append(history, idenStateData)
+		if uint32(len(history)) == n || idenStateData.BlockN == 0 {
+			return history, nil
+		}
+		idenStateData, err = ip.GetStateClosestToBlock(id, idenStateData.BlockN-1)
+		if err == ErrIdenNotOnChainOrBlockTooNew {
+			return history, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
 // GetStateByTime returns the Identity State Data of the given ID published at
 // queryBlockTs from the IdenStates Smart Contract.
 func (ip *IdenPubOnChain) GetStateByTime(id *core.ID, queryBlockTs int64) (*proof.IdenStateData, error) {
@@ -166,11 +254,57 @@ func (ip *IdenPubOnChain) GetStateClosestToTime(id *core.ID, queryBlockTs int64)
 	}, nil
 }
 
+// GetStateByState returns the Identity State Data of the given ID and
+// idenState from the StateUpdated events of the IdenStates Smart Contract,
+// because the contract doesn't index the states by value.  Only the events
+// from block fromBlockN on are filtered.  This requires the ethereum node to
+// keep the logs of the blocks in which the state was published.
+func (ip *IdenPubOnChain) GetStateByState(id *core.ID, idenState *merkletree.Hash,
+	fromBlockN uint64) (*proof.IdenStateData, error) {
+	var idenStateData *proof.IdenStateData
+	if err := ip.client.Call(func(c *ethclient.Client) error {
+		idenStates, err := contracts.NewState(ip.addresses.IdenStates, c)
+		if err != nil {
+			return err
+		}
+		iter, err := idenStates.FilterStateUpdated(&bind.FilterOpts{Start: fromBlockN})
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+		idBigInt, idenStateBigInt := id.BigInt(), idenState.BigInt()
+		for iter.Next() {
+			if iter.Event.Id.Cmp(idBigInt) == 0 && iter.Event.State.Cmp(idenStateBigInt) == 0 {
+				idenStateData = &proof.IdenStateData{
+					BlockN:    iter.Event.BlockN,
+					BlockTs:   int64(iter.Event.Timestamp),
+					IdenState: merkletree.NewHashFromBigInt(iter.Event.State),
+				}
+				return nil
+			}
+		}
+		return iter.Error()
+	}); err != nil {
+		return nil, err
+	}
+	if idenStateData == nil {
+		return nil, ErrIdenByStateNotFound
+	}
+	return idenStateData, nil
+}
+
 // InitState initializes the first Identity State of the given ID in the IdenStates Smart Contract.
 func (ip *IdenPubOnChain) InitState(id *core.ID, genesisState *merkletree.Hash,
 	newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error) {
-	if tx, err := ip.client.CallAuth(
-		1000000,
+	return ip.InitStateOpts(id, genesisState, newState, proof, nil)
+}
+
+// InitStateOpts is like InitState but the gas limit and gas price of the
+// transaction can be set with opts.
+func (ip *IdenPubOnChain) InitStateOpts(id *core.ID, genesisState *merkletree.Hash,
+	newState *merkletree.Hash, proof *zktypes.Proof, opts *eth.TxOpts) (*types.Transaction, error) {
+	if tx, err := ip.client.CallAuthOpts(
+		1000000, opts,
 		func(c *ethclient.Client, auth *bind.TransactOpts) (*types.Transaction, error) {
 			idenStates, err := contracts.NewState(ip.addresses.IdenStates, c)
 			if err != nil {
@@ -191,8 +325,15 @@ func (ip *IdenPubOnChain) InitState(id *core.ID, genesisState *merkletree.Hash,
 // SetState updates the Identity State of the given ID in the IdenStates Smart Contract.
 func (ip *IdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
 	proof *zktypes.Proof) (*types.Transaction, error) {
-	if tx, err := ip.client.CallAuth(
-		1000000,
+	return ip.SetStateOpts(id, newState, proof, nil)
+}
+
+// SetStateOpts is like SetState but the gas limit and gas price of the
+// transaction can be set with opts.
+func (ip *IdenPubOnChain) SetStateOpts(id *core.ID, newState *merkletree.Hash,
+	proof *zktypes.Proof, opts *eth.TxOpts) (*types.Transaction, error) {
+	if tx, err := ip.client.CallAuthOpts(
+		1000000, opts,
 		func(c *ethclient.Client, auth *bind.TransactOpts) (*types.Transaction, error) {
 			idenStates, err := contracts.NewState(ip.addresses.IdenStates, c)
 			if err != nil {
@@ -209,6 +350,34 @@ func (ip *IdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
 	}
 }
 
+// EstimateGas returns the gas needed by the InitState call if genesisState is
+// not nil, or by the SetState call otherwise, without sending it.
+func (ip *IdenPubOnChain) EstimateGas(id *core.ID, genesisState *merkletree.Hash,
+	newState *merkletree.Hash, proof *zktypes.Proof) (uint64, error) {
+	stateABI, err := abi.JSON(strings.NewReader(contracts.StateABI))
+	if err != nil {
+		return 0, err
+	}
+	proofA, proofB, proofC := zkutils.ProofToBigInts(proof)
+	var data []byte
+	if genesisState != nil {
+		data, err = stateABI.Pack("initState", newState.BigInt(), genesisState.BigInt(), id.BigInt(),
+			proofA, proofB, proofC)
+	} else {
+		data, err = stateABI.Pack("setState", newState.BigInt(), id.BigInt(), proofA, proofB, proofC)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ip.client.EstimateGas(ip.addresses.IdenStates, data)
+}
+
+// ResendTx replaces the pending transaction tx with one with the same
+// SetState or InitState call and a higher gasPrice.
+func (ip *IdenPubOnChain) ResendTx(tx *types.Transaction, gasPrice *big.Int) (*types.Transaction, error) {
+	return ip.client.ResendTx(tx, gasPrice)
+}
+
 // TxConfirmBlocks returns the number of confirmed blocks of transaction tx.
 func (ip *IdenPubOnChain) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
 	receipt, err := ip.client.GetReceipt(tx)
@@ -12,3 +12,31 @@ func TestIdenPubOnChainInterface(t *testing.T) {
 	idenPubOnChain = New(nil, ContractAddresses{})
 	require.NotNil(t, idenPubOnChain)
 }
+
+// Assert that IdenPubOnChain follows the TxResender interface
+func TestIdenPubOnChainTxResenderInterface(t *testing.T) {
+	var txResender TxResender //nolint:gosimple
+	txResender = New(nil, ContractAddresses{})
+	require.NotNil(t, txResender)
+}
+
+// Assert that IdenPubOnChain follows the IdenPubOnChainerOpts interface
+func TestIdenPubOnChainOptsInterface(t *testing.T) {
+	var idenPubOnChainOpts IdenPubOnChainerOpts //nolint:gosimple
+	idenPubOnChainOpts = New(nil, ContractAddresses{})
+	require.NotNil(t, idenPubOnChainOpts)
+}
+
+// Assert that IdenPubOnChain follows the IdenStateByStateReader interface
+func TestIdenPubOnChainByStateReaderInterface(t *testing.T) {
+	var byStateReader IdenStateByStateReader //nolint:gosimple
+	byStateReader = New(nil, ContractAddresses{})
+	require.NotNil(t, byStateReader)
+}
+
+// Assert that IdenPubOnChain follows the GasEstimator interface
+func TestIdenPubOnChainGasEstimatorInterface(t *testing.T) {
+	var gasEstimator GasEstimator //nolint:gosimple
+	gasEstimator = New(nil, ContractAddresses{})
+	require.NotNil(t, gasEstimator)
+}
@@ -0,0 +1,102 @@
+package l2
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// StateUpdate is an Identity State transition to be posted in a batch.
+type StateUpdate struct {
+	Id *core.ID
+	// GenesisState is only set in the first transition of the identity
+	// (InitState), and is nil otherwise.
+	GenesisState *merkletree.Hash
+	NewState     *merkletree.Hash
+	Proof        *zktypes.Proof
+}
+
+// BatchPoster aggregates the state updates of many identities and posts them
+// together, for example in a single transaction to an L2 rollup state
+// contract.
+type BatchPoster interface {
+	idenpubonchain.IdenStateReader
+	// Queue adds the update to the next batch and returns an identifier of
+	// the update.
+	Queue(update *StateUpdate) (uint64, error)
+	// Confirmations returns the number of confirmations of the batch that
+	// contains the update under the finality of the L2.  It must return
+	// eth.ErrReceiptNotReceived while the batch has not been posted.
+	Confirmations(updateID uint64) (*big.Int, error)
+}
+
+// IdenPubOnChain is an implementation of the IdenPubOnChainer that publishes
+// the identity states through a BatchPoster.  The transactions returned by
+// SetState and InitState are not sent to any chain: they are handles that
+// keep the update identifier as nonce.
+type IdenPubOnChain struct {
+	poster BatchPoster
+}
+
+// New creates a new IdenPubOnChain
+func New(poster BatchPoster) *IdenPubOnChain {
+	return &IdenPubOnChain{poster: poster}
+}
+
+// GetState returns the Identity State Data of the given ID.
+func (ip *IdenPubOnChain) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	return ip.poster.GetState(id)
+}
+
+// GetStateByBlock returns the Identity State Data of the given ID published at
+// queryBlockN.
+func (ip *IdenPubOnChain) GetStateByBlock(id *core.ID, queryBlockN uint64) (*proof.IdenStateData, error) {
+	return ip.poster.GetStateByBlock(id, queryBlockN)
+}
+
+// GetStateByTime returns the Identity State Data of the given ID published at
+// queryBlockTs.
+func (ip *IdenPubOnChain) GetStateByTime(id *core.ID, queryBlockTs int64) (*proof.IdenStateData, error) {
+	return ip.poster.GetStateByTime(id, queryBlockTs)
+}
+
+func (ip *IdenPubOnChain) queue(update *StateUpdate) (*types.Transaction, error) {
+	updateID, err := ip.poster.Queue(update)
+	if err != nil {
+		return nil, err
+	}
+	return types.NewTransaction(updateID, common.Address{}, nil, 0, nil, nil), nil
+}
+
+// SetState queues the update of the Identity State of the given ID.
+func (ip *IdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
+	zkProof *zktypes.Proof) (*types.Transaction, error) {
+	return ip.queue(&StateUpdate{Id: id, NewState: newState, Proof: zkProof})
+}
+
+// InitState queues the initialization of the first Identity State of the
+// given ID.
+func (ip *IdenPubOnChain) InitState(id *core.ID, genesisState,
+	newState *merkletree.Hash, zkProof *zktypes.Proof) (*types.Transaction, error) {
+	return ip.queue(&StateUpdate{Id: id, GenesisState: genesisState, NewState: newState,
+		Proof: zkProof})
+}
+
+// TxConfirmBlocks returns the number of confirmations of the batch that
+// contains the update of the transaction handle tx.
+func (ip *IdenPubOnChain) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
+	return ip.poster.Confirmations(tx.Nonce())
+}
+
+// EstimateGas returns 0, because the updates are posted in batches by the
+// BatchPoster, so the gas of a single update is not known.
+func (ip *IdenPubOnChain) EstimateGas(id *core.ID, genesisState,
+	newState *merkletree.Hash, zkProof *zktypes.Proof) (uint64, error) {
+	return 0, nil
+}
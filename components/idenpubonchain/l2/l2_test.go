@@ -0,0 +1,127 @@
+package l2
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/eth"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchPosterTest is a BatchPoster that posts the queued updates when post
+// is called, and keeps only the last state of each identity.
+type batchPosterTest struct {
+	blockN   uint64
+	updates  []*StateUpdate
+	postedAt map[uint64]uint64
+	states   map[core.ID]*proof.IdenStateData
+}
+
+func newBatchPosterTest() *batchPosterTest {
+	return &batchPosterTest{
+		postedAt: make(map[uint64]uint64),
+		states:   make(map[core.ID]*proof.IdenStateData),
+	}
+}
+
+func (p *batchPosterTest) post() {
+	p.blockN++
+	for i, u := range p.updates {
+		if _, ok := p.postedAt[uint64(i)]; ok {
+			continue
+		}
+		p.postedAt[uint64(i)] = p.blockN
+		p.states[*u.Id] = &proof.IdenStateData{BlockN: p.blockN, IdenState: u.NewState}
+	}
+}
+
+func (p *batchPosterTest) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	idenStateData, ok := p.states[*id]
+	if !ok {
+		return nil, idenpubonchain.ErrIdenNotOnChain
+	}
+	return idenStateData, nil
+}
+
+func (p *batchPosterTest) GetStateByBlock(id *core.ID, blockN uint64) (*proof.IdenStateData, error) {
+	return nil, idenpubonchain.ErrIdenByBlockNotFound
+}
+
+func (p *batchPosterTest) GetStateByTime(id *core.ID, blockTs int64) (*proof.IdenStateData, error) {
+	return nil, idenpubonchain.ErrIdenByTimeNotFound
+}
+
+func (p *batchPosterTest) Queue(update *StateUpdate) (uint64, error) {
+	p.updates = append(p.updates, update)
+	return uint64(len(p.updates) - 1), nil
+}
+
+func (p *batchPosterTest) Confirmations(updateID uint64) (*big.Int, error) {
+	blockN, ok := p.postedAt[updateID]
+	if !ok {
+		return nil, eth.ErrReceiptNotReceived
+	}
+	return new(big.Int).SetUint64(p.blockN - blockN), nil
+}
+
+// Assert that IdenPubOnChain follows the IdenPubOnChainer interface
+func TestL2IdenPubOnChainInterface(t *testing.T) {
+	var idenPubOnChain idenpubonchain.IdenPubOnChainer //nolint:gosimple
+	idenPubOnChain = New(newBatchPosterTest())
+	require.NotNil(t, idenPubOnChain)
+}
+
+func TestL2IdenPubOnChain(t *testing.T) {
+	poster := newBatchPosterTest()
+	ip := New(poster)
+
+	id0, id1 := &core.ID{0}, &core.ID{1}
+	state0, state1 := merkletree.NewHashFromBigInt(big.NewInt(10)),
+		merkletree.NewHashFromBigInt(big.NewInt(11))
+	tx0, err := ip.InitState(id0, &merkletree.HashZero, state0, nil)
+	require.Nil(t, err)
+	tx1, err := ip.SetState(id1, state1, nil)
+	require.Nil(t, err)
+	assert.NotEqual(t, tx0.Nonce(), tx1.Nonce())
+	assert.Equal(t, &merkletree.HashZero, poster.updates[tx0.Nonce()].GenesisState)
+	assert.Nil(t, poster.updates[tx1.Nonce()].GenesisState)
+
+	// The transaction handles survive a JSON round trip, as the Issuer
+	// stores them.
+	txJSON, err := json.Marshal(tx0)
+	require.Nil(t, err)
+	var tx0Load types.Transaction
+	require.Nil(t, json.Unmarshal(txJSON, &tx0Load))
+	assert.Equal(t, tx0.Nonce(), tx0Load.Nonce())
+
+	gas, err := ip.EstimateGas(id1, nil, state1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), gas)
+
+	_, err = ip.TxConfirmBlocks(tx0)
+	assert.Equal(t, eth.ErrReceiptNotReceived, err)
+	_, err = ip.GetState(id0)
+	assert.Equal(t, idenpubonchain.ErrIdenNotOnChain, err)
+
+	// Both updates are posted in the same batch.
+	poster.post()
+	poster.post()
+	for _, tx := range []*types.Transaction{tx0, &tx0Load, tx1} {
+		confirmBlocks, err := ip.TxConfirmBlocks(tx)
+		require.Nil(t, err)
+		assert.Equal(t, big.NewInt(1), confirmBlocks)
+	}
+	idenStateData, err := ip.GetState(id0)
+	require.Nil(t, err)
+	assert.Equal(t, state0, idenStateData.IdenState)
+	idenStateData, err = ip.GetState(id1)
+	require.Nil(t, err)
+	assert.Equal(t, state1, idenStateData.IdenState)
+}
@@ -20,6 +20,7 @@ type IdenStateHistory struct {
 	IdenStates []*proof.IdenStateData
 	ByTime     map[int64]*proof.IdenStateData
 	ByBlock    map[uint64]*proof.IdenStateData
+	ByState    map[merkletree.Hash]*proof.IdenStateData
 }
 
 func NewIdenStateHistory() *IdenStateHistory {
@@ -27,6 +28,7 @@ func NewIdenStateHistory() *IdenStateHistory {
 		IdenStates: make([]*proof.IdenStateData, 0),
 		ByTime:     make(map[int64]*proof.IdenStateData),
 		ByBlock:    make(map[uint64]*proof.IdenStateData),
+		ByState:    make(map[merkletree.Hash]*proof.IdenStateData),
 	}
 }
 
@@ -34,6 +36,7 @@ func (h *IdenStateHistory) Add(idenStateData *proof.IdenStateData) {
 	h.IdenStates = append(h.IdenStates, idenStateData)
 	h.ByTime[idenStateData.BlockTs] = idenStateData
 	h.ByBlock[idenStateData.BlockN] = idenStateData
+	h.ByState[*idenStateData.IdenState] = idenStateData
 }
 
 type IdIdenStateData struct {
@@ -110,6 +113,22 @@ func (ip *IdenPubOnChain) GetStateByBlock(id *core.ID, queryBlockN uint64) (*pro
 	return idenState, nil
 }
 
+// GetStateHistory returns up to the last n Identity States of the given ID
+// from the IdenStates Smart Contract, the most recent one first.
+func (ip *IdenPubOnChain) GetStateHistory(id *core.ID, n uint32) ([]*proof.IdenStateData, error) {
+	ip.rw.RLock()
+	defer ip.rw.RUnlock()
+	idenStatesData, ok := ip.idenStatesData[*id]
+	if !ok {
+		return nil, idenpubonchain.ErrIdenNotOnChain
+	}
+	history := make([]*proof.IdenStateData, 0, n)
+	for i := len(idenStatesData.IdenStates) - 1; i >= 0 && uint32(len(history)) < n; i-- {
+		history = append(history, idenStatesData.IdenStates[i])
+	}
+	return history, nil
+}
+
 // GetStateByTime returns the Identity State Data of the given ID published at
 // queryBlockTs from the IdenStates Smart Contract.
 func (ip *IdenPubOnChain) GetStateByTime(id *core.ID, queryBlockTs int64) (*proof.IdenStateData, error) {
@@ -126,6 +145,24 @@ func (ip *IdenPubOnChain) GetStateByTime(id *core.ID, queryBlockTs int64) (*proo
 	return idenState, nil
 }
 
+// GetStateByState returns the Identity State Data of the given ID and
+// idenState from the IdenStates Smart Contract.  The states are indexed by
+// value, so fromBlockN is only checked against the found one.
+func (ip *IdenPubOnChain) GetStateByState(id *core.ID, idenState *merkletree.Hash,
+	fromBlockN uint64) (*proof.IdenStateData, error) {
+	ip.rw.RLock()
+	defer ip.rw.RUnlock()
+	idenStatesData, ok := ip.idenStatesData[*id]
+	if !ok {
+		return nil, idenpubonchain.ErrIdenNotOnChain
+	}
+	idenStateData, ok := idenStatesData.ByState[*idenState]
+	if !ok || idenStateData.BlockN < fromBlockN {
+		return nil, idenpubonchain.ErrIdenByStateNotFound
+	}
+	return idenStateData, nil
+}
+
 // SetState updates the Identity State of the given ID in the IdenStates Smart Contract.
 func (ip *IdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
 	zkProof *zktypes.Proof) (*types.Transaction, error) {
@@ -178,6 +215,31 @@ func (ip *IdenPubOnChain) TxConfirmBlocks(tx *types.Transaction) (*big.Int, erro
 	return currentBlock.Sub(currentBlock, blockNumber), nil
 }
 
+// EstimateGas checks the InitState call if genesisState is not nil, or the
+// SetState call otherwise, without queueing it.  The local state doesn't
+// consume gas, so it returns 0 if the call would succeed.
+func (ip *IdenPubOnChain) EstimateGas(id *core.ID, genesisState,
+	newState *merkletree.Hash, zkProof *zktypes.Proof) (uint64, error) {
+	ip.rw.RLock()
+	defer ip.rw.RUnlock()
+	idenStatesData, ok := ip.idenStatesData[*id]
+	oldState := genesisState
+	if genesisState != nil {
+		if ok {
+			return 0, fmt.Errorf("identity already exists on chain")
+		}
+	} else {
+		if !ok {
+			return 0, idenpubonchain.ErrIdenNotOnChain
+		}
+		oldState = idenStatesData.IdenStates[len(idenStatesData.IdenStates)-1].IdenState
+	}
+	if !ip.verifyZKP(zkProof, id, oldState, newState) {
+		return 0, fmt.Errorf("zkproof verification failed")
+	}
+	return 0, nil
+}
+
 func (ip *IdenPubOnChain) verifyZKP(zkProof *zktypes.Proof,
 	id *core.ID, oldState, newState *merkletree.Hash) bool {
 	var idElem merkletree.ElemBytes
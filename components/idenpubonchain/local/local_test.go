@@ -1,11 +1,16 @@
 package local
 
 import (
+	"math/big"
 	"testing"
 	"time"
 
 	zktypes "github.com/iden3/go-circom-prover-verifier/types"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,3 +28,42 @@ func TestLocalIdenPubOnChainInterface(t *testing.T) {
 	)
 	require.NotNil(t, idenPubOnChain)
 }
+
+func TestLocalIdenPubOnChainEstimateGas(t *testing.T) {
+	ip := New(time.Now, func() uint64 { return 0 }, &zktypes.Vk{})
+	_, err := ip.EstimateGas(&core.ID{}, nil, &merkletree.HashZero, &zktypes.Proof{})
+	assert.Equal(t, idenpubonchain.ErrIdenNotOnChain, err)
+}
+
+func TestLocalIdenPubOnChainGetStateHistory(t *testing.T) {
+	var _ idenpubonchain.IdenStateHistoryReader = &IdenPubOnChain{}
+	ip := New(time.Now, func() uint64 { return 0 }, &zktypes.Vk{})
+	id := &core.ID{}
+	_, err := ip.GetStateHistory(id, 2)
+	assert.Equal(t, idenpubonchain.ErrIdenNotOnChain, err)
+
+	history := NewIdenStateHistory()
+	for i := 0; i < 3; i++ {
+		history.Add(&proof.IdenStateData{
+			BlockN:    uint64(i),
+			BlockTs:   int64(i * 10),
+			IdenState: merkletree.NewHashFromBigInt(big.NewInt(int64(i + 1))),
+		})
+	}
+	ip.idenStatesData[*id] = history
+
+	states, err := ip.GetStateHistory(id, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(states))
+	assert.Equal(t, uint64(2), states[0].BlockN)
+	assert.Equal(t, uint64(1), states[1].BlockN)
+
+	states, err = ip.GetStateHistory(id, 5)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(states))
+	assert.Equal(t, uint64(0), states[2].BlockN)
+
+	states, err = ip.GetStateHistory(id, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(states))
+}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"github.com/ethereum/go-ethereum/core/types"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/proof"
 	"github.com/iden3/go-iden3-core/merkletree"
@@ -32,6 +33,11 @@ func (m *IdenPubOnChainMock) GetStateByTime(id *core.ID, blockTimeStamp int64) (
 	return args.Get(0).(*proof.IdenStateData), args.Error(1)
 }
 
+func (m *IdenPubOnChainMock) GetStateByState(id *core.ID, idenState *merkletree.Hash, fromBlockN uint64) (*proof.IdenStateData, error) {
+	args := m.Called(id, idenState, fromBlockN)
+	return args.Get(0).(*proof.IdenStateData), args.Error(1)
+}
+
 func (m *IdenPubOnChainMock) InitState(id *core.ID, genesisState *merkletree.Hash, newState *merkletree.Hash, kOpProof []byte, stateTransitionProof []byte, signature *babyjub.SignatureComp) (*types.Transaction, error) {
 	args := m.Called(id, genesisState, newState, kOpProof, stateTransitionProof, signature)
 	return args.Get(0).(*types.Transaction), args.Error(1)
@@ -42,6 +48,11 @@ func (m *IdenPubOnChainMock) SetState(id *core.ID, newState *merkletree.Hash, kO
 	return args.Get(0).(*types.Transaction), args.Error(1)
 }
 
+func (m *IdenPubOnChainMock) EstimateGas(id *core.ID, genesisState *merkletree.Hash, newState *merkletree.Hash, proof *zktypes.Proof) (uint64, error) {
+	args := m.Called(id, genesisState, newState, proof)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
 // func (m *IdenPubOnChainMock) VerifyProofClaim(pc *proof.ProofClaim) (bool, error) {
 // 	args := m.Called(pc)
 // 	return args.Get(0).(bool), args.Error(1)
@@ -17,12 +17,14 @@ import (
 )
 
 var (
-	ErrIdenStateOnChainDoesntMatch    = fmt.Errorf("IdenState on chain doesn't match the one in the credential")
-	ErrMtpNonExistence                = fmt.Errorf("The Merkle Tree Proof is of non-existence")
+	ErrIdenStateOnChainDoesntMatch    = proof.ErrIdenStateOnChainDoesntMatch
+	ErrMtpNonExistence                = proof.ErrMtpNonExistence
 	ErrMtpExistence                   = fmt.Errorf("The Merkle Tree Proof is of existence")
-	ErrCalculatedIdenStateDoesntMatch = fmt.Errorf("Calculated IdenState doesn't match the one in the credential")
+	ErrCalculatedIdenStateDoesntMatch = proof.ErrCalculatedIdenStateDoesntMatch
 	ErrClaimExpired                   = fmt.Errorf("Expired claim")
 	ErrFailedVerifyZkProofCredential  = fmt.Errorf("failed verifing generated zk proof of credential")
+	ErrIdenStateTooOld                = fmt.Errorf("The credential IdenState is older than the accepted state age")
+	ErrStateHistoryUnsupported        = fmt.Errorf("The IdenPubOnChainer doesn't support reading the state history")
 )
 
 // Verifier allows verifying claims in three forms: credential of existence,
@@ -54,35 +56,52 @@ func NewWithTimeNow(idenPubOnChain idenpubonchain.IdenPubOnChainer, timeNow func
 }
 
 // VerifyCredentialExistence verifies a credential of existence.  That is, that
-// the claim was issued by a particular identity.
+// the claim was issued by a particular identity.  The claim schema doesn't
+// need to be known by the verifier (see proof.VerifyCredentialExistenceOnChain).
 func (v *Verifier) VerifyCredentialExistence(credExist *proof.CredentialExistence) error {
-	if !credExist.MtpClaim.Existence {
-		return ErrMtpNonExistence
+	return proof.VerifyCredentialExistenceOnChain(credExist, v.idenPubOnChain)
+}
+
+// VerifyOpts are the options of the credential verification.
+type VerifyOpts struct {
+	// MaxStateAge is the number of last identity states published on
+	// chain by the issuer that are accepted as the credential IdenState.
+	// 0 accepts any identity state that has been published on chain.
+	MaxStateAge uint32
+}
+
+// VerifyCredentialExistenceOpts verifies a credential of existence like
+// VerifyCredentialExistence.  If opts.MaxStateAge is not 0, the credential
+// IdenStateData must also match one of the last opts.MaxStateAge identity
+// states of the issuer on chain, which requires the IdenPubOnChainer to
+// implement idenpubonchain.IdenStateHistoryReader.
+func (v *Verifier) VerifyCredentialExistenceOpts(credExist *proof.CredentialExistence, opts VerifyOpts) error {
+	if opts.MaxStateAge == 0 {
+		return v.VerifyCredentialExistence(credExist)
 	}
-	// Verify that the idenState is built from claims merkle tree where the
-	// claim exists.
-	hi, hv, err := credExist.Claim.HiHv()
-	if err != nil {
+	historyReader, ok := v.idenPubOnChain.(idenpubonchain.IdenStateHistoryReader)
+	if !ok {
+		return ErrStateHistoryUnsupported
+	}
+	if err := proof.VerifyCredentialExistence(credExist); err != nil {
 		return err
 	}
-	claimsRoot, err := merkletree.RootFromProof(credExist.MtpClaim, hi, hv)
+	history, err := historyReader.GetStateHistory(credExist.Id, opts.MaxStateAge)
 	if err != nil {
 		return err
 	}
-	idenState := core.IdenState(claimsRoot, credExist.RevocationsTreeRoot, credExist.RootsTreeRoot)
-	if !idenState.Equals(credExist.IdenStateData.IdenState) {
-		return ErrCalculatedIdenStateDoesntMatch
+	for _, idenStateData := range history {
+		if idenStateData.BlockN == credExist.IdenStateData.BlockN &&
+			idenStateData.BlockTs == credExist.IdenStateData.BlockTs &&
+			idenStateData.IdenState.Equals(credExist.IdenStateData.IdenState) {
+			return nil
+		}
 	}
-
-	// Verify that the IdenStateData from the existence credential is in the smart contract.
-	idenStateDataOnChain, err := v.idenPubOnChain.GetStateByBlock(credExist.Id, credExist.IdenStateData.BlockN)
-	if err != nil {
+	// Distinguish a state older than the window from one not on chain.
+	if err := proof.VerifyCredentialExistenceOnChain(credExist, v.idenPubOnChain); err != nil {
 		return err
 	}
-	if !reflect.DeepEqual(idenStateDataOnChain, &credExist.IdenStateData) {
-		return ErrIdenStateOnChainDoesntMatch
-	}
-	return nil
+	return ErrIdenStateTooOld
 }
 
 // validateFreshness is a helper function that validates that the passed
@@ -149,7 +168,10 @@ func (v *Verifier) VerifyCredentialValidity(credValid *proof.CredentialValidity,
 	if err != nil {
 		return err
 	}
-	idenState := core.IdenState(credValid.ClaimsTreeRoot, revocationsTreeRoot, credValid.RootsTreeRoot)
+	idenState, err := core.IdenStateSafe(credValid.ClaimsTreeRoot, revocationsTreeRoot, credValid.RootsTreeRoot)
+	if err != nil {
+		return err
+	}
 	if !idenState.Equals(credValid.IdenStateData.IdenState) {
 		return ErrCalculatedIdenStateDoesntMatch
 	}
@@ -74,7 +74,7 @@ func TestVerifyCredentialExistence(t *testing.T) {
 	claim := claims.NewClaimBasic(indexBytes, valueBytes)
 
 	is, _, _ := newIssuer(t, idenPubOnChain, idenPubOffChain)
-	err := is.IssueClaim(claim)
+	issuedClaim, err := is.IssueClaim(claim)
 	require.Nil(t, err)
 
 	// Publishing state for the first time
@@ -88,7 +88,7 @@ func TestVerifyCredentialExistence(t *testing.T) {
 	err = is.SyncIdenStatePublic()
 	require.Nil(t, err)
 
-	credExist, err := is.GenCredentialExistence(claim)
+	credExist, err := is.GenCredentialExistence(issuedClaim)
 	require.Nil(t, err)
 
 	verifier := NewWithTimeNow(idenPubOnChain, func() time.Time {
@@ -207,7 +207,7 @@ func TestVerifyCredentialValidity(t *testing.T) {
 	claim1 := newClaimDemo(ho.ID(), []byte("foo"), []byte("bar"))
 
 	is, _, _ := newIssuer(t, idenPubOnChain, idenPubOffChain)
-	err := is.IssueClaim(claim1)
+	claim1, err := is.IssueClaim(claim1)
 	require.Nil(t, err)
 
 	// Publishing state for the first time
@@ -269,7 +269,7 @@ func TestVerifyCredentialValidity(t *testing.T) {
 
 	claim2 := newClaimDemo(ho.ID(), []byte("1234"), []byte("5678"))
 
-	err = is.IssueClaim(claim2)
+	claim2, err = is.IssueClaim(claim2)
 	require.Nil(t, err)
 
 	// claim3 is a claim with expiration at T=3500
@@ -284,9 +284,9 @@ func TestVerifyCredentialValidity(t *testing.T) {
 	metadata.Expiration = 3500
 	var entry merkletree.Entry
 	metadata.Marshal(&entry)
-	claim3 := claims.NewClaimGeneric(&entry)
+	claim3 := claims.NewClaimGenericFromEntry(&entry)
 
-	err = is.IssueClaim(claim3)
+	issuedClaim3, err := is.IssueClaim(claim3)
 	require.Nil(t, err)
 
 	err = is.PublishState()
@@ -301,7 +301,7 @@ func TestVerifyCredentialValidity(t *testing.T) {
 
 	credExistClaim2, err := is.GenCredentialExistence(claim2)
 	require.Nil(t, err)
-	credExistClaim3, err := is.GenCredentialExistence(claim3)
+	credExistClaim3, err := is.GenCredentialExistence(issuedClaim3)
 	require.Nil(t, err)
 
 	// HOLDER + VERIFIER
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/crypto"
@@ -14,6 +15,10 @@ import (
 // ErrInvalidClaimType indicates a type error when parsing an Entry into a claim.
 var ErrInvalidClaimType = errors.New("invalid claim type")
 
+// ErrExpirationOverlapsValue indicates that the expiration can't be set in a
+// claim because its value data uses the bytes where it's stored.
+var ErrExpirationOverlapsValue = errors.New("claim value data overlaps the expiration")
+
 // ClearMostSigByte sets the most significant byte of the element to 0 to make sure it fits
 // inside the FiniteField over R.
 func ClearMostSigByte(e [merkletree.ElemBytesLen]byte) merkletree.ElemBytes {
@@ -194,10 +199,12 @@ func (c *ClaimHeader) Unmarshal(e *merkletree.Entry) {
 }
 
 // Claimer is an intefrace that extends Entrier with a function that
-// returns the claim metadata.
+// returns the claim metadata and a function that returns a deep copy of the
+// claim.
 type Claimer interface {
 	merkletree.Entrier
 	Metadata() *Metadata
+	Clone() Claimer
 }
 
 // Metadata is a header and generic (some optional) values of a claim.
@@ -214,6 +221,15 @@ func NewMetadata(header ClaimHeader) Metadata {
 	return Metadata{header: header}
 }
 
+// clone returns a copy of the metadata that doesn't share the Subject.
+func (m Metadata) clone() Metadata {
+	if m.Subject != nil {
+		subject := *m.Subject
+		m.Subject = &subject
+	}
+	return m
+}
+
 // Header returns the header from the metadata.
 func (m *Metadata) Header() ClaimHeader {
 	return m.header
@@ -224,6 +240,26 @@ func (m *Metadata) Type() ClaimType {
 	return m.header.Type
 }
 
+// SetExpiration makes the claim expire at t, with a precision of seconds.
+// The expiration is stored in the value after the revocation nonce, so it
+// returns ErrExpirationOverlapsValue for the claim types whose value data
+// starts there (ClaimBasic and ClaimOtherIden).
+func (m *Metadata) SetExpiration(t time.Time) error {
+	if m.header.Type == ClaimTypeBasic || m.header.Type == ClaimTypeOtherIden {
+		return ErrExpirationOverlapsValue
+	}
+	m.header.Expiration = true
+	m.Expiration = t.Unix()
+	return nil
+}
+
+// IsExpired returns true if the claim has an expiration and it's before now.
+func IsExpired(claim merkletree.Entrier, now time.Time) bool {
+	var metadata Metadata
+	metadata.Unmarshal(claim.Entry())
+	return metadata.header.Expiration && time.Unix(metadata.Expiration, 0).Before(now)
+}
+
 // Marshal the Metadata into an entry
 func (m Metadata) Marshal(e *merkletree.Entry) {
 	m.header.Marshal(e)
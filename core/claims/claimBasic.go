@@ -64,3 +64,10 @@ func (c *ClaimBasic) Entry() *merkletree.Entry {
 func (c *ClaimBasic) Metadata() *Metadata {
 	return &c.metadata
 }
+
+// Clone returns a deep copy of the claim.
+func (c *ClaimBasic) Clone() Claimer {
+	c2 := *c
+	c2.metadata = c.metadata.clone()
+	return &c2
+}
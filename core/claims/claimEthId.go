@@ -1,52 +1,103 @@
 package claims
 
-// import (
-// 	"github.com/ethereum/go-ethereum/common"
-// 	"github.com/iden3/go-iden3-core/merkletree"
-// )
-//
-// // ClaimEthId is a claim to authorize an ethereum address for the identity. The address can be of a counterfactual smart contract, or a direct address from a private key
-// type ClaimEthId struct {
-// 	// Version is the claim version
-// 	Version uint32
-//
-// 	// Addr is the EthId that will use this identity in the ethereum blockchain
-// 	Address common.Address
-//
-// 	// IdentityFactory specifies that the ClaimEthId.Address is an smartcontract, and how this identity is created. It can be just an identitied of the method, or an smartcontract that creates the identity.
-// 	// IDEN3 specifies the contract address 0x9827348723984729834234 as the factory for its contrafactual identities
-// 	// If 0x000.0000, means that is not using an identity creator, and the identity is always available.
-// 	IdentityFactory common.Address
-// }
-//
-// // NewClaimEthId returns a ClaimEthId
-// func NewClaimEthId(addr, identityFactory common.Address) *ClaimEthId {
-// 	return &ClaimEthId{
-// 		Version:         0,
-// 		Address:         addr,
-// 		IdentityFactory: identityFactory,
-// 	}
-// }
-//
-// // NewClaimEthId deserializes a ClaimEthId from an Entry.
-// func NewClaimEthIdFromEntry(e *merkletree.Entry) *ClaimEthId {
-// 	c := &ClaimEthId{}
-// 	_, c.Version = GetClaimTypeVersion(e)
-// 	copyFromElemBytes(c.Address[:], 0, &e.Data[2])
-// 	copyFromElemBytes(c.IdentityFactory[:], 0, &e.Data[1])
-// 	return c
-// }
-//
-// // Entry serializes the claim into an Entry.
-// func (c *ClaimEthId) Entry() *merkletree.Entry {
-// 	e := &merkletree.Entry{}
-// 	SetClaimTypeVersion(e, c.Type(), c.Version)
-// 	copyToElemBytes(&e.Data[2], 0, c.Address[:])
-// 	copyToElemBytes(&e.Data[1], 0, c.IdentityFactory[:])
-// 	return e
-// }
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// ClaimEthId is a claim to authorize an ethereum address for the identity.
+// The address can be of a counterfactual smart contract, or a direct address
+// from a private key.  The entry has the following layout:
+// - Index[0]: header
+// - Index[1]: Address
+// - Index[2]: IdentityFactory
+// - Value[0]: revocation nonce
+// - Value[1]: Salt[:16]
+// - Value[2]: Salt[16:]
 //
-// // Type returns the ClaimType of the claim.
-// func (c *ClaimEthId) Type() ClaimType {
-// 	return *ClaimTypeEthId
-// }
+// The salt is split in two elements because 32 bytes don't fit in a single
+// element.  Claims with the zero Salt have the same entry as the claims
+// created before the Salt was added.
+type ClaimEthId struct {
+	metadata Metadata
+	// Address is the EthId that will use this identity in the ethereum
+	// blockchain.
+	Address common.Address
+	// IdentityFactory specifies that the Address is a smart contract, and
+	// how this identity is created.  It can be just an identifier of the
+	// method, or a smart contract that creates the identity.  The zero
+	// address means that the identity is not created by an identity
+	// factory, and it's always available.
+	IdentityFactory common.Address
+	// Salt is the CREATE2 salt used by the IdentityFactory to deploy the
+	// Address, which allows verifying the Address of a counterfactual
+	// (not yet deployed) identity.
+	Salt [32]byte
+}
+
+// NewClaimEthId returns a ClaimEthId with the provided addresses.
+func NewClaimEthId(addr, identityFactory common.Address) *ClaimEthId {
+	return &ClaimEthId{
+		metadata:        NewMetadata(ClaimHeaderEthId),
+		Address:         addr,
+		IdentityFactory: identityFactory,
+	}
+}
+
+// NewClaimEthIdWithSalt returns a ClaimEthId with the provided addresses and
+// the CREATE2 salt of the Address.
+func NewClaimEthIdWithSalt(addr, identityFactory common.Address, salt [32]byte) *ClaimEthId {
+	c := NewClaimEthId(addr, identityFactory)
+	c.Salt = salt
+	return c
+}
+
+// NewClaimEthIdFromEntry deserializes a ClaimEthId from an Entry.
+func NewClaimEthIdFromEntry(e *merkletree.Entry) *ClaimEthId {
+	c := &ClaimEthId{}
+	c.metadata.Unmarshal(e)
+	index := e.Index()
+	copy(c.Address[:], index[1][:])
+	copy(c.IdentityFactory[:], index[2][:])
+	value := e.Value()
+	copy(c.Salt[:16], value[1][:16])
+	copy(c.Salt[16:], value[2][:16])
+	return c
+}
+
+// Entry serializes the claim into an Entry.
+func (c *ClaimEthId) Entry() *merkletree.Entry {
+	e := &merkletree.Entry{}
+	index := e.Index()
+	copy(index[1][:], c.Address[:])
+	copy(index[2][:], c.IdentityFactory[:])
+	value := e.Value()
+	copy(value[1][:16], c.Salt[:16])
+	copy(value[2][:16], c.Salt[16:])
+	c.metadata.Marshal(e)
+	return e
+}
+
+// Create2Address returns the address of the contract deployed by the
+// IdentityFactory with CREATE2, the Salt and the keccak256 hash of the init
+// code.  It matches Address if the claim is of that contract.
+func (c *ClaimEthId) Create2Address(initCodeHash []byte) common.Address {
+	return crypto.CreateAddress2(c.IdentityFactory, c.Salt, initCodeHash)
+}
+
+func (c *ClaimEthId) Metadata() *Metadata {
+	return &c.metadata
+}
+
+// RevNonce returns the revocation nonce of the claim.
+func (c *ClaimEthId) RevNonce() uint32 {
+	return c.metadata.RevNonce
+}
+
+// Clone returns a deep copy of the claim.
+func (c *ClaimEthId) Clone() Claimer {
+	c2 := *c
+	c2.metadata = c.metadata.clone()
+	return &c2
+}
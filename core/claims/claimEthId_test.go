@@ -1,44 +1,56 @@
 package claims
 
-/*
-// TMP commented until ClaimEthId is updated to new spec
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
 func TestClaimEthId(t *testing.T) {
-	// If generateTest is true, the checked values will be used to generate a test vector
-	generateTest := false
-	// Init test
-	if err := testgen.InitTest("claimEthId", generateTest); err != nil {
-		panic(fmt.Errorf("error initializing test data: %w", err))
-	}
-	// Add input data to the test vector
-	if generateTest {
-		testgen.SetTestValue("idEthAddr", "0xe0fbce58cfaa72812103f003adce3f284fe5fc7c")
-		testgen.SetTestValue("idFactoryEthAddr", "0x66D0c2F85F1B717168cbB508AfD1c46e07227130")
-	}
-	ethId := common.HexToAddress(testgen.GetTestValue("idEthAddr").(string))
-	identityFactoryAddr := common.HexToAddress(testgen.GetTestValue("idFactoryEthAddr").(string))
+	ethId := common.HexToAddress("0xe0fbce58cfaa72812103f003adce3f284fe5fc7c")
+	identityFactoryAddr := common.HexToAddress("0x66D0c2F85F1B717168cbB508AfD1c46e07227130")
 
 	c0 := NewClaimEthId(ethId, identityFactoryAddr)
+	c0.Metadata().RevNonce = 1234
+	e := c0.Entry()
+	assert.True(t, merkletree.CheckEntryInField(*e))
 
-	c1 := NewClaimEthIdFromEntry(c0.Entry())
-	c2, err := NewClaimFromEntry(c0.Entry())
-	assert.Nil(t, err)
+	c1 := NewClaimEthIdFromEntry(e)
+	c2, err := NewClaimFromEntry(e)
+	require.Nil(t, err)
 	assert.Equal(t, c0, c1)
 	assert.Equal(t, c0, c2)
+	assert.Equal(t, ethId, c1.Address)
+	assert.Equal(t, identityFactoryAddr, c1.IdentityFactory)
+	assert.Equal(t, uint32(1234), c1.RevNonce())
+	assert.Nil(t, checkHeader(&c1.Metadata().header))
+}
 
-	assert.Equal(t, c0.Address, ethId)
-	assert.Equal(t, c0.IdentityFactory, identityFactoryAddr)
-	assert.Equal(t, c0.Address, c1.Address)
-	assert.Equal(t, c0.IdentityFactory, c1.IdentityFactory)
-
-	assert.Equal(t, c0.Entry().Bytes(), c1.Entry().Bytes())
-	assert.Equal(t, c0.Entry().Bytes(), c2.Entry().Bytes())
+func TestClaimEthIdSalt(t *testing.T) {
+	identityFactoryAddr := common.HexToAddress("0x66D0c2F85F1B717168cbB508AfD1c46e07227130")
+	initCodeHash := crypto.Keccak256([]byte("init code"))
+	var salt [32]byte
+	for i := range salt {
+		salt[i] = 0xff
+	}
+	ethId := crypto.CreateAddress2(identityFactoryAddr, salt, initCodeHash)
 
+	c0 := NewClaimEthIdWithSalt(ethId, identityFactoryAddr, salt)
 	e := c0.Entry()
-	checkClaim(e, t)
-	dataTestOutput(&e.Data)
-	// Stop test (write new test vector if needed)
-	if err := testgen.StopTest(); err != nil {
-		panic(fmt.Errorf("Error stopping test: %w", err))
-	}
+	assert.True(t, merkletree.CheckEntryInField(*e))
+	c1, err := NewClaimFromEntry(e)
+	require.Nil(t, err)
+	assert.Equal(t, c0, c1)
+	assert.Equal(t, ethId, c0.Create2Address(initCodeHash))
+
+	// The zero salt keeps the entry of the claims without salt
+	eNoSalt := NewClaimEthId(ethId, identityFactoryAddr).Entry()
+	eZeroSalt := NewClaimEthIdWithSalt(ethId, identityFactoryAddr, [32]byte{}).Entry()
+	assert.Equal(t, eNoSalt, eZeroSalt)
+	assert.Equal(t, merkletree.ElemBytes{}, eZeroSalt.Value()[1])
+	assert.Equal(t, merkletree.ElemBytes{}, eZeroSalt.Value()[2])
 }
-*/
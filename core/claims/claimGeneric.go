@@ -0,0 +1,88 @@
+package claims
+
+import (
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/merkletree"
+	cryptoUtils "github.com/iden3/go-iden3-crypto/utils"
+)
+
+// RegisterClaimTypeGeneric registers claimType as a ClaimGeneric type, so
+// that NewClaimFromEntry decodes the entries of that type into a
+// ClaimGeneric.
+func RegisterClaimTypeGeneric(claimType ClaimType) error {
+	return RegisterClaimType(claimType, func(e *merkletree.Entry) (Claimer, error) {
+		return NewClaimGenericFromEntry(e), nil
+	})
+}
+
+// ClaimGeneric is a claim of any type that keeps its Entry.  It allows
+// application defined claims without a specific (de)serialization.
+type ClaimGeneric struct {
+	metadata Metadata
+	entry    *merkletree.Entry
+}
+
+// NewClaimGeneric returns a ClaimGeneric of type claimType with the bytes of
+// indexData and valueData, in little endian, in the index and value slots,
+// with the following layout:
+// - Index[0]: header
+// - Index[1..3]: indexData
+// - Value[0]: revocation nonce
+// - Value[1..3]: valueData
+// Each slot must fit in a finite field element, and the missing slots are
+// set to zero.  claimType can't be a builtin claim type.
+func NewClaimGeneric(claimType ClaimType, indexData, valueData [][]byte) (Claimer, error) {
+	if builtinClaimType(claimType) {
+		return nil, fmt.Errorf("claim type %x is a builtin claim type", claimType[:])
+	}
+	e := &merkletree.Entry{}
+	if err := setClaimGenericSlots(e.Index()[1:], indexData); err != nil {
+		return nil, fmt.Errorf("invalid index data: %w", err)
+	}
+	if err := setClaimGenericSlots(e.Value()[1:], valueData); err != nil {
+		return nil, fmt.Errorf("invalid value data: %w", err)
+	}
+	return &ClaimGeneric{
+		metadata: NewMetadata(ClaimHeader{Type: claimType, Subject: ClaimSubjectSelf}),
+		entry:    e,
+	}, nil
+}
+
+func setClaimGenericSlots(slots []merkletree.ElemBytes, data [][]byte) error {
+	if len(data) > len(slots) {
+		return fmt.Errorf("%v slots, more than %v", len(data), len(slots))
+	}
+	for i, d := range data {
+		if len(d) > merkletree.ElemBytesLen {
+			return fmt.Errorf("slot %v has %v bytes, more than %v",
+				i, len(d), merkletree.ElemBytesLen)
+		}
+		copy(slots[i][:], d)
+		if !cryptoUtils.CheckBigIntInField(slots[i].BigInt()) {
+			return fmt.Errorf("slot %v: %w", i, merkletree.ErrElemNotInField)
+		}
+	}
+	return nil
+}
+
+// NewClaimGenericFromEntry returns a ClaimGeneric with the entry.
+func NewClaimGenericFromEntry(entry *merkletree.Entry) *ClaimGeneric {
+	var metadata Metadata
+	metadata.Unmarshal(entry)
+	return &ClaimGeneric{metadata: metadata, entry: entry}
+}
+
+func (c *ClaimGeneric) Entry() *merkletree.Entry {
+	c.metadata.Marshal(c.entry)
+	return c.entry
+}
+
+func (c *ClaimGeneric) Metadata() *Metadata {
+	return &c.metadata
+}
+
+// Clone returns a deep copy of the claim.
+func (c *ClaimGeneric) Clone() Claimer {
+	return &ClaimGeneric{metadata: c.metadata.clone(), entry: c.entry.Clone()}
+}
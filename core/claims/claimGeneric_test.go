@@ -0,0 +1,47 @@
+package claims
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimGeneric(t *testing.T) {
+	claimType := NewClaimTypeNum(1000)
+	c0, err := NewClaimGeneric(claimType, [][]byte{[]byte("index0"), []byte("index1")},
+		[][]byte{[]byte("value0")})
+	require.Nil(t, err)
+	c0.Metadata().RevNonce = 1234
+	e := c0.Entry()
+	assert.True(t, merkletree.CheckEntryInField(*e))
+	assert.Equal(t, claimType, c0.Metadata().Type())
+
+	assert.Equal(t, []byte("index1"), e.Index()[2][:len("index1")])
+	assert.Equal(t, []byte("value0"), e.Value()[1][:len("value0")])
+
+	// The entry is only decoded once the type is registered.
+	_, err = NewClaimFromEntry(e)
+	assert.Equal(t, ErrInvalidClaimType, err)
+	require.Nil(t, RegisterClaimTypeGeneric(claimType))
+	c1, err := NewClaimFromEntry(e)
+	require.Nil(t, err)
+	assert.Equal(t, c0, c1)
+
+	// Builtin types, too many slots and slots not in the field are rejected.
+	_, err = NewClaimGeneric(ClaimTypeBasic, nil, nil)
+	assert.NotNil(t, err)
+	assert.NotNil(t, RegisterClaimTypeGeneric(ClaimTypeBasic))
+	_, err = NewClaimGeneric(claimType, make([][]byte, merkletree.IndexLen), nil)
+	assert.NotNil(t, err)
+	_, err = NewClaimGeneric(claimType, nil, [][]byte{make([]byte, merkletree.ElemBytesLen+1)})
+	assert.NotNil(t, err)
+	notInField := make([]byte, merkletree.ElemBytesLen)
+	for i := range notInField {
+		notInField[i] = 0xff
+	}
+	_, err = NewClaimGeneric(claimType, [][]byte{notInField}, nil)
+	assert.True(t, errors.Is(err, merkletree.ErrElemNotInField))
+}
@@ -81,3 +81,16 @@ func (c *ClaimKeyBabyJub) Entry() *merkletree.Entry {
 func (c *ClaimKeyBabyJub) Metadata() *Metadata {
 	return &c.metadata
 }
+
+// Clone returns a deep copy of the claim.
+func (c *ClaimKeyBabyJub) Clone() Claimer {
+	c2 := *c
+	c2.metadata = c.metadata.clone()
+	if c.Ax != nil {
+		c2.Ax = new(big.Int).Set(c.Ax)
+	}
+	if c.Ay != nil {
+		c2.Ay = new(big.Int).Set(c.Ay)
+	}
+	return &c2
+}
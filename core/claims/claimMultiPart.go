@@ -0,0 +1,176 @@
+package claims
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-iden3-core/merkletree"
+	cryptoUtils "github.com/iden3/go-iden3-crypto/utils"
+)
+
+const (
+	// ClaimMultiPartElemsLen is the number of data elements in each part
+	// of a multi-part claim.
+	ClaimMultiPartElemsLen = 3
+	claimMultiPartIdxPos   = ClaimHeaderLen + ClaimVersionLen
+)
+
+// ClaimMultiPart is a part of a claim whose data doesn't fit in a single
+// entry.  The data is split in parts of ClaimMultiPartElemsLen elements, each
+// one stored in a different entry with the following layout:
+// - Index[0]: header | partIdx (uint32) | numParts (uint32)
+// - Index[1]: schemaHash
+// - Index[2]: HIndex of the head (part 0), zero in the head
+// - Index[3]: data[0]
+// - Value[0]: revocation nonce
+// - Value[1]: HIndex of the next part, zero in the last part
+// - Value[2]: data[1]
+// - Value[3]: data[2]
+// All the parts share the revocation nonce of the head.  A verifier must get
+// a credential for each part and then check that the parts are linked
+// together with MultiPartData.
+type ClaimMultiPart struct {
+	metadata   Metadata
+	SchemaHash [EntryFullBytesLen]byte
+	PartIdx    uint32
+	NumParts   uint32
+	HeadHIndex merkletree.Hash
+	NextHIndex merkletree.Hash
+	Data       [ClaimMultiPartElemsLen]*big.Int
+}
+
+// NewClaimMultiPart returns the linked parts of a multi-part claim with the
+// provided data.  Each part can have up to ClaimMultiPartElemsLen elements,
+// the missing ones are set to zero.
+func NewClaimMultiPart(schemaHash [EntryFullBytesLen]byte, parts [][]*big.Int) ([]*ClaimMultiPart, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("multi-part claim needs at least one part")
+	}
+	cs := make([]*ClaimMultiPart, len(parts))
+	for i, part := range parts {
+		if len(part) > ClaimMultiPartElemsLen {
+			return nil, fmt.Errorf("part %v has %v elements, more than %v",
+				i, len(part), ClaimMultiPartElemsLen)
+		}
+		c := &ClaimMultiPart{
+			metadata:   NewMetadata(ClaimHeaderMultiPart),
+			SchemaHash: schemaHash,
+			PartIdx:    uint32(i),
+			NumParts:   uint32(len(parts)),
+		}
+		for j := range c.Data {
+			c.Data[j] = big.NewInt(0)
+			if j < len(part) {
+				if !cryptoUtils.CheckBigIntInField(part[j]) {
+					return nil, fmt.Errorf("element %v of part %v not in the Finite Field", j, i)
+				}
+				c.Data[j] = new(big.Int).Set(part[j])
+			}
+		}
+		if i > 0 {
+			headHIndex, err := cs[0].Entry().HIndex()
+			if err != nil {
+				return nil, err
+			}
+			c.HeadHIndex = *headHIndex
+			prevNextHIndex, err := c.Entry().HIndex()
+			if err != nil {
+				return nil, err
+			}
+			cs[i-1].NextHIndex = *prevNextHIndex
+		}
+		cs[i] = c
+	}
+	return cs, nil
+}
+
+// NewClaimMultiPartFromEntry deserializes a ClaimMultiPart from an Entry.
+func NewClaimMultiPartFromEntry(e *merkletree.Entry) *ClaimMultiPart {
+	c := &ClaimMultiPart{}
+	c.metadata.Unmarshal(e)
+	index, value := e.Index(), e.Value()
+	c.PartIdx = binary.LittleEndian.Uint32(index[0][claimMultiPartIdxPos:])
+	c.NumParts = binary.LittleEndian.Uint32(index[0][claimMultiPartIdxPos+4:])
+	copy(c.SchemaHash[:], index[1][:EntryFullBytesLen])
+	copy(c.HeadHIndex[:], index[2][:])
+	copy(c.NextHIndex[:], value[1][:])
+	c.Data[0] = index[3].BigInt()
+	c.Data[1] = value[2].BigInt()
+	c.Data[2] = value[3].BigInt()
+	return c
+}
+
+// Entry serializes the claim into an Entry.
+func (c *ClaimMultiPart) Entry() *merkletree.Entry {
+	e := &merkletree.Entry{}
+	index, value := e.Index(), e.Value()
+	binary.LittleEndian.PutUint32(index[0][claimMultiPartIdxPos:], c.PartIdx)
+	binary.LittleEndian.PutUint32(index[0][claimMultiPartIdxPos+4:], c.NumParts)
+	copy(index[1][:], c.SchemaHash[:])
+	copy(index[2][:], c.HeadHIndex[:])
+	copy(value[1][:], c.NextHIndex[:])
+	index[3] = merkletree.NewElemBytesFromBigInt(c.Data[0])
+	value[2] = merkletree.NewElemBytesFromBigInt(c.Data[1])
+	value[3] = merkletree.NewElemBytesFromBigInt(c.Data[2])
+	c.metadata.Marshal(e)
+	return e
+}
+
+func (c *ClaimMultiPart) Metadata() *Metadata {
+	return &c.metadata
+}
+
+// Clone returns a deep copy of the claim.
+func (c *ClaimMultiPart) Clone() Claimer {
+	c2 := *c
+	c2.metadata = c.metadata.clone()
+	for i, d := range c.Data {
+		if d != nil {
+			c2.Data[i] = new(big.Int).Set(d)
+		}
+	}
+	return &c2
+}
+
+// MultiPartData checks that the parts (sorted by PartIdx) are a complete
+// multi-part claim linked from the head to the last part, and returns the
+// data of each part.
+func MultiPartData(parts []*ClaimMultiPart) ([][ClaimMultiPartElemsLen]*big.Int, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("multi-part claim needs at least one part")
+	}
+	head := parts[0]
+	headHIndex, err := head.Entry().HIndex()
+	if err != nil {
+		return nil, err
+	}
+	if !head.HeadHIndex.Equals(&merkletree.HashZero) {
+		return nil, fmt.Errorf("first part is not a head")
+	}
+	if head.NumParts != uint32(len(parts)) {
+		return nil, fmt.Errorf("expected %v parts, got %v", head.NumParts, len(parts))
+	}
+	data := make([][ClaimMultiPartElemsLen]*big.Int, len(parts))
+	for i, part := range parts {
+		if part.PartIdx != uint32(i) || part.NumParts != head.NumParts ||
+			part.SchemaHash != head.SchemaHash ||
+			part.metadata.RevNonce != head.metadata.RevNonce {
+			return nil, fmt.Errorf("part %v doesn't match the head", i)
+		}
+		if i > 0 && !part.HeadHIndex.Equals(headHIndex) {
+			return nil, fmt.Errorf("part %v doesn't reference the head", i)
+		}
+		nextHIndex := &merkletree.HashZero
+		if i < len(parts)-1 {
+			if nextHIndex, err = parts[i+1].Entry().HIndex(); err != nil {
+				return nil, err
+			}
+		}
+		if !part.NextHIndex.Equals(nextHIndex) {
+			return nil, fmt.Errorf("part %v doesn't reference the next part", i)
+		}
+		data[i] = part.Data
+	}
+	return data, nil
+}
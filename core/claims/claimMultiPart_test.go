@@ -0,0 +1,54 @@
+package claims
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimMultiPart(t *testing.T) {
+	schemaHash := HashString("schema")
+	parts := [][]*big.Int{
+		{big.NewInt(1), big.NewInt(2), big.NewInt(3)},
+		{big.NewInt(4), big.NewInt(5), big.NewInt(6)},
+		{big.NewInt(7)},
+	}
+	cs, err := NewClaimMultiPart(schemaHash, parts)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(cs))
+	for _, c := range cs {
+		c.Metadata().RevNonce = 1234
+	}
+
+	for _, c := range cs {
+		e := c.Entry()
+		assert.True(t, merkletree.CheckEntryInField(*e))
+		c1 := NewClaimMultiPartFromEntry(e)
+		assert.Equal(t, e, c1.Entry())
+		assert.Equal(t, c.Metadata(), c1.Metadata())
+		c2, err := NewClaimFromEntry(e)
+		assert.Nil(t, err)
+		assert.Equal(t, e, c2.Entry())
+	}
+
+	data, err := MultiPartData(cs)
+	require.Nil(t, err)
+	assert.Equal(t, [ClaimMultiPartElemsLen]*big.Int{big.NewInt(4), big.NewInt(5), big.NewInt(6)}, data[1])
+	assert.Equal(t, [ClaimMultiPartElemsLen]*big.Int{big.NewInt(7), big.NewInt(0), big.NewInt(0)}, data[2])
+
+	// Missing, unsorted and foreign parts are detected
+	_, err = MultiPartData(cs[:2])
+	assert.NotNil(t, err)
+	_, err = MultiPartData([]*ClaimMultiPart{cs[0], cs[2], cs[1]})
+	assert.NotNil(t, err)
+	csOther, err := NewClaimMultiPart(schemaHash, [][]*big.Int{{big.NewInt(1)}, {big.NewInt(8)}, {big.NewInt(9)}})
+	require.Nil(t, err)
+	_, err = MultiPartData([]*ClaimMultiPart{cs[0], csOther[1], cs[2]})
+	assert.NotNil(t, err)
+
+	_, err = NewClaimMultiPart(schemaHash, [][]*big.Int{{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}})
+	assert.NotNil(t, err)
+}
@@ -73,3 +73,10 @@ func (c *ClaimOtherIden) Entry() *merkletree.Entry {
 func (c *ClaimOtherIden) Metadata() *Metadata {
 	return &c.metadata
 }
+
+// Clone returns a deep copy of the claim.
+func (c *ClaimOtherIden) Clone() Claimer {
+	c2 := *c
+	c2.metadata = c.metadata.clone()
+	return &c2
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"testing"
+	"time"
 
 	"encoding/hex"
 	"encoding/json"
@@ -12,6 +13,7 @@ import (
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/merkletree"
 	"github.com/iden3/go-iden3-core/testgen"
+	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/iden3/go-iden3-crypto/poseidon"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -153,6 +155,35 @@ func TestMetadata(t *testing.T) {
 	}
 }
 
+func TestClaimExpiration(t *testing.T) {
+	sk := babyjub.NewRandPrivKey()
+	claim := NewClaimKeyBabyJub(sk.Public(), BabyJubKeyTypeGeneric)
+	now := time.Unix(1600000000, 0)
+	assert.False(t, IsExpired(claim, now))
+
+	require.Nil(t, claim.Metadata().SetExpiration(now))
+	assert.False(t, IsExpired(claim, now))
+	assert.True(t, IsExpired(claim, now.Add(time.Second)))
+
+	claimParsed, err := NewClaimFromEntry(claim.Entry())
+	require.Nil(t, err)
+	metadata := claimParsed.(*ClaimKeyBabyJub).Metadata()
+	assert.True(t, metadata.Header().Expiration)
+	assert.Equal(t, now.Unix(), metadata.Expiration)
+	assert.True(t, IsExpired(claimParsed, now.Add(time.Second)))
+
+	// The value data of ClaimBasic starts where the expiration is stored.
+	indexSlot, valueSlot := [IndexSlotLen]byte{}, [ValueSlotLen]byte{}
+	for i := 0; i < 8; i++ {
+		valueSlot[i] = byte(i + 1)
+	}
+	claimBasic := NewClaimBasic(indexSlot, valueSlot)
+	assert.Equal(t, ErrExpirationOverlapsValue, claimBasic.Metadata().SetExpiration(now))
+	claimBasicParsed := NewClaimBasicFromEntry(claimBasic.Entry())
+	assert.Equal(t, valueSlot, claimBasicParsed.ValueSlot)
+	assert.False(t, claimBasicParsed.Metadata().Header().Expiration)
+}
+
 // TODO: Update to new claim spec.
 //func TestForwardingInterop(t *testing.T) {
 //
@@ -219,3 +250,26 @@ func TestMetadata(t *testing.T) {
 //	assert.True(t, merkletree.CheckProof(rroot, rproofneg, setRootClaim.Hi(), merkletree.EmptyNodeValue, 140))
 //	assert.Equal(t, "0x00000000000000000000000000000000000000000000000000000000000000016f33cf71ff7bdbc492f9c3bd63b15577e6cedc70afd09051e1dfe2f04340c073", common3.HexEncode(rproofneg))
 //}
+
+func TestClaimClone(t *testing.T) {
+	id := core.ID{1, 2, 3}
+	c0 := NewClaimOtherIden(&id, [IndexSubjectSlotLen]byte{4}, [ValueSlotLen]byte{5})
+	c0.Metadata().RevNonce = 6
+	c1 := c0.Clone()
+	assert.Equal(t, c0.Entry(), c1.Entry())
+
+	// Modifying the clone doesn't modify the original claim.
+	c1.Metadata().RevNonce = 7
+	c1.Metadata().Subject[0] = 8
+	c1.(*ClaimOtherIden).IndexSlot[0] = 9
+	assert.Equal(t, uint32(6), c0.Metadata().RevNonce)
+	assert.Equal(t, &id, c0.Metadata().Subject)
+	assert.Equal(t, byte(4), c0.IndexSlot[0])
+
+	e := NewClaimBasic([IndexSlotLen]byte{1}, [ValueSlotLen]byte{2}).Entry()
+	g0 := NewClaimGenericFromEntry(e)
+	g1 := g0.Clone()
+	g1.Metadata().RevNonce = 3
+	assert.NotEqual(t, g0.Entry(), g1.Entry())
+	assert.Equal(t, e, g0.Entry())
+}
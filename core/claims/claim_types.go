@@ -24,6 +24,16 @@ var (
 	ClaimTypeOtherIden       = NewClaimTypeNum(2)
 	ClaimTypeStringOtherIden = "OtherIden"
 
+	// ClaimTypeMultiPart is a claim type for each part of a claim whose
+	// data doesn't fit in a single entry.
+	ClaimTypeMultiPart       = NewClaimTypeNum(3)
+	ClaimTypeStringMultiPart = "MultiPart"
+
+	// ClaimTypeEthId is a claim type to authorize an ethereum address to be
+	// used as the identity inside ethereum.
+	ClaimTypeEthId       = NewClaimTypeNum(4)
+	ClaimTypeStringEthId = "EthId"
+
 // 	// ClaimTypeSetRootKey is a claim type of the root key of a merkle tree that goes into the relay.
 // 	ClaimTypeSetRootKey = NewClaimTypeNum(2)
 // 	// ClaimTypeAssignName is a claim type to assign a name to an ID
@@ -36,8 +46,6 @@ var (
 // 	ClaimTypeAuthorizeService = NewClaimTypeNum(6)
 // 	// ClaimTypeNonce is a claim used to increment the tree nonce to modify the root hash
 // 	ClaimTypeNonce = NewClaimTypeNum(7)
-// 	// ClaimTypeEthId is a claim type to autorize an Eth Address to be used as Id inside Ethereum
-// 	ClaimTypeEthId = NewClaimTypeNum(8)
 // 	// ClaimTypeAuthEthKey is a claim type to authorize an Eth Address directly from a private key, allowing to specify if is used as KDisable (revoke), KReenable (recover), etc
 // 	ClaimTypeAuthEthKey = NewClaimTypeNum(9)
 )
@@ -51,6 +59,10 @@ func (ct ClaimType) MarshalText() ([]byte, error) {
 		str = fmt.Sprintf("str:%v", ClaimTypeStringKeyBabyJub)
 	case ClaimTypeOtherIden:
 		str = fmt.Sprintf("str:%v", ClaimTypeStringOtherIden)
+	case ClaimTypeMultiPart:
+		str = fmt.Sprintf("str:%v", ClaimTypeStringMultiPart)
+	case ClaimTypeEthId:
+		str = fmt.Sprintf("str:%v", ClaimTypeStringEthId)
 	default:
 		str = fmt.Sprintf("hex:%v", common.Hex(ct[:]))
 	}
@@ -68,6 +80,10 @@ func (ct *ClaimType) UnmarshalText(b []byte) error {
 			*ct = ClaimTypeKeyBabyJub
 		case ClaimTypeStringOtherIden:
 			*ct = ClaimTypeOtherIden
+		case ClaimTypeStringMultiPart:
+			*ct = ClaimTypeMultiPart
+		case ClaimTypeStringEthId:
+			*ct = ClaimTypeEthId
 		default:
 			return fmt.Errorf("Unknown ClaimType str:%v", str)
 		}
@@ -82,7 +98,9 @@ func (ct *ClaimType) UnmarshalText(b []byte) error {
 	return nil
 }
 
-// NewClaimFromEntry deserializes a valid claim type into a Claim.
+// NewClaimFromEntry deserializes a valid claim type into a Claim.  Entries of
+// the types registered with RegisterClaimTypeGeneric are deserialized into a
+// ClaimGeneric.
 func NewClaimFromEntry(e *merkletree.Entry) (merkletree.Entrier, error) {
 	for _, elemBytes := range e.Data {
 		bigint := elemBytes.BigInt()
@@ -106,6 +124,9 @@ func NewClaimFromEntry(e *merkletree.Entry) (merkletree.Entrier, error) {
 	case ClaimTypeOtherIden:
 		c := NewClaimOtherIdenFromEntry(e)
 		return c, nil
+	case ClaimTypeMultiPart:
+		c := NewClaimMultiPartFromEntry(e)
+		return c, nil
 	// case *ClaimTypeSetRootKey:
 	// 	c := NewClaimSetRootKeyFromEntry(e)
 	// 	return c, nil
@@ -117,13 +138,16 @@ func NewClaimFromEntry(e *merkletree.Entry) (merkletree.Entrier, error) {
 	// case *ClaimTypeAuthorizeService:
 	// 	c := NewClaimAuthorizeServiceFromEntry(e)
 	// 	return c, nil
-	// case *ClaimTypeEthId:
-	// 	c := NewClaimEthIdFromEntry(e)
-	// 	return c, nil
+	case ClaimTypeEthId:
+		c := NewClaimEthIdFromEntry(e)
+		return c, nil
 	// case *ClaimTypeAuthEthKey:
 	// 	c := NewClaimAuthEthKeyFromEntry(e)
 	// 	return c, nil
 	default:
+		if decoder := claimDecoder(metadata.Type()); decoder != nil {
+			return decoder(e)
+		}
 		return nil, ErrInvalidClaimType
 	}
 }
@@ -145,6 +169,16 @@ var (
 		SubjectPos: ClaimSubjectPosIndex,
 		Expiration: false,
 		Version:    false}
+	ClaimHeaderMultiPart = ClaimHeader{
+		Type:       ClaimTypeMultiPart,
+		Subject:    ClaimSubjectSelf,
+		Expiration: false,
+		Version:    false}
+	ClaimHeaderEthId = ClaimHeader{
+		Type:       ClaimTypeEthId,
+		Subject:    ClaimSubjectSelf,
+		Expiration: false,
+		Version:    false}
 )
 
 func checkHeader(header *ClaimHeader) error {
@@ -164,6 +198,16 @@ func checkHeader(header *ClaimHeader) error {
 			return fmt.Errorf("claim header for ClaimType %v is different than expected",
 				ClaimTypeStringOtherIden)
 		}
+	case ClaimTypeMultiPart:
+		if *header != ClaimHeaderMultiPart {
+			return fmt.Errorf("claim header for ClaimType %v is different than expected",
+				ClaimTypeStringMultiPart)
+		}
+	case ClaimTypeEthId:
+		if *header != ClaimHeaderEthId {
+			return fmt.Errorf("claim header for ClaimType %v is different than expected",
+				ClaimTypeStringEthId)
+		}
 	default:
 	}
 	return nil
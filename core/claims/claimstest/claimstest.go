@@ -0,0 +1,31 @@
+// Package claimstest provides helpers to test claim types.
+package claimstest
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// AssertClaimRoundTrip checks that the Entry of claim is inside the finite
+// field, that claims.NewClaimFromEntry, which calls the New<Type>FromEntry of
+// the claim type, decodes it into a claim equal to claim, and that the
+// decoded claim and a Clone of claim serialize into the same Entry.
+func AssertClaimRoundTrip(t testing.TB, claim claims.Claimer) {
+	e := claim.Entry()
+	assert.True(t, merkletree.CheckEntryInField(*e), "claim entry is not in the finite field")
+	_, err := e.HIndex()
+	require.Nil(t, err)
+
+	decoded, err := claims.NewClaimFromEntry(e)
+	require.Nil(t, err)
+	assert.Equal(t, claim, decoded)
+	assert.Equal(t, e.Data, decoded.Entry().Data)
+
+	clone := claim.Clone()
+	assert.Equal(t, claim, clone)
+	assert.Equal(t, e.Data, clone.Entry().Data)
+}
@@ -0,0 +1,32 @@
+package claimstest
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+func TestAssertClaimRoundTrip(t *testing.T) {
+	indexSlot, valueSlot := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexSlot[0], valueSlot[0] = 0x42, 0x43
+	claimBasic := claims.NewClaimBasic(indexSlot, valueSlot)
+	claimBasic.Metadata().RevNonce = 1
+
+	sk := babyjub.PrivateKey{}
+	claimKey := claims.NewClaimKeyBabyJub(sk.Public(), 1)
+
+	ethId := common.HexToAddress("0xe0fbce58cfaa72812103f003adce3f284fe5fc7c")
+	claimEthId := claims.NewClaimEthIdWithSalt(ethId, common.Address{}, [32]byte{1})
+
+	id := core.NewID(core.TypeBJP0, [27]byte{0x42})
+	var indexSubjectSlot [claims.IndexSubjectSlotLen]byte
+	copy(indexSubjectSlot[:], indexSlot[:])
+	claimOtherIden := claims.NewClaimOtherIden(&id, indexSubjectSlot, valueSlot)
+
+	for _, claim := range []claims.Claimer{claimBasic, claimKey, claimEthId, claimOtherIden} {
+		AssertClaimRoundTrip(t, claim)
+	}
+}
@@ -0,0 +1,49 @@
+package claims
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// ClaimDecoder decodes the entry of a claim of a registered type.
+type ClaimDecoder func(e *merkletree.Entry) (Claimer, error)
+
+var (
+	claimDecoders   = make(map[ClaimType]ClaimDecoder)
+	claimDecodersRw sync.RWMutex
+)
+
+// RegisterClaimType registers decoder as the decoder of the claims of type
+// claimType, so that NewClaimFromEntry uses it.  Registering a type again
+// replaces its decoder.  claimType can't be a builtin claim type.
+func RegisterClaimType(claimType ClaimType, decoder ClaimDecoder) error {
+	if builtinClaimType(claimType) {
+		return fmt.Errorf("claim type %x is a builtin claim type", claimType[:])
+	}
+	if decoder == nil {
+		return fmt.Errorf("nil decoder for claim type %x", claimType[:])
+	}
+	claimDecodersRw.Lock()
+	defer claimDecodersRw.Unlock()
+	claimDecoders[claimType] = decoder
+	return nil
+}
+
+// claimDecoder returns the decoder registered for claimType, or nil.
+func claimDecoder(claimType ClaimType) ClaimDecoder {
+	claimDecodersRw.RLock()
+	defer claimDecodersRw.RUnlock()
+	return claimDecoders[claimType]
+}
+
+func builtinClaimType(claimType ClaimType) bool {
+	switch claimType {
+	case ClaimTypeBasic, ClaimTypeKeyBabyJub, ClaimTypeOtherIden,
+		ClaimTypeMultiPart, ClaimTypeEthId:
+		return true
+	default:
+		return false
+	}
+}
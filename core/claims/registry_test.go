@@ -0,0 +1,60 @@
+package claims
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// claimTest is an application defined claim with the value in Index[1].
+type claimTest struct {
+	metadata Metadata
+	value    byte
+}
+
+func (c *claimTest) Entry() *merkletree.Entry {
+	e := &merkletree.Entry{}
+	e.Data[1][0] = c.value
+	c.metadata.Marshal(e)
+	return e
+}
+
+func (c *claimTest) Metadata() *Metadata { return &c.metadata }
+
+func (c *claimTest) Clone() Claimer {
+	clone := *c
+	return &clone
+}
+
+func TestRegisterClaimType(t *testing.T) {
+	claimType := NewClaimTypeNum(1001)
+	c0 := &claimTest{metadata: NewMetadata(ClaimHeader{Type: claimType}), value: 0x42}
+	e := c0.Entry()
+
+	_, err := NewClaimFromEntry(e)
+	assert.Equal(t, ErrInvalidClaimType, err)
+	errDecode := fmt.Errorf("invalid claimTest")
+	require.Nil(t, RegisterClaimType(claimType, func(e *merkletree.Entry) (Claimer, error) {
+		if e.Data[1][0] == 0 {
+			return nil, errDecode
+		}
+		var c claimTest
+		c.metadata.Unmarshal(e)
+		c.value = e.Data[1][0]
+		return &c, nil
+	}))
+	c1, err := NewClaimFromEntry(e)
+	require.Nil(t, err)
+	assert.Equal(t, c0.Entry(), c1.Entry())
+
+	_, err = NewClaimFromEntry(&merkletree.Entry{Data: merkletree.Data{e.Data[0]}})
+	assert.Equal(t, errDecode, err)
+
+	assert.NotNil(t, RegisterClaimType(ClaimTypeEthId, func(e *merkletree.Entry) (Claimer, error) {
+		return NewClaimEthIdFromEntry(e), nil
+	}))
+	assert.NotNil(t, RegisterClaimType(claimType, nil))
+}
@@ -73,3 +73,16 @@ func AddLeafRevocationsTree(mt *merkletree.MerkleTree, nonce, version uint32) er
 	l := NewLeafRevocationsTree(nonce, version)
 	return mt.AddEntry(l.Entry())
 }
+
+// GenRevocationProof generates the proof of existence (the nonce is revoked)
+// or non-existence (the nonce is not revoked) of the revocation nonce in the
+// revocations tree mt at root.  If root is nil, the current root is used.
+// The version of the revocation leaf is not part of its index, so it doesn't
+// affect the proof.
+func GenRevocationProof(mt *merkletree.MerkleTree, nonce uint32, root *merkletree.Hash) (*merkletree.Proof, error) {
+	hi, err := NewLeafRevocationsTree(nonce, 0).Entry().HIndex()
+	if err != nil {
+		return nil, err
+	}
+	return mt.GenerateProof(hi, root)
+}
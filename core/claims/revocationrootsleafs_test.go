@@ -8,6 +8,7 @@ import (
 	"github.com/iden3/go-iden3-core/merkletree"
 	"github.com/iden3/go-iden3-core/testgen"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLeafRootsTree(t *testing.T) {
@@ -83,3 +84,29 @@ func TestAddLeafRevocationsTree(t *testing.T) {
 	assert.Nil(t, err)
 	testgen.CheckTestValue(t, "proofRevocationsTree", hex.EncodeToString(proof.Bytes()))
 }
+
+func TestGenRevocationProof(t *testing.T) {
+	mt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	require.Nil(t, AddLeafRevocationsTree(mt, 1, 0xffffffff))
+	root1 := mt.RootKey()
+	require.Nil(t, AddLeafRevocationsTree(mt, 2, 0xffffffff))
+
+	proof, err := GenRevocationProof(mt, 1, nil)
+	require.Nil(t, err)
+	assert.True(t, proof.Existence)
+	proof, err = GenRevocationProof(mt, 2, nil)
+	require.Nil(t, err)
+	assert.True(t, proof.Existence)
+	proof, err = GenRevocationProof(mt, 3, nil)
+	require.Nil(t, err)
+	assert.False(t, proof.Existence)
+
+	// Nonce 2 was not yet revoked at root1
+	proof, err = GenRevocationProof(mt, 2, root1)
+	require.Nil(t, err)
+	assert.False(t, proof.Existence)
+	hi, err := NewLeafRevocationsTree(2, 0).Entry().HIndex()
+	require.Nil(t, err)
+	assert.True(t, merkletree.VerifyProof(root1, proof, hi, nil))
+}
@@ -7,26 +7,6 @@ import (
 	"github.com/iden3/go-iden3-core/merkletree"
 )
 
-type ClaimGeneric struct {
-	metadata Metadata
-	entry    *merkletree.Entry
-}
-
-func NewClaimGeneric(entry *merkletree.Entry) *ClaimGeneric {
-	var metadata Metadata
-	metadata.Unmarshal(entry)
-	return &ClaimGeneric{metadata: metadata, entry: entry}
-}
-
-func (c *ClaimGeneric) Entry() *merkletree.Entry {
-	c.metadata.Marshal(c.entry)
-	return c.entry
-}
-
-func (c *ClaimGeneric) Metadata() *Metadata {
-	return &c.metadata
-}
-
 func HexToClaimGeneric(h string) (ClaimGeneric, error) {
 	bytesValue, err := common3.HexDecode(h)
 	if err != nil {
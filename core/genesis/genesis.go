@@ -53,3 +53,17 @@ func CalculateIdGenesisMT(clt *merkletree.MerkleTree, rot *merkletree.MerkleTree
 
 	return id, nil
 }
+
+// CalculateIdGenesisFromClaimsTreeRoot calculates the Genesis ID from the root
+// of the genesis Claims Merkle Tree.
+func CalculateIdGenesisFromClaimsTreeRoot(clr *merkletree.Hash) (*core.ID, error) {
+	rot, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.AddLeafRootsTree(rot, clr); err != nil {
+		return nil, err
+	}
+	idenState := core.IdenState(clr, &merkletree.HashZero, rot.RootKey())
+	return core.IdGenesisFromIdenState(idenState), nil
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
 	"github.com/iden3/go-iden3-core/merkletree"
 	"github.com/iden3/go-iden3-core/testgen"
 	"github.com/iden3/go-iden3-crypto/babyjub"
@@ -59,6 +60,26 @@ func TestCalculateIdGenesis(t *testing.T) {
 	testgen.CheckTestValue(t, "idString4", id.String())
 }
 
+func TestCalculateIdGenesisFromClaimsTreeRoot(t *testing.T) {
+	kopStr := testgen.GetTestValue("kOp").(string)
+	var kopComp babyjub.PublicKeyComp
+	err := kopComp.UnmarshalText([]byte(kopStr))
+	assert.Nil(t, err)
+	kopPub, err := kopComp.Decompress()
+	assert.Nil(t, err)
+	claimKOp := claims.NewClaimKeyBabyJub(kopPub, claims.BabyJubKeyTypeAuthorizeKSign)
+
+	clt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	assert.Nil(t, err)
+	rot, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	assert.Nil(t, err)
+	id, err := CalculateIdGenesisMT(clt, rot, claimKOp, []merkletree.Entrier{})
+	assert.Nil(t, err)
+	idFromRoot, err := CalculateIdGenesisFromClaimsTreeRoot(clt.RootKey())
+	assert.Nil(t, err)
+	assert.Equal(t, id, idFromRoot)
+}
+
 // TODO: Review if this goes here or in proof
 func TestProofClaimGenesis(t *testing.T) {
 	//kOpStr := testgen.GetTestValue("kOp").(string)
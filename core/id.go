@@ -45,12 +45,23 @@ func (id *ID) Bytes() []byte {
 	return id[:]
 }
 
+// BigInt returns the ID as a field element, interpreting the ID bytes in
+// little endian, the same way it's used in the circuits.
 func (id *ID) BigInt() *big.Int {
 	var idElem merkletree.ElemBytes
 	copy(idElem[:], id[:])
 	return idElem.BigInt()
 }
 
+// IDFromBigInt returns the ID from a field element generated with ID.BigInt.
+func IDFromBigInt(i *big.Int) (ID, error) {
+	if i.Sign() < 0 || i.BitLen() > len(ID{})*8 {
+		return ID{}, errors.New("IDFromBigInt error: big.Int out of range")
+	}
+	idElem := merkletree.NewElemBytesFromBigInt(i)
+	return IDFromBytes(idElem[:len(ID{})])
+}
+
 func (id1 *ID) Equal(id2 *ID) bool {
 	return bytes.Equal(id1[:], id2[:])
 }
@@ -152,17 +163,44 @@ func IdGenesisFromIdenState(hash *merkletree.Hash) *ID {
 	return &id
 }
 
+// IdenStateTreeRoots is the set of the three roots of each Identity Merkle Tree.
+type IdenStateTreeRoots struct {
+	ClaimsTreeRoot      *merkletree.Hash
+	RevocationsTreeRoot *merkletree.Hash
+	RootsTreeRoot       *merkletree.Hash
+}
+
 // IdenState calculates the Identity State from the Claims Tree Root, Revocation Tree Root and Roots Tree Root.
+// The Identity State is the Poseidon hash of the inputs [clr, rer, ror, 0, 0,
+// 0], where each root is read as a little endian integer.
+// It panics if the roots are not inside the finite field, so IdenStateSafe
+// must be used with roots from untrusted sources.
 func IdenState(clr *merkletree.Hash, rer *merkletree.Hash, ror *merkletree.Hash) *merkletree.Hash {
+	idenState, err := IdenStateSafe(clr, rer, ror)
+	if err != nil {
+		panic(err)
+	}
+	return idenState
+}
+
+// IdenStateSafe calculates the Identity State like IdenState, returning an
+// error if the roots are not inside the finite field.
+func IdenStateSafe(clr *merkletree.Hash, rer *merkletree.Hash, ror *merkletree.Hash) (*merkletree.Hash, error) {
 	bi, err := merkletree.ElemBytesToPoseidonInput(merkletree.ElemBytes(*clr),
 		merkletree.ElemBytes(*rer),
 		merkletree.ElemBytes(*ror))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	idenState, err := poseidon.PoseidonHash(bi)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return merkletree.NewHashFromBigInt(idenState)
+	return merkletree.NewHashFromBigInt(idenState), nil
+}
+
+// IdenStateFromTreeRoots calculates the Identity State from the three roots
+// like IdenState.
+func IdenStateFromTreeRoots(roots IdenStateTreeRoots) *merkletree.Hash {
+	return IdenState(roots.ClaimsTreeRoot, roots.RevocationsTreeRoot, roots.RootsTreeRoot)
 }
@@ -6,13 +6,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/iden3/go-iden3-core/crypto"
+	"github.com/iden3/go-iden3-core/merkletree"
 	"github.com/iden3/go-iden3-core/testgen"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var generateTest = false
@@ -62,6 +65,28 @@ func TestIDparsers(t *testing.T) {
 	testgen.CheckTestValue(t, "idString0", id0FromString.String())
 }
 
+func TestIDBigInt(t *testing.T) {
+	var genesis [27]byte
+	genesis32bytes := crypto.HashBytes([]byte(testgen.GetTestValue("genesisUnhashedString0").(string)))
+	copy(genesis[:], genesis32bytes[:])
+	id := NewID(TypeBJP0, genesis)
+
+	// The ID is encoded in little endian: the first byte of the ID is
+	// the least significant byte of the big.Int.
+	idBigInt := id.BigInt()
+	assert.Equal(t, uint64(id[0]), new(big.Int).And(idBigInt, big.NewInt(0xff)).Uint64())
+	assert.Equal(t, uint64(id[30]), new(big.Int).Rsh(idBigInt, 30*8).Uint64())
+
+	idFromBigInt, err := IDFromBigInt(idBigInt)
+	require.Nil(t, err)
+	assert.Equal(t, id, idFromBigInt)
+
+	_, err = IDFromBigInt(new(big.Int).Lsh(big.NewInt(1), 31*8))
+	assert.NotNil(t, err)
+	_, err = IDFromBigInt(big.NewInt(0))
+	assert.NotNil(t, err)
+}
+
 func TestIDjsonParser(t *testing.T) {
 	id, err := IDFromString(testgen.GetTestValue("idStringInput").(string))
 	assert.Nil(t, err)
@@ -124,6 +149,27 @@ func TestCheckChecksum(t *testing.T) {
 	assert.Equal(t, errors.New("IDFromBytes error: byte array empty"), err)
 }
 
+func TestIdenStateSafe(t *testing.T) {
+	clr, rer, ror := merkletree.NewHashFromBigInt(big.NewInt(1)),
+		merkletree.NewHashFromBigInt(big.NewInt(2)), merkletree.NewHashFromBigInt(big.NewInt(3))
+	idenState, err := IdenStateSafe(clr, rer, ror)
+	require.Nil(t, err)
+	assert.Equal(t, IdenState(clr, rer, ror), idenState)
+	assert.Equal(t, idenState, IdenStateFromTreeRoots(IdenStateTreeRoots{
+		ClaimsTreeRoot:      clr,
+		RevocationsTreeRoot: rer,
+		RootsTreeRoot:       ror,
+	}))
+
+	rootInvalid := merkletree.Hash{}
+	for i := range rootInvalid {
+		rootInvalid[i] = 0xff
+	}
+	_, err = IdenStateSafe(clr, rer, &rootInvalid)
+	assert.NotNil(t, err)
+	assert.Panics(t, func() { IdenState(clr, rer, &rootInvalid) })
+}
+
 func initTest() {
 	// If generateTest is true, the checked values will be used to generate a test vector
 	// Init test
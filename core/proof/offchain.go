@@ -0,0 +1,112 @@
+package proof
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+	"github.com/iden3/go-iden3-crypto/utils"
+)
+
+var (
+	SigPrefixSignedState = []byte("signedstate:")
+	SigPrefixSetState    = []byte("setstate:")
+
+	ErrSignedStateInvalidSignature     = fmt.Errorf("invalid signed state signature")
+	ErrSignedStateIdDoesntMatch        = fmt.Errorf("credential Id doesn't match the one in the signed state")
+	ErrSignedStateIdenStateDoesntMatch = fmt.Errorf("credential IdenState doesn't match the one in the signed state")
+)
+
+// SignedState is an identity state signed by the identity operational key.
+// It allows identities that don't publish their state on chain to bind
+// credentials to a state (for example, published off chain together with the
+// PublicData).
+type SignedState struct {
+	Id        *core.ID
+	IdenState *merkletree.Hash
+	Signature *babyjub.SignatureComp
+}
+
+func (s SignedState) String() string {
+	type alias SignedState
+	return fmt.Sprintf("%+v", alias(s))
+}
+
+// sigPrefixElem returns the signature prefix as the first element of a
+// signed message, truncated to 31 bytes so that it's in the finite field.
+func sigPrefixElem(prefix []byte) *big.Int {
+	var prefix31 [31]byte
+	copy(prefix31[:], prefix)
+	prefixBigInt := new(big.Int)
+	utils.SetBigIntFromLEBytes(prefixBigInt, prefix31[:])
+	return prefixBigInt
+}
+
+// SignedStateElems returns the elements that are hashed and signed in a
+// SignedState.
+func SignedStateElems(id *core.ID, idenState *merkletree.Hash) [poseidon.T]*big.Int {
+	return [poseidon.T]*big.Int{sigPrefixElem(SigPrefixSignedState), id.BigInt(),
+		idenState.BigInt(), big.NewInt(0), big.NewInt(0), big.NewInt(0)}
+}
+
+// SetStateElems returns the elements that are hashed and signed to sign the
+// identity state transition from oldState to newState.
+func SetStateElems(oldState, newState *merkletree.Hash) [poseidon.T]*big.Int {
+	return [poseidon.T]*big.Int{sigPrefixElem(SigPrefixSetState), oldState.BigInt(),
+		newState.BigInt(), big.NewInt(0), big.NewInt(0), big.NewInt(0)}
+}
+
+// VerifyStateSignature verifies that sig is a signature of the identity state
+// transition from oldState to newState by the key pk, as signed by the
+// issuer SignState.  The caller is responsible of checking that pk is
+// authorized by a claims.ClaimKeyBabyJub of the identity.
+func VerifyStateSignature(pk *babyjub.PublicKeyComp, oldState, newState *merkletree.Hash,
+	sig *babyjub.SignatureComp) (bool, error) {
+	msg, err := poseidon.PoseidonHash(SetStateElems(oldState, newState))
+	if err != nil {
+		return false, err
+	}
+	return keystore.VerifySignatureElem(pk, msg, sig)
+}
+
+// VerifyStateSig verifies that the SignedState was signed by the operational
+// key kOp.  The caller is responsible of checking that kOp is a valid
+// operational key of the identity.
+func VerifyStateSig(signedState *SignedState, kOp *babyjub.PublicKeyComp) error {
+	msg, err := poseidon.PoseidonHash(SignedStateElems(signedState.Id, signedState.IdenState))
+	if err != nil {
+		return err
+	}
+	ok, err := keystore.VerifySignatureElem(kOp, msg, signedState.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSignedStateInvalidSignature
+	}
+	return nil
+}
+
+// VerifyCredentialOffChain verifies a credential of existence against an
+// identity state signed by the operational key kOp instead of against the
+// identity state published on chain, so the IdenStateData BlockN and BlockTs
+// of the credential are ignored.  This gives a lower assurance than an on
+// chain verification: a verifier can't know if the signed state is the
+// latest one of the identity.
+func VerifyCredentialOffChain(cred *CredentialExistence, signedState SignedState,
+	kOp *babyjub.PublicKeyComp) error {
+	if !cred.Id.Equals(signedState.Id) {
+		return ErrSignedStateIdDoesntMatch
+	}
+	if !cred.IdenStateData.IdenState.Equals(signedState.IdenState) {
+		return ErrSignedStateIdenStateDoesntMatch
+	}
+	if err := VerifyStateSig(&signedState, kOp); err != nil {
+		return err
+	}
+	return VerifyCredentialExistence(cred)
+}
@@ -3,9 +3,11 @@ package proof
 import (
 
 	// common3 "github.com/iden3/go-iden3-core/common"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
 	"github.com/iden3/go-iden3-core/merkletree"
 	// "github.com/iden3/go-iden3-crypto/babyjub"
 )
@@ -16,6 +18,23 @@ type IdenStateData struct {
 	IdenState *merkletree.Hash
 }
 
+var (
+	ErrMtpNonExistence                  = fmt.Errorf("The Merkle Tree Proof is of non-existence")
+	ErrCalculatedIdenStateDoesntMatch   = fmt.Errorf("Calculated IdenState doesn't match the one in the credential")
+	ErrSchemaVersionDoesntMatch         = fmt.Errorf("SchemaVersion doesn't match the one in the claim header")
+	ErrIdenStateOnChainDoesntMatch      = fmt.Errorf("IdenState on chain doesn't match the one in the credential")
+	ErrClaimRevoked                     = fmt.Errorf("the claim revocation nonce is in the revocations tree")
+	ErrMtpNotRevokedMissing             = fmt.Errorf("the credential doesn't have the MtpNotRevoked proof")
+	ErrCalculatedRevTreeRootDoesntMatch = fmt.Errorf("Calculated RevocationsTreeRoot doesn't match the one in the credential")
+	ErrIdenStateDoesntMatch             = fmt.Errorf("IdenState doesn't match the one in the credential")
+)
+
+// IdenStateByBlockReader gets the identity state published on chain at a
+// block.  It's implemented by idenpubonchain.IdenPubOnChainer.
+type IdenStateByBlockReader interface {
+	GetStateByBlock(id *core.ID, blockN uint64) (*IdenStateData, error)
+}
+
 type CredentialExistence struct {
 	Id                  *core.ID
 	IdenStateData       IdenStateData
@@ -24,6 +43,17 @@ type CredentialExistence struct {
 	RevocationsTreeRoot *merkletree.Hash
 	RootsTreeRoot       *merkletree.Hash
 	IdenPubUrl          string
+	// SchemaVersion is the version of the claim schema taken from the
+	// claim header, zero if the claim is not versioned.
+	SchemaVersion uint32
+	// MtpNotRevoked is the proof of non-existence of the claim revocation
+	// nonce in the revocations tree.  If the claim is revoked, it's a proof
+	// of existence instead.  It's nil in credentials generated without it.
+	MtpNotRevoked *merkletree.Proof
+	// Revoked is true if the claim revocation nonce is in the revocations
+	// tree of the credential identity state, so that the credential
+	// doesn't verify.
+	Revoked bool
 }
 
 func (c CredentialExistence) String() string {
@@ -31,6 +61,136 @@ func (c CredentialExistence) String() string {
 	return fmt.Sprintf("%+v", alias(c))
 }
 
+// ClaimSchemaVersion returns the schema version of a claim from its header,
+// or zero if the claim doesn't have the version flag.  Only the common header
+// is parsed, so it works with claims of any type.
+func ClaimSchemaVersion(claim *merkletree.Entry) uint32 {
+	var header claims.ClaimHeader
+	header.Unmarshal(claim)
+	if !header.Version {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(claim.Index()[0][claims.ClaimTypeLen+claims.ClaimFlagsLen:])
+}
+
+// KnownSchema returns true if the claim type of the credential is one of the
+// types known by this library, so that schema specific checks can be done
+// by parsing it with claims.NewClaimFromEntry.
+func (c *CredentialExistence) KnownSchema() bool {
+	_, err := claims.NewClaimFromEntry(c.Claim)
+	return err == nil
+}
+
+// VerifyCredentialExistence verifies that the claim of the credential is in
+// the claims tree from which the credential identity state is built.  Only the
+// merkle tree proof and the hashes are checked, so credentials with claims of
+// unknown types or schema versions can be verified too.  It's also verified
+// with the MtpNotRevoked that the claim is not revoked in the credential
+// revocations tree; credentials without it return ErrMtpNotRevokedMissing.
+// Checking that the identity state is in the smart contract is left to the
+// caller.
+func VerifyCredentialExistence(cred *CredentialExistence) error {
+	if cred.MtpNotRevoked == nil {
+		return ErrMtpNotRevokedMissing
+	}
+	if err := VerifyCredentialExistenceNoRevocation(cred); err != nil {
+		return err
+	}
+	return verifyNotRevoked(cred)
+}
+
+// VerifyCredentialExistenceNoRevocation verifies a credential like
+// VerifyCredentialExistence, but without checking that the claim is not
+// revoked, so it accepts credentials generated without the MtpNotRevoked.
+// The caller must check the revocation by other means, for example with a
+// credential of validity.
+func VerifyCredentialExistenceNoRevocation(cred *CredentialExistence) error {
+	if !cred.MtpClaim.Existence {
+		return ErrMtpNonExistence
+	}
+	if cred.SchemaVersion != ClaimSchemaVersion(cred.Claim) {
+		return ErrSchemaVersionDoesntMatch
+	}
+	hi, hv, err := cred.Claim.HiHv()
+	if err != nil {
+		return err
+	}
+	claimsRoot, err := merkletree.RootFromProof(cred.MtpClaim, hi, hv)
+	if err != nil {
+		return err
+	}
+	idenState, err := core.IdenStateSafe(claimsRoot, cred.RevocationsTreeRoot, cred.RootsTreeRoot)
+	if err != nil {
+		return err
+	}
+	if !idenState.Equals(cred.IdenStateData.IdenState) {
+		return ErrCalculatedIdenStateDoesntMatch
+	}
+	return nil
+}
+
+// verifyNotRevoked verifies that the MtpNotRevoked of the credential is a
+// proof of non-existence of the claim revocation nonce in the revocations
+// tree of the credential.
+func verifyNotRevoked(cred *CredentialExistence) error {
+	// NOTE: Once we add versions, this will require some changes that need to be thought properly!
+	nonce := claims.GetRevocationNonce(cred.Claim)
+	hi, hv, err := claims.NewLeafRevocationsTree(nonce, 0xffffffff).Entry().HiHv()
+	if err != nil {
+		return err
+	}
+	revocationsTreeRoot, err := merkletree.RootFromProof(cred.MtpNotRevoked, hi, hv)
+	if err != nil {
+		return err
+	}
+	if !revocationsTreeRoot.Equals(cred.RevocationsTreeRoot) {
+		return ErrCalculatedRevTreeRootDoesntMatch
+	}
+	if cred.MtpNotRevoked.Existence {
+		return ErrClaimRevoked
+	}
+	return nil
+}
+
+// VerifyCredentialExistenceOnChain verifies the credential like
+// VerifyCredentialExistence and then checks that the identity state data of
+// the credential is the one published on chain for the credential Id at its
+// block.  A forged proof is reported with ErrMtpNonExistence,
+// ErrSchemaVersionDoesntMatch or ErrCalculatedIdenStateDoesntMatch, and a
+// state that wasn't published at the block with
+// ErrIdenStateOnChainDoesntMatch.  Errors getting the state from the chain
+// are returned as is.  The credential stays valid after the identity
+// publishes a newer state; freshness is checked with validity credentials.
+func VerifyCredentialExistenceOnChain(cred *CredentialExistence, idenPubOnChain IdenStateByBlockReader) error {
+	if err := VerifyCredentialExistence(cred); err != nil {
+		return err
+	}
+	idenStateDataOnChain, err := idenPubOnChain.GetStateByBlock(cred.Id, cred.IdenStateData.BlockN)
+	if err != nil {
+		return err
+	}
+	if idenStateDataOnChain.BlockN != cred.IdenStateData.BlockN ||
+		idenStateDataOnChain.BlockTs != cred.IdenStateData.BlockTs ||
+		!idenStateDataOnChain.IdenState.Equals(cred.IdenStateData.IdenState) {
+		return ErrIdenStateOnChainDoesntMatch
+	}
+	return nil
+}
+
+// VerifyCredentialExistenceAtState verifies a credential of existence like
+// VerifyCredentialExistence, and that its identity state is expectedState
+// instead of checking it against the one published on chain, so the
+// IdenStateData BlockN and BlockTs of the credential are ignored.
+func VerifyCredentialExistenceAtState(cred *CredentialExistence, expectedState *merkletree.Hash) error {
+	if err := VerifyCredentialExistence(cred); err != nil {
+		return err
+	}
+	if !cred.IdenStateData.IdenState.Equals(expectedState) {
+		return ErrIdenStateDoesntMatch
+	}
+	return nil
+}
+
 type CredentialValidity struct {
 	CredentialExistence CredentialExistence
 	IdenStateData       IdenStateData
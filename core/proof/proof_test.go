@@ -0,0 +1,204 @@
+package proof
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mtpNotRevokedEmpty returns the proof of non-existence of the claim
+// revocation nonce in an empty revocations tree.
+func mtpNotRevokedEmpty(t *testing.T, claim *merkletree.Entry) *merkletree.Proof {
+	mt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	nonce := claims.GetRevocationNonce(claim)
+	hi, err := claims.NewLeafRevocationsTree(nonce, 0xffffffff).Entry().HIndex()
+	require.Nil(t, err)
+	mtp, err := mt.GenerateProof(hi, nil)
+	require.Nil(t, err)
+	return mtp
+}
+
+func TestVerifyCredentialExistenceUnknownSchema(t *testing.T) {
+	// A claim of a type that this library doesn't know, with a schema version.
+	metadata := claims.NewMetadata(claims.ClaimHeader{
+		Type:    claims.NewClaimTypeNum(0x1234),
+		Subject: claims.ClaimSubjectSelf,
+		Version: true,
+	})
+	metadata.Version = 7
+	claim := &merkletree.Entry{}
+	claim.Index()[3][0] = 0x42
+	metadata.Marshal(claim)
+
+	mt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	require.Nil(t, mt.AddEntry(claim))
+	hi, err := claim.HIndex()
+	require.Nil(t, err)
+	mtp, err := mt.GenerateProof(hi, nil)
+	require.Nil(t, err)
+
+	cred := &CredentialExistence{
+		IdenStateData: IdenStateData{
+			IdenState: core.IdenState(mt.RootKey(), &merkletree.HashZero, &merkletree.HashZero),
+		},
+		MtpClaim:            mtp,
+		Claim:               claim,
+		RevocationsTreeRoot: &merkletree.HashZero,
+		RootsTreeRoot:       &merkletree.HashZero,
+		SchemaVersion:       ClaimSchemaVersion(claim),
+	}
+	assert.Equal(t, uint32(7), cred.SchemaVersion)
+	assert.False(t, cred.KnownSchema())
+	assert.Equal(t, ErrMtpNotRevokedMissing, VerifyCredentialExistence(cred))
+	assert.Nil(t, VerifyCredentialExistenceNoRevocation(cred))
+	cred.MtpNotRevoked = mtpNotRevokedEmpty(t, claim)
+	assert.Nil(t, VerifyCredentialExistence(cred))
+
+	cred.SchemaVersion = 8
+	assert.Equal(t, ErrSchemaVersionDoesntMatch, VerifyCredentialExistence(cred))
+	cred.SchemaVersion = 7
+
+	cred.RootsTreeRoot = mt.RootKey()
+	assert.Equal(t, ErrCalculatedIdenStateDoesntMatch, VerifyCredentialExistence(cred))
+
+	// A root outside the finite field returns an error instead of panicking.
+	rootInvalid := merkletree.Hash{}
+	for i := range rootInvalid {
+		rootInvalid[i] = 0xff
+	}
+	cred.RootsTreeRoot = &rootInvalid
+	assert.NotNil(t, VerifyCredentialExistence(cred))
+}
+
+type idenStateByBlockReaderTest map[uint64]*IdenStateData
+
+func (r idenStateByBlockReaderTest) GetStateByBlock(id *core.ID, blockN uint64) (*IdenStateData, error) {
+	idenStateData, ok := r[blockN]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return idenStateData, nil
+}
+
+func TestVerifyCredentialExistenceOnChain(t *testing.T) {
+	claim := &merkletree.Entry{}
+	claim.Index()[3][0] = 0x42
+	mt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	require.Nil(t, mt.AddEntry(claim))
+	hi, err := claim.HIndex()
+	require.Nil(t, err)
+	mtp, err := mt.GenerateProof(hi, nil)
+	require.Nil(t, err)
+
+	idenState := core.IdenState(mt.RootKey(), &merkletree.HashZero, &merkletree.HashZero)
+	cred := &CredentialExistence{
+		Id:                  &core.ID{},
+		IdenStateData:       IdenStateData{BlockN: 10, BlockTs: 100, IdenState: idenState},
+		MtpClaim:            mtp,
+		Claim:               claim,
+		RevocationsTreeRoot: &merkletree.HashZero,
+		RootsTreeRoot:       &merkletree.HashZero,
+		MtpNotRevoked:       mtpNotRevokedEmpty(t, claim),
+	}
+	reader := idenStateByBlockReaderTest{
+		10: &IdenStateData{BlockN: 10, BlockTs: 100, IdenState: idenState},
+		11: &IdenStateData{BlockN: 11, BlockTs: 110, IdenState: &merkletree.HashZero},
+	}
+	assert.Nil(t, VerifyCredentialExistenceOnChain(cred, reader))
+
+	cred.IdenStateData.BlockN = 11
+	assert.Equal(t, ErrIdenStateOnChainDoesntMatch, VerifyCredentialExistenceOnChain(cred, reader))
+	cred.IdenStateData.BlockN = 12
+	assert.NotNil(t, VerifyCredentialExistenceOnChain(cred, reader))
+	cred.IdenStateData.BlockN = 10
+
+	cred.RootsTreeRoot = mt.RootKey()
+	assert.Equal(t, ErrCalculatedIdenStateDoesntMatch, VerifyCredentialExistenceOnChain(cred, reader))
+}
+
+func TestVerifyCredentialExistenceAtState(t *testing.T) {
+	claim := &merkletree.Entry{}
+	claim.Index()[3][0] = 0x42
+	mt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	require.Nil(t, mt.AddEntry(claim))
+	hi, err := claim.HIndex()
+	require.Nil(t, err)
+	mtp, err := mt.GenerateProof(hi, nil)
+	require.Nil(t, err)
+
+	idenState := core.IdenState(mt.RootKey(), &merkletree.HashZero, &merkletree.HashZero)
+	cred := &CredentialExistence{
+		Id:                  &core.ID{},
+		IdenStateData:       IdenStateData{IdenState: idenState},
+		MtpClaim:            mtp,
+		Claim:               claim,
+		RevocationsTreeRoot: &merkletree.HashZero,
+		RootsTreeRoot:       &merkletree.HashZero,
+		MtpNotRevoked:       mtpNotRevokedEmpty(t, claim),
+	}
+	assert.Nil(t, VerifyCredentialExistenceAtState(cred, idenState))
+	assert.Equal(t, ErrIdenStateDoesntMatch, VerifyCredentialExistenceAtState(cred, &merkletree.HashZero))
+
+	cred.RootsTreeRoot = mt.RootKey()
+	assert.Equal(t, ErrCalculatedIdenStateDoesntMatch, VerifyCredentialExistenceAtState(cred, idenState))
+}
+
+func TestSnapshotVerifier(t *testing.T) {
+	claim := &merkletree.Entry{}
+	claim.Index()[3][0] = 0x42
+	claimsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	require.Nil(t, claimsTree.AddEntry(claim))
+	hi, err := claim.HIndex()
+	require.Nil(t, err)
+	mtp, err := claimsTree.GenerateProof(hi, nil)
+	require.Nil(t, err)
+
+	revocationsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 40)
+	require.Nil(t, err)
+	var revocationsTreeDump bytes.Buffer
+	require.Nil(t, revocationsTree.DumpTree(&revocationsTreeDump, nil))
+
+	id := &core.ID{}
+	idenStateData := IdenStateData{
+		IdenState: core.IdenState(claimsTree.RootKey(), revocationsTree.RootKey(), &merkletree.HashZero),
+	}
+	snapshot := &VerifierSnapshot{
+		Id:                  id,
+		IdenStateData:       idenStateData,
+		ClaimsTreeRoot:      claimsTree.RootKey(),
+		RevocationsTreeRoot: revocationsTree.RootKey(),
+		RootsTreeRoot:       &merkletree.HashZero,
+		ClaimsHIndexes:      []*merkletree.Hash{hi},
+		RevocationsTree:     revocationsTreeDump.Bytes(),
+	}
+	_, err = NewSnapshotVerifier(snapshot)
+	assert.Equal(t, ErrSnapshotRevocationsTreeLevels, err)
+
+	snapshot.RevocationsTreeLevels = 40
+	verifier, err := NewSnapshotVerifier(snapshot)
+	require.Nil(t, err)
+	cred := &CredentialExistence{
+		Id:            id,
+		IdenStateData: idenStateData,
+		MtpClaim:      mtp,
+		Claim:         claim,
+	}
+	assert.Nil(t, verifier.Verify(cred))
+
+	snapshot.ClaimsHIndexes = []*merkletree.Hash{}
+	verifier, err = NewSnapshotVerifier(snapshot)
+	require.Nil(t, err)
+	assert.Equal(t, ErrSnapshotClaimNotFound, verifier.Verify(cred))
+}
@@ -0,0 +1,69 @@
+package proof
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+)
+
+var (
+	SigPrefixCredentialSigned = []byte("credsigned:")
+
+	ErrCredentialSignedInvalidSignature = fmt.Errorf("invalid credential signature")
+)
+
+// CredentialSigned is a credential of a claim signed by the issuer
+// operational key together with the identity state in which the claim was
+// added.  It provides a weaker guarantee than a CredentialExistence: the
+// verifier trusts the issuer signature instead of checking a merkle tree
+// proof against the identity state published in the smart contract.
+type CredentialSigned struct {
+	Id        *core.ID
+	IdenState *merkletree.Hash
+	Claim     *merkletree.Entry
+	Signature *babyjub.SignatureComp
+}
+
+func (c CredentialSigned) String() string {
+	type alias CredentialSigned
+	return fmt.Sprintf("%+v", alias(c))
+}
+
+// CredentialSignedElems returns the elements that are hashed and signed in a
+// CredentialSigned.
+func CredentialSignedElems(claim *merkletree.Entry,
+	idenState *merkletree.Hash) ([poseidon.T]*big.Int, error) {
+	hi, hv, err := claim.HiHv()
+	if err != nil {
+		return [poseidon.T]*big.Int{}, err
+	}
+	return [poseidon.T]*big.Int{sigPrefixElem(SigPrefixCredentialSigned), hi.BigInt(),
+		hv.BigInt(), idenState.BigInt(), big.NewInt(0), big.NewInt(0)}, nil
+}
+
+// VerifyCredentialSigned verifies that the CredentialSigned was signed by the
+// operational key kOp.  The caller is responsible of checking that kOp is a
+// valid operational key of the issuer identity.
+func VerifyCredentialSigned(cred *CredentialSigned, kOp *babyjub.PublicKeyComp) error {
+	toHash, err := CredentialSignedElems(cred.Claim, cred.IdenState)
+	if err != nil {
+		return err
+	}
+	msg, err := poseidon.PoseidonHash(toHash)
+	if err != nil {
+		return err
+	}
+	ok, err := keystore.VerifySignatureElem(kOp, msg, cred.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCredentialSignedInvalidSignature
+	}
+	return nil
+}
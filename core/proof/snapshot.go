@@ -0,0 +1,149 @@
+package proof
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	ErrSnapshotIdDoesntMatch            = fmt.Errorf("credential Id doesn't match the one in the snapshot")
+	ErrSnapshotIdenStateDoesntMatch     = fmt.Errorf("credential IdenState doesn't match the one in the snapshot")
+	ErrSnapshotMtpNonExistence          = fmt.Errorf("the credential merkle tree proof is of non-existence")
+	ErrSnapshotClaimsRootDoesntMatch    = fmt.Errorf("calculated claims tree root doesn't match the one in the snapshot")
+	ErrSnapshotCalcIdenStateDoesntMatch = fmt.Errorf("calculated IdenState doesn't match the one in the snapshot")
+	ErrSnapshotClaimNotFound            = fmt.Errorf("claim HIndex not found in the snapshot non-revoked claims")
+	ErrSnapshotClaimRevoked             = fmt.Errorf("claim revocation nonce found in the snapshot revocations tree")
+	ErrSnapshotRevocationsTreeLevels    = fmt.Errorf("the snapshot revocations tree levels are not set")
+)
+
+// VerifierSnapshot is a bundle of the public data of an identity at a
+// particular on chain identity state.  It contains the HIndex of every claim
+// that was not revoked at that state and the revocations tree, so that a
+// verifier can download it once and validate many credentials locally
+// without doing any request to the smart contract.
+type VerifierSnapshot struct {
+	Id                  *core.ID
+	IdenStateData       IdenStateData
+	ClaimsTreeRoot      *merkletree.Hash
+	RevocationsTreeRoot *merkletree.Hash
+	RootsTreeRoot       *merkletree.Hash
+	// ClaimsHIndexes are the HIndexes of the non-revoked claims.
+	ClaimsHIndexes []*merkletree.Hash
+	// RevocationsTree is the revocations tree serialized with
+	// merkletree.DumpTree.
+	RevocationsTree []byte
+	// RevocationsTreeLevels is the maximum number of levels of the
+	// revocations tree.
+	RevocationsTreeLevels int
+}
+
+// SnapshotVerifier verifies credentials of existence against a
+// VerifierSnapshot.  The snapshot is checked, its revocations tree imported
+// and its HIndexes indexed once, so that many credentials can be verified
+// with it.
+type SnapshotVerifier struct {
+	snapshot        *VerifierSnapshot
+	claimsHIndexes  map[merkletree.Hash]struct{}
+	revocationsTree *merkletree.MerkleTree
+}
+
+// NewSnapshotVerifier creates a SnapshotVerifier of the snapshot.  The
+// snapshot is trusted to be in the smart contract, so it's the caller
+// responsibility to obtain it from a trusted source (or check its
+// IdenStateData on chain once).
+func NewSnapshotVerifier(snapshot *VerifierSnapshot) (*SnapshotVerifier, error) {
+	if snapshot.RevocationsTreeLevels <= 0 {
+		return nil, ErrSnapshotRevocationsTreeLevels
+	}
+	idenState, err := core.IdenStateSafe(snapshot.ClaimsTreeRoot, snapshot.RevocationsTreeRoot,
+		snapshot.RootsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !idenState.Equals(snapshot.IdenStateData.IdenState) {
+		return nil, ErrSnapshotCalcIdenStateDoesntMatch
+	}
+	revocationsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(),
+		snapshot.RevocationsTreeLevels)
+	if err != nil {
+		return nil, err
+	}
+	if err := revocationsTree.ImportTree(bytes.NewReader(snapshot.RevocationsTree)); err != nil {
+		return nil, err
+	}
+	if !revocationsTree.RootKey().Equals(snapshot.RevocationsTreeRoot) {
+		return nil, fmt.Errorf("Imported revocations tree root (%v) doesn't match the expected root (%v)",
+			revocationsTree.RootKey(), snapshot.RevocationsTreeRoot)
+	}
+
+	claimsHIndexes := make(map[merkletree.Hash]struct{}, len(snapshot.ClaimsHIndexes))
+	for _, hi := range snapshot.ClaimsHIndexes {
+		claimsHIndexes[*hi] = struct{}{}
+	}
+	return &SnapshotVerifier{
+		snapshot:        snapshot,
+		claimsHIndexes:  claimsHIndexes,
+		revocationsTree: revocationsTree,
+	}, nil
+}
+
+// Verify verifies a credential of existence.  The credential must be built
+// for the identity state of the snapshot, and the claim must not be revoked
+// in it.
+func (v *SnapshotVerifier) Verify(cred *CredentialExistence) error {
+	snapshot := v.snapshot
+	if !cred.Id.Equals(snapshot.Id) {
+		return ErrSnapshotIdDoesntMatch
+	}
+	if !cred.IdenStateData.IdenState.Equals(snapshot.IdenStateData.IdenState) {
+		return ErrSnapshotIdenStateDoesntMatch
+	}
+	if !cred.MtpClaim.Existence {
+		return ErrSnapshotMtpNonExistence
+	}
+	hi, hv, err := cred.Claim.HiHv()
+	if err != nil {
+		return err
+	}
+	claimsRoot, err := merkletree.RootFromProof(cred.MtpClaim, hi, hv)
+	if err != nil {
+		return err
+	}
+	if !claimsRoot.Equals(snapshot.ClaimsTreeRoot) {
+		return ErrSnapshotClaimsRootDoesntMatch
+	}
+	if _, ok := v.claimsHIndexes[*hi]; !ok {
+		return ErrSnapshotClaimNotFound
+	}
+
+	// NOTE: Once we add versions, this will require some changes that need to be thought properly!
+	nonce := claims.GetRevocationNonce(cred.Claim)
+	revLeafHi, err := claims.NewLeafRevocationsTree(nonce, 0xffffffff).Entry().HIndex()
+	if err != nil {
+		return err
+	}
+	mtpNotNonce, err := v.revocationsTree.GenerateProof(revLeafHi, nil)
+	if err != nil {
+		return err
+	}
+	if mtpNotNonce.Existence {
+		return ErrSnapshotClaimRevoked
+	}
+	return nil
+}
+
+// VerifyWithSnapshot verifies a credential of existence against a
+// VerifierSnapshot.  To verify many credentials with the same snapshot, use a
+// SnapshotVerifier instead, which checks the snapshot only once.
+func VerifyWithSnapshot(cred *CredentialExistence, snapshot *VerifierSnapshot) error {
+	v, err := NewSnapshotVerifier(snapshot)
+	if err != nil {
+		return err
+	}
+	return v.Verify(cred)
+}
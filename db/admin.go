@@ -1,19 +1,38 @@
 package db
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 )
 
-func (l *LevelDbStorage) RawDump() error {
-	iter := l.ldb.NewIterator(nil, nil)
-	for iter.Next() {
-		fmt.Println(hex.EncodeToString(iter.Key()), " ", hex.EncodeToString(iter.Value()))
+// RawDump writes all the key values of the storage in hex to w, one per line
+// and sorted lexicographically by key, so that two dumps of the same storage
+// are byte-identical regardless of the backend.
+func RawDump(storage Storage, w io.Writer) error {
+	kvs := []KV{}
+	if err := storage.Iterate(func(k, v []byte) (bool, error) {
+		kvs = append(kvs, KV{clone(k), clone(v)})
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].K, kvs[j].K) < 0 })
+	for _, kv := range kvs {
+		if _, err := fmt.Fprintln(w, hex.EncodeToString(kv.K), " ", hex.EncodeToString(kv.V)); err != nil {
+			return err
+		}
 	}
-	iter.Release()
 	return nil
 }
 
+func (l *LevelDbStorage) RawDump() error {
+	return RawDump(l, os.Stdout)
+}
+
 func IPFSexport() error {
 	return nil
 }
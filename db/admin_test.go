@@ -0,0 +1,30 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRawDump(t *testing.T, sto Storage) {
+	tx, err := sto.NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte{3}, []byte{6})
+	tx.Put([]byte{1}, []byte{4})
+	tx.Put([]byte{2, 1}, []byte{5})
+	tx.Put([]byte{2}, []byte{7})
+	require.Nil(t, tx.Commit())
+
+	var dump0, dump1 bytes.Buffer
+	require.Nil(t, RawDump(sto, &dump0))
+	require.Nil(t, RawDump(sto, &dump1))
+	assert.Equal(t, dump0.Bytes(), dump1.Bytes())
+	assert.Equal(t, "01   04\n02   07\n0201   05\n03   06\n", dump0.String())
+}
+
+func TestRawDump(t *testing.T) {
+	testRawDump(t, levelDbStorage(t))
+	testRawDump(t, NewMemoryStorage())
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bytes"
 	"crypto/sha256"
 )
 
@@ -13,3 +14,46 @@ func (m kvMap) Get(k []byte) ([]byte, bool) {
 func (m kvMap) Put(k, v []byte) {
 	m[sha256.Sum256(k)] = KV{k, v}
 }
+func (m kvMap) Delete(k []byte) {
+	delete(m, sha256.Sum256(k))
+}
+
+// readSet keeps the values read by a transaction from the storage, with a nil
+// value for the keys that were not found.
+type readSet kvMap
+
+func (r readSet) add(k, v []byte) {
+	if r == nil {
+		return
+	}
+	h := sha256.Sum256(k)
+	if _, ok := r[h]; !ok {
+		r[h] = KV{clone(k), v}
+	}
+}
+
+func (r readSet) merge(r1 readSet) {
+	if r == nil {
+		return
+	}
+	for h, kv := range r1 {
+		if _, ok := r[h]; !ok {
+			r[h] = kv
+		}
+	}
+}
+
+// validate checks that the keys in the read set still have the same value
+// using get, which returns a nil value for the keys not found.
+func (r readSet) validate(get func(k []byte) ([]byte, error)) error {
+	for _, kv := range r {
+		v, err := get(kv.K)
+		if err != nil {
+			return err
+		}
+		if (v == nil) != (kv.V == nil) || !bytes.Equal(v, kv.V) {
+			return ErrTxConflict
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"encoding/json"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -13,11 +14,16 @@ import (
 type LevelDbStorage struct {
 	ldb    *leveldb.DB
 	prefix []byte
+	// commitMutex serializes the validation and write of the commits.
+	commitMutex *sync.Mutex
 }
 
 type LevelDbStorageTx struct {
 	*LevelDbStorage
 	cache kvMap
+	// dels are the keys deleted in the transaction.
+	dels  kvMap
+	reads readSet
 }
 
 func NewLevelDbStorage(path string, errorIfMissing bool) (*LevelDbStorage, error) {
@@ -28,7 +34,7 @@ func NewLevelDbStorage(path string, errorIfMissing bool) (*LevelDbStorage, error
 	if err != nil {
 		return nil, err
 	}
-	return &LevelDbStorage{ldb, []byte{}}, nil
+	return &LevelDbStorage{ldb, []byte{}, &sync.Mutex{}}, nil
 }
 
 type storageInfo struct {
@@ -67,11 +73,11 @@ func (l *LevelDbStorage) Info() string {
 }
 
 func (l *LevelDbStorage) WithPrefix(prefix []byte) Storage {
-	return &LevelDbStorage{l.ldb, concat(l.prefix, prefix)}
+	return &LevelDbStorage{l.ldb, concat(l.prefix, prefix), l.commitMutex}
 }
 
 func (l *LevelDbStorage) NewTx() (Tx, error) {
-	return &LevelDbStorageTx{l, make(kvMap)}, nil
+	return &LevelDbStorageTx{l, make(kvMap), make(kvMap), make(readSet)}, nil
 }
 
 // Get retreives a value from a key in the mt.Lvl
@@ -112,10 +118,16 @@ func (l *LevelDbStorageTx) Get(key []byte) ([]byte, error) {
 	if value, ok := l.cache.Get(fullkey); ok {
 		return value, nil
 	}
+	if _, ok := l.dels.Get(fullkey); ok {
+		return nil, ErrNotFound
+	}
 
 	value, err := l.ldb.Get(fullkey, nil)
 	if err == errors.ErrNotFound {
+		l.reads.add(fullkey, nil)
 		return nil, ErrNotFound
+	} else if err == nil {
+		l.reads.add(fullkey, value)
 	}
 
 	return value, err
@@ -123,29 +135,59 @@ func (l *LevelDbStorageTx) Get(key []byte) ([]byte, error) {
 
 // Insert saves a key:value into the mt.Lvl
 func (tx *LevelDbStorageTx) Put(k, v []byte) {
-	tx.cache.Put(concat(tx.prefix, k[:]), v)
+	fullkey := concat(tx.prefix, k[:])
+	tx.dels.Delete(fullkey)
+	tx.cache.Put(fullkey, v)
+}
+
+func (tx *LevelDbStorageTx) Delete(k []byte) {
+	fullkey := concat(tx.prefix, k[:])
+	tx.cache.Delete(fullkey)
+	tx.dels.Put(fullkey, nil)
 }
 
 func (tx *LevelDbStorageTx) Add(atx Tx) {
 	ldbtx := atx.(*LevelDbStorageTx)
 	for _, v := range ldbtx.cache {
+		tx.dels.Delete(v.K)
 		tx.cache.Put(v.K, v.V)
 	}
+	for _, v := range ldbtx.dels {
+		tx.cache.Delete(v.K)
+		tx.dels.Put(v.K, nil)
+	}
+	tx.reads.merge(ldbtx.reads)
 }
 
 func (l *LevelDbStorageTx) Commit() error {
+	l.commitMutex.Lock()
+	defer l.commitMutex.Unlock()
+	defer l.Close()
+	if err := l.reads.validate(func(k []byte) ([]byte, error) {
+		v, err := l.ldb.Get(k, nil)
+		if err == errors.ErrNotFound {
+			return nil, nil
+		}
+		return v, err
+	}); err != nil {
+		return err
+	}
 
 	var batch leveldb.Batch
 	for _, v := range l.cache {
 		batch.Put(v.K, v.V)
 	}
+	for _, v := range l.dels {
+		batch.Delete(v.K)
+	}
 
-	l.cache = nil
 	return l.ldb.Write(&batch, nil)
 }
 
 func (l *LevelDbStorageTx) Close() {
 	l.cache = nil
+	l.dels = nil
+	l.reads = nil
 }
 
 func (l *LevelDbStorage) Close() {
@@ -155,6 +197,13 @@ func (l *LevelDbStorage) Close() {
 	log.Info("Database closed")
 }
 
+// Compact compacts the keys of the storage prefix in the LevelDB, which
+// reclaims the space of deleted and overwritten keys.  It implements
+// Compacter.
+func (l *LevelDbStorage) Compact() error {
+	return l.ldb.CompactRange(*util.BytesPrefix(l.prefix))
+}
+
 func (l *LevelDbStorage) LevelDB() *leveldb.DB {
 	return l.ldb
 }
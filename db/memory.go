@@ -3,21 +3,26 @@ package db
 import (
 	"bytes"
 	"sort"
+	"sync"
 )
 
 type MemoryStorage struct {
 	prefix []byte
 	kv     kvMap
+	rw     *sync.RWMutex
 }
 
 type MemoryStorageTx struct {
 	s  *MemoryStorage
 	kv kvMap
+	// dels are the keys deleted in the transaction.
+	dels  kvMap
+	reads readSet
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	kvmap := make(kvMap)
-	return &MemoryStorage{[]byte{}, kvmap}
+	return &MemoryStorage{[]byte{}, kvmap, &sync.RWMutex{}}
 }
 
 func (l *MemoryStorage) Info() string {
@@ -25,16 +30,17 @@ func (l *MemoryStorage) Info() string {
 }
 
 func (m *MemoryStorage) WithPrefix(prefix []byte) Storage {
-	return &MemoryStorage{concat(m.prefix, prefix), m.kv}
+	return &MemoryStorage{concat(m.prefix, prefix), m.kv, m.rw}
 }
 
 func (m *MemoryStorage) NewTx() (Tx, error) {
-	return &MemoryStorageTx{m, make(kvMap)}, nil
+	return &MemoryStorageTx{m, make(kvMap), make(kvMap), make(readSet)}, nil
 }
 
 // Get retreives a value from a key in the mt.Lvl
 func (l *MemoryStorage) Get(key []byte) ([]byte, error) {
-
+	l.rw.RLock()
+	defer l.rw.RUnlock()
 	if v, ok := l.kv.Get(concat(l.prefix, key[:])); ok {
 		return v, nil
 	}
@@ -43,6 +49,7 @@ func (l *MemoryStorage) Get(key []byte) ([]byte, error) {
 
 func (l *MemoryStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
 	kvs := make([]KV, 0)
+	l.rw.RLock()
 	for _, v := range l.kv {
 		if len(v.K) < len(l.prefix) || !bytes.Equal(v.K[:len(l.prefix)], l.prefix) {
 			continue
@@ -51,6 +58,7 @@ func (l *MemoryStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
 		kvs = append(kvs, KV{localkey, v.V})
 
 	}
+	l.rw.RUnlock()
 	sort.SliceStable(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].K, kvs[j].K) < 0 })
 
 	for _, kv := range kvs {
@@ -65,10 +73,18 @@ func (l *MemoryStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
 
 func (tx *MemoryStorageTx) Get(key []byte) ([]byte, error) {
 
-	if v, ok := tx.kv.Get(concat(tx.s.prefix, key)); ok {
+	fullkey := concat(tx.s.prefix, key)
+	if v, ok := tx.kv.Get(fullkey); ok {
 		return v, nil
 	}
-	if v, ok := tx.s.kv.Get(concat(tx.s.prefix, key)); ok {
+	if _, ok := tx.dels.Get(fullkey); ok {
+		return nil, ErrNotFound
+	}
+	tx.s.rw.RLock()
+	defer tx.s.rw.RUnlock()
+	v, ok := tx.s.kv.Get(fullkey)
+	tx.reads.add(fullkey, v)
+	if ok {
 		return v, nil
 	}
 
@@ -76,26 +92,53 @@ func (tx *MemoryStorageTx) Get(key []byte) ([]byte, error) {
 }
 
 func (tx *MemoryStorageTx) Put(k, v []byte) {
-	tx.kv.Put(concat(tx.s.prefix, k), v)
+	fullkey := concat(tx.s.prefix, k)
+	tx.dels.Delete(fullkey)
+	tx.kv.Put(fullkey, v)
+}
+
+func (tx *MemoryStorageTx) Delete(k []byte) {
+	fullkey := concat(tx.s.prefix, k)
+	tx.kv.Delete(fullkey)
+	tx.dels.Put(fullkey, nil)
 }
 
 func (tx *MemoryStorageTx) Commit() error {
+	tx.s.rw.Lock()
+	defer tx.s.rw.Unlock()
+	defer tx.Close()
+	if err := tx.reads.validate(func(k []byte) ([]byte, error) {
+		v, _ := tx.s.kv.Get(k)
+		return v, nil
+	}); err != nil {
+		return err
+	}
 	for _, v := range tx.kv {
 		tx.s.kv.Put(v.K, v.V)
 	}
-	tx.kv = nil
+	for _, v := range tx.dels {
+		tx.s.kv.Delete(v.K)
+	}
 	return nil
 }
 
 func (tx *MemoryStorageTx) Add(atx Tx) {
 	mstx := atx.(*MemoryStorageTx)
 	for _, v := range mstx.kv {
+		tx.dels.Delete(v.K)
 		tx.kv.Put(v.K, v.V)
 	}
+	for _, v := range mstx.dels {
+		tx.kv.Delete(v.K)
+		tx.dels.Put(v.K, nil)
+	}
+	tx.reads.merge(mstx.reads)
 }
 
 func (tx *MemoryStorageTx) Close() {
 	tx.kv = nil
+	tx.dels = nil
+	tx.reads = nil
 }
 
 func (m *MemoryStorage) Close() {
@@ -6,6 +6,11 @@ import (
 
 var ErrNotFound = errors.New("key not found")
 
+// ErrTxConflict is returned by Tx.Commit when a key read in the transaction
+// was modified by another transaction committed in the meantime.  The
+// transaction is discarded and can be retried.
+var ErrTxConflict = errors.New("transaction conflict")
+
 type KV struct {
 	K []byte
 	V []byte
@@ -21,9 +26,18 @@ type Storage interface {
 	Iterate(func([]byte, []byte) (bool, error)) error
 }
 
+// Compacter is implemented by the Storage backends that can compact their
+// database to reclaim the space of deleted and overwritten keys.
+type Compacter interface {
+	Compact() error
+}
+
 type Tx interface {
 	Get([]byte) ([]byte, error)
 	Put(k, v []byte)
+	// Delete removes the key k.  Deleting a key that doesn't exist does
+	// nothing.
+	Delete(k []byte)
 	Add(Tx)
 	Commit() error
 	Close()
@@ -164,6 +164,26 @@ func testConcatTx(t *testing.T, sto Storage) {
 	assert.Equal(t, v2, []byte{8, 9})
 }
 
+func testTxRollback(t *testing.T, sto Storage) {
+	k := []byte{9}
+	sto1 := sto.WithPrefix([]byte{1})
+
+	tx, err := sto1.NewTx()
+	require.Nil(t, err)
+	tx.Put(k, []byte{4, 5, 6})
+	v, err := tx.Get(k)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{4, 5, 6}, v)
+	// Closing a tx without committing discards its writes
+	tx.Close()
+
+	_, err = sto1.Get(k)
+	assert.Equal(t, ErrNotFound, err)
+	kvs, err := sto.List(10)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(kvs))
+}
+
 func testList(t *testing.T, sto Storage) {
 	sto1 := sto.WithPrefix([]byte{1})
 	r1, err := sto1.List(100)
@@ -198,6 +218,100 @@ func testList(t *testing.T, sto Storage) {
 
 }
 
+func testTxConflict(t *testing.T, sto Storage) {
+	k1, k2, k3 := []byte{1}, []byte{2}, []byte{3}
+	tx, err := sto.NewTx()
+	require.Nil(t, err)
+	tx.Put(k1, []byte{4})
+	require.Nil(t, tx.Commit())
+
+	// A key read by tx1 is modified by tx2 before tx1 commits.
+	tx1, err := sto.NewTx()
+	require.Nil(t, err)
+	_, err = tx1.Get(k1)
+	require.Nil(t, err)
+	tx1.Put(k2, []byte{5})
+	tx2, err := sto.NewTx()
+	require.Nil(t, err)
+	tx2.Put(k1, []byte{6})
+	require.Nil(t, tx2.Commit())
+	assert.Equal(t, ErrTxConflict, tx1.Commit())
+	_, err = sto.Get(k2)
+	assert.Equal(t, ErrNotFound, err)
+
+	// A key not found by tx1 is created by tx2 before tx1 commits.
+	tx1, err = sto.NewTx()
+	require.Nil(t, err)
+	_, err = tx1.Get(k3)
+	require.Equal(t, ErrNotFound, err)
+	tx1.Put(k3, []byte{7})
+	tx2, err = sto.NewTx()
+	require.Nil(t, err)
+	tx2.Put(k3, []byte{8})
+	require.Nil(t, tx2.Commit())
+	assert.Equal(t, ErrTxConflict, tx1.Commit())
+	v, err := sto.Get(k3)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{8}, v)
+
+	// Transactions that don't overlap commit fine.
+	tx1, err = sto.NewTx()
+	require.Nil(t, err)
+	_, err = tx1.Get(k1)
+	require.Nil(t, err)
+	tx1.Put(k1, []byte{9})
+	tx2, err = sto.NewTx()
+	require.Nil(t, err)
+	_, err = tx2.Get(k3)
+	require.Nil(t, err)
+	tx2.Put(k3, []byte{10})
+	assert.Nil(t, tx2.Commit())
+	assert.Nil(t, tx1.Commit())
+}
+
+func testTxDelete(t *testing.T, sto Storage) {
+	k0, k1 := []byte("k0"), []byte("k1")
+	tx, err := sto.NewTx()
+	require.Nil(t, err)
+	tx.Put(k0, []byte{0})
+	tx.Put(k1, []byte{1})
+	require.Nil(t, tx.Commit())
+
+	tx, err = sto.NewTx()
+	require.Nil(t, err)
+	tx.Delete(k0)
+	tx.Delete([]byte("missing"))
+	_, err = tx.Get(k0)
+	assert.Equal(t, ErrNotFound, err)
+	// The key is only deleted after the commit
+	_, err = sto.Get(k0)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	_, err = sto.Get(k0)
+	assert.Equal(t, ErrNotFound, err)
+	v, err := sto.Get(k1)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{1}, v)
+
+	// A put after a delete in the same tx keeps the key, also when the txs
+	// are added.
+	tx, err = sto.NewTx()
+	require.Nil(t, err)
+	tx.Delete(k1)
+	tx.Put(k1, []byte{2})
+	tx2, err := sto.NewTx()
+	require.Nil(t, err)
+	tx2.Delete(k0)
+	tx.Add(tx2)
+	require.Nil(t, tx.Commit())
+	v, err = sto.Get(k1)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{2}, v)
+	kvs, err := sto.List(10)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(kvs))
+}
+
 func TestLevelDb(t *testing.T) {
 	testReturnKnownErrIfNotExists(t, levelDbStorage(t))
 	testStorageInsertGet(t, levelDbStorage(t))
@@ -205,6 +319,20 @@ func TestLevelDb(t *testing.T) {
 	testConcatTx(t, levelDbStorage(t))
 	testList(t, levelDbStorage(t))
 	testIterate(t, levelDbStorage(t))
+	testTxConflict(t, levelDbStorage(t))
+	testTxRollback(t, levelDbStorage(t))
+	testTxDelete(t, levelDbStorage(t))
+}
+
+func TestLevelDbCompact(t *testing.T) {
+	sto := levelDbStorage(t)
+	var c Compacter = sto.(*LevelDbStorage)
+	testStorageInsertGet(t, sto)
+	require.Nil(t, c.Compact())
+	require.Nil(t, sto.WithPrefix([]byte{1}).(Compacter).Compact())
+	v, err := sto.Get([]byte("key"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("data"), v)
 }
 
 func TestMemory(t *testing.T) {
@@ -214,6 +342,9 @@ func TestMemory(t *testing.T) {
 	testConcatTx(t, NewMemoryStorage())
 	testList(t, NewMemoryStorage())
 	testIterate(t, NewMemoryStorage())
+	testTxConflict(t, NewMemoryStorage())
+	testTxRollback(t, NewMemoryStorage())
+	testTxDelete(t, NewMemoryStorage())
 }
 
 func TestLevelDbInterface(t *testing.T) {
@@ -85,6 +85,50 @@ func (sl *StorageList) GetByIdx(tx Tx, idx uint32, value interface{}) ([]byte, e
 	return key, err
 }
 
+// RemoveLast removes the last entry of the StorageList in an open db
+// transaction and returns its key.  It returns ErrNotFound if the list is
+// empty.  Both the index and the value of the removed key are deleted.
+func (sl *StorageList) RemoveLast(tx Tx) ([]byte, error) {
+	length, err := sl.length.Get(tx)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, ErrNotFound
+	}
+	var idxBytes [4]byte
+	binary.LittleEndian.PutUint32(idxBytes[:], length-1)
+	key, err := tx.Get(append(sl.dbPrefixListByIdx, idxBytes[:]...))
+	if err != nil {
+		return nil, err
+	}
+	tx.Delete(append(sl.dbPrefixListByIdx, idxBytes[:]...))
+	tx.Delete(append(sl.dbPrefixList, key...))
+	sl.length.Set(tx, length-1)
+	return key, nil
+}
+
+// GetByRange reads the entries of the StorageList starting at the index start
+// into values, and returns their keys, in an open db transaction.  If the
+// list ends before len(values) entries are read, only the remaining entries
+// are read, and the number of keys returned is smaller than len(values).
+// Only the entries in the range are read.
+func (sl *StorageList) GetByRange(tx Tx, start uint32, values []interface{}) ([][]byte, error) {
+	length, err := sl.length.Get(tx)
+	if err != nil {
+		return nil, err
+	}
+	keys := [][]byte{}
+	for i := 0; i < len(values) && start+uint32(i) < length; i++ {
+		key, err := sl.GetByIdx(tx, start+uint32(i), values[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 // GetByIdx returns the value given the key of the StorageList in an open db transaction.
 func (sl *StorageList) Get(tx Tx, key []byte, value interface{}) error {
 	valueJSON, err := tx.Get(append(sl.dbPrefixList, key...))
@@ -76,4 +76,56 @@ func TestStorageList(t *testing.T) {
 		require.Equal(t, kv.Key, key)
 	}
 	tx.Close()
+
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	for _, r := range []struct{ start, count, n int }{{0, 4, 4}, {1, 2, 2}, {2, 10, 2}, {4, 1, 0}} {
+		values := make([]Entry, r.count)
+		valuesIface := make([]interface{}, r.count)
+		for i := range values {
+			valuesIface[i] = &values[i]
+		}
+		keys, err := sl.GetByRange(tx, uint32(r.start), valuesIface)
+		require.Nil(t, err)
+		require.Equal(t, r.n, len(keys))
+		for i, key := range keys {
+			require.Equal(t, entries[r.start+i].Key, key)
+			require.Equal(t, entries[r.start+i].Value, values[i])
+		}
+	}
+	tx.Close()
+
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	key, err := sl.RemoveLast(tx)
+	require.Nil(t, err)
+	require.Equal(t, []byte("three"), key)
+	require.Nil(t, tx.Commit())
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	values := make([]Entry, 2)
+	keys, err := sl.GetByRange(tx, 2, []interface{}{&values[0], &values[1]})
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte("two")}, keys)
+	require.Equal(t, Entry{Value: 2}, values[0])
+	length, err := sl.Length(tx)
+	require.Nil(t, err)
+	require.Equal(t, uint32(3), length)
+	var value Entry
+	_, err = sl.GetByIdx(tx, 3, &value)
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, ErrNotFound, sl.Get(tx, []byte("three"), &value))
+	require.Nil(t, sl.Append(tx, []byte("four"), Entry{Value: 4}))
+	key, err = sl.GetByIdx(tx, 3, &value)
+	require.Nil(t, err)
+	require.Equal(t, []byte("four"), key)
+	require.Equal(t, Entry{Value: 4}, value)
+	tx.Close()
+
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	sl.Init(tx)
+	_, err = sl.RemoveLast(tx)
+	require.Equal(t, ErrNotFound, err)
+	tx.Close()
 }
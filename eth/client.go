@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"time"
 
+	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
@@ -24,6 +25,9 @@ var (
 	ErrReceiptStatusFailed = fmt.Errorf("receipt status is failed")
 	// ErrReceiptNotRecieved when unable to retrieve a transaction
 	ErrReceiptNotReceived = fmt.Errorf("receipt not available")
+	// ErrGasPriceNotHigher when a replacement transaction doesn't have a
+	// higher gas price than the replaced one
+	ErrGasPriceNotHigher = fmt.Errorf("gas price is not higher than the one of the replaced transaction")
 )
 
 const (
@@ -55,22 +59,59 @@ func (c *Client) Account() *accounts.Account {
 	return c.account
 }
 
+// TxOpts are the options of a transaction sent with CallAuthOpts.  Dynamic
+// fee (EIP-1559) transactions are not supported by the go-ethereum version
+// used, so the fee is always given by the gas price.
+type TxOpts struct {
+	// GasLimit is the gas limit of the transaction.  If it's 0, the
+	// gasLimit passed to CallAuthOpts is used.
+	GasLimit uint64
+	// GasPrice is the gas price of the transaction.  If it's nil, the
+	// suggested gas price increased by 1% is used.
+	GasPrice *big.Int
+	// MaxGasPrice caps the gas price of the transaction.  If it's nil, the
+	// gas price is not capped.
+	MaxGasPrice *big.Int
+}
+
 // CallAuth performs a Smart Contract method call that requires authorization.
 // This call requires a valid account with Ether that can be spend during the
 // call.
 func (c *Client) CallAuth(gasLimit uint64,
+	fn func(*ethclient.Client, *bind.TransactOpts) (*types.Transaction, error)) (*types.Transaction, error) {
+	return c.CallAuthOpts(gasLimit, nil, fn)
+}
+
+// CallAuthOpts is like CallAuth but the gas limit and gas price of the
+// transaction can be set with opts, which can be nil.
+func (c *Client) CallAuthOpts(gasLimit uint64, opts *TxOpts,
 	fn func(*ethclient.Client, *bind.TransactOpts) (*types.Transaction, error)) (*types.Transaction, error) {
 	if c.account == nil {
 		return nil, ErrAccountNil
 	}
+	if opts == nil {
+		opts = &TxOpts{}
+	}
 
-	gasPrice, err := c.client.SuggestGasPrice(context.Background())
-	if err != nil {
-		return nil, err
+	var gasPrice *big.Int
+	if opts.GasPrice != nil {
+		gasPrice = new(big.Int).Set(opts.GasPrice)
+	} else {
+		var err error
+		gasPrice, err = c.client.SuggestGasPrice(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		inc := new(big.Int).Set(gasPrice)
+		inc.Div(inc, new(big.Int).SetUint64(100))
+		gasPrice.Add(gasPrice, inc)
+	}
+	if opts.MaxGasPrice != nil && gasPrice.Cmp(opts.MaxGasPrice) == 1 {
+		gasPrice.Set(opts.MaxGasPrice)
+	}
+	if opts.GasLimit != 0 {
+		gasLimit = opts.GasLimit
 	}
-	inc := new(big.Int).Set(gasPrice)
-	inc.Div(inc, new(big.Int).SetUint64(100))
-	gasPrice.Add(gasPrice, inc)
 	log.WithField("gasPrice", gasPrice).Debug("Transaction metadata")
 
 	auth, err := bind.NewKeyStoreTransactor(c.ks, *c.account)
@@ -92,6 +133,50 @@ func (c *Client) CallAuth(gasLimit uint64,
 	return tx, err
 }
 
+// EstimateGas returns the gas needed by a transaction from the account to the
+// Smart Contract at address to with the given call data, without sending it.
+func (c *Client) EstimateGas(to common.Address, data []byte) (uint64, error) {
+	if c.account == nil {
+		return 0, ErrAccountNil
+	}
+	return c.client.EstimateGas(context.Background(), ethereum.CallMsg{
+		From: c.account.Address,
+		To:   &to,
+		Data: data,
+	})
+}
+
+// ResendTx sends a replacement of the pending transaction tx, with the same
+// nonce, recipient, value, gas limit and data but with gasPrice, which must be
+// higher than the gas price of tx.  The signed replacement transaction is
+// returned.
+func (c *Client) ResendTx(tx *types.Transaction, gasPrice *big.Int) (*types.Transaction, error) {
+	if c.account == nil {
+		return nil, ErrAccountNil
+	}
+	if gasPrice.Cmp(tx.GasPrice()) <= 0 {
+		return nil, ErrGasPriceNotHigher
+	}
+	if tx.To() == nil {
+		return nil, fmt.Errorf("contract creation transactions can't be resent")
+	}
+	auth, err := bind.NewKeyStoreTransactor(c.ks, *c.account)
+	if err != nil {
+		return nil, err
+	}
+	rawTx := types.NewTransaction(tx.Nonce(), *tx.To(), tx.Value(), tx.Gas(), gasPrice, tx.Data())
+	signedTx, err := auth.Signer(types.HomesteadSigner{}, auth.From, rawTx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.client.SendTransaction(context.Background(), signedTx); err != nil {
+		return nil, err
+	}
+	log.WithField("tx", signedTx.Hash().Hex()).WithField("replacedTx", tx.Hash().Hex()).
+		WithField("nonce", signedTx.Nonce()).WithField("gasPrice", gasPrice).Debug("Transaction resent")
+	return signedTx, nil
+}
+
 type ContractData struct {
 	Address common.Address
 	Tx      *types.Transaction
@@ -0,0 +1,282 @@
+package issuer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	common3 "github.com/iden3/go-iden3-core/common"
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// exportVersion is the version of the format written by Export.
+const exportVersion = 1
+
+// issuerExport is the format written by Export.  Storage holds the hex
+// encoded key values of the Issuer storage, which contain the Config, the
+// three merkle trees, the list of identity states and the publishing status.
+// The other fields are used to verify the import.
+type issuerExport struct {
+	Version   int
+	Id        *core.ID
+	KOp       string
+	IdenState *merkletree.Hash
+	Storage   map[string]string
+}
+
+// dumpStorage calls f with every key value of storage hex encoded.
+func dumpStorage(storage db.Storage, f func(key, value string)) error {
+	return storage.Iterate(func(k, v []byte) (bool, error) {
+		f(common3.HexEncode(k), common3.HexEncode(v))
+		return true, nil
+	})
+}
+
+// RawDump calls f with every key value of the Issuer storage hex encoded.
+// The output can be imported with RawImport.
+func (is *Issuer) RawDump(f func(key, value string)) error {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	return dumpStorage(is.storage, f)
+}
+
+// RawImport writes the hex encoded key values of raw, as returned by RawDump,
+// into the Issuer storage in a single transaction and returns the number of
+// key values written.  Existing keys are overwritten, and the identity, merkle
+// trees and publishing status of the Issuer are reloaded from the storage, so
+// importing a dump into an Issuer created with a new storage backend results
+// in the dumped Issuer, with identical tree roots.  The Issuer keeps its
+// Config.
+func (is *Issuer) RawImport(raw map[string]string) (int, error) {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range raw {
+		kBytes, err := common3.HexDecode(k)
+		if err != nil {
+			tx.Close()
+			return 0, fmt.Errorf("invalid key %v: %w", k, err)
+		}
+		vBytes, err := common3.HexDecode(v)
+		if err != nil {
+			tx.Close()
+			return 0, fmt.Errorf("invalid value for key %v: %w", k, err)
+		}
+		tx.Put(kBytes, vBytes)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if err := is.loadStorage(); err != nil {
+		return 0, err
+	}
+	return len(raw), nil
+}
+
+// Compact compacts the Issuer storage to reclaim the space of the deleted and
+// overwritten keys, if the storage implements db.Compacter (like
+// db.LevelDbStorage).  For other storages it does nothing.
+func (is *Issuer) Compact() error {
+	if c, ok := is.storage.(db.Compacter); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+// ClaimsDump returns the key values of the claims tree storage hex encoded,
+// without the claims tree prefix.  The output can be imported with
+// MigrateLegacyDump.
+func (is *Issuer) ClaimsDump() (map[string]string, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	dump := make(map[string]string)
+	if err := dumpStorage(is.storage.WithPrefix(dbPrefixClaimsTree), func(k, v string) {
+		dump[k] = v
+	}); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// Export writes a versioned backup of the Issuer to w, which can be restored
+// with Import.  The private keys are not part of the Issuer storage, so they
+// are not exported and must be backed up from the KeyStore.
+func (is *Issuer) Export(w io.Writer) error {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	idenState, _ := is.state()
+	exp := issuerExport{
+		Version:   exportVersion,
+		Id:        is.id,
+		KOp:       common3.HexEncode(is.kOpComp[:]),
+		IdenState: idenState,
+		Storage:   make(map[string]string),
+	}
+	if err := dumpStorage(is.storage, func(k, v string) {
+		exp.Storage[k] = v
+	}); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(exp)
+}
+
+// Import restores an Issuer exported with Export into storage, which must be
+// empty, and loads it like Load.  The import fails if the ID, the operational
+// key or the identity state recomputed from the imported merkle trees don't
+// match the exported ones, in which case storage is not modified.
+func Import(r io.Reader, storage db.Storage, signer Signer,
+	idenPubOnChain idenpubonchain.IdenPubOnChainer,
+	idenStateZkProofConf *IdenStateZkProofConf,
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter) (*Issuer, error) {
+	var exp issuerExport
+	if err := json.NewDecoder(r).Decode(&exp); err != nil {
+		return nil, err
+	}
+	if exp.Version != exportVersion {
+		return nil, fmt.Errorf("%w: %v", ErrExportVersion, exp.Version)
+	}
+	if exp.Id == nil || exp.IdenState == nil {
+		return nil, fmt.Errorf("issuer export is missing the id or the identity state")
+	}
+	if kvs, err := storage.List(1); err != nil {
+		return nil, err
+	} else if len(kvs) != 0 {
+		return nil, fmt.Errorf("storage is not empty")
+	}
+
+	// The export is validated in a scratch storage so that a rejected
+	// import leaves storage empty.
+	scratch := db.NewMemoryStorage()
+	tx, err := scratch.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range exp.Storage {
+		kBytes, err := common3.HexDecode(k)
+		if err != nil {
+			tx.Close()
+			return nil, fmt.Errorf("invalid key %v: %w", k, err)
+		}
+		vBytes, err := common3.HexDecode(v)
+		if err != nil {
+			tx.Close()
+			return nil, fmt.Errorf("invalid value for key %v: %w", k, err)
+		}
+		tx.Put(kBytes, vBytes)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	is, err := Load(scratch, signer, idenPubOnChain, idenStateZkProofConf, idenPubOffChainWriter)
+	if err != nil {
+		return nil, err
+	}
+	if !is.ID().Equals(exp.Id) {
+		return nil, fmt.Errorf("imported id (%v) doesn't match the exported one (%v)", is.ID(), exp.Id)
+	}
+	if kOp := common3.HexEncode(is.KeyOperational()[:]); kOp != exp.KOp {
+		return nil, fmt.Errorf("imported kOp (%v) doesn't match the exported one (%v)", kOp, exp.KOp)
+	}
+	if idenState, _ := is.State(); !idenState.Equals(exp.IdenState) {
+		return nil, fmt.Errorf("imported identity state (%v) doesn't match the exported one (%v)",
+			idenState.Hex(), exp.IdenState.Hex())
+	}
+
+	if err := copyStorage(storage, scratch); err != nil {
+		return nil, err
+	}
+	return Load(storage, signer, idenPubOnChain, idenStateZkProofConf, idenPubOffChainWriter)
+}
+
+// copyStorage writes every key value of src into dst in a single
+// transaction.
+func copyStorage(dst, src db.Storage) error {
+	tx, err := dst.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := src.Iterate(func(k, v []byte) (bool, error) {
+		tx.Put(append([]byte{}, k...), append([]byte{}, v...))
+		return true, nil
+	}); err != nil {
+		tx.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+// credentialBundleHeader is the first line written by ExportCredentialBundle.
+type credentialBundleHeader struct {
+	Id                  *core.ID
+	IdenState           *merkletree.Hash
+	ClaimsTreeRoot      *merkletree.Hash
+	RevocationsTreeRoot *merkletree.Hash
+	RootsTreeRoot       *merkletree.Hash
+}
+
+// credentialBundleClaim is a claim line written by ExportCredentialBundle.
+type credentialBundleClaim struct {
+	Claim    *merkletree.Entry
+	MtpClaim *merkletree.Proof
+}
+
+// ExportCredentialBundle writes to w every claim of the claims tree of the
+// identity state idenState, which must be in the list of identity states of
+// the Issuer, together with its proof of existence in the claims tree root
+// of that state.  The output is a stream of JSON lines: the first one holds
+// the Id, idenState and its tree roots, and each of the following holds a
+// claim and its proof, so every claim can be verified against a published
+// identity state without calling GenCredentialExistence for each one.
+func (is *Issuer) ExportCredentialBundle(idenState *merkletree.Hash, w io.Writer) error {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	roots, err := is.getIdenStateTreeRoots(tx, idenState)
+	if err != nil {
+		return fmt.Errorf("identity state not found: %w", err)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(credentialBundleHeader{
+		Id:                  is.id,
+		IdenState:           idenState,
+		ClaimsTreeRoot:      roots.ClaimsTreeRoot,
+		RevocationsTreeRoot: roots.RevocationsTreeRoot,
+		RootsTreeRoot:       roots.RootsTreeRoot,
+	}); err != nil {
+		return err
+	}
+	var errWalk error
+	if err := is.claimsTree.WalkLeafs(roots.ClaimsTreeRoot, func(e *merkletree.Entry) {
+		if errWalk != nil {
+			return
+		}
+		hi, err := e.HIndex()
+		if err != nil {
+			errWalk = err
+			return
+		}
+		mtp, err := generateExistenceMTProof(is.claimsTree, hi, roots.ClaimsTreeRoot)
+		if err != nil {
+			errWalk = err
+			return
+		}
+		errWalk = enc.Encode(credentialBundleClaim{Claim: e, MtpClaim: mtp})
+	}); err != nil {
+		return err
+	}
+	return errWalk
+}
@@ -0,0 +1,210 @@
+package issuer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerRawDumpImport(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	for i := 0; i < 4; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+	}
+	idenState, roots := issuer.State()
+
+	raw := make(map[string]string)
+	require.Nil(t, issuer.RawDump(func(k, v string) { raw[k] = v }))
+
+	issuerImport, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	n, err := issuerImport.RawImport(raw)
+	require.Nil(t, err)
+	assert.Equal(t, len(raw), n)
+	idenStateImport, rootsImport := issuerImport.State()
+	assert.Equal(t, idenState, idenStateImport)
+	assert.Equal(t, roots, rootsImport)
+	assert.Equal(t, issuer.ID(), issuerImport.ID())
+	assert.Equal(t, issuer.KeyOperational(), issuerImport.KeyOperational())
+
+	rawImport := make(map[string]string)
+	require.Nil(t, issuerImport.RawDump(func(k, v string) { rawImport[k] = v }))
+	for k, v := range raw {
+		assert.Equal(t, v, rawImport[k])
+	}
+
+	_, err = issuerImport.RawImport(map[string]string{"0xzz": "0x00"})
+	assert.NotNil(t, err)
+
+	// The claims dump contains only the claims tree
+	claimsDump, err := issuer.ClaimsDump()
+	require.Nil(t, err)
+	assert.Less(t, len(claimsDump), len(raw))
+	storage := db.NewMemoryStorage()
+	require.Nil(t, MigrateLegacyDump(claimsDump, storage))
+	clt, err := merkletree.NewMerkleTree(storage.WithPrefix(dbPrefixClaimsTree), ConfigDefault.MaxLevelsClaimsTree)
+	require.Nil(t, err)
+	assert.Equal(t, roots.ClaimsTreeRoot, clt.RootKey())
+}
+
+func TestIssuerRawImportProving(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	signer := &signerBlockExport{KeyStore: keyStore, exporting: make(chan struct{}),
+		release: make(chan struct{})}
+	issuer.signer = signer
+	issuer.idenStateZkProofConf = &IdenStateZkProofConf{Levels: idenStateZkProofConf.Levels}
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	raw := make(map[string]string)
+	require.Nil(t, issuer.RawDump(func(k, v string) { raw[k] = v }))
+
+	// The storage is reloaded during the zk proof generation, which uses
+	// the Issuer fields captured before.
+	errCh := make(chan error, 1)
+	go func() { errCh <- issuer.PublishState() }()
+	<-signer.exporting
+	close(signer.release)
+	_, err = issuer.RawImport(raw)
+	require.Nil(t, err)
+	assert.NotNil(t, <-errCh)
+}
+
+func TestIssuerExportImport(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	var claimsIssued []claims.Claimer
+	for i := 0; i < 4; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		claim, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+		claimsIssued = append(claimsIssued, claim)
+	}
+	require.Nil(t, issuer.RevokeClaim(claimsIssued[0]))
+	idenState, roots := issuer.State()
+
+	var buf bytes.Buffer
+	require.Nil(t, issuer.Export(&buf))
+	exported := buf.Bytes()
+
+	storage := db.NewMemoryStorage()
+	issuerImport, err := Import(bytes.NewReader(exported), storage, keyStore,
+		idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	idenStateImport, rootsImport := issuerImport.State()
+	assert.Equal(t, idenState, idenStateImport)
+	assert.Equal(t, roots, rootsImport)
+	assert.Equal(t, issuer.ID(), issuerImport.ID())
+	revoked, err := issuerImport.ClaimRevoked(claimsIssued[0])
+	require.Nil(t, err)
+	assert.True(t, revoked)
+	_, err = issuerImport.SignBinary([]byte("test:"), []byte("msg"))
+	assert.Nil(t, err)
+
+	// The storage must be empty.
+	_, err = Import(bytes.NewReader(exported), storage, keyStore,
+		idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	assert.NotNil(t, err)
+
+	var exp issuerExport
+	require.Nil(t, json.Unmarshal(exported, &exp))
+	exp.Version = exportVersion + 1
+	expJSON, err := json.Marshal(exp)
+	require.Nil(t, err)
+	_, err = Import(bytes.NewReader(expJSON), db.NewMemoryStorage(), keyStore,
+		idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	assert.True(t, errors.Is(err, ErrExportVersion))
+
+	// An export whose trees don't match its identity state is rejected,
+	// and the storage is left empty for a retry.
+	exp.Version = exportVersion
+	exp.IdenState = roots.ClaimsTreeRoot
+	expJSON, err = json.Marshal(exp)
+	require.Nil(t, err)
+	storage = db.NewMemoryStorage()
+	_, err = Import(bytes.NewReader(expJSON), storage, keyStore,
+		idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	assert.NotNil(t, err)
+	_, err = Import(bytes.NewReader(exported), storage, keyStore,
+		idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	assert.Nil(t, err)
+}
+
+func TestIssuerExportCredentialBundle(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	for i := 0; i < 4; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+	}
+	idenState, roots := issuer.state()
+	appendIdenState(t, issuer, idenState, &roots)
+	// Claims issued after the exported state are not in the bundle
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	require.Nil(t, issuer.ExportCredentialBundle(idenState, &buf))
+	dec := json.NewDecoder(&buf)
+	var header credentialBundleHeader
+	require.Nil(t, dec.Decode(&header))
+	assert.Equal(t, idenState, header.IdenState)
+	assert.Equal(t, roots.ClaimsTreeRoot, header.ClaimsTreeRoot)
+	n := 0
+	for dec.More() {
+		var c credentialBundleClaim
+		require.Nil(t, dec.Decode(&c))
+		hi, hv, err := c.Claim.HiHv()
+		require.Nil(t, err)
+		assert.True(t, merkletree.VerifyProof(header.ClaimsTreeRoot, c.MtpClaim, hi, hv))
+		n++
+	}
+	// The 4 claims and the genesis operational key claim
+	assert.Equal(t, 5, n)
+
+	var hashUnknown merkletree.Hash
+	hashUnknown[0] = 0x42
+	assert.NotNil(t, issuer.ExportCredentialBundle(&hashUnknown, &buf))
+}
+
+func TestIssuerCompact(t *testing.T) {
+	// The memory storage doesn't compact
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	assert.Nil(t, issuer.Compact())
+
+	dir, err := ioutil.TempDir("", "issuer")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	storage, err := db.NewLevelDbStorage(dir, false)
+	require.Nil(t, err)
+	defer storage.Close()
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOp, pass))
+	cfg := ConfigDefault
+	cfg.GenesisOnly = true
+	_, err = Create(cfg, kOp, []claims.Claimer{}, storage, keyStore)
+	require.Nil(t, err)
+	issuer, err = Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+	idenState, _ := issuer.State()
+	require.Nil(t, issuer.Compact())
+	issuerLoad, err := Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+	idenStateLoad, _ := issuerLoad.State()
+	assert.Equal(t, idenState, idenStateLoad)
+}
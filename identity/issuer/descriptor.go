@@ -0,0 +1,111 @@
+package issuer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	common3 "github.com/iden3/go-iden3-core/common"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// IssuerDescriptor is the public information that holders and verifiers need
+// about an Issuer: its ID, its operational key and the url where it publishes
+// its off chain public data.
+type IssuerDescriptor struct {
+	ID             *core.ID
+	KeyOperational *babyjub.PublicKeyComp
+	// IdenPubUrl is empty if the Issuer doesn't publish off chain data.
+	IdenPubUrl string
+}
+
+type issuerDescriptorJSON struct {
+	ID             *core.ID
+	KeyOperational string
+	IdenPubUrl     string
+}
+
+// MarshalJSON serializes the descriptor with the ID in base58 and the
+// compressed operational key in hex.
+func (d IssuerDescriptor) MarshalJSON() ([]byte, error) {
+	var descriptor issuerDescriptorJSON
+	descriptor.ID = d.ID
+	if d.KeyOperational != nil {
+		descriptor.KeyOperational = common3.HexEncode(d.KeyOperational[:])
+	}
+	descriptor.IdenPubUrl = d.IdenPubUrl
+	return json.Marshal(descriptor)
+}
+
+// UnmarshalJSON deserializes the descriptor serialized by MarshalJSON.
+func (d *IssuerDescriptor) UnmarshalJSON(b []byte) error {
+	var descriptor issuerDescriptorJSON
+	if err := json.Unmarshal(b, &descriptor); err != nil {
+		return err
+	}
+	if descriptor.ID == nil {
+		return fmt.Errorf("issuer descriptor without ID")
+	}
+	var kOpComp babyjub.PublicKeyComp
+	if err := common3.HexDecodeInto(kOpComp[:], []byte(descriptor.KeyOperational)); err != nil {
+		return fmt.Errorf("invalid issuer descriptor KeyOperational: %w", err)
+	}
+	if _, err := kOpComp.Decompress(); err != nil {
+		return fmt.Errorf("invalid issuer descriptor KeyOperational: %w", err)
+	}
+	d.ID = descriptor.ID
+	d.KeyOperational = &kOpComp
+	d.IdenPubUrl = descriptor.IdenPubUrl
+	return nil
+}
+
+// PublicDescriptor returns the IssuerDescriptor of the Issuer.
+func (is *Issuer) PublicDescriptor() IssuerDescriptor {
+	descriptor := IssuerDescriptor{ID: is.id, KeyOperational: is.kOpComp}
+	if is.idenPubOffChainWriter != nil {
+		descriptor.IdenPubUrl = is.idenPubOffChainWriter.Url()
+	}
+	return descriptor
+}
+
+// GenesisData is the genesis information of an Issuer required to generate
+// the zk proofs of its identity state updates (see GenIdOwnershipGenesisInputs),
+// apart from the operational private key.
+type GenesisData struct {
+	// Id is the genesis ID derived from IdenState.
+	Id        *core.ID
+	IdenState *merkletree.Hash
+	// ClaimsTreeRoot is the root of the genesis claims tree.
+	ClaimsTreeRoot *merkletree.Hash
+	// ClaimKOpMtp is the proof of existence of the operational key claim in
+	// the genesis claims tree.
+	ClaimKOpMtp *merkletree.Proof
+}
+
+// GenesisData returns the genesis data of the Issuer.  It returns
+// ErrIdGenesisMismatch if the ID derived from the genesis identity state is
+// not the ID of the Issuer.
+func (is *Issuer) GenesisData() (*GenesisData, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	idenState, roots, err := is.genesisIdenState()
+	if err != nil {
+		return nil, err
+	}
+	id := core.IdGenesisFromIdenState(idenState)
+	if !id.Equals(is.id) {
+		return nil, ErrIdGenesisMismatch
+	}
+	var mtp merkletree.Proof
+	if err := db.LoadJSON(is.storage, dbKeyGenesisClaimKOpMtp, &mtp); err != nil {
+		return nil, fmt.Errorf("error getting genesis kOp claim mtp from storage: %w", err)
+	}
+	return &GenesisData{
+		Id:             id,
+		IdenState:      idenState,
+		ClaimsTreeRoot: roots.ClaimsTreeRoot,
+		ClaimKOpMtp:    &mtp,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package issuer
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerPublicDescriptor(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	descriptor := issuer.PublicDescriptor()
+	assert.Equal(t, issuer.ID(), descriptor.ID)
+	assert.Equal(t, issuer.KeyOperational(), descriptor.KeyOperational)
+	assert.Equal(t, idenPubOffChain.Url(), descriptor.IdenPubUrl)
+
+	descriptorJSON, err := json.Marshal(descriptor)
+	require.Nil(t, err)
+	var descriptorMap map[string]string
+	require.Nil(t, json.Unmarshal(descriptorJSON, &descriptorMap))
+	assert.Equal(t, issuer.ID().String(), descriptorMap["ID"])
+
+	var descriptorLoad IssuerDescriptor
+	require.Nil(t, json.Unmarshal(descriptorJSON, &descriptorLoad))
+	assert.Equal(t, descriptor, descriptorLoad)
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"ID": null}`), &descriptorLoad))
+	descriptorMap["KeyOperational"] = "0x1234"
+	descriptorJSON, err = json.Marshal(descriptorMap)
+	require.Nil(t, err)
+	assert.NotNil(t, json.Unmarshal(descriptorJSON, &descriptorLoad))
+
+	issuerGenesis, _, _ := newIssuer(t, true, nil, nil)
+	assert.Equal(t, "", issuerGenesis.PublicDescriptor().IdenPubUrl)
+}
+
+func TestIssuerGenesisData(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	genesisData, err := issuer.GenesisData()
+	require.Nil(t, err)
+	assert.Equal(t, issuer.ID(), genesisData.Id)
+	assert.True(t, genesisData.ClaimKOpMtp.Existence)
+	inputs, err := issuer.GenIdOwnershipGenesisInputs(idenStateZkProofConf.Levels)
+	require.Nil(t, err)
+	assert.Equal(t, inputs.ClaimsTreeRoot, genesisData.ClaimsTreeRoot.BigInt())
+	assert.Equal(t, inputs.MtpSiblings, genesisData.ClaimKOpMtp.AllSiblingsCircom(idenStateZkProofConf.Levels))
+
+	genesisDataJSON, err := json.Marshal(genesisData)
+	require.Nil(t, err)
+	var genesisDataDec GenesisData
+	require.Nil(t, json.Unmarshal(genesisDataJSON, &genesisDataDec))
+	assert.Equal(t, genesisData.Id, genesisDataDec.Id)
+	assert.Equal(t, genesisData.IdenState, genesisDataDec.IdenState)
+	assert.Equal(t, genesisData.ClaimKOpMtp.AllSiblings(), genesisDataDec.ClaimKOpMtp.AllSiblings())
+}
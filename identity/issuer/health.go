@@ -0,0 +1,248 @@
+package issuer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// HealthReport is a summary of the Issuer status, suitable to be served as
+// JSON in a health endpoint.
+type HealthReport struct {
+	Healthy bool `json:"healthy"`
+	// State is the current identity state, which may not be published yet.
+	State        *merkletree.Hash     `json:"state"`
+	StateOnChain *proof.IdenStateData `json:"stateOnChain"`
+	// StatePending is zero when there's no state pending to be published.
+	StatePending           *merkletree.Hash `json:"statePending"`
+	StatePendingTransacted bool             `json:"statePendingTransacted"`
+	// StatePendingAge is zero if unknown (the Issuer was loaded with a
+	// pending state) or if there's no state pending.
+	StatePendingAge time.Duration `json:"statePendingAge"`
+	LastSyncTime    time.Time     `json:"lastSyncTime"`
+	LastSyncErr     string        `json:"lastSyncErr,omitempty"`
+	// Number of leafs in each tree at the current state.
+	ClaimsTreeLeafs      int `json:"claimsTreeLeafs"`
+	RevocationsTreeLeafs int `json:"revocationsTreeLeafs"`
+	RootsTreeLeafs       int `json:"rootsTreeLeafs"`
+	// IdenStates is the number of states that have been published.
+	IdenStates   uint32 `json:"idenStates"`
+	NextNonce    uint32 `json:"nextNonce"`
+	StorageInfo  string `json:"storageInfo"`
+	SelfCheckErr string `json:"selfCheckErr,omitempty"`
+}
+
+func countLeafs(mt *merkletree.MerkleTree) (int, error) {
+	n := 0
+	err := mt.Walk(nil, func(node *merkletree.Node) {
+		if node.Type == merkletree.NodeTypeLeaf {
+			n++
+		}
+	})
+	return n, err
+}
+
+// leafCountCache keeps the number of leafs of the Issuer merkle trees by the
+// roots they were counted at, so that Health only walks the trees whose root
+// changed since the previous call.
+type leafCountCache struct {
+	sync.Mutex
+	counts map[merkletree.Hash]int
+}
+
+// countLeafs returns the number of leafs of each tree at its current root,
+// and keeps only the counts of these roots.
+func (c *leafCountCache) countLeafs(mts ...*merkletree.MerkleTree) ([]int, error) {
+	c.Lock()
+	defer c.Unlock()
+	counts := make(map[merkletree.Hash]int, len(mts))
+	ns := make([]int, len(mts))
+	for i, mt := range mts {
+		root := *mt.RootKey()
+		n, ok := c.counts[root]
+		if !ok {
+			var err error
+			if n, err = countLeafs(mt); err != nil {
+				return nil, err
+			}
+		}
+		counts[root] = n
+		ns[i] = n
+	}
+	c.counts = counts
+	return ns, nil
+}
+
+// selfCheck verifies the consistency between the idenStateList and the
+// on chain and pending identity states.
+func (is *Issuer) selfCheck(tx db.Tx) error {
+	idenState, idenStateTreeRoots, err := is.getIdenStateByIdx(tx, -1)
+	if err != nil {
+		return fmt.Errorf("unable to get the last identity state: %w", err)
+	}
+	idenStateCalc := core.IdenState(idenStateTreeRoots.ClaimsTreeRoot,
+		idenStateTreeRoots.RevocationsTreeRoot, idenStateTreeRoots.RootsTreeRoot)
+	if !idenState.Equals(idenStateCalc) {
+		return fmt.Errorf("last identity state (%v) doesn't match the one calculated from its roots (%v)",
+			idenState, idenStateCalc)
+	}
+	if idenStateOnChain := is.idenStateOnChain(); !idenStateOnChain.Equals(&merkletree.HashZero) {
+		if _, err := is.getIdenStateTreeRoots(tx, idenStateOnChain); err != nil {
+			return fmt.Errorf("on chain identity state (%v) not found: %w", idenStateOnChain, err)
+		}
+	}
+	if idenStatePending, _ := is.idenStatePending(); !idenStatePending.Equals(&merkletree.HashZero) {
+		if _, err := is.getIdenStateTreeRoots(tx, idenStatePending); err != nil {
+			return fmt.Errorf("pending identity state (%v) not found: %w", idenStatePending, err)
+		}
+	}
+	return nil
+}
+
+// Health returns a HealthReport of the Issuer.  The report is considered
+// healthy when the last sync didn't fail and the self check passes.  The
+// leafs of a tree are only counted again when its root changes.
+func (is *Issuer) Health() (*HealthReport, error) {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+
+	var r HealthReport
+	r.State, _ = is.state()
+	r.StateOnChain = is.idenStateDataOnChain()
+	r.StatePending, r.StatePendingTransacted = is.idenStatePending()
+	if !is.idenStatePendingSince.IsZero() {
+		r.StatePendingAge = time.Since(is.idenStatePendingSince)
+	}
+	r.LastSyncTime = is.lastSyncTime
+	if is.lastSyncErr != nil {
+		r.LastSyncErr = is.lastSyncErr.Error()
+	}
+	leafs, err := is.leafCounts.countLeafs(is.claimsTree, is.revocationsTree, is.rootsTree)
+	if err != nil {
+		return nil, err
+	}
+	r.ClaimsTreeLeafs, r.RevocationsTreeLeafs, r.RootsTreeLeafs = leafs[0], leafs[1], leafs[2]
+	if r.IdenStates, err = is.idenStateList.Length(tx); err != nil {
+		return nil, err
+	}
+	if r.NextNonce, err = is.nonceGen.Peek(tx); err != nil {
+		return nil, err
+	}
+	r.StorageInfo = is.storage.Info()
+	if err := is.selfCheck(tx); err != nil {
+		r.SelfCheckErr = err.Error()
+	}
+	r.Healthy = is.lastSyncErr == nil && r.SelfCheckErr == ""
+	return &r, nil
+}
+
+// genesisIdenState returns the genesis identity state and its tree roots,
+// calculated from the genesis claims tree root stored at Create.
+func (is *Issuer) genesisIdenState() (*merkletree.Hash, *IdenStateTreeRoots, error) {
+	var genesisClaimTreeRoot merkletree.Hash
+	if err := db.LoadJSON(is.storage, dbKeyGenesisClaimTreeRoot, &genesisClaimTreeRoot); err != nil {
+		return nil, nil, fmt.Errorf("error getting genesis claims tree root from storage: %w", err)
+	}
+	rot, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), is.cfg.MaxLevelsRootsTree)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := claims.AddLeafRootsTree(rot, &genesisClaimTreeRoot); err != nil {
+		return nil, nil, err
+	}
+	roots := IdenStateTreeRoots{
+		ClaimsTreeRoot:      &genesisClaimTreeRoot,
+		RevocationsTreeRoot: &merkletree.HashZero,
+		RootsTreeRoot:       rot.RootKey(),
+	}
+	idenState := core.IdenState(roots.ClaimsTreeRoot, roots.RevocationsTreeRoot, roots.RootsTreeRoot)
+	return idenState, &roots, nil
+}
+
+// RebuildStateList repairs the list of identity states when it's inconsistent
+// with the merkle trees, for example after a crash, and logs each repair with
+// the Issuer Logger:
+//   - The trailing entries that can't be read or whose identity state doesn't
+//     match the one calculated from their roots are removed.
+//   - If the list is empty, the genesis identity state is appended.
+//   - If the identity state on chain or the pending one is not in the list but
+//     it's the current identity state, the current identity state is appended.
+//
+// The repairs are stored in a single transaction, so nothing is stored if
+// the list can't be repaired.
+func (is *Issuer) RebuildStateList() error {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	length, err := is.idenStateList.Length(tx)
+	if err == db.ErrNotFound {
+		is.log().Warn("Identity state list not found, initializing it", nil)
+		is.idenStateList.Init(tx)
+	} else if err != nil {
+		return err
+	}
+	for ; length > 0; length-- {
+		idenState, roots, err := is.getIdenStateByIdx(tx, int64(length-1))
+		if err == nil && idenState.Equals(core.IdenState(roots.ClaimsTreeRoot,
+			roots.RevocationsTreeRoot, roots.RootsTreeRoot)) {
+			break
+		}
+		if _, err := is.idenStateList.RemoveLast(tx); err != nil {
+			return err
+		}
+		is.log().Warn("Removed invalid identity state from the list", Fields{"idx": length - 1, "err": err})
+	}
+	if length == 0 {
+		idenState, roots, err := is.genesisIdenState()
+		if err != nil {
+			return err
+		}
+		if err := is.idenStateList.Append(tx, idenState[:], roots); err != nil {
+			return err
+		}
+		length = 1
+		is.log().Warn("Appended genesis identity state to the list", Fields{"idenState": idenState.Hex()})
+	}
+
+	listed := make(map[merkletree.Hash]bool)
+	for idx := uint32(0); idx < length; idx++ {
+		idenState, _, err := is.getIdenStateByIdx(tx, int64(idx))
+		if err != nil {
+			return err
+		}
+		listed[*idenState] = true
+	}
+	idenStateCurrent, rootsCurrent := is.state()
+	idenStatePending, _ := is.idenStatePending()
+	for _, idenState := range []*merkletree.Hash{is.idenStateOnChain(), idenStatePending} {
+		if idenState.Equals(&merkletree.HashZero) || listed[*idenState] {
+			continue
+		}
+		if !idenState.Equals(idenStateCurrent) {
+			return fmt.Errorf("identity state %v is not in the list and is not the current one",
+				idenState.Hex())
+		}
+		if err := is.idenStateList.Append(tx, idenState[:], &rootsCurrent); err != nil {
+			return err
+		}
+		listed[*idenState] = true
+		is.log().Warn("Appended current identity state to the list", Fields{"idenState": idenState.Hex()})
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,106 @@
+package issuer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerHealth(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	health, err := issuer.Health()
+	require.Nil(t, err)
+	assert.True(t, health.Healthy)
+	assert.Equal(t, "", health.SelfCheckErr)
+	assert.Equal(t, &merkletree.HashZero, health.StateOnChain.IdenState)
+	assert.Equal(t, &merkletree.HashZero, health.StatePending)
+	assert.Equal(t, 1, health.ClaimsTreeLeafs)
+	assert.Equal(t, 0, health.RevocationsTreeLeafs)
+	assert.Equal(t, 1, health.RootsTreeLeafs)
+	assert.Equal(t, uint32(1), health.IdenStates)
+	assert.Equal(t, uint32(1), health.NextNonce)
+	// newIssuer calls Load, which syncs with the smart contract.
+	assert.False(t, health.LastSyncTime.IsZero())
+	assert.Equal(t, "", health.LastSyncErr)
+
+	// The leafs are counted again when the tree roots change.
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	health, err = issuer.Health()
+	require.Nil(t, err)
+	assert.Equal(t, 2, health.ClaimsTreeLeafs)
+	assert.Equal(t, 0, health.RevocationsTreeLeafs)
+	assert.Equal(t, 1, health.RootsTreeLeafs)
+	assert.Equal(t, map[merkletree.Hash]int{
+		*issuer.claimsTree.RootKey():      2,
+		*issuer.revocationsTree.RootKey(): 0,
+		*issuer.rootsTree.RootKey():       1,
+	}, issuer.leafCounts.counts)
+}
+
+func TestIssuerRebuildStateList(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	logger, hook := test.NewNullLogger()
+	issuer.SetLogger(NewLogrusLogger(logger))
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	genesisState, genesisRoots, err := issuer.getIdenStateByIdx(tx, 0)
+	require.Nil(t, err)
+	tx.Close()
+
+	// Nothing to repair
+	require.Nil(t, issuer.RebuildStateList())
+	assert.Equal(t, 0, len(hook.AllEntries()))
+
+	// An invalid entry is removed and the missing genesis state is
+	// appended.
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.idenStateList.Init(tx)
+	idenStateBad := merkletree.NewHashFromBigInt(big.NewInt(1))
+	require.Nil(t, issuer.idenStateList.Append(tx, idenStateBad[:], genesisRoots))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, issuer.RebuildStateList())
+	assert.Equal(t, 2, len(hook.AllEntries()))
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	length, err := issuer.idenStateList.Length(tx)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), length)
+	idenState, roots, err := issuer.getIdenStateByIdx(tx, 0)
+	require.Nil(t, err)
+	assert.Equal(t, genesisState, idenState)
+	assert.Equal(t, genesisRoots, roots)
+	tx.Close()
+
+	// A pending state missing from the list is appended if it's the
+	// current one.
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	idenStateCurrent, _ := issuer.State()
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenStateCurrent, false)
+	require.Nil(t, tx.Commit())
+	require.Nil(t, issuer.RebuildStateList())
+	assert.Equal(t, 3, len(hook.AllEntries()))
+	health, err := issuer.Health()
+	require.Nil(t, err)
+	assert.Equal(t, "", health.SelfCheckErr)
+	assert.Equal(t, uint32(2), health.IdenStates)
+
+	// A pending state that isn't the current one can't be recovered.
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenStateBad, true)
+	require.Nil(t, tx.Commit())
+	assert.NotNil(t, issuer.RebuildStateList())
+}
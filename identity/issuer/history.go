@@ -0,0 +1,161 @@
+package issuer
+
+import (
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// StateHistoryError is the error returned by VerifyStateHistory with the index
+// in the idenStateList of the first inconsistent entry.
+type StateHistoryError struct {
+	Idx uint32
+	Err error
+}
+
+func (e *StateHistoryError) Error() string {
+	return fmt.Sprintf("inconsistent identity state history at index %v: %v", e.Idx, e.Err)
+}
+
+func (e *StateHistoryError) Unwrap() error {
+	return e.Err
+}
+
+// claimsTreeLeafs returns the set of hIndexes of the leafs of the claims tree
+// at rootKey.
+func (is *Issuer) claimsTreeLeafs(rootKey *merkletree.Hash) (map[merkletree.Hash]bool, error) {
+	leafs := make(map[merkletree.Hash]bool)
+	var errKey error
+	err := is.claimsTree.Walk(rootKey, func(n *merkletree.Node) {
+		if n.Type != merkletree.NodeTypeLeaf {
+			return
+		}
+		hIndex, err := n.Entry.HIndex()
+		if err != nil {
+			errKey = err
+			return
+		}
+		leafs[*hIndex] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leafs, errKey
+}
+
+// VerifyStateHistory walks the list of identity states and verifies that
+// each identity state is the one calculated from its tree roots, and that
+// the claims tree of each identity state contains all the claims of the
+// previous one, since claims are never removed (they are revoked in the
+// revocations tree) but only their value can be updated.  On inconsistency, a
+// *StateHistoryError with the index of the first inconsistent identity state
+// is returned.  This detects corruption or tampering of the storage.  The
+// identity states pruned by PruneHistory are skipped.
+func (is *Issuer) VerifyStateHistory() error {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return err
+	}
+	prunedIdx, err := idenStatePrunedIdx.Get(tx)
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+	var leafsPrev map[merkletree.Hash]bool
+	for idx := prunedIdx; idx < idenStateListLen; idx++ {
+		idenState, idenStateTreeRoots, err := is.getIdenStateByIdx(tx, int64(idx))
+		if err != nil {
+			return &StateHistoryError{Idx: idx, Err: err}
+		}
+		idenStateCalc := core.IdenState(idenStateTreeRoots.ClaimsTreeRoot,
+			idenStateTreeRoots.RevocationsTreeRoot, idenStateTreeRoots.RootsTreeRoot)
+		if !idenState.Equals(idenStateCalc) {
+			return &StateHistoryError{Idx: idx, Err: fmt.Errorf(
+				"identity state (%v) doesn't match the one calculated from its roots (%v)",
+				idenState, idenStateCalc)}
+		}
+		leafs, err := is.claimsTreeLeafs(idenStateTreeRoots.ClaimsTreeRoot)
+		if err != nil {
+			return &StateHistoryError{Idx: idx, Err: err}
+		}
+		for hIndex := range leafsPrev {
+			if !leafs[hIndex] {
+				return &StateHistoryError{Idx: idx, Err: fmt.Errorf(
+					"claim with hIndex %v of the previous identity state is missing", hIndex.Hex())}
+			}
+		}
+		leafsPrev = leafs
+	}
+	return nil
+}
+
+// IdenStateHistoryEntry is an identity state of the Issuer history together
+// with its tree roots.
+type IdenStateHistoryEntry struct {
+	IdenState *merkletree.Hash
+	TreeRoots IdenStateTreeRoots
+}
+
+// StateHistoryLen returns the number of identity states in the Issuer
+// history, including the genesis state.
+func (is *Issuer) StateHistoryLen() (uint32, error) {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	return is.idenStateList.Length(tx)
+}
+
+// StateHistory returns up to limit identity states of the Issuer history
+// starting at offset, in the order they were created.  The first identity
+// state is the genesis one.
+func (is *Issuer) StateHistory(offset, limit uint32) ([]IdenStateHistoryEntry, error) {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= idenStateListLen {
+		return []IdenStateHistoryEntry{}, nil
+	}
+	if limit > idenStateListLen-offset {
+		limit = idenStateListLen - offset
+	}
+	entries := make([]IdenStateHistoryEntry, limit)
+	values := make([]interface{}, limit)
+	for i := range entries {
+		values[i] = &entries[i].TreeRoots
+	}
+	keys, err := is.idenStateList.GetByRange(tx, offset, values)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		var idenState merkletree.Hash
+		if err := idenState.SetBytes(key); err != nil {
+			return nil, fmt.Errorf("invalid stored identity state at index %v: %w",
+				offset+uint32(i), err)
+		}
+		entries[i].IdenState = &idenState
+	}
+	return entries, nil
+}
@@ -0,0 +1,95 @@
+package issuer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendIdenState(t *testing.T, is *Issuer, idenState *merkletree.Hash, roots *IdenStateTreeRoots) {
+	tx, err := is.storage.NewTx()
+	require.Nil(t, err)
+	require.Nil(t, is.idenStateList.Append(tx, idenState[:], roots))
+	require.Nil(t, tx.Commit())
+}
+
+func TestIssuerVerifyStateHistory(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	require.Nil(t, issuer.VerifyStateHistory())
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	idenState, roots := issuer.state()
+	appendIdenState(t, issuer, idenState, &roots)
+	require.Nil(t, issuer.VerifyStateHistory())
+
+	// A claims tree without the previous claims
+	rootsEmpty := roots
+	rootsEmpty.ClaimsTreeRoot = &merkletree.HashZero
+	appendIdenState(t, issuer, core.IdenState(rootsEmpty.ClaimsTreeRoot,
+		rootsEmpty.RevocationsTreeRoot, rootsEmpty.RootsTreeRoot), &rootsEmpty)
+	err = issuer.VerifyStateHistory()
+	var errHistory *StateHistoryError
+	require.True(t, errors.As(err, &errHistory))
+	assert.Equal(t, uint32(2), errHistory.Idx)
+}
+
+func TestIssuerVerifyStateHistoryIdenState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	idenState, roots := issuer.state()
+	idenStateBad := *idenState
+	idenStateBad[0] ^= 0x01
+	appendIdenState(t, issuer, &idenStateBad, &roots)
+	err := issuer.VerifyStateHistory()
+	var errHistory *StateHistoryError
+	require.True(t, errors.As(err, &errHistory))
+	assert.Equal(t, uint32(1), errHistory.Idx)
+}
+
+func TestIssuerStateHistory(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	idenStates := []*merkletree.Hash{}
+	idenState, _ := issuer.state()
+	idenStates = append(idenStates, idenState)
+	for i := 0; i < 3; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+		idenState, roots := issuer.state()
+		appendIdenState(t, issuer, idenState, &roots)
+		idenStates = append(idenStates, idenState)
+	}
+
+	n, err := issuer.StateHistoryLen()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(4), n)
+
+	history, err := issuer.StateHistory(0, 10)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(history))
+	for i, entry := range history {
+		assert.Equal(t, idenStates[i], entry.IdenState)
+		assert.Equal(t, entry.IdenState, core.IdenState(entry.TreeRoots.ClaimsTreeRoot,
+			entry.TreeRoots.RevocationsTreeRoot, entry.TreeRoots.RootsTreeRoot))
+	}
+
+	history, err = issuer.StateHistory(1, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(history))
+	assert.Equal(t, idenStates[1], history[0].IdenState)
+	assert.Equal(t, idenStates[2], history[1].IdenState)
+
+	history, err = issuer.StateHistory(4, 2)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(history))
+}
@@ -1,13 +1,18 @@
 package issuer
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/core/types"
+	common3 "github.com/iden3/go-iden3-core/common"
 	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
 	"github.com/iden3/go-iden3-core/core"
@@ -22,17 +27,16 @@ import (
 
 	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/iden3/go-iden3-crypto/poseidon"
-	"github.com/iden3/go-iden3-crypto/utils"
 
 	"github.com/iden3/go-circom-prover-verifier/prover"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
 	"github.com/iden3/go-circom-prover-verifier/verifier"
 	witnesscalc "github.com/iden3/go-circom-witnesscalc"
-
-	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrIdenGenesisOnly                    = fmt.Errorf("identity is genesis only")
+	ErrIdenNotGenesisOnly                 = fmt.Errorf("identity is not genesis only")
 	ErrIdenPubOnChainNil                  = fmt.Errorf("idenPubOnChain is nil")
 	ErrIdenStateSNARKPathsNil             = fmt.Errorf("idenStateZkProofConf is nil")
 	ErrEthClientNil                       = fmt.Errorf("ethClient is nil")
@@ -43,6 +47,30 @@ var (
 	ErrClaimNotFoundClaimsTree            = fmt.Errorf("claim not found in the claims tree: the claim hasn't been issued")
 	ErrClaimNotYetInOnChainState          = fmt.Errorf("claim has been issued but is not yet under a published on chain identity state")
 	ErrFailedVerifyZkProofIdenStateUpdate = fmt.Errorf("failed verifing generated zk proof of identity state update")
+	ErrInProgress                         = fmt.Errorf("publish with the same idempotency key in progress")
+	ErrClaimUpdateHIndexChanged           = fmt.Errorf("claim update would change the claim hIndex")
+	ErrClaimAlreadyRevoked                = fmt.Errorf("claim revocation nonce is already revoked")
+	ErrPreparedStateOutdated              = fmt.Errorf("prepared identity state is no longer the pending one")
+	ErrKeyNotAuthorized                   = fmt.Errorf("key is not authorized in the current claims tree")
+	ErrRevokeKeyOperational               = fmt.Errorf("the genesis operational key can't be revoked")
+	ErrIdenStatePendingTxNotSent          = fmt.Errorf("no transaction of a pending IdenState has been sent")
+	ErrIdenStatePendingTxNotFailed        = fmt.Errorf("the transaction of the pending IdenState hasn't failed")
+	ErrIdenStatePendingChanged            = fmt.Errorf("the pending IdenState changed while its transaction was resent")
+	ErrTxResendNotSupported               = fmt.Errorf("idenPubOnChain doesn't support resending transactions")
+	ErrExportVersion                      = fmt.Errorf("unsupported issuer export version")
+	ErrTxOptsNotSupported                 = fmt.Errorf("idenPubOnChain doesn't support transaction options")
+	ErrGasEstimateNotSupported            = fmt.Errorf("idenPubOnChain doesn't support estimating gas")
+	ErrStateByStateNotSupported           = fmt.Errorf("idenPubOnChain doesn't support querying by identity state")
+	ErrIdGenesisMismatch                  = fmt.Errorf("stored id doesn't match the one derived from the genesis claims tree root")
+	ErrDeterministicNonces                = fmt.Errorf("Config.DeterministicNonces requires CreateWithNonces")
+	ErrNoDeterministicNonces              = fmt.Errorf("CreateWithNonces requires Config.DeterministicNonces")
+	ErrNoncesCountMismatch                = fmt.Errorf("number of nonces doesn't match the number of genesis claims")
+	ErrNoncesNotUnique                    = fmt.Errorf("repeated genesis claim nonce")
+	ErrClaimExpired                       = fmt.Errorf("claim has expired")
+	ErrRevocationBitfieldTooLarge         = fmt.Errorf("revocation bitfield would be larger than RevocationBitfieldMaxLen")
+	ErrKeyExportNotSupported              = fmt.Errorf("signer doesn't support exporting keys")
+	ErrClaimAlreadyIssued                 = fmt.Errorf("claim is already issued: %w", merkletree.ErrEntryIndexAlreadyExists)
+	ErrHIndexCollision                    = fmt.Errorf("a different claim with the same hIndex is issued: %w", ErrClaimAlreadyIssued)
 )
 
 var (
@@ -50,6 +78,7 @@ var (
 	dbPrefixRevocationTree    = []byte("treerevocation:")
 	dbPrefixRootsTree         = []byte("treeroots:")
 	dbPrefixIdenStateList     = []byte("idenstates:")
+	dbPrefixPublishOnce       = []byte("publishonce:")
 	dbKeyConfig               = []byte("config")
 	dbKeyKOp                  = []byte("kop")
 	dbKeyClaimKOpHi           = []byte("claimkophi")
@@ -59,16 +88,25 @@ var (
 	dbKeyNonceIdx             = []byte("nonceidx")
 	// dbKeyIdenStateOnChain     = []byte("idenstateonchain")
 	dbKeyIdenStateDataOnChain       = []byte("idenstatedataonchain")
+	dbKeyIdenStateFirstBlockN       = []byte("idenstatefirstblockn")
 	dbKeyIdenStatePending           = []byte("idenstatepending")
 	dbKeyIdenStatePendingTransacted = []byte("idenstatependingtxed")
 	dbKeyEthTxSetState              = []byte("ethtxsetstate")
 	dbKeyEthTxInitState             = []byte("ethtxinitstate")
+	dbKeyEthTxsReplaced             = []byte("ethtxsreplaced")
 )
 
 var (
-	SigPrefixSetState = []byte("setstate:")
+	SigPrefixSetState = proof.SigPrefixSetState
+	// SigPrefixMessage is the prefix of the messages signed with Sign, so
+	// that their signatures can't be used in other protocols.
+	SigPrefixMessage = []byte("message:")
 )
 
+// txConflictRetries is the number of times a write of the Issuer is retried
+// when the storage returns db.ErrTxConflict.
+const txConflictRetries = 3
+
 // ConfigDefault is a default configuration for the Issuer.
 var ConfigDefault = Config{MaxLevelsClaimsTree: 140, MaxLevelsRevocationTree: 140, MaxLevelsRootsTree: 140, GenesisOnly: false, ConfirmBlocks: 3}
 
@@ -79,6 +117,60 @@ type Config struct {
 	MaxLevelsRootsTree      int
 	GenesisOnly             bool
 	ConfirmBlocks           uint64
+	// NodeCacheSize is the number of nodes of each merkle tree that are
+	// kept in memory.  Nodes are fetched from the storage on demand.  0
+	// disables the cache.
+	NodeCacheSize int
+	// StateSyncCacheTTL is the time during which the identity state
+	// obtained from the smart contract in SyncIdenStatePublic is reused,
+	// for example between calls to Load with the same IdenPubOnChainer.
+	// The cache is not used while there's a pending state.  0 disables
+	// the cache.
+	StateSyncCacheTTL time.Duration
+	// VerifyOnLoad makes Load check that the stored ID is the one derived
+	// from the stored genesis claims tree root, to detect a corrupted
+	// storage early.
+	VerifyOnLoad bool
+	// DeterministicNonces is set for the Issuers created with
+	// CreateWithNonces, whose genesis claims have the nonces given at
+	// creation instead of consecutive ones.
+	DeterministicNonces bool
+	// StoragePrefix is prepended to all the keys of the Issuer in the
+	// storage, so that many Issuers can share one storage.  It should end
+	// with a separator (like "issuer0:") so that the prefixes of different
+	// Issuers don't overlap.  An Issuer created with a StoragePrefix must
+	// be loaded with LoadWithPrefix.
+	StoragePrefix []byte
+	// RefuseExpiredClaims makes GenCredentialExistence return
+	// ErrClaimExpired for the claims whose expiration has passed.
+	RefuseExpiredClaims bool
+	// RPCRetries is the number of times that a call to the ethereum node
+	// in SyncIdenStatePublic is retried when it fails with an error that
+	// may be transient, like a network error.  Errors like
+	// idenpubonchain.ErrIdenNotOnChain are not retried.  0 disables the
+	// retries.
+	RPCRetries int
+	// RPCRetryBase is the wait before the first retry, which doubles with
+	// every retry.  0 means RPCRetryBaseDefault.
+	RPCRetryBase time.Duration
+	// OnStatePending is called with the new identity state after it's
+	// sent to the blockchain by PublishState.  It can be nil.
+	OnStatePending func(new *merkletree.Hash) `json:"-"`
+	// OnStateConfirmed is called by SyncIdenStatePublic with the previous
+	// and the new identity state on chain when a pending identity state
+	// becomes the one on chain.  It can be nil.
+	//
+	// The callbacks are not stored with the Config, so they must be set
+	// with SetStateCallbacks after Load.
+	OnStateConfirmed func(old, new *merkletree.Hash) `json:"-"`
+	// Logger is used to log messages.  If it's nil, the logrus standard
+	// logger is used.  Like the callbacks, it's not stored with the
+	// Config, so it must be set with SetLogger after Load.
+	Logger Logger `json:"-"`
+	// Metrics receives the timings of the zk proof generation.  If it's
+	// nil, they are discarded.  It's not stored with the Config, so it
+	// must be set with SetMetrics after Load.
+	Metrics Metrics `json:"-"`
 }
 
 // IdenStateZkProofConf are the paths to the SNARK related files required to
@@ -88,16 +180,18 @@ type IdenStateZkProofConf struct {
 	Files  zkutils.ZkFiles
 }
 
-// IdenStateTreeRoots is the set of the three roots of each Identity Merkle Tree.
-type IdenStateTreeRoots struct {
-	ClaimsTreeRoot      *merkletree.Hash
-	RevocationsTreeRoot *merkletree.Hash
-	RootsTreeRoot       *merkletree.Hash
-}
+// IdenStateTreeRoots is the set of the three roots of each Identity Merkle
+// Tree.  It's an alias of core.IdenStateTreeRoots, so the Identity State can
+// be calculated with core.IdenStateFromTreeRoots.
+type IdenStateTreeRoots = core.IdenStateTreeRoots
 
 // Issuer is an identity that issues claims
 type Issuer struct {
-	rw              *sync.RWMutex
+	rw *sync.RWMutex
+	// publish serializes the identity state publications, which hold rw
+	// only briefly so that the zk proof is generated without blocking the
+	// readers.
+	publish         *sync.Mutex
 	storage         db.Storage
 	id              *core.ID
 	claimsTree      *merkletree.MerkleTree
@@ -108,7 +202,7 @@ type Issuer struct {
 	// idenPubOffChainWriter can be nil if the identity doesn't ever update
 	// it's state after genesis.
 	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter
-	keyStore              *keystore.KeyStore
+	signer                Signer
 	kOpComp               *babyjub.PublicKeyComp
 	nonceGen              *UniqueNonceGen
 	idenStateList         *db.StorageList
@@ -125,6 +219,25 @@ type Issuer struct {
 	_ethTxInitState             *types.Transaction
 	idenStateZkProofConf        *IdenStateZkProofConf
 	cfg                         Config
+	// ethTxsReplaced are the transactions of the pending identity state
+	// replaced by ResubmitPendingState, which can still be mined instead
+	// of the last one.
+	_ethTxsReplaced []*types.Transaction
+	// idenStatePendingSince is the time when the current pending state
+	// was set.  It's not persisted, so it's zero after Load.
+	idenStatePendingSince time.Time
+	// lastSyncTime and lastSyncErr hold the result of the last call to
+	// SyncIdenStatePublic.
+	lastSyncTime time.Time
+	lastSyncErr  error
+	// zkProofLast is the last zk proof generated by prepareState, which
+	// is reused while the identity state transition doesn't change.
+	zkProofLast *PreparedState
+	// zkProofDone is closed when the last zk proof generation started by
+	// prepareState finishes.  It's guarded by publish.
+	zkProofDone chan struct{}
+	// leafCounts caches the number of leafs of the trees for Health.
+	leafCounts *leafCountCache
 }
 
 //
@@ -134,6 +247,14 @@ type Issuer struct {
 func (is *Issuer) idenStateDataOnChain() *proof.IdenStateData { return is._idenStateDataOnChain }
 
 func (is *Issuer) setIdenStateDataOnChain(tx db.Tx, v *proof.IdenStateData) error {
+	// Keep the block of the first published state as the lower bound to
+	// look for the older states on chain.
+	if (is._idenStateDataOnChain == nil || is._idenStateDataOnChain.IdenState.Equals(&merkletree.HashZero)) &&
+		!v.IdenState.Equals(&merkletree.HashZero) {
+		if err := db.StoreJSON(tx, dbKeyIdenStateFirstBlockN, v.BlockN); err != nil {
+			return err
+		}
+	}
 	is._idenStateDataOnChain = v
 	return db.StoreJSON(tx, dbKeyIdenStateDataOnChain, v)
 }
@@ -178,6 +299,11 @@ func bool2byte(v bool) byte {
 func (is *Issuer) setIdenStatePending(tx db.Tx, v *merkletree.Hash, transacted bool) {
 	is._idenStatePending = v
 	is._idenStatePendingTransacted = transacted
+	if v.Equals(&merkletree.HashZero) {
+		is.idenStatePendingSince = time.Time{}
+	} else if is.idenStatePendingSince.IsZero() {
+		is.idenStatePendingSince = time.Now()
+	}
 	tx.Put(dbKeyIdenStatePending, v[:])
 	tx.Put(dbKeyIdenStatePendingTransacted, []byte{bool2byte(transacted)})
 }
@@ -188,7 +314,9 @@ func (is *Issuer) loadIdenStatePending() error {
 		return err
 	}
 	var v merkletree.Hash
-	copy(v[:], b)
+	if err := v.SetBytes(b); err != nil {
+		return fmt.Errorf("invalid stored pending identity state: %w", err)
+	}
 	is._idenStatePending = &v
 
 	transactedBytes, err := is.storage.Get(dbKeyIdenStatePendingTransacted)
@@ -223,6 +351,23 @@ func (is *Issuer) loadEthTxInitState() error {
 	return db.LoadJSON(is.storage, dbKeyEthTxInitState, &is._ethTxInitState)
 }
 
+func (is *Issuer) ethTxsReplaced() []*types.Transaction { return is._ethTxsReplaced }
+
+func (is *Issuer) setEthTxsReplaced(tx db.Tx, v []*types.Transaction) error {
+	is._ethTxsReplaced = v
+	return db.StoreJSON(tx, dbKeyEthTxsReplaced, v)
+}
+
+func (is *Issuer) loadEthTxsReplaced() error {
+	is._ethTxsReplaced = nil
+	err := db.LoadJSON(is.storage, dbKeyEthTxsReplaced, &is._ethTxsReplaced)
+	// Storages created before ResubmitPendingState don't have it.
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
 // loadMTs loads the three identity merkle trees from the storage using the configuration.
 func loadMTs(cfg *Config, storage db.Storage) (*merkletree.MerkleTree, *merkletree.MerkleTree,
 	*merkletree.MerkleTree, error) {
@@ -230,15 +375,15 @@ func loadMTs(cfg *Config, storage db.Storage) (*merkletree.MerkleTree, *merkletr
 	retStorage := storage.WithPrefix(dbPrefixRevocationTree)
 	rotStorage := storage.WithPrefix(dbPrefixRootsTree)
 
-	clt, err := merkletree.NewMerkleTree(cltStorage, cfg.MaxLevelsClaimsTree)
+	clt, err := merkletree.NewMerkleTreeWithNodeCache(cltStorage, cfg.MaxLevelsClaimsTree, cfg.NodeCacheSize)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	ret, err := merkletree.NewMerkleTree(retStorage, cfg.MaxLevelsRevocationTree)
+	ret, err := merkletree.NewMerkleTreeWithNodeCache(retStorage, cfg.MaxLevelsRevocationTree, cfg.NodeCacheSize)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	rot, err := merkletree.NewMerkleTree(rotStorage, cfg.MaxLevelsRootsTree)
+	rot, err := merkletree.NewMerkleTreeWithNodeCache(rotStorage, cfg.MaxLevelsRootsTree, cfg.NodeCacheSize)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -249,7 +394,49 @@ func loadMTs(cfg *Config, storage db.Storage) (*merkletree.MerkleTree, *merkletr
 // Create a new Issuer, creating a new genesis ID and initializes the
 // storages.  The extraGenesisClaims metadata's are updated.
 func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []claims.Claimer,
-	storage db.Storage, keyStore *keystore.KeyStore) (*core.ID, error) {
+	storage db.Storage, signer Signer) (*core.ID, error) {
+	if cfg.DeterministicNonces {
+		return nil, ErrDeterministicNonces
+	}
+	return create(cfg, kOpComp, extraGenesisClaims, nil, storage, signer)
+}
+
+// CreateWithNonces is like Create but the revocation nonces of the genesis
+// claims are kOpNonce for the kOp claim and extraNonces for the
+// extraGenesisClaims, so that the genesis ID is reproducible.  The nonces
+// must be unique and lower than MaxNonce, and cfg.DeterministicNonces must
+// be set.  The claims issued afterwards get nonces higher than all of them.
+func CreateWithNonces(cfg Config, kOpComp *babyjub.PublicKeyComp, kOpNonce uint32,
+	extraGenesisClaims []claims.Claimer, extraNonces []uint32,
+	storage db.Storage, signer Signer) (*core.ID, error) {
+	if !cfg.DeterministicNonces {
+		return nil, ErrNoDeterministicNonces
+	}
+	if len(extraNonces) != len(extraGenesisClaims) {
+		return nil, fmt.Errorf("%w: %v nonces for %v extra genesis claims",
+			ErrNoncesCountMismatch, len(extraNonces), len(extraGenesisClaims))
+	}
+	nonces := append([]uint32{kOpNonce}, extraNonces...)
+	seen := make(map[uint32]bool, len(nonces))
+	for _, nonce := range nonces {
+		if nonce >= MaxNonce {
+			return nil, fmt.Errorf("nonce %v is not lower than MaxNonce", nonce)
+		}
+		if seen[nonce] {
+			return nil, fmt.Errorf("%w: %v", ErrNoncesNotUnique, nonce)
+		}
+		seen[nonce] = true
+	}
+	return create(cfg, kOpComp, extraGenesisClaims, nonces, storage, signer)
+}
+
+// create implements Create and CreateWithNonces.  If nonces is nil, the
+// genesis claims get consecutive nonces from the UniqueNonceGen, otherwise
+// nonces contains the one of the kOp claim followed by the ones of the
+// extraGenesisClaims.
+func create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []claims.Claimer,
+	nonces []uint32, storage db.Storage, signer Signer) (*core.ID, error) {
+	storage = storage.WithPrefix(cfg.StoragePrefix)
 	clt, ret, rot, err := loadMTs(&cfg, storage)
 	if err != nil {
 		return nil, err
@@ -263,14 +450,30 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 
 	// Initialize the UniqueNonceGen to generate revocation nonces for claims.
 	nonceGen := NewUniqueNonceGen(db.NewStorageValue(dbKeyNonceIdx))
-	nonceGen.Init(tx)
+	if nonces == nil {
+		nonceGen.Init(tx)
+	} else {
+		var next uint32
+		for _, nonce := range nonces {
+			if nonce >= next {
+				next = nonce + 1
+			}
+		}
+		nonceGen.InitNext(tx, next)
+	}
+	nextNonce := func(i int) (uint32, error) {
+		if nonces != nil {
+			return nonces[i], nil
+		}
+		return nonceGen.Next(tx)
+	}
 
 	// Create the Claim to authorize the Operational Key (kOp)
 	kOp, err := kOpComp.Decompress()
 	if err != nil {
 		return nil, err
 	}
-	nonce, err := nonceGen.Next(tx)
+	nonce, err := nextNonce(0)
 	if err != nil {
 		return nil, err
 	}
@@ -278,7 +481,7 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 	claimKOp.Metadata().RevNonce = nonce
 	extraGenesisClaimsEntriers := make([]merkletree.Entrier, len(extraGenesisClaims))
 	for i, claim := range extraGenesisClaims {
-		nonce, err := nonceGen.Next(tx)
+		nonce, err := nextNonce(i + 1)
 		if err != nil {
 			return nil, err
 		}
@@ -318,6 +521,8 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 
 	is := Issuer{
 		rw:                    &sync.RWMutex{},
+		publish:               &sync.Mutex{},
+		leafCounts:            &leafCountCache{},
 		id:                    id,
 		claimsTree:            clt,
 		revocationsTree:       ret,
@@ -325,7 +530,7 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 		idenPubOnChain:        nil,
 		idenPubOffChainWriter: nil,
 		// idenStateWriter: idenStateWriter,
-		keyStore:      keyStore,
+		signer:        signer,
 		kOpComp:       kOpComp,
 		storage:       storage,
 		nonceGen:      nonceGen,
@@ -352,6 +557,9 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 	if err := is.setEthTxSetState(tx, nil); err != nil {
 		return nil, err
 	}
+	if err := is.setEthTxsReplaced(tx, nil); err != nil {
+		return nil, err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, err
@@ -361,7 +569,7 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 }
 
 // Load creates an Issuer by loading a previously created Issuer (with New).
-func Load(storage db.Storage, keyStore *keystore.KeyStore,
+func Load(storage db.Storage, signer Signer,
 	idenPubOnChain idenpubonchain.IdenPubOnChainer,
 	idenStateZkProofConf *IdenStateZkProofConf,
 	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter) (*Issuer, error) {
@@ -374,70 +582,34 @@ func Load(storage db.Storage, keyStore *keystore.KeyStore,
 		return nil, err
 	}
 	if !cfg.GenesisOnly {
-		if idenPubOnChain == nil {
-			return nil, ErrIdenPubOnChainNil
-		}
-		if idenStateZkProofConf == nil {
-			return nil, ErrIdenStateSNARKPathsNil
-		}
-		if err := idenStateZkProofConf.Files.LoadAll(); err != nil {
-			return nil, fmt.Errorf("error loading zk files: %w", err)
-		}
-		if idenPubOffChainWriter == nil {
-			return nil, ErrIdenPubOffChainWriterNil
+		if err := checkOnChainDeps(idenPubOnChain, idenStateZkProofConf, idenPubOffChainWriter); err != nil {
+			return nil, err
 		}
 	}
 
-	kOpCompBytes, err := storage.Get(dbKeyKOp)
-	if err != nil {
-		return nil, fmt.Errorf("error getting kop from storage: %w", err)
-	}
-	var kOpComp babyjub.PublicKeyComp
-	copy(kOpComp[:], kOpCompBytes)
-
-	var id core.ID
-	idBytes, err := storage.Get(dbKeyId)
-	if err != nil {
-		return nil, fmt.Errorf("error getting id from storage: %w", err)
-	}
-	copy(id[:], idBytes)
-
-	clt, ret, rot, err := loadMTs(&cfg, storage)
-	if err != nil {
-		return nil, fmt.Errorf("error loading merkle trees from storage: %w", err)
-	}
-
 	nonceGen := NewUniqueNonceGen(db.NewStorageValue(dbKeyNonceIdx))
 	idenStateList := db.NewStorageList(dbPrefixIdenStateList)
 
 	is := Issuer{
 		rw:                    &sync.RWMutex{},
-		id:                    &id,
-		claimsTree:            clt,
-		revocationsTree:       ret,
-		rootsTree:             rot,
+		publish:               &sync.Mutex{},
+		leafCounts:            &leafCountCache{},
 		idenPubOnChain:        idenPubOnChain,
 		idenPubOffChainWriter: idenPubOffChainWriter,
-		keyStore:              keyStore,
-		kOpComp:               &kOpComp,
+		signer:                signer,
 		storage:               storage,
 		nonceGen:              nonceGen,
 		idenStateList:         idenStateList,
 		idenStateZkProofConf:  idenStateZkProofConf,
 		cfg:                   cfg,
 	}
-
-	if err := is.loadIdenStateDataOnChain(); err != nil {
-		return nil, err
-	}
-	if err := is.loadIdenStatePending(); err != nil {
-		return nil, err
-	}
-	if err := is.loadEthTxInitState(); err != nil {
+	if err := is.loadStorage(); err != nil {
 		return nil, err
 	}
-	if err := is.loadEthTxSetState(); err != nil {
-		return nil, err
+	if is.cfg.VerifyOnLoad {
+		if err := is.verifyIdGenesis(); err != nil {
+			return nil, err
+		}
 	}
 
 	if !is.cfg.GenesisOnly {
@@ -448,6 +620,151 @@ func Load(storage db.Storage, keyStore *keystore.KeyStore,
 	return &is, nil
 }
 
+// verifyIdGenesis checks that the Issuer ID is the one derived from the
+// genesis claims tree root stored at Create.
+func (is *Issuer) verifyIdGenesis() error {
+	var genesisClaimTreeRoot merkletree.Hash
+	if err := db.LoadJSON(is.storage, dbKeyGenesisClaimTreeRoot, &genesisClaimTreeRoot); err != nil {
+		return fmt.Errorf("error getting genesis claims tree root from storage: %w", err)
+	}
+	id, err := genesis.CalculateIdGenesisFromClaimsTreeRoot(&genesisClaimTreeRoot)
+	if err != nil {
+		return err
+	}
+	if !id.Equals(is.id) {
+		return fmt.Errorf("%w: stored %v, derived %v", ErrIdGenesisMismatch, is.id, id)
+	}
+	return nil
+}
+
+// LoadWithPrefix is like Load for an Issuer created with a
+// Config.StoragePrefix equal to prefix.
+func LoadWithPrefix(prefix []byte, storage db.Storage, signer Signer,
+	idenPubOnChain idenpubonchain.IdenPubOnChainer,
+	idenStateZkProofConf *IdenStateZkProofConf,
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter) (*Issuer, error) {
+	return Load(storage.WithPrefix(prefix), signer, idenPubOnChain, idenStateZkProofConf,
+		idenPubOffChainWriter)
+}
+
+// checkOnChainDeps checks the dependencies required by an Issuer that is not
+// GenesisOnly.
+func checkOnChainDeps(idenPubOnChain idenpubonchain.IdenPubOnChainer,
+	idenStateZkProofConf *IdenStateZkProofConf,
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter) error {
+	if idenPubOnChain == nil {
+		return ErrIdenPubOnChainNil
+	}
+	if idenStateZkProofConf == nil {
+		return ErrIdenStateSNARKPathsNil
+	}
+	if err := idenStateZkProofConf.Files.LoadAll(); err != nil {
+		return fmt.Errorf("error loading zk files: %w", err)
+	}
+	if idenPubOffChainWriter == nil {
+		return ErrIdenPubOffChainWriterNil
+	}
+	return nil
+}
+
+// EnableOnChain turns a GenesisOnly Issuer into one that publishes its
+// identity state on chain, keeping its ID.  The dependencies are checked like
+// in Load, the updated Config is stored so that the following calls to Load
+// require them, and the identity state is synced with the smart contract.
+func (is *Issuer) EnableOnChain(idenPubOnChain idenpubonchain.IdenPubOnChainer,
+	idenStateZkProofConf *IdenStateZkProofConf,
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter) error {
+	if err := checkOnChainDeps(idenPubOnChain, idenStateZkProofConf, idenPubOffChainWriter); err != nil {
+		return err
+	}
+	if err := is.enableOnChain(idenPubOnChain, idenStateZkProofConf, idenPubOffChainWriter); err != nil {
+		return err
+	}
+	if err := is.SyncIdenStatePublic(); err != nil {
+		return fmt.Errorf("error syncing idenstate from smart contract: %w", err)
+	}
+	return nil
+}
+
+func (is *Issuer) enableOnChain(idenPubOnChain idenpubonchain.IdenPubOnChainer,
+	idenStateZkProofConf *IdenStateZkProofConf,
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter) error {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	if !is.cfg.GenesisOnly {
+		return ErrIdenNotGenesisOnly
+	}
+	cfg := is.cfg
+	cfg.GenesisOnly = false
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	tx.Put(dbKeyConfig, cfgJSON)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Only GenesisOnly is updated, so the other fields of the Config
+	// can be read without the lock.
+	is.cfg.GenesisOnly = false
+	is.idenPubOnChain = idenPubOnChain
+	is.idenStateZkProofConf = idenStateZkProofConf
+	is.idenPubOffChainWriter = idenPubOffChainWriter
+	return nil
+}
+
+// genesisOnly returns Config.GenesisOnly, which is changed by EnableOnChain.
+// The on chain dependencies set by EnableOnChain can be used without the lock
+// once it returns false.  It must be called without is.rw held.
+func (is *Issuer) genesisOnly() bool {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	return is.cfg.GenesisOnly
+}
+
+// loadStorage loads the identity, the merkle trees and the publishing status
+// of the Issuer from its storage.
+func (is *Issuer) loadStorage() error {
+	kOpCompBytes, err := is.storage.Get(dbKeyKOp)
+	if err != nil {
+		return fmt.Errorf("error getting kop from storage: %w", err)
+	}
+	var kOpComp babyjub.PublicKeyComp
+	copy(kOpComp[:], kOpCompBytes)
+
+	var id core.ID
+	idBytes, err := is.storage.Get(dbKeyId)
+	if err != nil {
+		return fmt.Errorf("error getting id from storage: %w", err)
+	}
+	copy(id[:], idBytes)
+
+	clt, ret, rot, err := loadMTs(&is.cfg, is.storage)
+	if err != nil {
+		return fmt.Errorf("error loading merkle trees from storage: %w", err)
+	}
+	is.kOpComp, is.id = &kOpComp, &id
+	is.claimsTree, is.revocationsTree, is.rootsTree = clt, ret, rot
+
+	if err := is.loadIdenStateDataOnChain(); err != nil {
+		return err
+	}
+	if err := is.loadIdenStatePending(); err != nil {
+		return err
+	}
+	if err := is.loadEthTxInitState(); err != nil {
+		return err
+	}
+	if err := is.loadEthTxSetState(); err != nil {
+		return err
+	}
+	return is.loadEthTxsReplaced()
+}
+
 // state returns the current Identity State and the three merkle tree roots.
 func (is *Issuer) state() (*merkletree.Hash, IdenStateTreeRoots) {
 	clr, rer, ror := is.claimsTree.RootKey(), is.revocationsTree.RootKey(), is.rootsTree.RootKey()
@@ -466,6 +783,89 @@ func (is *Issuer) State() (*merkletree.Hash, IdenStateTreeRoots) {
 	return is.state()
 }
 
+// cloneTreeMemory returns a copy of mt at its current root backed by an in
+// memory storage.
+func cloneTreeMemory(mt *merkletree.MerkleTree) (*merkletree.MerkleTree, error) {
+	var buf bytes.Buffer
+	if err := mt.DumpTree(&buf, nil); err != nil {
+		return nil, err
+	}
+	mtClone, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), mt.MaxLevels())
+	if err != nil {
+		return nil, err
+	}
+	if err := mtClone.ImportTree(&buf); err != nil {
+		return nil, err
+	}
+	return mtClone, nil
+}
+
+// PreviewState returns the Identity State that would be published after
+// issuing pendingClaims (in order) and revoking the claims with the
+// pendingRevocations nonces, without modifying the Issuer.  The changes are
+// applied to in memory copies of the trees, and the pending claims get the
+// nonces that IssueClaim would assign them.  The trees are copied without
+// holding the Issuer lock.
+func (is *Issuer) PreviewState(pendingClaims []claims.Claimer,
+	pendingRevocations []uint32) (*merkletree.Hash, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	nonce, err := is.nonceGen.Peek(tx)
+	if err != nil {
+		is.rw.RUnlock()
+		return nil, err
+	}
+	_, idenStateTreeRootsLast, err := is.getIdenStateByIdx(tx, -1)
+	if err != nil {
+		is.rw.RUnlock()
+		return nil, err
+	}
+	var trees [3]*merkletree.MerkleTree
+	for i, mt := range []*merkletree.MerkleTree{is.claimsTree, is.revocationsTree, is.rootsTree} {
+		if trees[i], err = mt.Clone(); err != nil {
+			is.rw.RUnlock()
+			return nil, err
+		}
+	}
+	is.rw.RUnlock()
+
+	claimsTree, err := cloneTreeMemory(trees[0])
+	if err != nil {
+		return nil, err
+	}
+	revocationsTree, err := cloneTreeMemory(trees[1])
+	if err != nil {
+		return nil, err
+	}
+	for i, claim := range pendingClaims {
+		metadata := *claim.Metadata()
+		metadata.RevNonce = nonce + uint32(i)
+		e := claim.Entry()
+		metadata.Marshal(e)
+		if err := claimsTree.AddEntry(e); err != nil {
+			return nil, fmt.Errorf("error adding pending claim %v: %w", i, err)
+		}
+	}
+	for _, revNonce := range pendingRevocations {
+		if err := claims.AddLeafRevocationsTree(revocationsTree, revNonce, 0xffffffff); err != nil {
+			return nil, fmt.Errorf("error revoking pending nonce %v: %w", revNonce, err)
+		}
+	}
+	idenState, _, err := previewIdenState(trees[2], IdenStateTreeRoots{
+		ClaimsTreeRoot:      claimsTree.RootKey(),
+		RevocationsTreeRoot: revocationsTree.RootKey(),
+		RootsTreeRoot:       trees[2].RootKey(),
+	}, idenStateTreeRootsLast)
+	return idenState, err
+}
+
 // StateDataOnChain returns the last known IdentityState Data known to be on chain.
 func (is *Issuer) StateDataOnChain() *proof.IdenStateData {
 	is.rw.RLock()
@@ -473,61 +873,209 @@ func (is *Issuer) StateDataOnChain() *proof.IdenStateData {
 	return is.idenStateDataOnChain()
 }
 
+// StateBlockNumber returns the block number in which the idenState was
+// published in the Smart Contract.  For the on chain state the block number
+// is taken from the last sync.  For older states the IdenStates Smart
+// Contract is queried from the block of the first published state on, which
+// requires the IdenPubOnChainer to implement
+// idenpubonchain.IdenStateByStateReader and the ethereum node to keep the
+// logs of the blocks in which the state was published; if it doesn't, the
+// error from the node is returned.
+func (is *Issuer) StateBlockNumber(idenState *merkletree.Hash) (uint64, error) {
+	if is.genesisOnly() {
+		return 0, ErrIdenGenesisOnly
+	}
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	idenStateData := is.idenStateDataOnChain()
+	_, err = is.getIdenStateTreeRoots(tx, idenState)
+	is.rw.RUnlock()
+	if idenStateData.IdenState.Equals(&merkletree.HashZero) {
+		return 0, ErrIdenStateOnChainZero
+	}
+	if idenStateData.IdenState.Equals(idenState) {
+		return idenStateData.BlockN, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("identity state not found: %w", err)
+	}
+	reader, ok := is.idenPubOnChain.(idenpubonchain.IdenStateByStateReader)
+	if !ok {
+		return 0, ErrStateByStateNotSupported
+	}
+	// Issuers created before the first block was stored don't have it,
+	// so they look from the genesis block.
+	var fromBlockN uint64
+	if err := db.LoadJSON(is.storage, dbKeyIdenStateFirstBlockN, &fromBlockN); err != nil &&
+		err != db.ErrNotFound {
+		return 0, err
+	}
+	idenStateDataOld, err := reader.GetStateByState(is.id, idenState, fromBlockN)
+	if err != nil {
+		return 0, err
+	}
+	return idenStateDataOld.BlockN, nil
+}
+
 // ID returns the Issuer ID (Identity ID).
 func (is *Issuer) ID() *core.ID {
 	return is.id
 }
 
-// KeyOperational returns the identity's operational key.
+// SetStateCallbacks sets the OnStatePending and OnStateConfirmed callbacks of
+// the Issuer Config.  They are called without holding the Issuer lock.
+func (is *Issuer) SetStateCallbacks(onStatePending func(new *merkletree.Hash),
+	onStateConfirmed func(old, new *merkletree.Hash)) {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	is.cfg.OnStatePending, is.cfg.OnStateConfirmed = onStatePending, onStateConfirmed
+}
+
+// KeyOperational returns the identity's genesis operational key, which is
+// the one used to sign and prove the identity state updates.
 func (is *Issuer) KeyOperational() *babyjub.PublicKeyComp {
 	return is.kOpComp
 }
 
+// NonceCount returns the number of revocation nonces consumed by the claims
+// issued so far, including the genesis ones.  Once it reaches MaxNonce, no
+// more claims can be issued.
+func (is *Issuer) NonceCount() (uint32, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	return is.nonceGen.Peek(tx)
+}
+
 // SyncIdenStatePublic updates the IdenStateOnChain and IdenStatePending from
 // the values in the Smart Contract.
 func (is *Issuer) SyncIdenStatePublic() error {
-	if is.cfg.GenesisOnly {
+	return is.SyncIdenStatePublicConfirm(is.cfg.ConfirmBlocks)
+}
+
+// SyncIdenStatePublicConfirm is like SyncIdenStatePublic but a pending
+// identity state is only considered published after minBlocks confirmations
+// instead of the configured ConfirmBlocks.  The calls to the ethereum node,
+// which may be retried, are done without blocking the readers of the Issuer.
+func (is *Issuer) SyncIdenStatePublicConfirm(minBlocks uint64) error {
+	if is.genesisOnly() {
 		return ErrIdenGenesisOnly
 	}
+	is.rw.RLock()
+	sync := is.stateSync()
+	is.rw.RUnlock()
+	idenStateData, err := is.getStateSync(sync, minBlocks)
+
 	is.rw.Lock()
-	defer is.rw.Unlock()
+	idenStateOnChain := is.idenStateOnChain()
+	if err == nil && idenStateData != nil {
+		err = is.syncIdenStatePublic(sync, idenStateData)
+	}
+	idenStateOnChainNew := is.idenStateOnChain()
+	is.lastSyncTime, is.lastSyncErr = time.Now(), err
+	onStateConfirmed := is.cfg.OnStateConfirmed
+	is.rw.Unlock()
+	if err != nil {
+		return err
+	}
+	if !idenStateOnChainNew.Equals(idenStateOnChain) && onStateConfirmed != nil {
+		onStateConfirmed(idenStateOnChain, idenStateOnChainNew)
+	}
+	return nil
+}
+
+// stateSync is the publishing status of the Issuer checked by
+// SyncIdenStatePublic, captured with the lock held so that the calls to the
+// ethereum node are done without it.
+type stateSync struct {
+	id               *core.ID
+	idenStatePending *merkletree.Hash
+	transacted       bool
+	idenStateOnChain *merkletree.Hash
+	// ethTxs are the transactions sent for the pending identity state,
+	// the last one first.
+	ethTxs []*types.Transaction
+}
+
+// stateSync returns the current publishing status.  It must be called with
+// is.rw held.
+func (is *Issuer) stateSync() *stateSync {
+	idenStatePending, transacted := is.idenStatePending()
+	sync := &stateSync{
+		id:               is.id,
+		idenStatePending: idenStatePending,
+		transacted:       transacted,
+		idenStateOnChain: is.idenStateOnChain(),
+	}
+	if transacted {
+		sync.ethTxs = append([]*types.Transaction{is.ethTxPending()}, is.ethTxsReplaced()...)
+	}
+	return sync
+}
+
+// current returns true if the publishing status of is hasn't changed since
+// sync was captured.  It must be called with is.rw held.
+func (sync *stateSync) current(is *Issuer) bool {
+	idenStatePending, transacted := is.idenStatePending()
+	return idenStatePending.Equals(sync.idenStatePending) && transacted == sync.transacted &&
+		is.idenStateOnChain().Equals(sync.idenStateOnChain) &&
+		(!transacted || len(is.ethTxsReplaced())+1 == len(sync.ethTxs))
+}
+
+// getStateSync returns the identity state in the smart contract to sync the
+// Issuer with.  If there's a pending state, it returns nil until its
+// ethereum transaction has at least minBlocks confirmations.  It's called
+// without is.rw held.
+func (is *Issuer) getStateSync(sync *stateSync, minBlocks uint64) (*proof.IdenStateData, error) {
 	// If there's a pending state, check that the ethereum Tx was
 	// succsefully and only call GetState when the number of confirmed
-	// blocks is equal or higher than is.cfg.ConfirmBlocks
-	idenStatePending, transacted := is.idenStatePending()
+	// blocks is equal or higher than minBlocks
 	// (C)(idenStatePending: X, transacted: true)
-	if !idenStatePending.Equals(&merkletree.HashZero) && transacted {
-		var ethTx *types.Transaction
-		// If idenStateOnChain is zero, the pending state was caused by
-		// InitState.  Otherwise it was a regular SetState.
-		if is.idenStateOnChain().Equals(&merkletree.HashZero) {
-			ethTx = is.ethTxInitState()
-		} else {
-			ethTx = is.ethTxSetState()
-		}
-		confirmBlocks, err := is.idenPubOnChain.TxConfirmBlocks(ethTx)
+	if !sync.idenStatePending.Equals(&merkletree.HashZero) && sync.transacted {
+		ethTx, confirmBlocks, err := is.ethTxsConfirmBlocks(sync.ethTxs)
 		if err == eth.ErrReceiptNotReceived {
-			return nil
+			return nil, nil
 		} else if err != nil {
-			return fmt.Errorf("TxConfirmBlocks: %w", err)
+			return nil, fmt.Errorf("TxConfirmBlocks: %w", err)
 		}
-		log.WithField("tx", ethTx.Hash().Hex()).
-			WithField("TxConfirmBlocks", confirmBlocks).
-			WithField("cfg.ConfirmBlocks", is.cfg.ConfirmBlocks).
-			Debug("State Update Tx")
-		if confirmBlocks.Cmp(new(big.Int).SetUint64(is.cfg.ConfirmBlocks)) == -1 {
-			return nil
+		is.log().Debug("State Update Tx", Fields{
+			"tx":              ethTx.Hash().Hex(),
+			"TxConfirmBlocks": confirmBlocks,
+			"minBlocks":       minBlocks,
+		})
+		if confirmBlocks.Cmp(new(big.Int).SetUint64(minBlocks)) == -1 {
+			return nil, nil
 		}
 	}
 
-	idenStateData, err := is.idenPubOnChain.GetState(is.id)
-	if err == idenpubonchain.ErrIdenNotOnChain {
-		idenStateData = &proof.IdenStateData{
-			IdenState: &merkletree.HashZero,
-		}
-	} else if err != nil {
-		return fmt.Errorf("error calling idenstates smart contract getState: %w", err)
+	// The cache is not used while there's a pending state so that its
+	// confirmation is not missed.
+	idenStateData, err := is.getStateOnChain(sync.id, sync.idenStatePending.Equals(&merkletree.HashZero))
+	if err != nil {
+		return nil, fmt.Errorf("error calling idenstates smart contract getState: %w", err)
+	}
+	return idenStateData, nil
+}
+
+// syncIdenStatePublic updates the publishing status of the Issuer, captured
+// in sync, with the identity state in the smart contract.  It must be called
+// with is.rw held.
+func (is *Issuer) syncIdenStatePublic(sync *stateSync, idenStateData *proof.IdenStateData) error {
+	// The publishing status has changed during the calls to the
+	// ethereum node, so the result is outdated.  The next sync checks the
+	// new status.
+	if !sync.current(is) {
+		return nil
 	}
+	idenStatePending, transacted := sync.idenStatePending, sync.transacted
 
 	// (A)(idenStatePending: 0, transacted: false)
 	if idenStatePending.Equals(&merkletree.HashZero) && !transacted {
@@ -577,32 +1125,214 @@ func (is *Issuer) SyncIdenStatePublic() error {
 		idenStateData.IdenState, idenStatePending, is.idenStateOnChain())
 }
 
-// IssueClaim adds a new claim to the Claims Merkle Tree of the Issuer.  The
-// Identity State is not updated.  The claim metadata is updated if the issue
-// is successfull.
-func (is *Issuer) IssueClaim(claim claims.Claimer) error {
-	if is.cfg.GenesisOnly {
-		return ErrIdenGenesisOnly
+// ethTxPending returns the last transaction sent for the pending identity
+// state.
+func (is *Issuer) ethTxPending() *types.Transaction {
+	// If idenStateOnChain is zero, the pending state was caused by
+	// InitState.  Otherwise it was a regular SetState.
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		return is.ethTxInitState()
 	}
-	is.rw.Lock()
-	defer is.rw.Unlock()
-	tx, err := is.storage.NewTx()
-	if err != nil {
-		return err
+	return is.ethTxSetState()
+}
+
+// ethTxsConfirmBlocks calls TxConfirmBlocks with the transactions sent for
+// the pending identity state, starting with the last one, and returns the
+// first one that has a receipt with its result.  The transactions replaced
+// by ResubmitPendingState share the nonce, so only one of them can be mined.
+// It returns eth.ErrReceiptNotReceived if none of them has a receipt.
+func (is *Issuer) ethTxsConfirmBlocks(ethTxs []*types.Transaction) (*types.Transaction, *big.Int, error) {
+	for _, ethTx := range ethTxs {
+		var confirmBlocks *big.Int
+		err := is.retryRPC(func() (err error) {
+			confirmBlocks, err = is.idenPubOnChain.TxConfirmBlocks(ethTx)
+			return err
+		})
+		if err != eth.ErrReceiptNotReceived {
+			return ethTx, confirmBlocks, err
+		}
+	}
+	return ethTxs[0], nil, eth.ErrReceiptNotReceived
+}
+
+// retryOnTxConflict calls f again while it fails with db.ErrTxConflict, up
+// to txConflictRetries times.
+func retryOnTxConflict(f func() error) error {
+	err := f()
+	for i := 0; i < txConflictRetries && errors.Is(err, db.ErrTxConflict); i++ {
+		err = f()
+	}
+	return err
+}
+
+// IssueClaim adds a new claim to the Claims Merkle Tree of the Issuer.  The
+// Identity State is not updated.  The claim is not modified: a clone of it
+// with the revocation nonce set in its metadata is issued and returned.  If a
+// claim with the same index is already issued, ErrClaimAlreadyIssued is
+// returned without consuming a revocation nonce, wrapped in
+// ErrHIndexCollision if the issued claim is a different one.
+func (is *Issuer) IssueClaim(claim claims.Claimer) (claims.Claimer, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
 	}
-	nonce, err := is.nonceGen.Next(tx)
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	return is.issueNewClaim(claim)
+}
+
+// issueNewClaim issues a clone of claim if it's not already issued.
+func (is *Issuer) issueNewClaim(claim claims.Claimer) (claims.Claimer, error) {
+	hi, issued, err := is.claimIssued(claim.Entry())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := tx.Commit(); err != nil {
-		return err
+	if issued {
+		return nil, fmt.Errorf("error adding claim with hIndex %v: %w", hi.Hex(), ErrClaimAlreadyIssued)
 	}
-	claim.Metadata().RevNonce = nonce
-	err = is.claimsTree.AddClaim(claim)
+	return is.issueClaim(claim.Clone())
+}
+
+// CheckClaimCollision returns ErrHIndexCollision if a different claim with
+// the same hIndex as claim is already issued, so that IssueClaim would fail.
+// The revocation nonce is not compared, as it's set when the claim is
+// issued.  It returns nil if claim is not issued or if it's already issued.
+func (is *Issuer) CheckClaimCollision(claim merkletree.Entrier) error {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	_, _, err := is.claimIssued(claim.Entry())
+	return err
+}
+
+// claimIssued returns the hIndex of e and true if e is in the claims tree,
+// ignoring the revocation nonce.  If a different entry with the same hIndex
+// is in the claims tree, ErrHIndexCollision is returned.
+func (is *Issuer) claimIssued(e *merkletree.Entry) (*merkletree.Hash, bool, error) {
+	hi, err := e.HIndex()
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	return nil
+	issued, err := is.claimsTree.GetEntryByIndex(hi)
+	if err == merkletree.ErrEntryIndexNotFound {
+		return hi, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	withNonce := merkletree.Entry{Data: e.Data}
+	binary.LittleEndian.PutUint32(withNonce.Data[merkletree.IndexLen][:claims.ClaimRevNonceLen],
+		claims.GetRevocationNonce(issued))
+	if !withNonce.Equals(issued) {
+		return nil, false, fmt.Errorf("%w: hIndex %v", ErrHIndexCollision, hi.Hex())
+	}
+	return hi, true, nil
+}
+
+// ReissueClaim is like IssueClaim, but if a claim with the same index is
+// already issued, it's replaced by a clone of claim with the revocation nonce
+// of the replaced one, like in UpdateClaim.
+func (is *Issuer) ReissueClaim(claim claims.Claimer) (claims.Claimer, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	claim = claim.Clone()
+	hi, err := claim.Entry().HIndex()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := is.claimsTree.GetEntryByIndex(hi)
+	if err == merkletree.ErrEntryIndexNotFound {
+		return is.issueClaim(claim)
+	} else if err != nil {
+		return nil, err
+	}
+	claim.Metadata().RevNonce = claims.GetRevocationNonce(entry)
+	if err := retryOnTxConflict(func() error {
+		return is.claimsTree.UpdateEntry(claim.Entry())
+	}); err != nil {
+		return nil, fmt.Errorf("error updating claim with hIndex %v: %w", hi.Hex(), err)
+	}
+	return claim, nil
+}
+
+// issueClaim adds claim to the Claims Merkle Tree with a new revocation
+// nonce set in its metadata.
+func (is *Issuer) issueClaim(claim claims.Claimer) (claims.Claimer, error) {
+	// The nonce advance is committed together with the claim, so that a
+	// failed AddClaim doesn't consume a nonce.
+	var nonce uint32
+	err := retryOnTxConflict(func() error {
+		tx, err := is.storage.NewTx()
+		if err != nil {
+			return err
+		}
+		if nonce, err = is.nonceGen.Next(tx); err != nil {
+			tx.Close()
+			return err
+		}
+		claim.Metadata().RevNonce = nonce
+		return is.claimsTree.AddClaimWithTx(claim, tx)
+	})
+	if err != nil {
+		hi, errHi := claim.Entry().HIndex()
+		if errHi != nil {
+			return nil, fmt.Errorf("error adding claim with nonce %v: %w", nonce, err)
+		}
+		return nil, fmt.Errorf("error adding claim with hIndex %v and nonce %v: %w", hi.Hex(), nonce, err)
+	}
+	return claim, nil
+}
+
+// IssueMultiPartClaim issues all the parts of a multi-part claim (see
+// claims.ClaimMultiPart) sharing a single revocation nonce.  The parts are
+// added in a single transaction together with the nonce advance, so that
+// either all the parts are issued or none is.
+func (is *Issuer) IssueMultiPartClaim(schemaHash [claims.EntryFullBytesLen]byte,
+	parts [][]*big.Int) ([]*claims.ClaimMultiPart, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	cs, err := claims.NewClaimMultiPart(schemaHash, parts)
+	if err != nil {
+		return nil, err
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	for _, c := range cs {
+		hi, err := c.Entry().HIndex()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := is.claimsTree.GetDataByIndex(hi); err == nil {
+			return nil, fmt.Errorf("error adding part %v with hIndex %v: %w",
+				c.PartIdx, hi.Hex(), merkletree.ErrEntryIndexAlreadyExists)
+		} else if err != merkletree.ErrEntryIndexNotFound {
+			return nil, err
+		}
+	}
+	entries := make([]merkletree.Entrier, len(cs))
+	for i, c := range cs {
+		entries[i] = c
+	}
+	var nonce uint32
+	err = retryOnTxConflict(func() error {
+		tx, err := is.storage.NewTx()
+		if err != nil {
+			return err
+		}
+		if nonce, err = is.nonceGen.Next(tx); err != nil {
+			tx.Close()
+			return err
+		}
+		for _, c := range cs {
+			c.Metadata().RevNonce = nonce
+		}
+		return is.claimsTree.AddEntriesWithTx(entries, tx)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error adding the parts with nonce %v: %w", nonce, err)
+	}
+	return cs, nil
 }
 
 // getIdenStateByIdx gets identity state and identity state tree roots of the
@@ -625,7 +1355,9 @@ func (is *Issuer) getIdenStateByIdx(tx db.Tx, idx int64) (*merkletree.Hash, *Ide
 		return nil, nil, err
 	}
 	var idenState merkletree.Hash
-	copy(idenState[:], idenStateBytes)
+	if err := idenState.SetBytes(idenStateBytes); err != nil {
+		return nil, nil, fmt.Errorf("invalid stored identity state at index %v: %w", idxAbs, err)
+	}
 	return &idenState, &idenStateTreeRoots, nil
 }
 
@@ -644,218 +1376,1258 @@ func (is *Issuer) getIdenStateTreeRoots(tx db.Tx, idenState *merkletree.Hash) (*
 //                     ^\ (C)(idenStatePending: X, transacted: true) </
 
 // PublishState calculates the current Issuer identity state, and if it's
-// different than the last one, it publishes in in the blockchain.
+// different than the last one, it publishes in in the blockchain.  The
+// readers of the Issuer, like State and GenCredentialExistence, are not blocked
+// during the zk proof generation.
 func (is *Issuer) PublishState() error {
-	if is.cfg.GenesisOnly {
+	return is.PublishStateCtx(context.Background())
+}
+
+// zkProofResult is the result of a zk proof generated in a goroutine.
+type zkProofResult struct {
+	zkProofOut *zkutils.ZkProofOut
+	err        error
+}
+
+// PublishStateCtx is like PublishState but it returns ctx.Err() as soon as
+// the ctx is done before the identity state is sent to the blockchain.  The
+// zk proof generation can't be interrupted, so it continues in the
+// background until it finishes, and the following publications wait for it
+// instead of starting another one.  A cancelled publish leaves the new
+// identity state pending, and it's resumed by the next call, reusing the zk
+// proof if it was generated.  Once the transaction is sent, the publish is
+// not cancelled.
+func (is *Issuer) PublishStateCtx(ctx context.Context) error {
+	return is.PublishStateOpts(ctx, nil)
+}
+
+// PublishStateOpts is like PublishStateCtx but the gas limit and gas price of
+// the ethereum transaction are set with opts, which requires an
+// idenPubOnChain that implements idenpubonchain.IdenPubOnChainerOpts.  A nil
+// opts keeps the defaults of idenPubOnChain.
+func (is *Issuer) PublishStateOpts(ctx context.Context, opts *eth.TxOpts) error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	is.publish.Lock()
+	defer is.publish.Unlock()
+	return is.publishState(ctx, opts)
+}
+
+// publishState publishes the new identity state.  It must be called with
+// is.publish held and is.rw not held.
+func (is *Issuer) publishState(ctx context.Context, opts *eth.TxOpts) error {
+	prepared, err := is.prepareState(ctx, true)
+	if err != nil {
+		return err
+	}
+	if prepared == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	is.rw.Lock()
+	err = is.submitPreparedState(prepared, opts)
+	onStatePending := is.cfg.OnStatePending
+	is.rw.Unlock()
+	if err != nil {
+		return err
+	}
+	if onStatePending != nil {
+		onStatePending(prepared.IdenState)
+	}
+	return nil
+}
+
+// IssueClaimAndPublish issues claim like IssueClaim and publishes the new
+// identity state like PublishState, without other publications in between.
+// It returns after the transaction is sent, with the new identity state
+// pending.  If there's already a pending identity state, which wouldn't
+// contain the claim, ErrIdenStatePendingNotNil is returned and the claim is
+// not issued.  If the publication fails, the claim stays issued and it's
+// published by the next PublishState.
+func (is *Issuer) IssueClaimAndPublish(claim claims.Claimer) (claims.Claimer, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	is.publish.Lock()
+	defer is.publish.Unlock()
+	is.rw.Lock()
+	if idenStatePending, _ := is.idenStatePending(); !idenStatePending.Equals(&merkletree.HashZero) {
+		is.rw.Unlock()
+		return nil, ErrIdenStatePendingNotNil
+	}
+	claim, err := is.issueNewClaim(claim)
+	is.rw.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := is.publishState(context.Background(), nil); err != nil {
+		return claim, fmt.Errorf("error publishing the identity state with the issued claim: %w", err)
+	}
+	return claim, nil
+}
+
+// PreparedState is a new identity state of the Issuer ready to be published
+// in the blockchain.  It only holds values, so it can be serialized (for
+// example as JSON) and submitted later with SubmitPreparedState.
+type PreparedState struct {
+	// IdenStateOld is the last identity state published (or being
+	// published) in the blockchain.
+	IdenStateOld *merkletree.Hash
+	IdenState    *merkletree.Hash
+	// IdenStateTreeRoots are the roots of the merkle trees of IdenState,
+	// which are published off chain.
+	IdenStateTreeRoots IdenStateTreeRoots
+	ZkProofOut         *zkutils.ZkProofOut
+}
+
+// PrepareState does everything PublishState does up to sending the new
+// identity state to the blockchain, and returns the new identity state with
+// its verified zk proof.  It returns nil if the identity state hasn't
+// changed.  The new identity state is kept pending, so it's the one published
+// by the next call to PublishState or SubmitPreparedState.
+func (is *Issuer) PrepareState() (*PreparedState, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	is.publish.Lock()
+	defer is.publish.Unlock()
+	return is.prepareState(context.Background(), true)
+}
+
+// EstimateStateGas returns the gas needed to publish the current identity
+// state in the blockchain, without publishing it.  Like PrepareState, it
+// generates the zk proof, but the new identity state is not set pending, so
+// the claims issued afterwards are still published with it.  The proof is
+// reused by the next PublishState if the identity state hasn't changed.  It
+// returns 0 if the identity state hasn't changed since the last one
+// published.  The IdenPubOnChainer must implement
+// idenpubonchain.GasEstimator, otherwise ErrGasEstimateNotSupported is
+// returned.
+func (is *Issuer) EstimateStateGas() (uint64, error) {
+	if is.genesisOnly() {
+		return 0, ErrIdenGenesisOnly
+	}
+	estimator, ok := is.idenPubOnChain.(idenpubonchain.GasEstimator)
+	if !ok {
+		return 0, ErrGasEstimateNotSupported
+	}
+	is.publish.Lock()
+	defer is.publish.Unlock()
+	prepared, err := is.prepareState(context.Background(), false)
+	if err != nil {
+		return 0, err
+	}
+	if prepared == nil {
+		return 0, nil
+	}
+	var genesisState *merkletree.Hash
+	is.rw.RLock()
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		genesisState = prepared.IdenStateOld
+	}
+	is.rw.RUnlock()
+	return estimator.EstimateGas(is.id, genesisState, prepared.IdenState,
+		&prepared.ZkProofOut.Proof)
+}
+
+// SubmitPreparedState publishes an identity state prepared with PrepareState
+// in the blockchain.  It returns ErrPreparedStateOutdated if the prepared
+// identity state is no longer the pending one.
+func (is *Issuer) SubmitPreparedState(prepared *PreparedState) error {
+	return is.SubmitPreparedStateOpts(prepared, nil)
+}
+
+// SubmitPreparedStateOpts is like SubmitPreparedState but the gas limit and
+// gas price of the ethereum transaction are set with opts, like in
+// PublishStateOpts.
+func (is *Issuer) SubmitPreparedStateOpts(prepared *PreparedState, opts *eth.TxOpts) error {
+	if is.genesisOnly() {
 		return ErrIdenGenesisOnly
 	}
 	is.rw.Lock()
+	err := is.submitPreparedState(prepared, opts)
+	onStatePending := is.cfg.OnStatePending
+	is.rw.Unlock()
+	if err != nil {
+		return err
+	}
+	if onStatePending != nil {
+		onStatePending(prepared.IdenState)
+	}
+	return nil
+}
+
+// prepareState prepares the new identity state and its zk proof.  The write
+// lock is only held while the pending identity state is set and checked, so
+// the readers are not blocked during the zk proof generation, which uses the
+// roots captured at the start.  If persist is false, the new identity state
+// is not set pending.  It must be called with is.publish held and is.rw not
+// held.
+func (is *Issuer) prepareState(ctx context.Context, persist bool) (*PreparedState, error) {
+	is.rw.Lock()
+	prepared, err := is.prepareStateSnapshot(persist)
+	zkProofSnapshot := is.zkProofSnapshot()
+	is.rw.Unlock()
+	if err != nil || prepared == nil {
+		return nil, err
+	}
+
+	zkProofOut := prepared.ZkProofOut
+	if zkProofOut == nil {
+		// A zk proof generation left running by a cancelled publish
+		// holds the publication until it finishes, so that they don't
+		// pile up.  Its proof may be the one needed now.
+		if is.zkProofDone != nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-is.zkProofDone:
+			}
+			is.rw.RLock()
+			if p := is.zkProofLast; p != nil && p.IdenStateOld.Equals(prepared.IdenStateOld) &&
+				p.IdenState.Equals(prepared.IdenState) {
+				zkProofOut = p.ZkProofOut
+			}
+			is.rw.RUnlock()
+		}
+	}
+	if zkProofOut == nil {
+		zkProofResultCh := make(chan zkProofResult, 1)
+		zkProofDone := make(chan struct{})
+		is.zkProofDone = zkProofDone
+		go func() {
+			defer close(zkProofDone)
+			zkProofOut, err := is.genZkProofIdenStateUpdate(zkProofSnapshot, prepared.IdenStateOld,
+				prepared.IdenState)
+			if err == nil {
+				is.rw.Lock()
+				is.zkProofLast = &PreparedState{IdenStateOld: prepared.IdenStateOld,
+					IdenState: prepared.IdenState, ZkProofOut: zkProofOut}
+				is.rw.Unlock()
+			}
+			zkProofResultCh <- zkProofResult{zkProofOut: zkProofOut, err: err}
+		}()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r := <-zkProofResultCh:
+			if r.err != nil {
+				return nil, r.err
+			}
+			zkProofOut = r.zkProofOut
+		}
+	}
+
+	if !persist {
+		prepared.ZkProofOut = zkProofOut
+		return prepared, nil
+	}
+	is.rw.Lock()
 	defer is.rw.Unlock()
+	// The storage may have been replaced (for example with RawImport)
+	// during the zk proof generation.
+	idenStatePending, transacted := is.idenStatePending()
+	if transacted || !idenStatePending.Equals(prepared.IdenState) {
+		return nil, ErrPreparedStateOutdated
+	}
+	prepared.ZkProofOut = zkProofOut
+	return prepared, nil
+}
+
+// prepareStateSnapshot sets the new identity state as pending (only if
+// persist is true) and returns it without the zk proof, unless the last
+// generated one can be reused.  It returns nil if the identity state hasn't
+// changed.
+func (is *Issuer) prepareStateSnapshot(persist bool) (*PreparedState, error) {
 	idenStatePending, transacted := is.idenStatePending()
 	// (C)(idenStatePending: X, transacted: true)
 	if !idenStatePending.Equals(&merkletree.HashZero) && transacted {
-		return ErrIdenStatePendingNotNil
+		return nil, ErrIdenStatePendingNotNil
 	}
 
 	idenState, idenStateTreeRoots := is.state()
 
 	tx0, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
 	defer tx0.Close()
+	idenStateLast, idenStateTreeRootsLast, err := is.getIdenStateByIdx(tx0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// (A)(idenStatePending: 0, transacted: false) && idenState != idenStateLast
+	if idenStatePending.Equals(&merkletree.HashZero) && !transacted {
+		if idenState.Equals(idenStateLast) {
+			// IdenState hasn't changed, there's no need to do
+			// anything!
+			return nil, nil
+		}
+
+		// idenState != idenStateLast
+		if persist {
+			idenState, idenStateTreeRoots, err = is.appendIdenStatePending(idenStateTreeRootsLast)
+		} else {
+			idenState, idenStateTreeRoots, err = is.previewIdenStatePending(idenStateTreeRootsLast)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// The pending identity state is the last one in the list,
+		// even if claims have been issued after it.
+		idenState, idenStateTreeRoots = idenStateLast, *idenStateTreeRootsLast
+		idenStateLast, _, err = is.getIdenStateByIdx(tx0, -2)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// (B)(idenStatePending: X, transacted: false)
+
+	var zkProofOut *zkutils.ZkProofOut
+	if p := is.zkProofLast; p != nil && p.IdenStateOld.Equals(idenStateLast) &&
+		p.IdenState.Equals(idenState) {
+		zkProofOut = p.ZkProofOut
+	}
+
+	return &PreparedState{
+		IdenStateOld:       idenStateLast,
+		IdenState:          idenState,
+		IdenStateTreeRoots: idenStateTreeRoots,
+		ZkProofOut:         zkProofOut,
+	}, nil
+}
+
+// AbortPendingState discards the pending identity state when its ethereum
+// transaction has failed, so that a new identity state can be published.  The
+// pending identity state is removed from the identity state list.  It returns
+// ErrIdenStatePendingTxNotSent if there's no pending identity state with a
+// sent transaction, and ErrIdenStatePendingTxNotFailed if the transaction is
+// still unconfirmed or has succeeded.
+func (is *Issuer) AbortPendingState() error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.RLock()
+	sync := is.stateSync()
+	is.rw.RUnlock()
+	idenStatePending := sync.idenStatePending
+	if idenStatePending.Equals(&merkletree.HashZero) || !sync.transacted {
+		return ErrIdenStatePendingTxNotSent
+	}
+	_, _, err := is.ethTxsConfirmBlocks(sync.ethTxs)
+	if err == nil || errors.Is(err, eth.ErrReceiptNotReceived) {
+		return ErrIdenStatePendingTxNotFailed
+	} else if !errors.Is(err, eth.ErrReceiptStatusFailed) {
+		return fmt.Errorf("TxConfirmBlocks: %w", err)
+	}
+
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	// The pending identity state may have been confirmed or resubmitted
+	// during the calls to the ethereum node.
+	if !sync.current(is) {
+		return ErrIdenStatePendingTxNotFailed
+	}
+
+	tx, err := is.storage.NewTx()
 	if err != nil {
 		return err
 	}
-	idenStateLast, idenStateTreeRootsLast, err := is.getIdenStateByIdx(tx0, -1)
+	key, err := is.idenStateList.RemoveLast(tx)
+	if err != nil {
+		tx.Close()
+		return err
+	}
+	if !bytes.Equal(key, idenStatePending[:]) {
+		tx.Close()
+		return fmt.Errorf("Fatal error: the last identity state (%x) is not the pending one (%v)",
+			key, idenStatePending)
+	}
+	is.setIdenStatePending(tx, &merkletree.HashZero, false)
+	return tx.Commit()
+}
+
+// ResubmitPendingState replaces the sent transaction of the pending identity
+// state, which is stuck unconfirmed, with one with a higher gasPrice.  The
+// proof of the stored transaction is reused, and the replacement transaction
+// is stored so that SyncIdenStatePublic tracks it.  The replaced
+// transactions are kept too, because any of them can be the one mined.  The
+// IdenPubOnChainer must implement idenpubonchain.TxResender, otherwise
+// ErrTxResendNotSupported is returned.  The ethereum node is called without
+// holding the Issuer lock, and ErrIdenStatePendingChanged is returned if the
+// pending identity state changes in the meantime.
+func (is *Issuer) ResubmitPendingState(gasPrice *big.Int) error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	// Serialize the resubmissions with each other and with the
+	// publications, which also replace the pending transaction.
+	is.publish.Lock()
+	defer is.publish.Unlock()
+	is.rw.RLock()
+	sync := is.stateSync()
+	is.rw.RUnlock()
+	if sync.idenStatePending.Equals(&merkletree.HashZero) || !sync.transacted {
+		return ErrIdenStatePendingTxNotSent
+	}
+	resender, ok := is.idenPubOnChain.(idenpubonchain.TxResender)
+	if !ok {
+		return ErrTxResendNotSupported
+	}
+
+	ethTxPending := sync.ethTxs[0]
+	ethTx, err := resender.ResendTx(ethTxPending, gasPrice)
+	if err != nil {
+		if sync.idenStateOnChain.Equals(&merkletree.HashZero) {
+			return fmt.Errorf("error resending initState transaction: %w", err)
+		}
+		return fmt.Errorf("error resending setState transaction: %w", err)
+	}
+
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	// The pending identity state may have been confirmed during the call
+	// to the ethereum node.
+	if !sync.current(is) {
+		return ErrIdenStatePendingChanged
+	}
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if sync.idenStateOnChain.Equals(&merkletree.HashZero) {
+		err = is.setEthTxInitState(tx, ethTx)
+	} else {
+		err = is.setEthTxSetState(tx, ethTx)
+	}
+	if err != nil {
+		tx.Close()
+		return err
+	}
+	ethTxsReplaced := append(append([]*types.Transaction{}, is.ethTxsReplaced()...), ethTxPending)
+	if err := is.setEthTxsReplaced(tx, ethTxsReplaced); err != nil {
+		tx.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+// appendIdenStatePending appends the current identity state to the identity
+// state list and sets it as the pending one, not yet transacted.  If the
+// ClaimsTreeRoot has changed since idenStateTreeRootsLast (claims have been
+// added), the ClaimsTreeRoot is first added to the RootsTree.
+func (is *Issuer) appendIdenStatePending(idenStateTreeRootsLast *IdenStateTreeRoots) (*merkletree.Hash,
+	IdenStateTreeRoots, error) {
+	idenState, idenStateTreeRoots := is.state()
+	if !idenStateTreeRoots.ClaimsTreeRoot.Equals(idenStateTreeRootsLast.ClaimsTreeRoot) {
+		// The ClaimsTreeRoot can already be in the RootsTree if the
+		// publication of a state with it was aborted.
+		err := claims.AddLeafRootsTree(is.rootsTree, idenStateTreeRoots.ClaimsTreeRoot)
+		if err != nil && err != merkletree.ErrEntryIndexAlreadyExists {
+			return nil, IdenStateTreeRoots{}, err
+		}
+		idenState, idenStateTreeRoots = is.state()
+	}
+
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return nil, IdenStateTreeRoots{}, err
+	}
+	if err := is.idenStateList.Append(tx, idenState[:], &idenStateTreeRoots); err != nil {
+		tx.Close()
+		return nil, IdenStateTreeRoots{}, err
+	}
+	is.setIdenStatePending(tx, idenState, false)
+	if err := tx.Commit(); err != nil {
+		return nil, IdenStateTreeRoots{}, err
+	}
+	return idenState, idenStateTreeRoots, nil
+}
+
+// previewIdenStatePending returns the identity state that
+// appendIdenStatePending would set pending, without modifying the Issuer.
+func (is *Issuer) previewIdenStatePending(idenStateTreeRootsLast *IdenStateTreeRoots) (*merkletree.Hash,
+	IdenStateTreeRoots, error) {
+	_, idenStateTreeRoots := is.state()
+	return previewIdenState(is.rootsTree, idenStateTreeRoots, idenStateTreeRootsLast)
+}
+
+// previewIdenState returns the identity state of idenStateTreeRoots, whose
+// RootsTreeRoot is the one of rootsTree, once its ClaimsTreeRoot is added to
+// rootsTree if it differs from the one of idenStateTreeRootsLast, like
+// appendIdenStatePending does.  The ClaimsTreeRoot is added to an in memory
+// copy of rootsTree.
+func previewIdenState(rootsTree *merkletree.MerkleTree, idenStateTreeRoots IdenStateTreeRoots,
+	idenStateTreeRootsLast *IdenStateTreeRoots) (*merkletree.Hash, IdenStateTreeRoots, error) {
+	if !idenStateTreeRoots.ClaimsTreeRoot.Equals(idenStateTreeRootsLast.ClaimsTreeRoot) {
+		rootsTree, err := cloneTreeMemory(rootsTree)
+		if err != nil {
+			return nil, IdenStateTreeRoots{}, err
+		}
+		err = claims.AddLeafRootsTree(rootsTree, idenStateTreeRoots.ClaimsTreeRoot)
+		if err != nil && err != merkletree.ErrEntryIndexAlreadyExists {
+			return nil, IdenStateTreeRoots{}, err
+		}
+		idenStateTreeRoots.RootsTreeRoot = rootsTree.RootKey()
+	}
+	idenState := core.IdenState(idenStateTreeRoots.ClaimsTreeRoot,
+		idenStateTreeRoots.RevocationsTreeRoot, idenStateTreeRoots.RootsTreeRoot)
+	return idenState, idenStateTreeRoots, nil
+}
+
+func (is *Issuer) submitPreparedState(prepared *PreparedState, opts *eth.TxOpts) error {
+	idenStatePending, transacted := is.idenStatePending()
+	if transacted || !idenStatePending.Equals(prepared.IdenState) {
+		return ErrPreparedStateOutdated
+	}
+	idenState := prepared.IdenState
+	idenPubOnChainOpts, ok := is.idenPubOnChain.(idenpubonchain.IdenPubOnChainerOpts)
+	if opts != nil && !ok {
+		return ErrTxOptsNotSupported
+	}
+
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		// Identity State not present in the Smart Contract. First time
+		// publishing it.
+		var ethTx *types.Transaction
+		if opts != nil {
+			ethTx, err = idenPubOnChainOpts.InitStateOpts(is.id, prepared.IdenStateOld, idenState,
+				&prepared.ZkProofOut.Proof, opts)
+		} else {
+			ethTx, err = is.idenPubOnChain.InitState(is.id, prepared.IdenStateOld, idenState,
+				&prepared.ZkProofOut.Proof)
+		}
+		if err != nil {
+			return fmt.Errorf("error calling idenstates smart contract initState: %w", err)
+		}
+
+		if err := is.setEthTxInitState(tx, ethTx); err != nil {
+			return err
+		}
+	} else {
+		// Identity State already present in the Smart Contract.
+		// Update it.
+		var ethTx *types.Transaction
+		if opts != nil {
+			ethTx, err = idenPubOnChainOpts.SetStateOpts(is.id, idenState,
+				&prepared.ZkProofOut.Proof, opts)
+		} else {
+			ethTx, err = is.idenPubOnChain.SetState(is.id, idenState, &prepared.ZkProofOut.Proof)
+		}
+		if err != nil {
+			return fmt.Errorf("error calling idenstates smart contract setState: %w", err)
+		}
+
+		if err := is.setEthTxSetState(tx, ethTx); err != nil {
+			return err
+		}
+	}
+	if err := is.setEthTxsReplaced(tx, nil); err != nil {
+		return err
+	}
+	is.setIdenStatePending(tx, idenState, true)
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// finally, Publish the Public Off Chain identity data
+	publicData := &idenpuboffchain.PublicData{
+		IdenState:           idenState,
+		ClaimsTreeRoot:      prepared.IdenStateTreeRoots.ClaimsTreeRoot,
+		RevocationsTreeRoot: prepared.IdenStateTreeRoots.RevocationsTreeRoot,
+		RevocationsTree:     is.revocationsTree,
+		RootsTreeRoot:       prepared.IdenStateTreeRoots.RootsTreeRoot,
+		RootsTree:           is.rootsTree,
+	}
+	if err := is.idenPubOffChainWriter.Publish(is.id, publicData); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeClaim revokes an already issued claim.
+func (is *Issuer) RevokeClaim(claim merkletree.Entrier) error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+
+	hi, err := claim.Entry().HIndex()
+	if err != nil {
+		return err
+	}
+	entry, err := is.claimsTree.GetEntryByIndex(hi)
+	if err != nil {
+		return err
+	}
+	nonce := claims.GetRevocationNonce(entry)
+
+	if err := is.revokeNonce(nonce); err != nil {
+		return fmt.Errorf("error revoking claim with hIndex %v and nonce %v: %w", hi.Hex(), nonce, err)
+	}
+	return nil
+}
+
+// RevokeClaimByNonce revokes the claim with the given revocation nonce,
+// without requiring the claim.  It returns ErrClaimAlreadyRevoked if the
+// nonce is already revoked.
+func (is *Issuer) RevokeClaimByNonce(nonce uint32) error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+
+	if err := is.revokeNonce(nonce); err != nil {
+		return fmt.Errorf("error revoking claim with nonce %v: %w", nonce, err)
+	}
+	return nil
+}
+
+// revokeNonce adds the revocation nonce to the revocations tree.  The nonce
+// of the genesis kOp claim is rejected, as kOp is required to publish new
+// identity states.
+func (is *Issuer) revokeNonce(nonce uint32) error {
+	claimKOpHiBytes, err := is.storage.Get(dbKeyClaimKOpHi)
+	if err != nil {
+		return err
+	}
+	var claimKOpHi merkletree.Hash
+	if err := claimKOpHi.SetBytes(claimKOpHiBytes); err != nil {
+		return fmt.Errorf("invalid stored kOp claim hIndex: %w", err)
+	}
+	claimKOp, err := is.claimsTree.GetEntryByIndex(&claimKOpHi)
+	if err != nil {
+		return err
+	}
+	if nonce == claims.GetRevocationNonce(claimKOp) {
+		return ErrRevokeKeyOperational
+	}
+
+	revoked, err := is.nonceRevoked(nonce, nil)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrClaimAlreadyRevoked
+	}
+	return retryOnTxConflict(func() error {
+		return claims.AddLeafRevocationsTree(is.revocationsTree, nonce, 0xffffffff)
+	})
+}
+
+// UpdateClaim allows updating the value of an already issued claim.  The
+// index and the revocation nonce of the claim are kept, so the revocation
+// nonce in value is ignored.
+func (is *Issuer) UpdateClaim(hIndex *merkletree.Hash, value []merkletree.ElemBytes) error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	if len(value) != merkletree.DataLen-merkletree.IndexLen {
+		return fmt.Errorf("invalid value length: %v", len(value))
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+
+	entry, err := is.claimsTree.GetEntryByIndex(hIndex)
+	if err != nil {
+		return fmt.Errorf("error getting claim with hIndex %v: %w", hIndex.Hex(), err)
+	}
+	nonce := claims.GetRevocationNonce(entry)
+	copy(entry.Data[merkletree.IndexLen:], value)
+	// Keep the revocation nonce of the issued claim.
+	binary.LittleEndian.PutUint32(entry.Data[merkletree.IndexLen][:claims.ClaimRevNonceLen], nonce)
+	hi, err := entry.HIndex()
+	if err != nil {
+		return err
+	}
+	if !hi.Equals(hIndex) {
+		return ErrClaimUpdateHIndexChanged
+	}
+
+	if err := retryOnTxConflict(func() error {
+		return is.claimsTree.UpdateEntry(entry)
+	}); err != nil {
+		return fmt.Errorf("error updating claim with hIndex %v: %w", hIndex.Hex(), err)
+	}
+	return nil
+}
+
+// Sign signs the UTF-8 bytes of a message prefixed with SigPrefixMessage by
+// the kOp of the issuer, and returns the hex encoded compressed signature.
+func (is *Issuer) Sign(msg string) (string, error) {
+	sig, err := is.SignBinary(SigPrefixMessage, []byte(msg))
+	if err != nil {
+		return "", err
+	}
+	return common3.HexEncode(sig[:]), nil
+}
+
+// VerifySign verifies that sigHex is a signature returned by Sign of the
+// message msg with the public key pk.
+func VerifySign(msg, sigHex string, pk *babyjub.PublicKeyComp) (bool, error) {
+	var sig babyjub.SignatureComp
+	if err := common3.HexDecodeInto(sig[:], []byte(sigHex)); err != nil {
+		return false, err
+	}
+	return keystore.VerifySignatureRaw(pk, &sig, append(SigPrefixMessage, msg...))
+}
+
+// SignBinary signs a binary message by the kOp of the issuer.
+func (is *Issuer) SignBinary(prefix, msg []byte) (*babyjub.SignatureComp, error) {
+	return is.signer.SignRaw(is.kOpComp, append(prefix, msg...))
+}
+
+// SignBinaryWith signs a binary message by the key pk, which must be
+// authorized in the current claims tree of the issuer (see AuthorizeKey).
+func (is *Issuer) SignBinaryWith(pk *babyjub.PublicKeyComp, prefix, msg []byte) (*babyjub.SignatureComp, error) {
+	key, err := pk.Decompress()
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := is.ClaimRevoked(claims.NewClaimKeyBabyJub(key, claims.BabyJubKeyTypeAuthorizeKSign))
+	if errors.Is(err, ErrClaimNotFoundClaimsTree) || (err == nil && revoked) {
+		return nil, ErrKeyNotAuthorized
+	} else if err != nil {
+		return nil, err
+	}
+	return is.signer.SignRaw(pk, append(prefix, msg...))
+}
+
+// SignState signs the Identity State transition (oldState+newState) by the kOp of the issuer.
+// The signature can be verified with proof.VerifyStateSignature.
+func (is *Issuer) SignState(oldState, newState *merkletree.Hash) (*babyjub.SignatureComp, error) {
+	return is.SignElems(proof.SetStateElems(oldState, newState))
+}
+
+// SignElems signs a [poseidon.T]*big.Int of elements in *big.Int format
+func (is *Issuer) SignElems(toHash [poseidon.T]*big.Int) (*babyjub.SignatureComp, error) {
+	e, err := poseidon.PoseidonHash(toHash)
+	if err != nil {
+		return nil, err
+	}
+	return is.signer.SignElem(is.kOpComp, e)
+}
+
+func generateExistenceMTProof(mt *merkletree.MerkleTree, hi, root *merkletree.Hash) (*merkletree.Proof, error) {
+	mtp, err := mt.GenerateProof(hi, root)
+	if err != nil {
+		return nil, err
+	}
+	if !mtp.Existence {
+		return nil, ErrClaimNotFoundStateOnChain
+	}
+	return mtp, nil
+}
+
+// generateNotRevokedMTProof generates the proof of non-existence of the
+// revocation nonce of the claim in the revocations tree at root, which is a
+// proof of existence if the claim is revoked.
+func generateNotRevokedMTProof(mt *merkletree.MerkleTree, claim *merkletree.Entry,
+	root *merkletree.Hash) (*merkletree.Proof, error) {
+	// NOTE: Once we add versions, this will require some changes that need to be thought properly!
+	return claims.GenRevocationProof(mt, claims.GetRevocationNonce(claim), root)
+}
+
+// GenCredentialExistence generates an existence credential (claim + proof of
+// existence) of an issued claim.  The result contains all data necessary to
+// validate the credential against the Identity State found in the blockchain.
+// If the claim is revoked in the Identity State on chain, the credential has
+// Revoked set, as it won't verify.  With Config.RefuseExpiredClaims, expired
+// claims return ErrClaimExpired.
+// For credentials of genesis claims without state on chain, see
+// GenCredentialExistenceGenesis.
+func (is *Issuer) GenCredentialExistence(claim merkletree.Entrier) (*proof.CredentialExistence, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	if is.cfg.RefuseExpiredClaims && claims.IsExpired(claim, time.Now()) {
+		return nil, ErrClaimExpired
+	}
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	idenStateData := is.idenStateDataOnChain()
+	if idenStateData.IdenState.Equals(&merkletree.HashZero) {
+		return nil, ErrIdenStateOnChainZero
+	}
+	idenStateTreeRoots, err := is.getIdenStateTreeRoots(tx, idenStateData.IdenState)
+	if err != nil {
+		return nil, err
+	}
+	claimEntry := claim.Entry()
+	hi, err := claimEntry.HIndex()
+	if err != nil {
+		return nil, err
+	}
+	mtpExist, err := generateExistenceMTProof(is.claimsTree, hi,
+		idenStateTreeRoots.ClaimsTreeRoot)
+	if err != nil {
+		// We were unable to generate a proof from the claims tree
+		// associated with the on chain identity state.  Check if the
+		// claim exists in the current claims tree.
+		if err := is.claimsTree.EntryExists(claimEntry, nil); err != nil {
+			return nil, ErrClaimNotFoundClaimsTree
+		} else {
+			return nil, ErrClaimNotYetInOnChainState
+		}
+	} else {
+		// We were able to generate a proof from the claims tree with
+		// the HIndex.  Check the HValue is also valid!
+		if err := is.claimsTree.EntryExists(claimEntry, idenStateTreeRoots.ClaimsTreeRoot); err != nil {
+			return nil, ErrClaimNotFoundClaimsTree
+		}
+	}
+	mtpNotRevoked, err := generateNotRevokedMTProof(is.revocationsTree, claimEntry,
+		idenStateTreeRoots.RevocationsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &proof.CredentialExistence{
+		Id:                  is.id,
+		IdenStateData:       *idenStateData,
+		MtpClaim:            mtpExist,
+		Claim:               claimEntry,
+		RevocationsTreeRoot: idenStateTreeRoots.RevocationsTreeRoot,
+		RootsTreeRoot:       idenStateTreeRoots.RootsTreeRoot,
+		IdenPubUrl:          is.idenPubOffChainWriter.Url(),
+		SchemaVersion:       proof.ClaimSchemaVersion(claimEntry),
+		MtpNotRevoked:       mtpNotRevoked,
+		Revoked:             mtpNotRevoked.Existence,
+	}, nil
+}
+
+// GenCredentialExistenceGenesis generates an existence credential of a claim
+// in the genesis claims tree.  The credential is validated against the
+// genesis identity state, from which the identity ID is derived, so it
+// doesn't require any state on chain and can be generated by a Genesis Only
+// Identity.  The IdenStateData only has the IdenState, and the IdenPubUrl is
+// empty.
+func (is *Issuer) GenCredentialExistenceGenesis(claim merkletree.Entrier) (*proof.CredentialExistence, error) {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	var genesisClaimTreeRoot merkletree.Hash
+	if err := db.LoadJSON(is.storage, dbKeyGenesisClaimTreeRoot, &genesisClaimTreeRoot); err != nil {
+		return nil, err
+	}
+	_, genesisTreeRoots, err := is.getIdenStateByIdx(tx, 0)
+	if err != nil {
+		return nil, err
+	}
+	claimEntry := claim.Entry()
+	hi, err := claimEntry.HIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := is.claimsTree.EntryExists(claimEntry, &genesisClaimTreeRoot); err != nil {
+		if errors.Is(err, merkletree.ErrEntryIndexNotFound) {
+			return nil, ErrClaimNotFoundClaimsTree
+		}
+		return nil, fmt.Errorf("unable to look up the claim in the genesis claims tree: %w", err)
+	}
+	mtpExist, err := generateExistenceMTProof(is.claimsTree, hi, &genesisClaimTreeRoot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate the genesis claim mtp: %w", err)
+	}
+	mtpNotRevoked, err := generateNotRevokedMTProof(is.revocationsTree, claimEntry,
+		genesisTreeRoots.RevocationsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	idenState := core.IdenState(&genesisClaimTreeRoot, genesisTreeRoots.RevocationsTreeRoot,
+		genesisTreeRoots.RootsTreeRoot)
+	return &proof.CredentialExistence{
+		Id:                  is.id,
+		IdenStateData:       proof.IdenStateData{IdenState: idenState},
+		MtpClaim:            mtpExist,
+		Claim:               claimEntry,
+		RevocationsTreeRoot: genesisTreeRoots.RevocationsTreeRoot,
+		RootsTreeRoot:       genesisTreeRoots.RootsTreeRoot,
+		SchemaVersion:       proof.ClaimSchemaVersion(claimEntry),
+		MtpNotRevoked:       mtpNotRevoked,
+		Revoked:             mtpNotRevoked.Existence,
+	}, nil
+}
+
+// GenCredentialSigned generates a credential of the claim signed with the
+// operational key together with the current identity state.  See
+// proof.CredentialSigned for the guarantees that it provides.
+func (is *Issuer) GenCredentialSigned(claim merkletree.Entrier) (*proof.CredentialSigned, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	claimEntry := claim.Entry()
+	if err := is.claimsTree.EntryExists(claimEntry, nil); err != nil {
+		return nil, ErrClaimNotFoundClaimsTree
+	}
+	idenState, _ := is.state()
+	toHash, err := proof.CredentialSignedElems(claimEntry, idenState)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := is.SignElems(toHash)
+	if err != nil {
+		return nil, err
+	}
+	return &proof.CredentialSigned{
+		Id:        is.id,
+		IdenState: idenState,
+		Claim:     claimEntry,
+		Signature: sig,
+	}, nil
+}
+
+// GenCredentialOffChain generates an existence credential of an issued claim
+// for the current identity state together with the current identity state
+// signed by the operational key, so that the credential can be verified with
+// proof.VerifyCredentialOffChain without the state being published on chain.
+func (is *Issuer) GenCredentialOffChain(claim merkletree.Entrier) (*proof.CredentialExistence,
+	*proof.SignedState, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	claimEntry := claim.Entry()
+	if err := is.claimsTree.EntryExists(claimEntry, nil); err != nil {
+		return nil, nil, ErrClaimNotFoundClaimsTree
+	}
+	hi, err := claimEntry.HIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	idenState, idenStateTreeRoots := is.state()
+	mtpExist, err := generateExistenceMTProof(is.claimsTree, hi, idenStateTreeRoots.ClaimsTreeRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	mtpNotRevoked, err := generateNotRevokedMTProof(is.revocationsTree, claimEntry,
+		idenStateTreeRoots.RevocationsTreeRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := is.SignElems(proof.SignedStateElems(is.id, idenState))
+	if err != nil {
+		return nil, nil, err
+	}
+	cred := &proof.CredentialExistence{
+		Id:                  is.id,
+		IdenStateData:       proof.IdenStateData{IdenState: idenState},
+		MtpClaim:            mtpExist,
+		Claim:               claimEntry,
+		RevocationsTreeRoot: idenStateTreeRoots.RevocationsTreeRoot,
+		RootsTreeRoot:       idenStateTreeRoots.RootsTreeRoot,
+		SchemaVersion:       proof.ClaimSchemaVersion(claimEntry),
+		MtpNotRevoked:       mtpNotRevoked,
+		Revoked:             mtpNotRevoked.Existence,
+	}
+	signedState := &proof.SignedState{
+		Id:        is.id,
+		IdenState: idenState,
+		Signature: sig,
+	}
+	return cred, signedState, nil
+}
+
+// nonceRevoked returns true if the revocation nonce is in the revocations
+// tree with the given root.
+func (is *Issuer) nonceRevoked(nonce uint32, root *merkletree.Hash) (bool, error) {
+	// NOTE: Once we add versions, this will require some changes that need to be thought properly!
+	hi, err := claims.NewLeafRevocationsTree(nonce, 0xffffffff).Entry().HIndex()
+	if err != nil {
+		return false, err
+	}
+	mtp, err := is.revocationsTree.GenerateProof(hi, root)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return mtp.Existence, nil
+}
 
-	// (A)(idenStatePending: 0, transacted: false) && idenState != idenStateLast
-	if idenStatePending.Equals(&merkletree.HashZero) && !transacted {
-		if idenState.Equals(idenStateLast) {
-			// IdenState hasn't changed, there's no need to do
-			// anything!
-			return nil
-		}
-
-		// idenState != idenStateLast
+// HasClaim returns true if the claim (index and value) is in the current
+// claims tree.  It doesn't require any state on chain.
+func (is *Issuer) HasClaim(claim merkletree.Entrier) (bool, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	claimEntry := claim.Entry()
+	hi, err := claimEntry.HIndex()
+	if err != nil {
+		return false, err
+	}
+	data, err := is.claimsTree.GetDataByIndex(hi)
+	if err == merkletree.ErrEntryIndexNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// Data.Equal only compares the index, so compare the whole data.
+	return *data == claimEntry.Data, nil
+}
 
-		// If the ClaimsTreeRoot has changed (claims have been added), add the
-		// ClaimsTreeRoot to the RootsTree.
-		if !idenStateTreeRoots.ClaimsTreeRoot.Equals(idenStateTreeRootsLast.ClaimsTreeRoot) {
-			if err := claims.AddLeafRootsTree(is.rootsTree, idenStateTreeRoots.ClaimsTreeRoot); err != nil {
-				return err
-			}
-			idenState, idenStateTreeRoots = is.state()
+// ClaimsByType returns the claims of type claimType in the current claims
+// tree.  Leafs that can't be decoded by claims.NewClaimFromEntry, like claims
+// of unknown or custom types, are skipped.
+func (is *Issuer) ClaimsByType(claimType claims.ClaimType) ([]merkletree.Entrier, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	var cs []merkletree.Entrier
+	if err := is.claimsTree.WalkLeafs(nil, func(e *merkletree.Entry) {
+		var metadata claims.Metadata
+		metadata.Unmarshal(e)
+		if metadata.Type() != claimType {
+			return
 		}
-
-		tx, err := is.storage.NewTx()
+		c, err := claims.NewClaimFromEntry(e)
 		if err != nil {
-			return err
-		}
-
-		if err := is.idenStateList.Append(tx, idenState[:], &idenStateTreeRoots); err != nil {
-			return err
+			return
 		}
+		cs = append(cs, c)
+	}); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
 
-		is.setIdenStatePending(tx, idenState, false)
-
-		if err := tx.Commit(); err != nil {
-			return err
+// PendingClaims returns the claims of the current claims tree that are not
+// in the claims tree of the identity state on chain, either because they were
+// issued or updated after it.  Without identity state on chain, the genesis
+// claims are not pending.  Like in ClaimsByType, leafs that can't be decoded
+// by claims.NewClaimFromEntry are skipped.
+func (is *Issuer) PendingClaims() ([]merkletree.Entrier, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	var claimsTreeRootOnChain *merkletree.Hash
+	if idenStateOnChain := is.idenStateOnChain(); idenStateOnChain.Equals(&merkletree.HashZero) {
+		_, roots, err := is.genesisIdenState()
+		if err != nil {
+			return nil, err
 		}
+		claimsTreeRootOnChain = roots.ClaimsTreeRoot
 	} else {
-		idenStateLast, idenStateTreeRootsLast, err = is.getIdenStateByIdx(tx0, -2)
+		tx, err := is.storage.NewTx()
 		if err != nil {
-			return err
+			return nil, err
 		}
-	}
-
-	// (B)(idenStatePending: X, transacted: false)
-
-	zkProofOut, err := is.GenZkProofIdenStateUpdate(idenStateLast, idenState)
-	if err != nil {
-		return err
-	}
-
-	tx, err := is.storage.NewTx()
-	if err != nil {
-		return err
-	}
-
-	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
-		// Identity State not present in the Smart Contract. First time
-		// publishing it.
-		ethTx, err := is.idenPubOnChain.InitState(is.id, idenStateLast, idenState, &zkProofOut.Proof)
+		defer tx.Close()
+		roots, err := is.getIdenStateTreeRoots(tx, idenStateOnChain)
 		if err != nil {
-			return fmt.Errorf("error calling idenstates smart contract initState: %w", err)
+			return nil, err
 		}
+		claimsTreeRootOnChain = roots.ClaimsTreeRoot
+	}
 
-		if err := is.setEthTxInitState(tx, ethTx); err != nil {
-			return err
+	var cs []merkletree.Entrier
+	var errWalk error
+	if err := is.claimsTree.WalkLeafs(nil, func(e *merkletree.Entry) {
+		if errWalk != nil {
+			return
 		}
-	} else {
-		// Identity State already present in the Smart Contract.
-		// Update it.
-		ethTx, err := is.idenPubOnChain.SetState(is.id, idenState, &zkProofOut.Proof)
+		hi, err := e.HIndex()
 		if err != nil {
-			return fmt.Errorf("error calling idenstates smart contract setState: %w", err)
+			errWalk = err
+			return
 		}
-
-		if err := is.setEthTxSetState(tx, ethTx); err != nil {
-			return err
+		eOnChain, err := is.claimsTree.GetEntryByIndexAtRoot(hi, claimsTreeRootOnChain)
+		if err == nil && eOnChain.Equals(e) {
+			return
+		} else if err != nil && err != merkletree.ErrEntryIndexNotFound {
+			errWalk = err
+			return
+		}
+		c, err := claims.NewClaimFromEntry(e)
+		if err != nil {
+			return
 		}
+		cs = append(cs, c)
+	}); err != nil {
+		return nil, err
 	}
-	is.setIdenStatePending(tx, idenState, true)
-
-	if err := tx.Commit(); err != nil {
-		return err
+	if errWalk != nil {
+		return nil, errWalk
 	}
+	return cs, nil
+}
 
-	publicData := idenpuboffchain.PublicData{
-		IdenState:           idenState,
-		ClaimsTreeRoot:      idenStateTreeRoots.ClaimsTreeRoot,
-		RevocationsTreeRoot: idenStateTreeRoots.RevocationsTreeRoot,
-		RevocationsTree:     is.revocationsTree,
-		RootsTreeRoot:       idenStateTreeRoots.RootsTreeRoot,
-		RootsTree:           is.rootsTree,
+// ClaimRevoked returns true if the issued claim is revoked in the current
+// revocations tree.  The revocation nonce is taken from the issued claim
+// with the same index, so it returns ErrClaimNotFoundClaimsTree if the claim
+// hasn't been issued.
+func (is *Issuer) ClaimRevoked(claim merkletree.Entrier) (bool, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	hi, err := claim.Entry().HIndex()
+	if err != nil {
+		return false, err
 	}
-
-	// finally, Publish the Public Off Chain identity data
-	if err := is.idenPubOffChainWriter.Publish(is.id, &publicData); err != nil {
-		return err
+	entry, err := is.claimsTree.GetEntryByIndex(hi)
+	if err == merkletree.ErrEntryIndexNotFound {
+		return false, ErrClaimNotFoundClaimsTree
+	} else if err != nil {
+		return false, err
 	}
-	return nil
+	return is.nonceRevoked(claims.GetRevocationNonce(entry), nil)
 }
 
-// RevokeClaim revokes an already issued claim.
-func (is *Issuer) RevokeClaim(claim merkletree.Entrier) error {
-	if is.cfg.GenesisOnly {
-		return ErrIdenGenesisOnly
-	}
-	is.rw.Lock()
-	defer is.rw.Unlock()
-
-	hi, err := claim.Entry().HIndex()
+// AuthorizeKey issues a ClaimKeyBabyJub of type BabyJubKeyTypeAuthorizeKSign
+// for pk, so that it can sign with SignBinaryWith.  The authorized key can be
+// revoked by revoking the claim.  New identity states are always signed and
+// proven with the genesis kOp, which can't be rotated.
+func (is *Issuer) AuthorizeKey(pk *babyjub.PublicKeyComp) error {
+	key, err := pk.Decompress()
 	if err != nil {
 		return err
 	}
-	data, err := is.claimsTree.GetDataByIndex(hi)
+	_, err = is.IssueClaim(claims.NewClaimKeyBabyJub(key, claims.BabyJubKeyTypeAuthorizeKSign))
+	return err
+}
+
+// RevokeKey revokes the ClaimKeyBabyJub of type BabyJubKeyTypeAuthorizeKSign
+// of pk.  It returns ErrKeyNotAuthorized if the key has never been authorized
+// and ErrRevokeKeyOperational for the genesis kOp.
+func (is *Issuer) RevokeKey(pk *babyjub.PublicKeyComp) error {
+	key, err := pk.Decompress()
 	if err != nil {
 		return err
 	}
-	nonce := claims.GetRevocationNonce(&merkletree.Entry{Data: *data})
-
-	if err := claims.AddLeafRevocationsTree(is.revocationsTree, nonce, 0xffffffff); err != nil {
-		return err
+	err = is.RevokeClaim(claims.NewClaimKeyBabyJub(key, claims.BabyJubKeyTypeAuthorizeKSign))
+	if errors.Is(err, merkletree.ErrEntryIndexNotFound) {
+		return ErrKeyNotAuthorized
 	}
-	return nil
+	return err
 }
 
-// UpdateClaim allows updating the value of an already issued claim.
-func (is *Issuer) UpdateClaim(hIndex *merkletree.Hash, value []merkletree.ElemBytes) error {
-	if is.cfg.GenesisOnly {
-		return ErrIdenGenesisOnly
+// AuthorizedKeys returns the public keys of the ClaimKeyBabyJub claims of
+// type BabyJubKeyTypeAuthorizeKSign in the current claims tree that are not
+// revoked in the current revocations tree.
+func (is *Issuer) AuthorizedKeys() ([]*babyjub.PublicKeyComp, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	var keyClaims []*claims.ClaimKeyBabyJub
+	if err := is.claimsTree.Walk(nil, func(n *merkletree.Node) {
+		if n.Type != merkletree.NodeTypeLeaf {
+			return
+		}
+		var header claims.ClaimHeader
+		header.Unmarshal(n.Entry)
+		if header.Type != claims.ClaimTypeKeyBabyJub {
+			return
+		}
+		c := claims.NewClaimKeyBabyJubFromEntry(n.Entry)
+		if c.KeyType == claims.BabyJubKeyTypeAuthorizeKSign {
+			keyClaims = append(keyClaims, c)
+		}
+	}); err != nil {
+		return nil, err
 	}
-	return fmt.Errorf("TODO")
-}
-
-// Sign signs a message by the kOp of the issuer.
-func (is *Issuer) Sign(string) (string, error) {
-	return "", fmt.Errorf("TODO")
-}
-
-// SignBinary signs a binary message by the kOp of the issuer.
-func (is *Issuer) SignBinary(prefix, msg []byte) (*babyjub.SignatureComp, error) {
-	return is.keyStore.SignRaw(is.kOpComp, append(prefix, msg...))
-}
-
-// SignState signs the Identity State transition (oldState+newState) by the kOp of the issuer.
-func (is *Issuer) SignState(oldState, newState *merkletree.Hash) (*babyjub.SignatureComp, error) {
-	var prefix31 [31]byte
-	copy(prefix31[:], SigPrefixSetState)
-	prefixBigInt := new(big.Int)
-	utils.SetBigIntFromLEBytes(prefixBigInt, prefix31[:])
-
-	toHash := [poseidon.T]*big.Int{prefixBigInt, oldState.BigInt(), newState.BigInt(), big.NewInt(0), big.NewInt(0), big.NewInt(0)}
-
-	return is.SignElems(toHash)
+	keys := []*babyjub.PublicKeyComp{}
+	for _, c := range keyClaims {
+		revoked, err := is.nonceRevoked(c.Metadata().RevNonce, nil)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			continue
+		}
+		pk := babyjub.PublicKey{X: c.Ax, Y: c.Ay}
+		pkComp := pk.Compress()
+		keys = append(keys, &pkComp)
+	}
+	return keys, nil
 }
 
-// SignElems signs a [poseidon.T]*big.Int of elements in *big.Int format
-func (is *Issuer) SignElems(toHash [poseidon.T]*big.Int) (*babyjub.SignatureComp, error) {
-	e, err := poseidon.PoseidonHash(toHash)
+// RevocationBitfieldMaxLen is the maximum length in bytes of the bitfield
+// returned by RevocationBitfield.
+const RevocationBitfieldMaxLen = 1 << 20
+
+// RevocationBitfield returns a bitfield where the bit i is set if the claim
+// with revocation nonce i is revoked in the current on chain identity state,
+// along with the maximum nonce issued.  The bit i is found in the byte i/8 at
+// the position i%8 (see common.TestBit).  This trades the cryptographic
+// proof of non-revocation for compactness, so it's only suitable when the
+// verifier trusts the Issuer (or the bitfield is signed by it).  It returns
+// ErrRevocationBitfieldTooLarge if the bitfield needs more than
+// RevocationBitfieldMaxLen bytes, which can happen with few claims if the
+// Issuer was created with a high genesis nonce (see CreateWithNonces).
+func (is *Issuer) RevocationBitfield() ([]byte, uint32, error) {
+	if is.genesisOnly() {
+		return nil, 0, ErrIdenGenesisOnly
+	}
+	tx, err := is.storage.NewTx()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return is.keyStore.SignElem(is.kOpComp, e)
-}
-
-func generateExistenceMTProof(mt *merkletree.MerkleTree, hi, root *merkletree.Hash) (*merkletree.Proof, error) {
-	mtp, err := mt.GenerateProof(hi, root)
+	defer tx.Close()
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	idenStateData := is.idenStateDataOnChain()
+	if idenStateData.IdenState.Equals(&merkletree.HashZero) {
+		return nil, 0, ErrIdenStateOnChainZero
+	}
+	idenStateTreeRoots, err := is.getIdenStateTreeRoots(tx, idenStateData.IdenState)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	if !mtp.Existence {
-		return nil, ErrClaimNotFoundStateOnChain
+	nextNonce, err := is.nonceGen.Peek(tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The genesis claim kOp takes a nonce lower than nextNonce (0 with
+	// Create, or any one with CreateWithNonces, which makes the following
+	// nonces higher), so nextNonce > 0.
+	maxNonce := nextNonce - 1
+	if uint64(maxNonce)/8+1 > RevocationBitfieldMaxLen {
+		return nil, 0, ErrRevocationBitfieldTooLarge
+	}
+	bitfield := make([]byte, uint64(maxNonce)/8+1)
+	if err := is.revocationsTree.Walk(idenStateTreeRoots.RevocationsTreeRoot, func(n *merkletree.Node) {
+		if n.Type != merkletree.NodeTypeLeaf {
+			return
+		}
+		leaf := claims.NewLeafRevocationsTreeFromEntry(n.Entry)
+		if leaf.Nonce <= maxNonce {
+			common3.SetBit(bitfield, uint(leaf.Nonce))
+		}
+	}); err != nil {
+		return nil, 0, err
 	}
-	return mtp, nil
+	return bitfield, maxNonce, nil
 }
 
-// GenCredentialExistence generates an existence credential (claim + proof of
-// existence) of an issued claim.  The result contains all data necessary to
-// validate the credential against the Identity State found in the blockchain.
-// For now, there are no genesis credentials.
-func (is *Issuer) GenCredentialExistence(claim merkletree.Entrier) (*proof.CredentialExistence, error) {
-	// TODO: Once a genesis credential is implemented, figure out what to
-	// return here.  Maybe this function will error and there will be a
-	// "GenCredentialExistenceGenesis".  Maybe this function will be able
-	// to return a credential even when there's no state on chain.
-	if is.cfg.GenesisOnly {
+// VerifierSnapshot returns a bundle of the public data of the Issuer at the
+// current on chain identity state, which verifiers can use to verify many
+// credentials locally with a proof.SnapshotVerifier.
+func (is *Issuer) VerifierSnapshot() (*proof.VerifierSnapshot, error) {
+	if is.genesisOnly() {
 		return nil, ErrIdenGenesisOnly
 	}
 	tx, err := is.storage.NewTx()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Close()
 	is.rw.RLock()
 	defer is.rw.RUnlock()
 	idenStateData := is.idenStateDataOnChain()
@@ -866,37 +2638,50 @@ func (is *Issuer) GenCredentialExistence(claim merkletree.Entrier) (*proof.Crede
 	if err != nil {
 		return nil, err
 	}
-	claimEntry := claim.Entry()
-	hi, err := claimEntry.HIndex()
-	if err != nil {
-		return nil, err
-	}
-	mtpExist, err := generateExistenceMTProof(is.claimsTree, hi,
-		idenStateTreeRoots.ClaimsTreeRoot)
-	if err != nil {
-		// We were unable to generate a proof from the claims tree
-		// associated with the on chain identity state.  Check if the
-		// claim exists in the current claims tree.
-		if err := is.claimsTree.EntryExists(claimEntry, nil); err != nil {
-			return nil, ErrClaimNotFoundClaimsTree
-		} else {
-			return nil, ErrClaimNotYetInOnChainState
+
+	hIndexes := []*merkletree.Hash{}
+	var errWalk error
+	if err := is.claimsTree.Walk(idenStateTreeRoots.ClaimsTreeRoot, func(n *merkletree.Node) {
+		if n.Type != merkletree.NodeTypeLeaf || errWalk != nil {
+			return
 		}
-	} else {
-		// We were able to generate a proof from the claims tree with
-		// the HIndex.  Check the HValue is also valid!
-		if err := is.claimsTree.EntryExists(claimEntry, idenStateTreeRoots.ClaimsTreeRoot); err != nil {
-			return nil, ErrClaimNotFoundClaimsTree
+		nonce := claims.GetRevocationNonce(n.Entry)
+		revoked, err := is.nonceRevoked(nonce, idenStateTreeRoots.RevocationsTreeRoot)
+		if err != nil {
+			errWalk = err
+			return
+		}
+		if revoked {
+			return
 		}
+		hi, err := n.Entry.HIndex()
+		if err != nil {
+			errWalk = err
+			return
+		}
+		hIndexes = append(hIndexes, hi)
+	}); err != nil {
+		return nil, err
 	}
-	return &proof.CredentialExistence{
-		Id:                  is.id,
-		IdenStateData:       *idenStateData,
-		MtpClaim:            mtpExist,
-		Claim:               claimEntry,
-		RevocationsTreeRoot: idenStateTreeRoots.RevocationsTreeRoot,
-		RootsTreeRoot:       idenStateTreeRoots.RootsTreeRoot,
-		IdenPubUrl:          is.idenPubOffChainWriter.Url(),
+	if errWalk != nil {
+		return nil, errWalk
+	}
+
+	var revocationsTree bytes.Buffer
+	if err := is.revocationsTree.DumpTree(&revocationsTree,
+		idenStateTreeRoots.RevocationsTreeRoot); err != nil {
+		return nil, err
+	}
+
+	return &proof.VerifierSnapshot{
+		Id:                    is.id,
+		IdenStateData:         *idenStateData,
+		ClaimsTreeRoot:        idenStateTreeRoots.ClaimsTreeRoot,
+		RevocationsTreeRoot:   idenStateTreeRoots.RevocationsTreeRoot,
+		RootsTreeRoot:         idenStateTreeRoots.RootsTreeRoot,
+		ClaimsHIndexes:        hIndexes,
+		RevocationsTree:       revocationsTree.Bytes(),
+		RevocationsTreeLevels: is.cfg.MaxLevelsRevocationTree,
 	}, nil
 }
 
@@ -909,14 +2694,49 @@ type IdOwnershipGenesisInputs struct {
 	// RootTreeRoot   *big.Int
 }
 
+// zkProofSnapshot is what the zk proof of an identity state update needs
+// from the Issuer, captured with is.rw held so that the proof is generated
+// without it.
+type zkProofSnapshot struct {
+	id      *core.ID
+	kOpComp *babyjub.PublicKeyComp
+	storage db.Storage
+	conf    *IdenStateZkProofConf
+}
+
+// zkProofSnapshot returns the current zkProofSnapshot.  It must be called
+// with is.rw held.
+func (is *Issuer) zkProofSnapshot() *zkProofSnapshot {
+	return &zkProofSnapshot{id: is.id, kOpComp: is.kOpComp, storage: is.storage,
+		conf: is.idenStateZkProofConf}
+}
+
+// exportKOp returns the operational private key kOpComp exported from the
+// Signer.
+func (is *Issuer) exportKOp(kOpComp *babyjub.PublicKeyComp) (*babyjub.PrivateKey, error) {
+	sk, err := is.signer.ExportKey(kOpComp)
+	if err != nil {
+		return nil, fmt.Errorf("the zk proof requires the operational private key, "+
+			"which the Signer can't export: %w", err)
+	}
+	return sk, nil
+}
+
 func (is *Issuer) GenIdOwnershipGenesisInputs(levels int) (*IdOwnershipGenesisInputs, error) {
-	sk, err := is.keyStore.ExportKey(is.kOpComp)
+	is.rw.RLock()
+	zkProofSnapshot := is.zkProofSnapshot()
+	is.rw.RUnlock()
+	return is.genIdOwnershipGenesisInputs(zkProofSnapshot, levels)
+}
+
+func (is *Issuer) genIdOwnershipGenesisInputs(z *zkProofSnapshot, levels int) (*IdOwnershipGenesisInputs, error) {
+	sk, err := is.exportKOp(z.kOpComp)
 	if err != nil {
 		return nil, err
 	}
 
 	var mtp merkletree.Proof
-	err = db.LoadJSON(is.storage, dbKeyGenesisClaimKOpMtp, &mtp)
+	err = db.LoadJSON(z.storage, dbKeyGenesisClaimKOpMtp, &mtp)
 	if err != nil {
 		return nil, err
 	}
@@ -927,12 +2747,12 @@ func (is *Issuer) GenIdOwnershipGenesisInputs(levels int) (*IdOwnershipGenesisIn
 	}
 
 	var genesisClaimTreeRoot merkletree.Hash
-	err = db.LoadJSON(is.storage, dbKeyGenesisClaimTreeRoot, &genesisClaimTreeRoot)
+	err = db.LoadJSON(z.storage, dbKeyGenesisClaimTreeRoot, &genesisClaimTreeRoot)
 	if err != nil {
 		return nil, err
 	}
 	return &IdOwnershipGenesisInputs{
-		Id:             is.id.BigInt(),
+		Id:             z.id.BigInt(),
 		PrivateKey:     (*big.Int)(sk.Scalar()),
 		MtpSiblings:    siblings,
 		ClaimsTreeRoot: genesisClaimTreeRoot.BigInt(),
@@ -942,16 +2762,84 @@ func (is *Issuer) GenIdOwnershipGenesisInputs(levels int) (*IdOwnershipGenesisIn
 }
 
 func (is *Issuer) GenZkProofIdenStateUpdate(oldIdState, newIdState *merkletree.Hash) (*zkutils.ZkProofOut, error) {
-	pk, err := is.idenStateZkProofConf.Files.ProvingKey()
+	is.rw.RLock()
+	zkProofSnapshot := is.zkProofSnapshot()
+	is.rw.RUnlock()
+	return is.genZkProofIdenStateUpdate(zkProofSnapshot, oldIdState, newIdState)
+}
+
+// genZkProofIdenStateUpdate is GenZkProofIdenStateUpdate with the Issuer
+// fields captured in z, so that it's called without is.rw held.
+func (is *Issuer) genZkProofIdenStateUpdate(z *zkProofSnapshot,
+	oldIdState, newIdState *merkletree.Hash) (*zkutils.ZkProofOut, error) {
+	start := time.Now()
+	inputs, err := is.zkInputsIdenStateUpdate(z, oldIdState, newIdState)
+	if err != nil {
+		return nil, err
+	}
+	// The WASM is loaded before the keys, because the ZkFiles are locked
+	// while the proving key is parsed.
+	witnessCalcWASM, err := z.conf.Files.WitnessCalcWASM()
+	if err != nil {
+		return nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
+	}
+	// The keys are loaded (and parsed if they are not cached yet)
+	// concurrently with the witness calculation, which doesn't depend on
+	// them.
+	type zkKeys struct {
+		pk  *zktypes.Pk
+		vk  *zktypes.Vk
+		err error
+	}
+	zkKeysCh := make(chan zkKeys, 1)
+	go func() {
+		pk, err := z.conf.Files.ProvingKey()
+		if err != nil {
+			zkKeysCh <- zkKeys{err: fmt.Errorf("error loading zk pk: %w", err)}
+			return
+		}
+		vk, err := z.conf.Files.VerificationKey()
+		if err != nil {
+			zkKeysCh <- zkKeys{err: fmt.Errorf("error loading zk vk: %w", err)}
+			return
+		}
+		zkKeysCh <- zkKeys{pk: pk, vk: vk}
+	}()
+
+	wit, err := witnesscalc.CalculateWitnessBinWASM(witnessCalcWASM, inputs)
+	if err == nil {
+		is.metrics().ObserveWitnessCalcDuration(time.Since(start))
+	}
+	keys := <-zkKeysCh
+	if keys.err != nil {
+		return nil, keys.err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error loading zk pk: %w", err)
+		return nil, err
 	}
-	vk, err := is.idenStateZkProofConf.Files.VerificationKey()
+	pk, vk := keys.pk, keys.vk
+
+	start = time.Now()
+	proof, pubSignals, err := prover.GenerateProof(pk, wit)
 	if err != nil {
-		return nil, fmt.Errorf("error loading zk vk: %w", err)
+		return nil, err
+	}
+	// Verify zk proof
+	if !verifier.Verify(vk, proof, pubSignals) {
+		return nil, ErrFailedVerifyZkProofIdenStateUpdate
 	}
 
-	idOwnershipInputs, err := is.GenIdOwnershipGenesisInputs(is.idenStateZkProofConf.Levels)
+	elapsed := time.Since(start)
+	is.metrics().ObserveProofGenDuration(elapsed)
+	is.log().Debug("Proof generated", Fields{"elapsed": elapsed})
+	return &zkutils.ZkProofOut{Proof: *proof, PubSignals: pubSignals}, nil
+}
+
+// zkInputsIdenStateUpdate returns the inputs of the zk proof of the identity
+// state update from oldIdState to newIdState.
+func (is *Issuer) zkInputsIdenStateUpdate(z *zkProofSnapshot,
+	oldIdState, newIdState *merkletree.Hash) (map[string]interface{}, error) {
+	idOwnershipInputs, err := is.genIdOwnershipGenesisInputs(z, z.conf.Levels)
 	if err != nil {
 		return nil, fmt.Errorf("error generating idOwnership inputs: %w", err)
 	}
@@ -964,34 +2852,26 @@ func (is *Issuer) GenZkProofIdenStateUpdate(oldIdState, newIdState *merkletree.H
 	inputs["siblings"] = idOwnershipInputs.MtpSiblings
 	inputs["claimsTreeRoot"] = idOwnershipInputs.ClaimsTreeRoot
 	inputs["newIdState"] = newIdState.BigInt()
+	return inputs, nil
+}
 
-	witnessCalcWASM, err := is.idenStateZkProofConf.Files.WitnessCalcWASM()
-	if err != nil {
-		return nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
-	}
-	wit, err := witnesscalc.CalculateWitnessBinWASM(witnessCalcWASM, inputs)
+// genZkWitnessIdenStateUpdate calculates the witness of the zk proof of the
+// identity state update from oldIdState to newIdState.
+func (is *Issuer) genZkWitnessIdenStateUpdate(oldIdState, newIdState *merkletree.Hash) ([]*big.Int, error) {
+	is.rw.RLock()
+	zkProofSnapshot := is.zkProofSnapshot()
+	is.rw.RUnlock()
+	inputs, err := is.zkInputsIdenStateUpdate(zkProofSnapshot, oldIdState, newIdState)
 	if err != nil {
 		return nil, err
 	}
 
-	start := time.Now()
-	proof, pubSignals, err := prover.GenerateProof(pk, wit)
+	witnessCalcWASM, err := zkProofSnapshot.conf.Files.WitnessCalcWASM()
 	if err != nil {
-		return nil, err
-	}
-	// Verify zk proof
-	if !verifier.Verify(vk, proof, pubSignals) {
-		return nil, ErrFailedVerifyZkProofIdenStateUpdate
+		return nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
 	}
-
-	log.WithField("elapsed", time.Since(start)).Debug("Proof generated")
-	return &zkutils.ZkProofOut{Proof: *proof, PubSignals: pubSignals}, nil
+	return witnesscalc.CalculateWitnessBinWASM(witnessCalcWASM, inputs)
 }
 
-// TODO: Create an Admin struct that exposes the following:
-// - The 3 Merle Trees
-// - RawDump(f func(key, value string))
-// - RawImport(raw map[string]string) (int, error)
-// - ClaimsDump() map[string]string
-// The return and input types are open to change.  They are based on the old
+// TODO: Expose the 3 Merkle Trees for administration, based on the old
 // components/idenadminutils/idenadminutils.go
@@ -1,22 +1,35 @@
 package issuer
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	bn256 "github.com/ethereum/go-ethereum/crypto/bn256/cloudflare"
+	"github.com/iden3/go-circom-prover-verifier/prover"
 	zktypes "github.com/iden3/go-circom-prover-verifier/types"
 	"github.com/iden3/go-circom-prover-verifier/verifier"
+	common3 "github.com/iden3/go-iden3-core/common"
 	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
 	idenpuboffchanlocal "github.com/iden3/go-iden3-core/components/idenpuboffchain/local"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
 	idenpubonchainlocal "github.com/iden3/go-iden3-core/components/idenpubonchain/local"
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
 	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/eth"
 	"github.com/iden3/go-iden3-core/keystore"
 	"github.com/iden3/go-iden3-core/merkletree"
 	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -29,7 +42,7 @@ var idenStateZkProofConf *IdenStateZkProofConf
 
 var pass = []byte("my passphrase")
 
-func newIssuer(t *testing.T, genesisOnly bool, idenPubOnChain idenpubonchain.IdenPubOnChainer,
+func newIssuer(t testing.TB, genesisOnly bool, idenPubOnChain idenpubonchain.IdenPubOnChainer,
 	idenPubOffChainWrite idenpuboffchain.IdenPubOffChainWriter) (*Issuer, db.Storage, *keystore.KeyStore) {
 	cfg := ConfigDefault
 	cfg.GenesisOnly = genesisOnly
@@ -58,6 +71,177 @@ func TestNewLoadIssuer(t *testing.T) {
 	assert.Equal(t, issuer.id, issuerLoad.id)
 }
 
+func TestLoadIssuerCorruptedState(t *testing.T) {
+	_, storage, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	tx.Put(dbKeyIdenStatePending, []byte{0x01, 0x02})
+	require.Nil(t, tx.Commit())
+	_, err = Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	assert.True(t, errors.Is(err, merkletree.ErrHashBadSize))
+}
+
+func TestLoadIssuerVerifyOnLoad(t *testing.T) {
+	cfg := ConfigDefault
+	cfg.GenesisOnly = true
+	cfg.VerifyOnLoad = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	id, err := Create(cfg, kOp, []claims.Claimer{}, storage, keyStore)
+	require.Nil(t, err)
+	issuer, err := Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+	assert.Equal(t, id, issuer.ID())
+
+	idBad := *id
+	idBad[3] ^= 0xff
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	tx.Put(dbKeyId, idBad[:])
+	require.Nil(t, tx.Commit())
+	_, err = Load(storage, keyStore, nil, nil, nil)
+	assert.True(t, errors.Is(err, ErrIdGenesisMismatch))
+}
+
+func TestCreateWithNonces(t *testing.T) {
+	cfg := ConfigDefault
+	cfg.GenesisOnly = true
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	newExtraClaims := func() []claims.Claimer {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = 0x42
+		claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+		indexBytes[0] = 0x43
+		claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+		return []claims.Claimer{claim0, claim1}
+	}
+
+	_, err = CreateWithNonces(cfg, kOp, 7, newExtraClaims(), []uint32{3, 5}, db.NewMemoryStorage(), keyStore)
+	assert.Equal(t, ErrNoDeterministicNonces, err)
+	cfg.DeterministicNonces = true
+	_, err = Create(cfg, kOp, newExtraClaims(), db.NewMemoryStorage(), keyStore)
+	assert.Equal(t, ErrDeterministicNonces, err)
+	_, err = CreateWithNonces(cfg, kOp, 7, newExtraClaims(), []uint32{3}, db.NewMemoryStorage(), keyStore)
+	assert.True(t, errors.Is(err, ErrNoncesCountMismatch))
+	_, err = CreateWithNonces(cfg, kOp, 7, newExtraClaims(), []uint32{3, 7}, db.NewMemoryStorage(), keyStore)
+	assert.True(t, errors.Is(err, ErrNoncesNotUnique))
+
+	// The same nonces give the same ID.
+	storage := db.NewMemoryStorage()
+	extraClaims := newExtraClaims()
+	id, err := CreateWithNonces(cfg, kOp, 7, extraClaims, []uint32{3, 5}, storage, keyStore)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(5), extraClaims[1].Metadata().RevNonce)
+	idRepeat, err := CreateWithNonces(cfg, kOp, 7, newExtraClaims(), []uint32{3, 5},
+		db.NewMemoryStorage(), keyStore)
+	require.Nil(t, err)
+	assert.Equal(t, id, idRepeat)
+	idOther, err := CreateWithNonces(cfg, kOp, 7, newExtraClaims(), []uint32{5, 3},
+		db.NewMemoryStorage(), keyStore)
+	require.Nil(t, err)
+	assert.NotEqual(t, id, idOther)
+
+	// The following nonces are higher than the genesis ones.
+	issuer, err := Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+	n, err := issuer.NonceCount()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(8), n)
+}
+
+func TestIssuerStoragePrefix(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	prefixes := [][]byte{[]byte("issuer0:"), []byte("issuer1:")}
+	issuers := make([]*Issuer, len(prefixes))
+	for i, prefix := range prefixes {
+		cfg := ConfigDefault
+		cfg.StoragePrefix = prefix
+		kOp, err := keyStore.NewKey(pass)
+		require.Nil(t, err)
+		require.Nil(t, keyStore.UnlockKey(kOp, pass))
+		id, err := Create(cfg, kOp, []claims.Claimer{}, storage, keyStore)
+		require.Nil(t, err)
+		issuers[i], err = LoadWithPrefix(prefix, storage, keyStore, idenPubOnChain,
+			idenStateZkProofConf, idenPubOffChain)
+		require.Nil(t, err)
+		assert.Equal(t, id, issuers[i].ID())
+	}
+	assert.NotEqual(t, issuers[0].ID(), issuers[1].ID())
+	_, err = Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	assert.NotNil(t, err)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err = issuers[0].IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	idenState1, _ := issuers[1].State()
+	issuer1, err := LoadWithPrefix(prefixes[1], storage, keyStore, idenPubOnChain,
+		idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	idenState1Load, _ := issuer1.State()
+	assert.Equal(t, idenState1, idenState1Load)
+	n, err := issuer1.NonceCount()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), n)
+}
+
+func TestIssuerEnableOnChain(t *testing.T) {
+	issuer, storage, keyStore := newIssuer(t, true, nil, nil)
+	id := issuer.ID()
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	assert.Equal(t, ErrIdenGenesisOnly, err)
+
+	assert.Equal(t, ErrIdenPubOnChainNil, issuer.EnableOnChain(nil, idenStateZkProofConf, idenPubOffChain))
+	assert.Equal(t, ErrIdenPubOffChainWriterNil, issuer.EnableOnChain(idenPubOnChain, idenStateZkProofConf, nil))
+	assert.True(t, issuer.cfg.GenesisOnly)
+
+	require.Nil(t, issuer.EnableOnChain(idenPubOnChain, idenStateZkProofConf, idenPubOffChain))
+	assert.Equal(t, id, issuer.ID())
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	assert.Equal(t, ErrIdenNotGenesisOnly, issuer.EnableOnChain(idenPubOnChain, idenStateZkProofConf, idenPubOffChain))
+
+	// The stored config is updated
+	_, err = Load(storage, keyStore, nil, nil, nil)
+	assert.Equal(t, ErrIdenPubOnChainNil, err)
+	issuerLoad, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	assert.False(t, issuerLoad.cfg.GenesisOnly)
+	assert.Equal(t, id, issuerLoad.ID())
+}
+
+func TestIssuerEnableOnChainConcurrent(t *testing.T) {
+	issuer, _, _ := newIssuer(t, true, nil, nil)
+
+	// The methods that check GenesisOnly can be called while the Issuer
+	// is enabled on chain.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		for i := 0; i < 16; i++ {
+			indexBytes[0] = byte(i)
+			_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+			assert.True(t, err == nil || err == ErrIdenGenesisOnly)
+		}
+	}()
+	require.Nil(t, issuer.EnableOnChain(idenPubOnChain, idenStateZkProofConf, idenPubOffChain))
+	<-done
+}
+
 func TestIssuerGenesis(t *testing.T) {
 	issuer, _, _ := newIssuer(t, true, nil, nil)
 
@@ -102,7 +286,7 @@ func TestIssuerPublish(t *testing.T) {
 	//
 
 	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
-	err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
 	require.Nil(t, err)
 
 	// Publishing state for the first time
@@ -135,7 +319,7 @@ func TestIssuerPublish(t *testing.T) {
 
 	indexBytes, valueBytes = [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
 	indexBytes[0] = 0x42
-	err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
 	require.Nil(t, err)
 
 	oldState := newState
@@ -173,10 +357,10 @@ func TestIssuerCredential(t *testing.T) {
 	indexBytes[0] = 0x42
 	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
 
-	err := issuer.IssueClaim(claim0)
+	issuedClaim0, err := issuer.IssueClaim(claim0)
 	require.Nil(t, err)
 
-	credExist, err := issuer.GenCredentialExistence(claim0)
+	credExist, err := issuer.GenCredentialExistence(issuedClaim0)
 	assert.Nil(t, credExist)
 	assert.Equal(t, ErrIdenStateOnChainZero, err)
 
@@ -193,7 +377,7 @@ func TestIssuerCredential(t *testing.T) {
 	idenStatePending, _ := issuer.idenStatePending()
 	assert.Equal(t, &merkletree.HashZero, idenStatePending)
 
-	_, err = issuer.GenCredentialExistence(claim0)
+	_, err = issuer.GenCredentialExistence(issuedClaim0)
 	assert.Nil(t, err)
 
 	// Issue another claim
@@ -201,13 +385,85 @@ func TestIssuerCredential(t *testing.T) {
 	indexBytes[0] = 0x81
 	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
 
-	err = issuer.IssueClaim(claim1)
+	issuedClaim1, err := issuer.IssueClaim(claim1)
 	require.Nil(t, err)
 
-	_, err = issuer.GenCredentialExistence(claim1)
+	_, err = issuer.GenCredentialExistence(issuedClaim1)
 	assert.Equal(t, ErrClaimNotYetInOnChainState, err)
 }
 
+func TestIssuerRefuseExpiredClaims(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	sk := babyjub.NewRandPrivKey()
+	claim := claims.NewClaimKeyBabyJub(sk.Public(), claims.BabyJubKeyTypeGeneric)
+	require.Nil(t, claim.Metadata().SetExpiration(time.Now().Add(-time.Hour)))
+	issuedClaim, err := issuer.IssueClaim(claim)
+	require.Nil(t, err)
+
+	_, err = issuer.GenCredentialExistence(issuedClaim)
+	assert.Equal(t, ErrIdenStateOnChainZero, err)
+	issuer.cfg.RefuseExpiredClaims = true
+	_, err = issuer.GenCredentialExistence(issuedClaim)
+	assert.Equal(t, ErrClaimExpired, err)
+}
+
+func TestIssuerVerifierSnapshot(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	_, err := issuer.VerifierSnapshot()
+	assert.Equal(t, ErrIdenStateOnChainZero, err)
+
+	// Issue two claims
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	indexBytes[0] = 0x81
+	claim1, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+
+	credExist0, err := issuer.GenCredentialExistence(claim0)
+	require.Nil(t, err)
+	credExist1, err := issuer.GenCredentialExistence(claim1)
+	require.Nil(t, err)
+
+	snapshot, err := issuer.VerifierSnapshot()
+	require.Nil(t, err)
+	// kOp claim + 2 claims
+	assert.Equal(t, 3, len(snapshot.ClaimsHIndexes))
+	assert.Nil(t, proof.VerifyWithSnapshot(credExist0, snapshot))
+	assert.Nil(t, proof.VerifyWithSnapshot(credExist1, snapshot))
+
+	// Revoke claim1
+	require.Nil(t, issuer.RevokeClaim(claim1))
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+
+	credExist0, err = issuer.GenCredentialExistence(claim0)
+	require.Nil(t, err)
+	assert.False(t, credExist0.Revoked)
+	credExist1, err = issuer.GenCredentialExistence(claim1)
+	require.Nil(t, err)
+	assert.True(t, credExist1.Revoked)
+
+	snapshot, err = issuer.VerifierSnapshot()
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(snapshot.ClaimsHIndexes))
+	assert.Equal(t, issuer.cfg.MaxLevelsRevocationTree, snapshot.RevocationsTreeLevels)
+	verifier, err := proof.NewSnapshotVerifier(snapshot)
+	require.Nil(t, err)
+	assert.Nil(t, verifier.Verify(credExist0))
+	assert.Equal(t, proof.ErrSnapshotClaimNotFound, verifier.Verify(credExist1))
+}
+
 func TestIssuerGenZkProofIdenStateUpdate(t *testing.T) {
 	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
 	var oldIdState, newIdState merkletree.Hash
@@ -222,18 +478,162 @@ func TestIssuerGenZkProofIdenStateUpdate(t *testing.T) {
 	assert.True(t, v)
 }
 
+// BenchmarkGenZkProofIdenStateUpdate compares the zk proof generation with
+// the proving key parsed before the witness calculation (sequential) and
+// concurrently with it, with the proving key not cached.
+func BenchmarkGenZkProofIdenStateUpdate(b *testing.B) {
+	issuer, _, _ := newIssuer(b, false, idenPubOnChain, idenPubOffChain)
+	issuer.idenStateZkProofConf = &IdenStateZkProofConf{
+		Levels: idenStateZkProofConf.Levels,
+		Files: *zkutils.NewZkFiles(idenStateZkFilesUrl, idenStateZkFilesPath,
+			zkutils.ProvingKeyFormatJSON, idenStateZkFilesHashes, false),
+	}
+	var oldIdState, newIdState merkletree.Hash
+	oldIdState[0] = 41
+	newIdState[0] = 42
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pk, err := issuer.idenStateZkProofConf.Files.ProvingKey()
+			require.Nil(b, err)
+			vk, err := issuer.idenStateZkProofConf.Files.VerificationKey()
+			require.Nil(b, err)
+			wit, err := issuer.genZkWitnessIdenStateUpdate(&oldIdState, &newIdState)
+			require.Nil(b, err)
+			proof, pubSignals, err := prover.GenerateProof(pk, wit)
+			require.Nil(b, err)
+			require.True(b, verifier.Verify(vk, proof, pubSignals))
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := issuer.GenZkProofIdenStateUpdate(&oldIdState, &newIdState)
+			require.Nil(b, err)
+		}
+	})
+}
+
+func TestIssuerZkInputs(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	oldIdState := merkletree.NewHashFromBigInt(big.NewInt(1))
+	newIdState := merkletree.NewHashFromBigInt(big.NewInt(2))
+	inputs, err := issuer.zkInputsIdenStateUpdate(issuer.zkProofSnapshot(), oldIdState, newIdState)
+	require.Nil(t, err)
+	assert.Equal(t, issuer.ID().BigInt(), inputs["id"])
+	assert.Equal(t, oldIdState.BigInt(), inputs["oldIdState"])
+	assert.Equal(t, newIdState.BigInt(), inputs["newIdState"])
+
+	// A Signer that refuses the export stops the proof generation.
+	issuer.signer = &signerNoExport{keyStore}
+	_, err = issuer.zkInputsIdenStateUpdate(issuer.zkProofSnapshot(), oldIdState, newIdState)
+	assert.True(t, errors.Is(err, ErrKeyExportNotSupported))
+}
+
+// signerBlockExport is a Signer whose ExportKey signals exporting and blocks
+// until release is closed.
+type signerBlockExport struct {
+	*keystore.KeyStore
+	exporting chan struct{}
+	release   chan struct{}
+}
+
+func (s *signerBlockExport) ExportKey(pk *babyjub.PublicKeyComp) (*babyjub.PrivateKey, error) {
+	close(s.exporting)
+	<-s.release
+	return s.KeyStore.ExportKey(pk)
+}
+
+func TestIssuerPublishStateReaders(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	signer := &signerBlockExport{KeyStore: keyStore, exporting: make(chan struct{}),
+		release: make(chan struct{})}
+	issuer.signer = signer
+	// Without zk files, the zk proof generation fails after the inputs are
+	// calculated.
+	issuer.idenStateZkProofConf = &IdenStateZkProofConf{Levels: idenStateZkProofConf.Levels}
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- issuer.PublishState() }()
+	<-signer.exporting
+
+	// The zk proof is being generated, and the readers are not blocked.
+	idenStatePending, _ := issuer.IdenStatePending()
+	idenStateCh := make(chan *merkletree.Hash, 1)
+	go func() {
+		idenState, _ := issuer.State()
+		idenStateCh <- idenState
+	}()
+	select {
+	case idenState := <-idenStateCh:
+		assert.Equal(t, idenStatePending, idenState)
+	case <-time.After(10 * time.Second):
+		t.Error("State is blocked during the zk proof generation")
+	}
+	close(signer.release)
+	assert.NotNil(t, <-errCh)
+
+	// The new identity state stays pending for the next publish.
+	idenStatePendingAfter, transacted := issuer.IdenStatePending()
+	assert.Equal(t, idenStatePending, idenStatePendingAfter)
+	assert.False(t, transacted)
+}
+
+func TestIssuerPublishStateCtxCancelProving(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	signer := &signerBlockExport{KeyStore: keyStore, exporting: make(chan struct{}),
+		release: make(chan struct{})}
+	issuer.signer = signer
+	issuer.idenStateZkProofConf = &IdenStateZkProofConf{Levels: idenStateZkProofConf.Levels}
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- issuer.PublishStateCtx(ctx) }()
+	<-signer.exporting
+	cancel()
+	assert.Equal(t, context.Canceled, <-errCh)
+
+	// The next publish waits for the running zk proof generation instead
+	// of starting another one, which would export the key again.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, issuer.PublishStateCtx(ctx))
+
+	close(signer.release)
+	<-issuer.zkProofDone
+	idenStatePending, transacted := issuer.IdenStatePending()
+	assert.NotEqual(t, &merkletree.HashZero, idenStatePending)
+	assert.False(t, transacted)
+}
+
 var vk *zktypes.Vk
 var blockN uint64
 
+const (
+	idenStateZkFilesUrl  = "http://161.35.72.58:9000/circuit-idstate/"
+	idenStateZkFilesPath = "/tmp/iden3/idenstatezk-issuer"
+)
+
+var idenStateZkFilesHashes = zkutils.ZkFilesHashes{
+	ProvingKey:      "2c72fceb10323d8b274dbd7649a63c1b6a11fff3a1e4cd7f5ec12516f32ec452",
+	VerificationKey: "473952ff80aef85403005eb12d1e78a3f66b1cc11e7bd55d6bfe94e0b5577640",
+	WitnessCalcWASM: "8eafd9314c4d2664a23bf98a4f42cd0c29984960ae3544747ba5fbd60905c41f",
+}
+
 func TestMain(m *testing.M) {
 	log.SetLevel(log.DebugLevel)
-	zkFiles := zkutils.NewZkFiles("http://161.35.72.58:9000/circuit-idstate/", "/tmp/iden3/idenstatezk-issuer",
-		zkutils.ProvingKeyFormatJSON,
-		zkutils.ZkFilesHashes{
-			ProvingKey:      "2c72fceb10323d8b274dbd7649a63c1b6a11fff3a1e4cd7f5ec12516f32ec452",
-			VerificationKey: "473952ff80aef85403005eb12d1e78a3f66b1cc11e7bd55d6bfe94e0b5577640",
-			WitnessCalcWASM: "8eafd9314c4d2664a23bf98a4f42cd0c29984960ae3544747ba5fbd60905c41f",
-		}, true)
+	zkFiles := zkutils.NewZkFiles(idenStateZkFilesUrl, idenStateZkFilesPath,
+		zkutils.ProvingKeyFormatJSON, idenStateZkFilesHashes, true)
 	if err := zkFiles.LoadAll(); err != nil {
 		panic(err)
 	}
@@ -260,3 +660,1171 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(m.Run())
 }
+
+func TestIssuerRevocationBitfield(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	_, _, err := issuer.RevocationBitfield()
+	assert.Equal(t, ErrIdenStateOnChainZero, err)
+
+	// Issue 9 claims with nonces 1 to 9 (the genesis claim has nonce 0)
+	claimsBasic := []*claims.ClaimBasic{}
+	for i := 0; i < 9; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		claim := claims.NewClaimBasic(indexBytes, valueBytes)
+		_, err := issuer.IssueClaim(claim)
+		require.Nil(t, err)
+		claimsBasic = append(claimsBasic, claim)
+	}
+	require.Nil(t, issuer.RevokeClaim(claimsBasic[2]))
+	require.Nil(t, issuer.RevokeClaim(claimsBasic[8]))
+
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+
+	bitfield, maxNonce, err := issuer.RevocationBitfield()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(9), maxNonce)
+	assert.Equal(t, []byte{0x08, 0x02}, bitfield)
+}
+
+func TestIssuerRevocationBitfieldMaxLen(t *testing.T) {
+	cfg := ConfigDefault
+	cfg.DeterministicNonces = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOp, pass))
+	_, err = CreateWithNonces(cfg, kOp, RevocationBitfieldMaxLen*8, []claims.Claimer{}, []uint32{},
+		storage, keyStore)
+	require.Nil(t, err)
+	issuer, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+
+	// Take the genesis state as the on chain one.
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	idenStateGenesis, _, err := issuer.getIdenStateByIdx(tx, 0)
+	require.Nil(t, err)
+	tx.Close()
+	issuer._idenStateDataOnChain = &proof.IdenStateData{IdenState: idenStateGenesis}
+
+	_, _, err = issuer.RevocationBitfield()
+	assert.Equal(t, ErrRevocationBitfieldTooLarge, err)
+}
+
+func TestIssuerCredentialSigned(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+
+	_, err := issuer.GenCredentialSigned(claim0)
+	assert.Equal(t, ErrClaimNotFoundClaimsTree, err)
+
+	issuedClaim0, err := issuer.IssueClaim(claim0)
+	require.Nil(t, err)
+
+	credSigned, err := issuer.GenCredentialSigned(issuedClaim0)
+	require.Nil(t, err)
+	idenState, _ := issuer.State()
+	assert.Equal(t, idenState, credSigned.IdenState)
+	assert.Nil(t, proof.VerifyCredentialSigned(credSigned, issuer.KeyOperational()))
+
+	credSigned.IdenState = &merkletree.HashZero
+	assert.Equal(t, proof.ErrCredentialSignedInvalidSignature,
+		proof.VerifyCredentialSigned(credSigned, issuer.KeyOperational()))
+}
+
+func TestIssuerSignState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	oldState, _ := issuer.State()
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	newState, _ := issuer.State()
+
+	sig, err := issuer.SignState(oldState, newState)
+	require.Nil(t, err)
+	ok, err := proof.VerifyStateSignature(issuer.KeyOperational(), oldState, newState, sig)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = proof.VerifyStateSignature(issuer.KeyOperational(), newState, oldState, sig)
+	require.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestIssuerCredentialOffChain(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+
+	_, _, err := issuer.GenCredentialOffChain(claim0)
+	assert.Equal(t, ErrClaimNotFoundClaimsTree, err)
+
+	issuedClaim0, err := issuer.IssueClaim(claim0)
+	require.Nil(t, err)
+
+	cred, signedState, err := issuer.GenCredentialOffChain(issuedClaim0)
+	require.Nil(t, err)
+	idenState, _ := issuer.State()
+	assert.Equal(t, idenState, signedState.IdenState)
+	kOp := issuer.KeyOperational()
+	assert.Nil(t, proof.VerifyCredentialOffChain(cred, *signedState, kOp))
+
+	// The state signature must be valid.
+	signedStateBad := *signedState
+	signedStateBad.Id = &core.ID{}
+	assert.Equal(t, proof.ErrSignedStateIdDoesntMatch,
+		proof.VerifyCredentialOffChain(cred, signedStateBad, kOp))
+	cred.Id = signedStateBad.Id
+	assert.Equal(t, proof.ErrSignedStateInvalidSignature,
+		proof.VerifyCredentialOffChain(cred, signedStateBad, kOp))
+	cred.Id = signedState.Id
+
+	// The credential must be bound to the signed state.
+	cred.RootsTreeRoot = &merkletree.HashZero
+	assert.Equal(t, proof.ErrCalculatedIdenStateDoesntMatch,
+		proof.VerifyCredentialOffChain(cred, *signedState, kOp))
+	assert.False(t, cred.Revoked)
+
+	// A credential of a revoked claim is flagged.
+	require.Nil(t, issuer.RevokeClaim(issuedClaim0))
+	cred, signedState, err = issuer.GenCredentialOffChain(issuedClaim0)
+	require.Nil(t, err)
+	assert.True(t, cred.Revoked)
+	assert.Equal(t, proof.ErrClaimRevoked, proof.VerifyCredentialOffChain(cred, *signedState, kOp))
+}
+
+func TestIssuerIssueClaimError(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err := issuer.IssueClaim(claim0)
+	require.Nil(t, err)
+
+	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err = issuer.IssueClaim(claim1)
+	assert.True(t, errors.Is(err, ErrClaimAlreadyIssued))
+	assert.True(t, errors.Is(err, merkletree.ErrEntryIndexAlreadyExists))
+	hi, err2 := claim1.Entry().HIndex()
+	require.Nil(t, err2)
+	assert.Contains(t, err.Error(), hi.Hex())
+
+	// The failed issue doesn't consume a nonce.
+	indexBytes[0] = 0x43
+	claim2, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	assert.Equal(t, uint32(2), claim2.Metadata().RevNonce)
+}
+
+func TestIssuerCheckClaimCollision(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+	assert.Nil(t, issuer.CheckClaimCollision(claim0))
+	_, err := issuer.IssueClaim(claim0)
+	require.Nil(t, err)
+	// The same claim is not a collision
+	assert.Nil(t, issuer.CheckClaimCollision(claim0))
+
+	valueBytes[0] = 0x01
+	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+	assert.True(t, errors.Is(issuer.CheckClaimCollision(claim1), ErrHIndexCollision))
+	_, err = issuer.IssueClaim(claim1)
+	assert.True(t, errors.Is(err, ErrHIndexCollision))
+	assert.True(t, errors.Is(err, ErrClaimAlreadyIssued))
+}
+
+func TestIssuerReissueClaim(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	// The issued claim is replaced keeping its revocation nonce.
+	valueBytes[0] = 0x01
+	claim1, err := issuer.ReissueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	assert.Equal(t, claim0.Metadata().RevNonce, claim1.Metadata().RevNonce)
+	hi, err := claim1.Entry().HIndex()
+	require.Nil(t, err)
+	entry, err := issuer.claimsTree.GetEntryByIndex(hi)
+	require.Nil(t, err)
+	assert.True(t, entry.Equals(claim1.Entry()))
+
+	// A claim that is not issued yet is issued with a new nonce.
+	indexBytes[0] = 0x43
+	claim2, err := issuer.ReissueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	assert.Equal(t, claim0.Metadata().RevNonce+1, claim2.Metadata().RevNonce)
+}
+
+func TestIssuerIssueClaimClone(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+	entry0 := claim0.Entry()
+
+	issuedClaim0, err := issuer.IssueClaim(claim0)
+	require.Nil(t, err)
+	assert.Equal(t, entry0, claim0.Entry())
+	assert.Equal(t, uint32(0), claim0.Metadata().RevNonce)
+	// The genesis kOp claim has nonce 0.
+	assert.Equal(t, uint32(1), issuedClaim0.Metadata().RevNonce)
+	assert.Nil(t, issuer.claimsTree.EntryExists(issuedClaim0.Entry(), nil))
+}
+
+func TestIssuerAuthorizedKeys(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	keys, err := issuer.AuthorizedKeys()
+	require.Nil(t, err)
+	assert.Equal(t, []*babyjub.PublicKeyComp{issuer.KeyOperational()}, keys)
+
+	kSignComp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	kSign, err := kSignComp.Decompress()
+	require.Nil(t, err)
+	claimKSign := claims.NewClaimKeyBabyJub(kSign, claims.BabyJubKeyTypeAuthorizeKSign)
+	_, err = issuer.IssueClaim(claimKSign)
+	require.Nil(t, err)
+	kGenericComp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	kGeneric, err := kGenericComp.Decompress()
+	require.Nil(t, err)
+	_, err = issuer.IssueClaim(claims.NewClaimKeyBabyJub(kGeneric, claims.BabyJubKeyTypeGeneric))
+	require.Nil(t, err)
+
+	keys, err = issuer.AuthorizedKeys()
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []*babyjub.PublicKeyComp{issuer.KeyOperational(), kSignComp}, keys)
+
+	require.Nil(t, issuer.RevokeClaim(claimKSign))
+	keys, err = issuer.AuthorizedKeys()
+	require.Nil(t, err)
+	assert.Equal(t, []*babyjub.PublicKeyComp{issuer.KeyOperational()}, keys)
+}
+
+func TestIssuerPreviewState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	newClaim := func(b byte) *claims.ClaimBasic {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = b
+		return claims.NewClaimBasic(indexBytes, valueBytes)
+	}
+	claim0, err := issuer.IssueClaim(newClaim(0x42))
+	require.Nil(t, err)
+
+	claim1, claim2 := newClaim(0x43), newClaim(0x44)
+	stateBefore, _ := issuer.State()
+	preview, err := issuer.PreviewState([]claims.Claimer{claim1, claim2},
+		[]uint32{claim0.Metadata().RevNonce})
+	require.Nil(t, err)
+	stateAfter, _ := issuer.State()
+	assert.Equal(t, stateBefore, stateAfter)
+	assert.NotEqual(t, stateBefore, preview)
+
+	_, err = issuer.IssueClaim(claim1)
+	require.Nil(t, err)
+	_, err = issuer.IssueClaim(claim2)
+	require.Nil(t, err)
+	require.Nil(t, issuer.RevokeClaim(claim0))
+	// The preview is the state that PrepareState and PublishState set
+	// pending, which includes the new claims tree root in the roots tree.
+	issuer.rw.Lock()
+	prepared, err := issuer.prepareStateSnapshot(true)
+	issuer.rw.Unlock()
+	require.Nil(t, err)
+	assert.Equal(t, prepared.IdenState, preview)
+	idenStatePending, _ := issuer.IdenStatePending()
+	assert.Equal(t, idenStatePending, preview)
+
+	_, err = issuer.PreviewState([]claims.Claimer{newClaim(0x42)}, nil)
+	assert.True(t, errors.Is(err, merkletree.ErrEntryIndexAlreadyExists))
+}
+
+func TestIssuerStateBlockNumber(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	_, err := issuer.StateBlockNumber(&merkletree.HashZero)
+	assert.Equal(t, ErrIdenStateOnChainZero, err)
+
+	publish := func(b byte) *merkletree.Hash {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = b
+		_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+		require.Nil(t, issuer.PublishState())
+		idenPubOnChain.Sync()
+		blockN += 10
+		require.Nil(t, issuer.SyncIdenStatePublic())
+		return issuer.IdenStateOnChain()
+	}
+
+	idenState0 := publish(0x42)
+	blockN0 := issuer.StateDataOnChain().BlockN
+	idenState1 := publish(0x81)
+	blockN1 := issuer.StateDataOnChain().BlockN
+	assert.Less(t, blockN0, blockN1)
+
+	n0, err := issuer.StateBlockNumber(idenState0)
+	require.Nil(t, err)
+	assert.Equal(t, blockN0, n0)
+	n1, err := issuer.StateBlockNumber(idenState1)
+	require.Nil(t, err)
+	assert.Equal(t, blockN1, n1)
+}
+
+// idenPubOnChainByState is an IdenPubOnChainer that records the fromBlockN
+// of GetStateByState.
+type idenPubOnChainByState struct {
+	idenpubonchain.IdenPubOnChainer
+	fromBlockN uint64
+}
+
+func (ip *idenPubOnChainByState) GetStateByState(id *core.ID, idenState *merkletree.Hash,
+	fromBlockN uint64) (*proof.IdenStateData, error) {
+	ip.fromBlockN = fromBlockN
+	return &proof.IdenStateData{BlockN: fromBlockN, IdenState: idenState}, nil
+}
+
+func TestIssuerStateBlockNumberFromBlock(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	idenState0, _ := issuer.state()
+
+	setOnChain := func(idenState *merkletree.Hash, blockN uint64) {
+		tx, err := issuer.storage.NewTx()
+		require.Nil(t, err)
+		require.Nil(t, issuer.setIdenStateDataOnChain(tx,
+			&proof.IdenStateData{IdenState: idenState, BlockN: blockN}))
+		require.Nil(t, tx.Commit())
+	}
+	setOnChain(idenState0, 7)
+	setOnChain(merkletree.NewHashFromBigInt(big.NewInt(42)), 20)
+
+	issuer.idenPubOnChain = &idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain}
+	_, err := issuer.StateBlockNumber(idenState0)
+	assert.Equal(t, ErrStateByStateNotSupported, err)
+
+	// The older states are looked for from the first published one.
+	ip := &idenPubOnChainByState{IdenPubOnChainer: idenPubOnChain}
+	issuer.idenPubOnChain = ip
+	n, err := issuer.StateBlockNumber(idenState0)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(7), n)
+	assert.Equal(t, uint64(7), ip.fromBlockN)
+}
+
+func TestIssuerClaimsByType(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	issued := []merkletree.Entrier{}
+	for i := 0; i < 2; i++ {
+		indexBytes[0] = byte(i)
+		claim, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+		issued = append(issued, claim)
+	}
+	// A claim of a custom type is skipped.
+	customType := claims.NewClaimTypeNum(1000)
+	var custom merkletree.Entry
+	claims.ClaimHeader{Type: customType}.Marshal(&custom)
+	custom.Data[1][0] = 0x42
+	require.Nil(t, issuer.claimsTree.AddEntry(&custom))
+
+	cs, err := issuer.ClaimsByType(claims.ClaimTypeBasic)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(cs))
+	for _, c := range issued {
+		found := false
+		for _, cTree := range cs {
+			if *c.Entry() == *cTree.Entry() {
+				found = true
+			}
+		}
+		assert.True(t, found)
+	}
+
+	cs, err = issuer.ClaimsByType(claims.ClaimTypeKeyBabyJub)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(cs))
+
+	cs, err = issuer.ClaimsByType(customType)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(cs))
+}
+
+func TestIssuerPendingClaims(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	// The genesis claims are not pending
+	cs, err := issuer.PendingClaims()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(cs))
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	cs, err = issuer.PendingClaims()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(cs))
+	assert.Equal(t, claim0.Entry(), cs[0].Entry())
+
+	// Set the current state on chain
+	idenState, roots := issuer.state()
+	appendIdenState(t, issuer, idenState, &roots)
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	require.Nil(t, issuer.setIdenStateDataOnChain(tx, &proof.IdenStateData{IdenState: idenState}))
+	require.Nil(t, tx.Commit())
+	cs, err = issuer.PendingClaims()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(cs))
+
+	// Issued and updated claims are pending
+	indexBytes[0] = 0x43
+	claim1, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	hi, err := claim0.Entry().HIndex()
+	require.Nil(t, err)
+	value := claim0.Entry().Value()
+	value[1][0] = 0x01
+	require.Nil(t, issuer.UpdateClaim(hi, value[:]))
+	cs, err = issuer.PendingClaims()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(cs))
+	hiPending := map[merkletree.Hash]bool{}
+	for _, c := range cs {
+		hi, err := c.Entry().HIndex()
+		require.Nil(t, err)
+		hiPending[*hi] = true
+	}
+	hi1, err := claim1.Entry().HIndex()
+	require.Nil(t, err)
+	assert.True(t, hiPending[*hi])
+	assert.True(t, hiPending[*hi1])
+}
+
+func TestIssuerIssueClaimEthId(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	claim := claims.NewClaimEthId(common.HexToAddress("0xe0fbce58cfaa72812103f003adce3f284fe5fc7c"),
+		common.Address{})
+	issuedClaim, err := issuer.IssueClaim(claim)
+	require.Nil(t, err)
+	// The genesis kOp claim has nonce 0.
+	assert.Equal(t, uint32(1), issuedClaim.(*claims.ClaimEthId).RevNonce())
+
+	cs, err := issuer.ClaimsByType(claims.ClaimTypeEthId)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(cs))
+	claimTree := cs[0].(*claims.ClaimEthId)
+	assert.Equal(t, claim.Address, claimTree.Address)
+	assert.Equal(t, uint32(1), claimTree.RevNonce())
+}
+
+func TestIssuerIssueMultiPartClaim(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	schemaHash := claims.HashString("schema")
+	parts := [][]*big.Int{
+		{big.NewInt(1), big.NewInt(2), big.NewInt(3)},
+		{big.NewInt(4), big.NewInt(5)},
+	}
+	cs, err := issuer.IssueMultiPartClaim(schemaHash, parts)
+	require.Nil(t, err)
+
+	// Reassemble the parts from the claims tree
+	partsTree := []*claims.ClaimMultiPart{}
+	for _, c := range cs {
+		hi, err := c.Entry().HIndex()
+		require.Nil(t, err)
+		data, err := issuer.claimsTree.GetDataByIndex(hi)
+		require.Nil(t, err)
+		partsTree = append(partsTree, claims.NewClaimMultiPartFromEntry(&merkletree.Entry{Data: *data}))
+	}
+	assert.Equal(t, uint32(1), partsTree[1].Metadata().RevNonce)
+	data, err := claims.MultiPartData(partsTree)
+	require.Nil(t, err)
+	assert.Equal(t, 0, data[1][1].Cmp(big.NewInt(5)))
+
+	// Issuing the same multi-part claim again doesn't add any part nor
+	// consume a nonce.
+	root := issuer.claimsTree.RootKey()
+	nonceCount, err := issuer.NonceCount()
+	require.Nil(t, err)
+	_, err = issuer.IssueMultiPartClaim(schemaHash, parts)
+	assert.True(t, errors.Is(err, merkletree.ErrEntryIndexAlreadyExists))
+	assert.Equal(t, root, issuer.claimsTree.RootKey())
+	nonceCountAfter, err := issuer.NonceCount()
+	require.Nil(t, err)
+	assert.Equal(t, nonceCount, nonceCountAfter)
+}
+
+func TestIssuerUpdateClaim(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	valueBytes[0] = 0x01
+	claim, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	hi, hv, err := claim.Entry().HiHv()
+	require.Nil(t, err)
+
+	valueBytes[0] = 0x02
+	claimUpdate := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.UpdateClaim(hi, claimUpdate.Entry().Value()))
+
+	data, err := issuer.claimsTree.GetDataByIndex(hi)
+	require.Nil(t, err)
+	entry := &merkletree.Entry{Data: *data}
+	hiUpdate, hvUpdate, err := entry.HiHv()
+	require.Nil(t, err)
+	assert.Equal(t, hi, hiUpdate)
+	assert.NotEqual(t, hv, hvUpdate)
+	// The revocation nonce of the issued claim is kept.
+	assert.Equal(t, claim.Metadata().RevNonce, claims.GetRevocationNonce(entry))
+	assert.Equal(t, claimUpdate.Entry().Value()[1:], entry.Value()[1:])
+
+	// Claim not issued
+	indexBytes[0] = 0x43
+	hiNotFound, err := claims.NewClaimBasic(indexBytes, valueBytes).Entry().HIndex()
+	require.Nil(t, err)
+	err = issuer.UpdateClaim(hiNotFound, claimUpdate.Entry().Value())
+	assert.True(t, errors.Is(err, merkletree.ErrEntryIndexNotFound))
+
+	err = issuer.UpdateClaim(hi, claimUpdate.Entry().Value()[1:])
+	assert.NotNil(t, err)
+
+	issuerGenesis, _, _ := newIssuer(t, true, nil, nil)
+	assert.Equal(t, ErrIdenGenesisOnly, issuerGenesis.UpdateClaim(hi, claimUpdate.Entry().Value()))
+}
+
+func TestIssuerSign(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	for _, msg := range []string{"", "hello", strings.Repeat("long message ", 10)} {
+		sig, err := issuer.Sign(msg)
+		require.Nil(t, err)
+		ok, err := VerifySign(msg, sig, issuer.KeyOperational())
+		require.Nil(t, err)
+		assert.True(t, ok)
+
+		ok, err = VerifySign(msg+"x", sig, issuer.KeyOperational())
+		require.Nil(t, err)
+		assert.False(t, ok)
+
+		// The signature is not valid for the unprefixed message.
+		var sigComp babyjub.SignatureComp
+		require.Nil(t, common3.HexDecodeInto(sigComp[:], []byte(sig)))
+		ok, err = keystore.VerifySignatureRaw(issuer.KeyOperational(), &sigComp, []byte(msg))
+		require.Nil(t, err)
+		assert.False(t, ok)
+	}
+
+	_, err := VerifySign("hello", "0x1234", issuer.KeyOperational())
+	assert.NotNil(t, err)
+}
+
+func TestIssuerAuthorizeKey(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	kSignComp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kSignComp, pass))
+	msg := []byte("hello")
+	_, err = issuer.SignBinaryWith(kSignComp, SigPrefixSetState, msg)
+	assert.Equal(t, ErrKeyNotAuthorized, err)
+
+	require.Nil(t, issuer.AuthorizeKey(kSignComp))
+	keys, err := issuer.AuthorizedKeys()
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []*babyjub.PublicKeyComp{issuer.KeyOperational(), kSignComp}, keys)
+
+	sig, err := issuer.SignBinaryWith(kSignComp, SigPrefixSetState, msg)
+	require.Nil(t, err)
+	ok, err := keystore.VerifySignatureRaw(kSignComp, sig, append(SigPrefixSetState, msg...))
+	require.Nil(t, err)
+	assert.True(t, ok)
+	sig, err = issuer.SignBinaryWith(issuer.KeyOperational(), SigPrefixSetState, msg)
+	require.Nil(t, err)
+	sigKOp, err := issuer.SignBinary(SigPrefixSetState, msg)
+	require.Nil(t, err)
+	assert.Equal(t, sigKOp, sig)
+
+	require.Nil(t, issuer.RevokeKey(kSignComp))
+	_, err = issuer.SignBinaryWith(kSignComp, SigPrefixSetState, msg)
+	assert.Equal(t, ErrKeyNotAuthorized, err)
+	keys, err = issuer.AuthorizedKeys()
+	require.Nil(t, err)
+	assert.Equal(t, []*babyjub.PublicKeyComp{issuer.KeyOperational()}, keys)
+	err = issuer.RevokeKey(kSignComp)
+	assert.True(t, errors.Is(err, ErrClaimAlreadyRevoked))
+
+	kOtherComp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	assert.Equal(t, ErrKeyNotAuthorized, issuer.RevokeKey(kOtherComp))
+
+	// The genesis kOp can't be revoked
+	err = issuer.RevokeKey(issuer.KeyOperational())
+	assert.True(t, errors.Is(err, ErrRevokeKeyOperational))
+	kOp, err := issuer.KeyOperational().Decompress()
+	require.Nil(t, err)
+	err = issuer.RevokeClaim(claims.NewClaimKeyBabyJub(kOp, claims.BabyJubKeyTypeAuthorizeKSign))
+	assert.True(t, errors.Is(err, ErrRevokeKeyOperational))
+}
+
+func TestIssuerGenCredentialExistenceGenesis(t *testing.T) {
+	issuer, _, _ := newIssuer(t, true, nil, nil)
+
+	kOp, err := issuer.KeyOperational().Decompress()
+	require.Nil(t, err)
+	claimKOp := claims.NewClaimKeyBabyJub(kOp, claims.BabyJubKeyTypeAuthorizeKSign)
+	credExist, err := issuer.GenCredentialExistenceGenesis(claimKOp)
+	require.Nil(t, err)
+	require.Nil(t, proof.VerifyCredentialExistence(credExist))
+	assert.Equal(t, issuer.ID(), core.IdGenesisFromIdenState(credExist.IdenStateData.IdenState))
+	assert.Equal(t, "", credExist.IdenPubUrl)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err = issuer.GenCredentialExistenceGenesis(claims.NewClaimBasic(indexBytes, valueBytes))
+	assert.Equal(t, ErrClaimNotFoundClaimsTree, err)
+}
+
+func TestIssuerHasClaimClaimRevoked(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	ok, err := issuer.HasClaim(claim)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	_, err = issuer.ClaimRevoked(claim)
+	assert.Equal(t, ErrClaimNotFoundClaimsTree, err)
+
+	claimIssued, err := issuer.IssueClaim(claim)
+	require.Nil(t, err)
+	ok, err = issuer.HasClaim(claimIssued)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	// The issued claim has a different revocation nonce in the value.
+	ok, err = issuer.HasClaim(claim)
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	revoked, err := issuer.ClaimRevoked(claimIssued)
+	require.Nil(t, err)
+	assert.False(t, revoked)
+	require.Nil(t, issuer.RevokeClaim(claimIssued))
+	revoked, err = issuer.ClaimRevoked(claimIssued)
+	require.Nil(t, err)
+	assert.True(t, revoked)
+}
+
+func TestIssuerRevokeClaimByNonce(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	require.Nil(t, issuer.RevokeClaimByNonce(claim.Metadata().RevNonce))
+	revoked, err := issuer.ClaimRevoked(claim)
+	require.Nil(t, err)
+	assert.True(t, revoked)
+
+	err = issuer.RevokeClaimByNonce(claim.Metadata().RevNonce)
+	assert.True(t, errors.Is(err, ErrClaimAlreadyRevoked))
+	err = issuer.RevokeClaim(claim)
+	assert.True(t, errors.Is(err, ErrClaimAlreadyRevoked))
+}
+
+func TestIssuerCredentialNotRevoked(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	cred, _, err := issuer.GenCredentialOffChain(claim0)
+	require.Nil(t, err)
+	require.NotNil(t, cred.MtpNotRevoked)
+	assert.False(t, cred.MtpNotRevoked.Existence)
+	assert.Nil(t, proof.VerifyCredentialExistence(cred))
+
+	// The proof must be for the credential revocations tree.
+	mtpNotRevoked := cred.MtpNotRevoked
+	cred.MtpNotRevoked = cred.MtpClaim
+	assert.Equal(t, proof.ErrCalculatedRevTreeRootDoesntMatch, proof.VerifyCredentialExistence(cred))
+	cred.MtpNotRevoked = mtpNotRevoked
+
+	require.Nil(t, issuer.RevokeClaim(claim0))
+	credRevoked, _, err := issuer.GenCredentialOffChain(claim0)
+	require.Nil(t, err)
+	assert.True(t, credRevoked.MtpNotRevoked.Existence)
+	assert.Equal(t, proof.ErrClaimRevoked, proof.VerifyCredentialExistence(credRevoked))
+	// The credential of the previous state is still valid.
+	assert.Nil(t, proof.VerifyCredentialExistence(cred))
+}
+
+func TestIssuerPublishStateCtxCancel(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, issuer.PublishStateCtx(ctx))
+	idenStatePending, _ := issuer.idenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePending)
+	assert.Nil(t, issuer.ethTxInitState())
+}
+
+func TestIssuerPrepareState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	// Nothing to prepare
+	prepared, err := issuer.PrepareState()
+	require.Nil(t, err)
+	assert.Nil(t, prepared)
+
+	// A prepared state that is not pending is not submitted
+	idenState, _ := issuer.State()
+	err = issuer.SubmitPreparedState(&PreparedState{IdenStateOld: idenState, IdenState: idenState})
+	assert.Equal(t, ErrPreparedStateOutdated, err)
+	assert.Nil(t, issuer.ethTxInitState())
+
+	issuerGenesis, _, _ := newIssuer(t, true, nil, nil)
+	_, err = issuerGenesis.PrepareState()
+	assert.Equal(t, ErrIdenGenesisOnly, err)
+}
+
+// idenPubOnChainConfirm is an IdenPubOnChainer where every transaction has
+// confirmBlocks confirmations and the identity state is idenState.
+type idenPubOnChainConfirm struct {
+	idenpubonchain.IdenPubOnChainer
+	confirmBlocks int64
+	idenState     *merkletree.Hash
+	// err is returned by TxConfirmBlocks if it's not nil.
+	err error
+}
+
+func (ip *idenPubOnChainConfirm) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
+	if ip.err != nil {
+		return nil, ip.err
+	}
+	return big.NewInt(ip.confirmBlocks), nil
+}
+
+func (ip *idenPubOnChainConfirm) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	return &proof.IdenStateData{IdenState: ip.idenState}, nil
+}
+
+func (ip *idenPubOnChainConfirm) InitState(id *core.ID, genesisState, newState *merkletree.Hash,
+	zkProof *zktypes.Proof) (*types.Transaction, error) {
+	return types.NewTransaction(0, common.Address{}, nil, 0, nil, nil), nil
+}
+
+func TestIssuerSyncIdenStatePublicConfirm(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	idenState := merkletree.NewHashFromBigInt(big.NewInt(1))
+	issuer.idenPubOnChain = &idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain,
+		confirmBlocks: 2, idenState: idenState}
+
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenState, true)
+	require.Nil(t, issuer.setEthTxInitState(tx, types.NewTransaction(0, common.Address{}, nil, 0, nil, nil)))
+	require.Nil(t, tx.Commit())
+
+	require.Equal(t, uint64(3), issuer.cfg.ConfirmBlocks)
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	idenStatePending, _ := issuer.IdenStatePending()
+	assert.Equal(t, idenState, idenStatePending)
+	require.Nil(t, issuer.SyncIdenStatePublicConfirm(3))
+	idenStatePending, _ = issuer.IdenStatePending()
+	assert.Equal(t, idenState, idenStatePending)
+
+	require.Nil(t, issuer.SyncIdenStatePublicConfirm(2))
+	idenStatePending, _ = issuer.IdenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePending)
+	assert.Equal(t, idenState, issuer.IdenStateOnChain())
+}
+
+func TestIssuerAbortPendingState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	ipConfirm := &idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain,
+		err: eth.ErrReceiptNotReceived}
+	issuer.idenPubOnChain = ipConfirm
+	assert.Equal(t, ErrIdenStatePendingTxNotSent, issuer.AbortPendingState())
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	historyLen, err := issuer.StateHistoryLen()
+	require.Nil(t, err)
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	_, idenStateTreeRootsLast, err := issuer.getIdenStateByIdx(tx, -1)
+	require.Nil(t, err)
+	tx.Close()
+	idenState, _, err := issuer.appendIdenStatePending(idenStateTreeRootsLast)
+	require.Nil(t, err)
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenState, true)
+	require.Nil(t, issuer.setEthTxInitState(tx, types.NewTransaction(0, common.Address{}, nil, 0, nil, nil)))
+	require.Nil(t, tx.Commit())
+
+	// The transaction is unconfirmed or has succeeded
+	assert.Equal(t, ErrIdenStatePendingTxNotFailed, issuer.AbortPendingState())
+	ipConfirm.err = nil
+	assert.Equal(t, ErrIdenStatePendingTxNotFailed, issuer.AbortPendingState())
+
+	ipConfirm.err = eth.ErrReceiptStatusFailed
+	require.Nil(t, issuer.AbortPendingState())
+	idenStatePending, _ := issuer.IdenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePending)
+	historyLenAbort, err := issuer.StateHistoryLen()
+	require.Nil(t, err)
+	assert.Equal(t, historyLen, historyLenAbort)
+
+	// The state can be published again
+	idenStateAgain, _, err := issuer.appendIdenStatePending(idenStateTreeRootsLast)
+	require.Nil(t, err)
+	assert.Equal(t, idenState, idenStateAgain)
+}
+
+// idenPubOnChainResend is an idenPubOnChainConfirm that can resend
+// transactions.
+type idenPubOnChainResend struct {
+	idenPubOnChainConfirm
+}
+
+func (ip *idenPubOnChainResend) ResendTx(tx *types.Transaction, gasPrice *big.Int) (*types.Transaction, error) {
+	return types.NewTransaction(tx.Nonce(), *tx.To(), tx.Value(), tx.Gas(), gasPrice, tx.Data()), nil
+}
+
+func TestIssuerResubmitPendingState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	issuer.idenPubOnChain = &idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain}
+	gasPrice := big.NewInt(20)
+	assert.Equal(t, ErrIdenStatePendingTxNotSent, issuer.ResubmitPendingState(gasPrice))
+
+	ethTx := types.NewTransaction(7, common.Address{}, nil, 1000, big.NewInt(10), []byte{0x42})
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, merkletree.NewHashFromBigInt(big.NewInt(1)), true)
+	require.Nil(t, issuer.setEthTxInitState(tx, ethTx))
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, ErrTxResendNotSupported, issuer.ResubmitPendingState(gasPrice))
+
+	issuer.idenPubOnChain = &idenPubOnChainResend{idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain}}
+	require.Nil(t, issuer.ResubmitPendingState(gasPrice))
+	ethTxResent := issuer.ethTxInitState()
+	assert.Equal(t, ethTx.Nonce(), ethTxResent.Nonce())
+	assert.Equal(t, ethTx.Data(), ethTxResent.Data())
+	assert.Equal(t, gasPrice, ethTxResent.GasPrice())
+	require.Equal(t, 1, len(issuer.ethTxsReplaced()))
+	assert.Equal(t, ethTx.Hash(), issuer.ethTxsReplaced()[0].Hash())
+}
+
+// idenPubOnChainResendHook is an idenPubOnChainResend that calls hook while
+// resending a transaction.
+type idenPubOnChainResendHook struct {
+	idenPubOnChainResend
+	hook func()
+}
+
+func (ip *idenPubOnChainResendHook) ResendTx(tx *types.Transaction, gasPrice *big.Int) (*types.Transaction, error) {
+	ip.hook()
+	return ip.idenPubOnChainResend.ResendTx(tx, gasPrice)
+}
+
+func TestIssuerResubmitPendingStateUnlocked(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	ethTx := types.NewTransaction(7, common.Address{}, nil, 1000, big.NewInt(10), []byte{0x42})
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, merkletree.NewHashFromBigInt(big.NewInt(1)), true)
+	require.Nil(t, issuer.setEthTxInitState(tx, ethTx))
+	require.Nil(t, tx.Commit())
+
+	// The Issuer can be read while the ethereum node is called.
+	ip := &idenPubOnChainResendHook{idenPubOnChainResend: idenPubOnChainResend{
+		idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain}}}
+	ip.hook = func() { issuer.State() }
+	issuer.idenPubOnChain = ip
+	require.Nil(t, issuer.ResubmitPendingState(big.NewInt(20)))
+
+	// The pending state is confirmed during the call to the ethereum node.
+	ip.hook = func() {
+		issuer.rw.Lock()
+		defer issuer.rw.Unlock()
+		tx, err := issuer.storage.NewTx()
+		require.Nil(t, err)
+		issuer.setIdenStatePending(tx, &merkletree.HashZero, false)
+		require.Nil(t, tx.Commit())
+	}
+	assert.Equal(t, ErrIdenStatePendingChanged, issuer.ResubmitPendingState(big.NewInt(30)))
+	assert.Equal(t, big.NewInt(20), issuer.ethTxInitState().GasPrice())
+}
+
+// idenPubOnChainMined is an idenPubOnChainConfirm where only the transaction
+// with hash mined has a receipt.
+type idenPubOnChainMined struct {
+	idenPubOnChainResend
+	mined common.Hash
+}
+
+func (ip *idenPubOnChainMined) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
+	if tx.Hash() != ip.mined {
+		return nil, eth.ErrReceiptNotReceived
+	}
+	return big.NewInt(ip.confirmBlocks), nil
+}
+
+func TestIssuerResubmitPendingStateReplacedMined(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	idenStatePending := merkletree.NewHashFromBigInt(big.NewInt(1))
+	ethTx := types.NewTransaction(7, common.Address{}, nil, 1000, big.NewInt(10), []byte{0x42})
+	ip := &idenPubOnChainMined{idenPubOnChainResend: idenPubOnChainResend{idenPubOnChainConfirm{
+		IdenPubOnChainer: idenPubOnChain, confirmBlocks: 100, idenState: idenStatePending}},
+		mined: ethTx.Hash()}
+	issuer.idenPubOnChain = ip
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenStatePending, true)
+	require.Nil(t, issuer.setEthTxInitState(tx, ethTx))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, issuer.ResubmitPendingState(big.NewInt(20)))
+
+	// The original transaction is mined instead of the replacement.
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	idenStatePendingAfter, _ := issuer.IdenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePendingAfter)
+	assert.Equal(t, idenStatePending, issuer.IdenStateOnChain())
+}
+
+// idenPubOnChainOpts is an idenPubOnChainConfirm that accepts transaction
+// options and keeps the last ones.
+type idenPubOnChainOpts struct {
+	idenPubOnChainConfirm
+	opts *eth.TxOpts
+}
+
+func (ip *idenPubOnChainOpts) InitStateOpts(id *core.ID, genesisState, newState *merkletree.Hash,
+	zkProof *zktypes.Proof, opts *eth.TxOpts) (*types.Transaction, error) {
+	ip.opts = opts
+	return types.NewTransaction(0, common.Address{}, nil, opts.GasLimit, opts.GasPrice, nil), nil
+}
+
+func (ip *idenPubOnChainOpts) SetStateOpts(id *core.ID, newState *merkletree.Hash,
+	zkProof *zktypes.Proof, opts *eth.TxOpts) (*types.Transaction, error) {
+	ip.opts = opts
+	return types.NewTransaction(1, common.Address{}, nil, opts.GasLimit, opts.GasPrice, nil), nil
+}
+
+// idenPubOnChainEstimate is an IdenPubOnChainer that records the arguments of
+// EstimateGas.
+type idenPubOnChainEstimate struct {
+	idenpubonchain.IdenPubOnChainer
+	genesisState *merkletree.Hash
+	newState     *merkletree.Hash
+}
+
+func (ip *idenPubOnChainEstimate) EstimateGas(id *core.ID, genesisState *merkletree.Hash,
+	newState *merkletree.Hash, proof *zktypes.Proof) (uint64, error) {
+	ip.genesisState, ip.newState = genesisState, newState
+	return 1234, nil
+}
+
+func TestIssuerEstimateStateGas(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	ip := &idenPubOnChainEstimate{IdenPubOnChainer: idenPubOnChain}
+	issuer.idenPubOnChain = ip
+
+	// Nothing to publish
+	gas, err := issuer.EstimateStateGas()
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), gas)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	idenStateGenesis, rootsGenesis, err := issuer.getIdenStateByIdx(tx, -1)
+	require.Nil(t, err)
+	tx.Close()
+	historyLen, err := issuer.StateHistoryLen()
+	require.Nil(t, err)
+
+	// The proof of the same transition is reused, and the new identity
+	// state is not set pending.
+	idenState, _, err := issuer.previewIdenStatePending(rootsGenesis)
+	require.Nil(t, err)
+	issuer.zkProofLast = &PreparedState{IdenStateOld: idenStateGenesis, IdenState: idenState,
+		ZkProofOut: &zkutils.ZkProofOut{}}
+	gas, err = issuer.EstimateStateGas()
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1234), gas)
+	assert.Equal(t, idenStateGenesis, ip.genesisState)
+	assert.Equal(t, idenState, ip.newState)
+	idenStatePending, _ := issuer.IdenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePending)
+	historyLenEstimate, err := issuer.StateHistoryLen()
+	require.Nil(t, err)
+	assert.Equal(t, historyLen, historyLenEstimate)
+
+	// The pending identity state is the one estimated.
+	idenStateAppended, _, err := issuer.appendIdenStatePending(rootsGenesis)
+	require.Nil(t, err)
+	assert.Equal(t, idenState, idenStateAppended)
+	gas, err = issuer.EstimateStateGas()
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1234), gas)
+	assert.Equal(t, idenState, ip.newState)
+
+	issuerGenesis, _, _ := newIssuer(t, true, nil, nil)
+	_, err = issuerGenesis.EstimateStateGas()
+	assert.Equal(t, ErrIdenGenesisOnly, err)
+}
+
+func TestIssuerIssueClaimAndPublish(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	// Without zk files, the publication fails after the claim is issued.
+	issuer.idenStateZkProofConf = &IdenStateZkProofConf{Levels: idenStateZkProofConf.Levels}
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0, err := issuer.IssueClaimAndPublish(claims.NewClaimBasic(indexBytes, valueBytes))
+	assert.NotNil(t, err)
+	require.NotNil(t, claim0)
+	hi, err := claim0.Entry().HIndex()
+	require.Nil(t, err)
+	_, err = issuer.claimsTree.GetDataByIndex(hi)
+	assert.Nil(t, err)
+	idenStatePending, transacted := issuer.IdenStatePending()
+	idenState, _ := issuer.State()
+	assert.Equal(t, idenState, idenStatePending)
+	assert.False(t, transacted)
+
+	// The pending identity state doesn't contain a new claim, so it's not
+	// issued.
+	indexBytes[0] = 0x43
+	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err = issuer.IssueClaimAndPublish(claim1)
+	assert.Equal(t, ErrIdenStatePendingNotNil, err)
+	hi, err = claim1.Entry().HIndex()
+	require.Nil(t, err)
+	_, err = issuer.claimsTree.GetDataByIndex(hi)
+	assert.Equal(t, merkletree.ErrEntryIndexNotFound, err)
+}
+
+func TestIssuerSubmitPreparedStateOpts(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	issuer.idenPubOnChain = &idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain}
+	idenStateOld, roots := issuer.State()
+	idenState := merkletree.NewHashFromBigInt(big.NewInt(1))
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenState, false)
+	require.Nil(t, tx.Commit())
+	zkProof := zktypes.Proof{A: new(bn256.G1).ScalarBaseMult(big.NewInt(1)),
+		B: new(bn256.G2).ScalarBaseMult(big.NewInt(2)), C: new(bn256.G1).ScalarBaseMult(big.NewInt(3))}
+	prepared := &PreparedState{IdenStateOld: idenStateOld, IdenState: idenState,
+		IdenStateTreeRoots: roots, ZkProofOut: &zkutils.ZkProofOut{Proof: zkProof}}
+	opts := &eth.TxOpts{GasLimit: 500000, GasPrice: big.NewInt(20)}
+
+	assert.Equal(t, ErrTxOptsNotSupported, issuer.SubmitPreparedStateOpts(prepared, opts))
+	idenStatePending, transacted := issuer.IdenStatePending()
+	assert.Equal(t, idenState, idenStatePending)
+	assert.False(t, transacted)
+
+	// A PreparedState can be submitted after a JSON round trip.
+	preparedJSON, err := json.Marshal(prepared)
+	require.Nil(t, err)
+	var preparedUnmarshaled PreparedState
+	require.Nil(t, json.Unmarshal(preparedJSON, &preparedUnmarshaled))
+	assert.Equal(t, prepared.IdenState, preparedUnmarshaled.IdenState)
+	assert.Equal(t, prepared.IdenStateTreeRoots, preparedUnmarshaled.IdenStateTreeRoots)
+	assert.Equal(t, prepared.ZkProofOut.Proof.A.String(), preparedUnmarshaled.ZkProofOut.Proof.A.String())
+
+	ip := &idenPubOnChainOpts{idenPubOnChainConfirm: idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain}}
+	issuer.idenPubOnChain = ip
+	require.Nil(t, issuer.SubmitPreparedStateOpts(&preparedUnmarshaled, opts))
+	assert.Equal(t, opts, ip.opts)
+	assert.Equal(t, opts.GasLimit, issuer.ethTxInitState().Gas())
+	assert.Equal(t, opts.GasPrice, issuer.ethTxInitState().GasPrice())
+	_, transacted = issuer.IdenStatePending()
+	assert.True(t, transacted)
+}
+
+func TestIssuerStateCallbacks(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	idenStateOld, _ := issuer.State()
+	idenState := merkletree.NewHashFromBigInt(big.NewInt(1))
+	issuer.idenPubOnChain = &idenPubOnChainConfirm{IdenPubOnChainer: idenPubOnChain,
+		confirmBlocks: 3, idenState: idenState}
+
+	// The callbacks can use the Issuer
+	var pending, confirmedOld, confirmedNew *merkletree.Hash
+	issuer.SetStateCallbacks(func(new *merkletree.Hash) {
+		pending = new
+		_, _ = issuer.State()
+	}, func(old, new *merkletree.Hash) {
+		confirmedOld, confirmedNew = old, new
+		_, _ = issuer.State()
+	})
+
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, idenState, false)
+	require.Nil(t, tx.Commit())
+	_, roots := issuer.State()
+	require.Nil(t, issuer.SubmitPreparedState(&PreparedState{IdenStateOld: idenStateOld,
+		IdenState: idenState, IdenStateTreeRoots: roots, ZkProofOut: &zkutils.ZkProofOut{}}))
+	assert.Equal(t, idenState, pending)
+	assert.Nil(t, confirmedNew)
+
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, &merkletree.HashZero, confirmedOld)
+	assert.Equal(t, idenState, confirmedNew)
+
+	// No new confirmation
+	confirmedNew = nil
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Nil(t, confirmedNew)
+}
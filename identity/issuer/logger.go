@@ -0,0 +1,61 @@
+package issuer
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are the key values attached to a log message.
+type Fields map[string]interface{}
+
+// Logger is used by the Issuer to log messages with fields.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+// logrusLogger is a Logger that logs to a logrus logger.
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+// NewLogrusLogger returns a Logger that logs to logger.
+func NewLogrusLogger(logger logrus.FieldLogger) Logger {
+	return &logrusLogger{logger: logger}
+}
+
+func (l *logrusLogger) Debug(msg string, fields Fields) {
+	l.logger.WithFields(logrus.Fields(fields)).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, fields Fields) {
+	l.logger.WithFields(logrus.Fields(fields)).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, fields Fields) {
+	l.logger.WithFields(logrus.Fields(fields)).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, fields Fields) {
+	l.logger.WithFields(logrus.Fields(fields)).Error(msg)
+}
+
+// logDefault is the Logger used when Config.Logger is nil.
+var logDefault = NewLogrusLogger(logrus.StandardLogger())
+
+// log returns the Logger of the Issuer Config, or logDefault if it's not set.
+func (is *Issuer) log() Logger {
+	if is.cfg.Logger != nil {
+		return is.cfg.Logger
+	}
+	return logDefault
+}
+
+// SetLogger sets the Logger of the Issuer Config.  A nil logger restores
+// the default one, which logs to the logrus standard logger.
+func (is *Issuer) SetLogger(logger Logger) {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	is.cfg.Logger = logger
+}
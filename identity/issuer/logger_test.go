@@ -0,0 +1,43 @@
+package issuer
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	logrusLogger, hook := test.NewNullLogger()
+	logrusLogger.SetLevel(logrus.DebugLevel)
+	logger := NewLogrusLogger(logrusLogger)
+
+	logger.Debug("debug", Fields{"a": 1})
+	logger.Info("info", nil)
+	logger.Warn("warn", nil)
+	logger.Error("error", Fields{"b": "x"})
+	require.Equal(t, 4, len(hook.AllEntries()))
+	entry := hook.AllEntries()[0]
+	assert.Equal(t, logrus.DebugLevel, entry.Level)
+	assert.Equal(t, "debug", entry.Message)
+	assert.Equal(t, 1, entry.Data["a"])
+	entry = hook.LastEntry()
+	assert.Equal(t, logrus.ErrorLevel, entry.Level)
+	assert.Equal(t, "x", entry.Data["b"])
+}
+
+func TestIssuerSetLogger(t *testing.T) {
+	issuer, _, _ := newIssuer(t, true, nil, nil)
+	assert.Equal(t, logDefault, issuer.log())
+
+	logrusLogger, hook := test.NewNullLogger()
+	logger := NewLogrusLogger(logrusLogger)
+	issuer.SetLogger(logger)
+	issuer.log().Info("info", nil)
+	assert.Equal(t, 1, len(hook.AllEntries()))
+
+	issuer.SetLogger(nil)
+	assert.Equal(t, logDefault, issuer.log())
+}
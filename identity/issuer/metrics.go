@@ -0,0 +1,40 @@
+package issuer
+
+import (
+	"time"
+)
+
+// Metrics receives measurements of the Issuer operations, so that they can
+// be exported to a monitoring system.
+type Metrics interface {
+	// ObserveWitnessCalcDuration is called with the time taken to
+	// calculate the witness of an identity state update zk proof.
+	ObserveWitnessCalcDuration(d time.Duration)
+	// ObserveProofGenDuration is called with the time taken to generate
+	// and verify an identity state update zk proof.
+	ObserveProofGenDuration(d time.Duration)
+}
+
+// metricsNop is a Metrics that discards the measurements.
+type metricsNop struct{}
+
+func (metricsNop) ObserveWitnessCalcDuration(d time.Duration) {}
+
+func (metricsNop) ObserveProofGenDuration(d time.Duration) {}
+
+// metrics returns the Metrics of the Issuer Config, or a Metrics that
+// discards the measurements if it's not set.
+func (is *Issuer) metrics() Metrics {
+	if is.cfg.Metrics != nil {
+		return is.cfg.Metrics
+	}
+	return metricsNop{}
+}
+
+// SetMetrics sets the Metrics of the Issuer Config.  A nil metrics discards
+// the measurements.
+func (is *Issuer) SetMetrics(metrics Metrics) {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	is.cfg.Metrics = metrics
+}
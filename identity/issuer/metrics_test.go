@@ -0,0 +1,34 @@
+package issuer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type metricsTest struct {
+	witnessCalc []time.Duration
+	proofGen    []time.Duration
+}
+
+func (m *metricsTest) ObserveWitnessCalcDuration(d time.Duration) {
+	m.witnessCalc = append(m.witnessCalc, d)
+}
+
+func (m *metricsTest) ObserveProofGenDuration(d time.Duration) {
+	m.proofGen = append(m.proofGen, d)
+}
+
+func TestIssuerSetMetrics(t *testing.T) {
+	issuer, _, _ := newIssuer(t, true, nil, nil)
+	assert.Equal(t, metricsNop{}, issuer.metrics())
+
+	metrics := &metricsTest{}
+	issuer.SetMetrics(metrics)
+	issuer.metrics().ObserveProofGenDuration(time.Second)
+	assert.Equal(t, []time.Duration{time.Second}, metrics.proofGen)
+
+	issuer.SetMetrics(nil)
+	assert.Equal(t, metricsNop{}, issuer.metrics())
+}
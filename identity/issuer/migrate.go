@@ -0,0 +1,77 @@
+package issuer
+
+import (
+	"fmt"
+
+	common3 "github.com/iden3/go-iden3-core/common"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// MigrateLegacyDump imports a dump generated by the RawDump of the old
+// components/idenadminutils into storage.  The legacy dump is a map of hex
+// encoded keys and values of the storage of a single merkle tree without
+// prefix, which corresponds to the current claims tree, so the entries are
+// imported under dbPrefixClaimsTree.  Before the import the claims tree is
+// rebuilt from its leafs to validate that its root is consistent with the
+// dumped nodes, so a rejected dump doesn't modify storage.  The storage must
+// not contain a claims tree already.
+func MigrateLegacyDump(legacy map[string]string, storage db.Storage) error {
+	cltStorage := storage.WithPrefix(dbPrefixClaimsTree)
+	if kvs, err := cltStorage.List(1); err != nil {
+		return err
+	} else if len(kvs) != 0 {
+		return fmt.Errorf("storage already contains a claims tree")
+	}
+
+	scratch := db.NewMemoryStorage()
+	tx, err := scratch.NewTx()
+	if err != nil {
+		return err
+	}
+	for k, v := range legacy {
+		kBytes, err := common3.HexDecode(k)
+		if err != nil {
+			tx.Close()
+			return fmt.Errorf("invalid legacy key %v: %w", k, err)
+		}
+		vBytes, err := common3.HexDecode(v)
+		if err != nil {
+			tx.Close()
+			return fmt.Errorf("invalid legacy value for key %v: %w", k, err)
+		}
+		tx.Put(kBytes, vBytes)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	clt, err := merkletree.NewMerkleTree(scratch, ConfigDefault.MaxLevelsClaimsTree)
+	if err != nil {
+		return err
+	}
+	if clt.RootKey().Equals(&merkletree.HashZero) {
+		return fmt.Errorf("legacy dump doesn't contain a merkle tree root")
+	}
+	cltCheck, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), ConfigDefault.MaxLevelsClaimsTree)
+	if err != nil {
+		return err
+	}
+	var errWalk error
+	if err := clt.Walk(nil, func(n *merkletree.Node) {
+		if n.Type != merkletree.NodeTypeLeaf || errWalk != nil {
+			return
+		}
+		errWalk = cltCheck.AddEntry(n.Entry)
+	}); err != nil {
+		return fmt.Errorf("imported claims tree is incomplete: %w", err)
+	}
+	if errWalk != nil {
+		return errWalk
+	}
+	if !clt.RootKey().Equals(cltCheck.RootKey()) {
+		return fmt.Errorf("imported claims tree root (%v) doesn't match the one "+
+			"calculated from its leafs (%v)", clt.RootKey(), cltCheck.RootKey())
+	}
+	return copyStorage(cltStorage, scratch)
+}
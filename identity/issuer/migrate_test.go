@@ -0,0 +1,60 @@
+package issuer
+
+import (
+	"testing"
+
+	common3 "github.com/iden3/go-iden3-core/common"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateLegacyDump(t *testing.T) {
+	// Build a legacy dump from a merkle tree without prefix
+	legacyStorage := db.NewMemoryStorage()
+	legacyMT, err := merkletree.NewMerkleTree(legacyStorage, 140)
+	require.Nil(t, err)
+	var claim0 *claims.ClaimBasic
+	for i := 0; i < 8; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		claim := claims.NewClaimBasic(indexBytes, valueBytes)
+		require.Nil(t, legacyMT.AddClaim(claim))
+		if i == 0 {
+			claim0 = claim
+		}
+	}
+	legacy := make(map[string]string)
+	err = legacyStorage.Iterate(func(k, v []byte) (bool, error) {
+		legacy[common3.HexEncode(k)] = common3.HexEncode(v)
+		return true, nil
+	})
+	require.Nil(t, err)
+
+	storage := db.NewMemoryStorage()
+	require.Nil(t, MigrateLegacyDump(legacy, storage))
+	clt, err := merkletree.NewMerkleTree(storage.WithPrefix(dbPrefixClaimsTree), 140)
+	require.Nil(t, err)
+	assert.Equal(t, legacyMT.RootKey(), clt.RootKey())
+
+	// A second migration into the same storage is rejected
+	assert.NotNil(t, MigrateLegacyDump(legacy, storage))
+
+	// A dump with a modified leaf is rejected
+	hi, hv, err := claim0.Entry().HiHv()
+	require.Nil(t, err)
+	leafKey, err := merkletree.LeafKey(hi, hv)
+	require.Nil(t, err)
+	leafValue, err := common3.HexDecode(legacy[common3.HexEncode(leafKey[:])])
+	require.Nil(t, err)
+	leafValue[1+2*merkletree.ElemBytesLen] ^= 0x01
+	legacy[common3.HexEncode(leafKey[:])] = common3.HexEncode(leafValue)
+	storage = db.NewMemoryStorage()
+	assert.NotNil(t, MigrateLegacyDump(legacy, storage))
+	// The rejected dump leaves the storage empty.
+	kvs, err := storage.List(1)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(kvs))
+}
@@ -14,6 +14,9 @@ import (
 // 	Set(v uint32) error
 // }
 
+// MaxNonce is the number of unique nonces that a UniqueNonceGen can generate.
+const MaxNonce = 0xffffffff
+
 // UniqueNonceGen is a generator of unique nonces with persistent state.
 type UniqueNonceGen struct {
 	index *db.StorageValue
@@ -33,7 +36,16 @@ func (u *UniqueNonceGen) Init(tx db.Tx) {
 	u.index.Set(tx, 0)
 }
 
-// Next returns a new unique nonce.
+// InitNext initializes the unique nonce generator so that next is the first
+// nonce generated.
+func (u *UniqueNonceGen) InitNext(tx db.Tx, next uint32) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.index.Set(tx, next)
+}
+
+// Next returns a new unique nonce.  The nonce is only consumed once tx is
+// committed.
 func (u *UniqueNonceGen) Next(tx db.Tx) (uint32, error) {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
@@ -41,9 +53,16 @@ func (u *UniqueNonceGen) Next(tx db.Tx) (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
-	if i == 0xffffffff {
+	if i == MaxNonce {
 		return 0, fmt.Errorf("Reached maximum nonce value")
 	}
 	u.index.Set(tx, i+1)
 	return i, nil
 }
+
+// Peek returns the next nonce that will be generated without consuming it.
+func (u *UniqueNonceGen) Peek(tx db.Tx) (uint32, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.index.Get(tx)
+}
@@ -3,6 +3,7 @@ package issuer
 import (
 	"testing"
 
+	"github.com/iden3/go-iden3-core/core/claims"
 	"github.com/iden3/go-iden3-core/db"
 	"github.com/stretchr/testify/require"
 )
@@ -24,6 +25,34 @@ func TestUniqueNonceGen(t *testing.T) {
 	n2, err := nonceGen.Next(tx)
 	require.Nil(t, err)
 	require.Equal(t, uint32(2), n2)
+	n3, err := nonceGen.Peek(tx)
+	require.Nil(t, err)
+	require.Equal(t, uint32(3), n3)
+	n3, err = nonceGen.Next(tx)
+	require.Nil(t, err)
+	require.Equal(t, uint32(3), n3)
 	err = tx.Commit()
 	require.Nil(t, err)
+
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	nonceGen.index.Set(tx, MaxNonce)
+	_, err = nonceGen.Next(tx)
+	require.NotNil(t, err)
+	tx.Close()
+}
+
+func TestIssuerNonceCount(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	// The genesis kOp claim uses the first nonce.
+	n, err := issuer.NonceCount()
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), n)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	n, err = issuer.NonceCount()
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), n)
 }
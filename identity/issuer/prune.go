@@ -0,0 +1,160 @@
+package issuer
+
+import (
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// idenStatePrunedIdx is the index of the first identity state of the list
+// whose merkle trees have not been pruned by PruneHistory.
+var idenStatePrunedIdx = db.NewStorageValue([]byte("idenstateprunedidx"))
+
+// reachableNodes adds to keys the keys of the nodes of mt reachable from
+// rootKey.  The subtrees of the keys already in keys are skipped, so that the
+// nodes shared by multiple roots are only walked once.
+func reachableNodes(mt *merkletree.MerkleTree, rootKey *merkletree.Hash,
+	keys map[merkletree.Hash]bool) error {
+	if rootKey.Equals(&merkletree.HashZero) || keys[*rootKey] {
+		return nil
+	}
+	n, err := mt.GetNode(rootKey)
+	if err != nil {
+		return err
+	}
+	keys[*rootKey] = true
+	if n.Type == merkletree.NodeTypeMiddle {
+		if err := reachableNodes(mt, n.ChildL, keys); err != nil {
+			return err
+		}
+		return reachableNodes(mt, n.ChildR, keys)
+	}
+	return nil
+}
+
+// pruneTree deletes in tx the nodes of mt that are not reachable from any
+// of rootKeys and returns the keys of the deleted nodes.
+func pruneTree(tx db.Tx, mt *merkletree.MerkleTree, rootKeys []*merkletree.Hash) ([]merkletree.Hash, error) {
+	keys := make(map[merkletree.Hash]bool)
+	for _, rootKey := range rootKeys {
+		if err := reachableNodes(mt, rootKey, keys); err != nil {
+			return nil, err
+		}
+	}
+	var deleted []merkletree.Hash
+	if err := mt.Storage().Iterate(func(k, v []byte) (bool, error) {
+		// Skip the keys that are not nodes, like the current root.
+		if len(k) != merkletree.ElemBytesLen {
+			return true, nil
+		}
+		var key merkletree.Hash
+		copy(key[:], k)
+		if !keys[key] {
+			tx.Delete(k)
+			deleted = append(deleted, key)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// PruneHistory deletes the nodes of the merkle trees that are only reachable
+// from the roots of old identity states, and returns the number of deleted
+// nodes.  The trees of the last keepStates identity states, of the current
+// identity state, of the pending identity state, and of the identity state on
+// chain (or the genesis one if nothing has been published yet) are kept.
+// The identity state list is not modified, but the credentials and proofs of
+// the pruned identity states can't be generated anymore, and
+// VerifyStateHistory skips them.
+func (is *Issuer) PruneHistory(keepStates uint32) (int, error) {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	length, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return 0, err
+	}
+	prunedIdx := uint32(0)
+	if length > keepStates {
+		prunedIdx = length - keepStates
+	}
+	_, current := is.state()
+	roots := []IdenStateTreeRoots{current}
+	for idx := prunedIdx; idx < length; idx++ {
+		_, idenStateTreeRoots, err := is.getIdenStateByIdx(tx, int64(idx))
+		if err != nil {
+			return 0, err
+		}
+		roots = append(roots, *idenStateTreeRoots)
+	}
+	if idenStatePending, _ := is.idenStatePending(); !idenStatePending.Equals(&merkletree.HashZero) {
+		pending, err := is.getIdenStateTreeRoots(tx, idenStatePending)
+		if err != nil {
+			return 0, err
+		}
+		roots = append(roots, *pending)
+	}
+	if idenStateOnChain := is.idenStateOnChain(); idenStateOnChain.Equals(&merkletree.HashZero) {
+		_, genesis, err := is.genesisIdenState()
+		if err != nil {
+			return 0, err
+		}
+		roots = append(roots, *genesis)
+	} else {
+		onChain, err := is.getIdenStateTreeRoots(tx, idenStateOnChain)
+		if err != nil {
+			return 0, err
+		}
+		roots = append(roots, *onChain)
+	}
+
+	var claimsTreeRoots, revocationsTreeRoots, rootsTreeRoots []*merkletree.Hash
+	for _, r := range roots {
+		claimsTreeRoots = append(claimsTreeRoots, r.ClaimsTreeRoot)
+		revocationsTreeRoots = append(revocationsTreeRoots, r.RevocationsTreeRoot)
+		rootsTreeRoots = append(rootsTreeRoots, r.RootsTreeRoot)
+	}
+	trees := []struct {
+		mt       *merkletree.MerkleTree
+		rootKeys []*merkletree.Hash
+		deleted  []merkletree.Hash
+	}{
+		{mt: is.claimsTree, rootKeys: claimsTreeRoots},
+		{mt: is.revocationsTree, rootKeys: revocationsTreeRoots},
+		{mt: is.rootsTree, rootKeys: rootsTreeRoots},
+	}
+	n := 0
+	for i := range trees {
+		t := &trees[i]
+		txTree, err := t.mt.Storage().NewTx()
+		if err != nil {
+			return 0, err
+		}
+		if t.deleted, err = pruneTree(txTree, t.mt, t.rootKeys); err != nil {
+			txTree.Close()
+			return 0, err
+		}
+		tx.Add(txTree)
+		n += len(t.deleted)
+	}
+	// Don't move the pruned index back if keepStates is increased.
+	if prunedIdxOld, err := idenStatePrunedIdx.Get(tx); err == nil && prunedIdxOld > prunedIdx {
+		prunedIdx = prunedIdxOld
+	} else if err != nil && err != db.ErrNotFound {
+		return 0, err
+	}
+	idenStatePrunedIdx.Set(tx, prunedIdx)
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, t := range trees {
+		t.mt.EvictNodeCache(t.deleted)
+	}
+	return n, nil
+}
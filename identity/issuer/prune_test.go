@@ -0,0 +1,87 @@
+package issuer
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerPruneHistory(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	issuer.cfg.NodeCacheSize = 1024
+	clt, ret, rot, err := loadMTs(&issuer.cfg, issuer.storage)
+	require.Nil(t, err)
+	issuer.claimsTree, issuer.revocationsTree, issuer.rootsTree = clt, ret, rot
+	_, genesisRoots := issuer.State()
+
+	var rootsList []IdenStateTreeRoots
+	for i := 0; i < 4; i++ {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = byte(i)
+		_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+		require.Nil(t, err)
+		idenState, roots := issuer.state()
+		appendIdenState(t, issuer, idenState, &roots)
+		rootsList = append(rootsList, roots)
+	}
+	// A claim issued after the last identity state
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	_, current := issuer.State()
+
+	countLeafs := func(rootKey *merkletree.Hash) (int, error) {
+		leafs, err := issuer.claimsTreeLeafs(rootKey)
+		return len(leafs), err
+	}
+	// Walk the old trees so that their nodes are in the node cache.
+	for _, roots := range rootsList {
+		_, err := countLeafs(roots.ClaimsTreeRoot)
+		require.Nil(t, err)
+	}
+
+	n, err := issuer.PruneHistory(2)
+	require.Nil(t, err)
+	assert.True(t, n > 0)
+	n, err = issuer.PruneHistory(2)
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// The last 2 identity states, the current and the genesis one are kept
+	for i, rootKey := range []*merkletree.Hash{genesisRoots.ClaimsTreeRoot, rootsList[2].ClaimsTreeRoot,
+		rootsList[3].ClaimsTreeRoot, current.ClaimsTreeRoot} {
+		_, err := countLeafs(rootKey)
+		assert.Nil(t, err, "root %v", i)
+	}
+	// The older ones are pruned
+	for _, roots := range rootsList[:2] {
+		_, err := countLeafs(roots.ClaimsTreeRoot)
+		assert.NotNil(t, err)
+	}
+	assert.Nil(t, issuer.VerifyStateHistory())
+
+	// Issuing claims after pruning works
+	indexBytes[0] = 0x43
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	_, current = issuer.State()
+	nLeafs, err := countLeafs(current.ClaimsTreeRoot)
+	require.Nil(t, err)
+	assert.Equal(t, 7, nLeafs)
+
+	// The trees of the pending identity state are kept, even with no
+	// other identity states.
+	_, pendingRoots, err := issuer.appendIdenStatePending(&rootsList[3])
+	require.Nil(t, err)
+	indexBytes[0] = 0x44
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	_, err = issuer.PruneHistory(0)
+	require.Nil(t, err)
+	_, err = countLeafs(pendingRoots.ClaimsTreeRoot)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,104 @@
+package issuer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// publishOnceRecord is the result of a PublishStateOnce call stored under its
+// idempotency key.
+type publishOnceRecord struct {
+	InProgress bool
+	// IdenState is the pending state after the publish, or the last state
+	// if there was nothing to publish.
+	IdenState *merkletree.Hash
+	EthTx     *types.Transaction
+	Err       string
+}
+
+// PublishStateOnce calls PublishState at most once for each idempotencyKey.
+// The result of the call is stored together with the resulting ethereum
+// transaction in the Issuer storage, so that a retried call with the same
+// key returns the same result without generating a new proof or sending a
+// new transaction.  A call with a key whose publish hasn't finished yet
+// returns ErrInProgress.  If the process stops while publishing, the key
+// stays in progress, so a new key must be used.
+func (is *Issuer) PublishStateOnce(idempotencyKey string) error {
+	if is.genesisOnly() {
+		return ErrIdenGenesisOnly
+	}
+	storage := is.storage.WithPrefix(dbPrefixPublishOnce)
+	key := []byte(idempotencyKey)
+
+	tx, err := storage.NewTx()
+	if err != nil {
+		return err
+	}
+	recordJSON, err := tx.Get(key)
+	if err == nil {
+		tx.Close()
+		var record publishOnceRecord
+		if err := json.Unmarshal(recordJSON, &record); err != nil {
+			return err
+		}
+		if record.InProgress {
+			return ErrInProgress
+		}
+		if record.Err != "" {
+			return fmt.Errorf("error publishing state with idempotency key %v: %v",
+				idempotencyKey, record.Err)
+		}
+		return nil
+	} else if err != db.ErrNotFound {
+		tx.Close()
+		return err
+	}
+	// A concurrent call with the same key makes the commit fail with
+	// db.ErrTxConflict.
+	if err := db.StoreJSON(tx, key, publishOnceRecord{InProgress: true}); err != nil {
+		tx.Close()
+		return err
+	}
+	if err := tx.Commit(); errors.Is(err, db.ErrTxConflict) {
+		return ErrInProgress
+	} else if err != nil {
+		return err
+	}
+
+	errPublish := is.PublishState()
+	var record publishOnceRecord
+	if errPublish != nil {
+		record.Err = errPublish.Error()
+	} else {
+		is.rw.RLock()
+		idenStatePending, _ := is.idenStatePending()
+		if idenStatePending.Equals(&merkletree.HashZero) {
+			record.IdenState, _ = is.state()
+		} else {
+			record.IdenState = idenStatePending
+			if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+				record.EthTx = is.ethTxInitState()
+			} else {
+				record.EthTx = is.ethTxSetState()
+			}
+		}
+		is.rw.RUnlock()
+	}
+	tx, err = storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := db.StoreJSON(tx, key, record); err != nil {
+		tx.Close()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return errPublish
+}
@@ -0,0 +1,61 @@
+package issuer
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerPublishStateOnceRecords(t *testing.T) {
+	issuer, storage, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	storage = storage.WithPrefix(dbPrefixPublishOnce)
+
+	// Nothing to publish
+	require.Nil(t, issuer.PublishStateOnce("k0"))
+	var record publishOnceRecord
+	require.Nil(t, db.LoadJSON(storage, []byte("k0"), &record))
+	assert.False(t, record.InProgress)
+	idenState, _ := issuer.State()
+	assert.Equal(t, idenState, record.IdenState)
+	assert.Nil(t, record.EthTx)
+
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	require.Nil(t, db.StoreJSON(tx, []byte("k1"), publishOnceRecord{InProgress: true}))
+	require.Nil(t, db.StoreJSON(tx, []byte("k2"), publishOnceRecord{Err: "failed"}))
+	require.Nil(t, tx.Commit())
+
+	assert.Equal(t, ErrInProgress, issuer.PublishStateOnce("k1"))
+	err = issuer.PublishStateOnce("k2")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed")
+}
+
+func TestIssuerPublishStateOnce(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	_, err := issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+
+	require.Nil(t, issuer.PublishStateOnce("k0"))
+	idenStatePending, _ := issuer.idenStatePending()
+	ethTx := issuer.ethTxInitState()
+
+	// A retry doesn't publish again, even if there's a new state.
+	indexBytes[0] = 0x43
+	_, err = issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes))
+	require.Nil(t, err)
+	require.Nil(t, issuer.PublishStateOnce("k0"))
+	idenStatePendingRetry, _ := issuer.idenStatePending()
+	assert.Equal(t, idenStatePending, idenStatePendingRetry)
+	assert.Equal(t, ethTx.Hash(), issuer.ethTxInitState().Hash())
+
+	// A new key publishes, which fails because the previous state is
+	// still pending.
+	assert.Equal(t, ErrIdenStatePendingNotNil, issuer.PublishStateOnce("k1"))
+}
@@ -0,0 +1,44 @@
+package issuer
+
+import (
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// IssuerReader is a read only view of an Issuer.  It shares the storage and
+// the merkle trees of the Issuer, so it sees its updates, but it can't issue
+// claims, sign or publish the identity state.
+type IssuerReader struct {
+	is *Issuer
+}
+
+// ReadOnly returns a read only view of the Issuer.
+func (is *Issuer) ReadOnly() *IssuerReader {
+	return &IssuerReader{is: is}
+}
+
+// ID returns the Issuer ID (Identity ID).
+func (r *IssuerReader) ID() *core.ID {
+	return r.is.ID()
+}
+
+// State calls Issuer.State.
+func (r *IssuerReader) State() (*merkletree.Hash, IdenStateTreeRoots) {
+	return r.is.State()
+}
+
+// StateDataOnChain calls Issuer.StateDataOnChain.
+func (r *IssuerReader) StateDataOnChain() *proof.IdenStateData {
+	return r.is.StateDataOnChain()
+}
+
+// GenCredentialExistence calls Issuer.GenCredentialExistence.
+func (r *IssuerReader) GenCredentialExistence(claim merkletree.Entrier) (*proof.CredentialExistence, error) {
+	return r.is.GenCredentialExistence(claim)
+}
+
+// HasClaim calls Issuer.HasClaim.
+func (r *IssuerReader) HasClaim(claim merkletree.Entrier) (bool, error) {
+	return r.is.HasClaim(claim)
+}
@@ -0,0 +1,36 @@
+package issuer
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerReadOnly(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	reader := issuer.ReadOnly()
+	assert.Equal(t, issuer.ID(), reader.ID())
+	assert.Equal(t, issuer.StateDataOnChain(), reader.StateDataOnChain())
+
+	// The reader sees the updates of the Issuer.
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	ok, err := reader.HasClaim(claim)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	issuedClaim, err := issuer.IssueClaim(claim)
+	require.Nil(t, err)
+	ok, err = reader.HasClaim(issuedClaim)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	idenState, roots := issuer.State()
+	idenStateReader, rootsReader := reader.State()
+	assert.Equal(t, idenState, idenStateReader)
+	assert.Equal(t, roots, rootsReader)
+
+	_, err = reader.GenCredentialExistence(issuedClaim)
+	assert.Equal(t, ErrIdenStateOnChainZero, err)
+}
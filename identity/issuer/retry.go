@@ -0,0 +1,62 @@
+package issuer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/eth"
+)
+
+// rpcErrNotRetriable are the errors of the IdenPubOnChainer reads that are
+// results rather than failures of the call, so retrying them doesn't help.
+var rpcErrNotRetriable = []error{
+	idenpubonchain.ErrIdenNotOnChain,
+	idenpubonchain.ErrIdenNotOnChainOrBlockTooNew,
+	idenpubonchain.ErrIdenNotOnChainOrTimeTooNew,
+	idenpubonchain.ErrIdenByBlockNotFound,
+	idenpubonchain.ErrIdenByTimeNotFound,
+	idenpubonchain.ErrIdenByStateNotFound,
+	eth.ErrReceiptNotReceived,
+	eth.ErrReceiptStatusFailed,
+}
+
+// rpcErrRetriable returns true if err may be caused by a transient failure
+// of the ethereum node, like a network error.  Errors returned by the node
+// as a JSON-RPC error response are not retriable.
+func rpcErrRetriable(err error) bool {
+	for _, e := range rpcErrNotRetriable {
+		if errors.Is(err, e) {
+			return false
+		}
+	}
+	var rpcErr interface{ ErrorCode() int }
+	return !errors.As(err, &rpcErr)
+}
+
+// RPCRetryBaseDefault is the wait before the first retry of a call to the
+// ethereum node when Config.RPCRetryBase is 0.
+const RPCRetryBaseDefault = 500 * time.Millisecond
+
+// retryRPC calls f until it succeeds, it returns an error that is not
+// retriable or it has been retried Config.RPCRetries times.  The wait before
+// each retry starts at Config.RPCRetryBase and doubles every retry.  It must
+// be called without is.rw held, so that the waits don't block the Issuer.
+func (is *Issuer) retryRPC(f func() error) error {
+	wait := is.cfg.RPCRetryBase
+	if wait == 0 {
+		wait = RPCRetryBaseDefault
+	}
+	err := f()
+	for i := 0; i < is.cfg.RPCRetries && err != nil && rpcErrRetriable(err); i++ {
+		is.log().Warn("Retrying call to the ethereum node", Fields{
+			"err":   err,
+			"retry": i + 1,
+			"wait":  wait,
+		})
+		time.Sleep(wait)
+		wait *= 2
+		err = f()
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package issuer
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/eth"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idenPubOnChainFlaky is an IdenPubOnChainer whose first reads, up to
+// fails, return err.
+type idenPubOnChainFlaky struct {
+	idenpubonchain.IdenPubOnChainer
+	fails int
+	err   error
+	calls int
+}
+
+func (ip *idenPubOnChainFlaky) fail() error {
+	ip.calls++
+	if ip.calls <= ip.fails {
+		return ip.err
+	}
+	return nil
+}
+
+func (ip *idenPubOnChainFlaky) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	if err := ip.fail(); err != nil {
+		return nil, err
+	}
+	return ip.IdenPubOnChainer.GetState(id)
+}
+
+func (ip *idenPubOnChainFlaky) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
+	if err := ip.fail(); err != nil {
+		return nil, err
+	}
+	return big.NewInt(0), nil
+}
+
+func TestIssuerSyncIdenStatePublicRetry(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	issuer.cfg.RPCRetries = 2
+	issuer.cfg.RPCRetryBase = time.Millisecond
+	errNetwork := fmt.Errorf("connection refused")
+
+	ip := &idenPubOnChainFlaky{IdenPubOnChainer: idenPubOnChain, fails: 2, err: errNetwork}
+	issuer.idenPubOnChain = ip
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 3, ip.calls)
+
+	ip = &idenPubOnChainFlaky{IdenPubOnChainer: idenPubOnChain, fails: 3, err: errNetwork}
+	issuer.idenPubOnChain = ip
+	err := issuer.SyncIdenStatePublic()
+	assert.True(t, errors.Is(err, errNetwork))
+	assert.Equal(t, 3, ip.calls)
+
+	// Logical errors are not retried
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, merkletree.NewHashFromBigInt(big.NewInt(1)), true)
+	require.Nil(t, issuer.setEthTxInitState(tx, types.NewTransaction(0, common.Address{}, nil, 0, nil, nil)))
+	require.Nil(t, tx.Commit())
+	ip = &idenPubOnChainFlaky{IdenPubOnChainer: idenPubOnChain, fails: 1, err: eth.ErrReceiptNotReceived}
+	issuer.idenPubOnChain = ip
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 1, ip.calls)
+}
+
+// idenPubOnChainBlockGetState is an IdenPubOnChainer whose GetState signals
+// calling and blocks until release is closed.
+type idenPubOnChainBlockGetState struct {
+	idenpubonchain.IdenPubOnChainer
+	calling chan struct{}
+	release chan struct{}
+}
+
+func (ip *idenPubOnChainBlockGetState) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	close(ip.calling)
+	<-ip.release
+	return ip.IdenPubOnChainer.GetState(id)
+}
+
+func TestIssuerSyncIdenStatePublicReaders(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	ip := &idenPubOnChainBlockGetState{IdenPubOnChainer: idenPubOnChain,
+		calling: make(chan struct{}), release: make(chan struct{})}
+	issuer.idenPubOnChain = ip
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- issuer.SyncIdenStatePublic() }()
+	<-ip.calling
+
+	// The readers are not blocked during the call to the ethereum node.
+	idenStateCh := make(chan *merkletree.Hash, 1)
+	go func() {
+		idenState, _ := issuer.State()
+		idenStateCh <- idenState
+	}()
+	select {
+	case <-idenStateCh:
+	case <-time.After(10 * time.Second):
+		t.Error("State is blocked during SyncIdenStatePublic")
+	}
+	close(ip.release)
+	assert.Nil(t, <-errCh)
+}
@@ -0,0 +1,23 @@
+package issuer
+
+import (
+	"math/big"
+
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// Signer signs with the babyjub keys of the Issuer, like its operational key.
+// *keystore.KeyStore implements it.  Implementations that keep the keys in an
+// HSM or a remote signer can't export them, so their ExportKey must return an
+// error (like ErrKeyExportNotSupported).  In that case the Issuer can sign,
+// but it can't generate the zk proofs of the identity state updates, because
+// the circuit takes the operational private key as input.
+type Signer interface {
+	// SignElem signs the field element msg with the key of pk.
+	SignElem(pk *babyjub.PublicKeyComp, msg *big.Int) (*babyjub.SignatureComp, error)
+	// SignRaw signs the poseidon hash of msg with the key of pk.
+	SignRaw(pk *babyjub.PublicKeyComp, msg []byte) (*babyjub.SignatureComp, error)
+	// ExportKey returns the private key of pk, which is an input of the
+	// identity state update zk proof.
+	ExportKey(pk *babyjub.PublicKeyComp) (*babyjub.PrivateKey, error)
+}
@@ -0,0 +1,36 @@
+package issuer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signerNoExport is a Signer that can't export its keys, like an HSM.
+type signerNoExport struct {
+	*keystore.KeyStore
+}
+
+func (s *signerNoExport) ExportKey(pk *babyjub.PublicKeyComp) (*babyjub.PrivateKey, error) {
+	return nil, ErrKeyExportNotSupported
+}
+
+func TestIssuerSignerNoExport(t *testing.T) {
+	_, storage, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	issuer, err := Load(storage, &signerNoExport{keyStore}, idenPubOnChain, idenStateZkProofConf,
+		idenPubOffChain)
+	require.Nil(t, err)
+
+	sig, err := issuer.Sign("hello")
+	require.Nil(t, err)
+	ok, err := VerifySign("hello", sig, issuer.KeyOperational())
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = issuer.GenIdOwnershipGenesisInputs(idenStateZkProofConf.Levels)
+	assert.True(t, errors.Is(err, ErrKeyExportNotSupported))
+}
@@ -0,0 +1,81 @@
+package issuer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// stateSyncCacheKey identifies the identity states in stateSyncCache by the
+// IdenPubOnChainer they were obtained from and the identity ID, so that
+// Issuers using different smart contracts don't share states.
+type stateSyncCacheKey struct {
+	idenPubOnChain idenpubonchain.IdenPubOnChainer
+	id             core.ID
+}
+
+// stateSyncCacheEntry is an identity state obtained from the smart contract,
+// the time it was obtained and the TTL it was cached with.
+type stateSyncCacheEntry struct {
+	idenStateData *proof.IdenStateData
+	time          time.Time
+	ttl           time.Duration
+}
+
+// stateSyncCache keeps the identity states obtained by SyncIdenStatePublic.
+// It's shared by all the Issuers so that it's reused between calls to Load.
+// The expired entries are removed when a new entry is added.
+var stateSyncCache = struct {
+	sync.Mutex
+	entries map[stateSyncCacheKey]stateSyncCacheEntry
+}{entries: make(map[stateSyncCacheKey]stateSyncCacheEntry)}
+
+// getStateOnChain returns the identity state of the identity id of the
+// Issuer in the smart contract, or a zero state if the identity is not on
+// chain.  The result is reused for cfg.StateSyncCacheTTL unless useCache is
+// false.
+func (is *Issuer) getStateOnChain(id *core.ID, useCache bool) (*proof.IdenStateData, error) {
+	ttl := is.cfg.StateSyncCacheTTL
+	key := stateSyncCacheKey{idenPubOnChain: is.idenPubOnChain, id: *id}
+	if useCache && ttl > 0 {
+		stateSyncCache.Lock()
+		entry, ok := stateSyncCache.entries[key]
+		stateSyncCache.Unlock()
+		if ok && time.Since(entry.time) < ttl {
+			return entry.idenStateData, nil
+		}
+	}
+
+	var idenStateData *proof.IdenStateData
+	err := is.retryRPC(func() (err error) {
+		idenStateData, err = is.idenPubOnChain.GetState(id)
+		return err
+	})
+	if err == idenpubonchain.ErrIdenNotOnChain {
+		idenStateData = &proof.IdenStateData{
+			IdenState: &merkletree.HashZero,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		now := time.Now()
+		stateSyncCache.Lock()
+		for k, entry := range stateSyncCache.entries {
+			if now.Sub(entry.time) >= entry.ttl {
+				delete(stateSyncCache.entries, k)
+			}
+		}
+		stateSyncCache.entries[key] = stateSyncCacheEntry{
+			idenStateData: idenStateData,
+			time:          now,
+			ttl:           ttl,
+		}
+		stateSyncCache.Unlock()
+	}
+	return idenStateData, nil
+}
@@ -0,0 +1,72 @@
+package issuer
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idenPubOnChainCount is an IdenPubOnChainer that counts the calls to GetState.
+type idenPubOnChainCount struct {
+	idenpubonchain.IdenPubOnChainer
+	getStateCalls int
+}
+
+func (ip *idenPubOnChainCount) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	ip.getStateCalls++
+	return ip.IdenPubOnChainer.GetState(id)
+}
+
+func TestIssuerStateSyncCache(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	idenPubOnChainCountOther := &idenPubOnChainCount{IdenPubOnChainer: idenPubOnChain}
+	idenPubOnChainCount := &idenPubOnChainCount{IdenPubOnChainer: idenPubOnChain}
+	issuer.idenPubOnChain = idenPubOnChainCount
+
+	// Without TTL the cache is not used
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 2, idenPubOnChainCount.getStateCalls)
+
+	issuer.cfg.StateSyncCacheTTL = time.Minute
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 3, idenPubOnChainCount.getStateCalls)
+
+	// The cache is bypassed with a pending state
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, merkletree.NewHashFromBigInt(big.NewInt(1)), false)
+	require.Nil(t, tx.Commit())
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 4, idenPubOnChainCount.getStateCalls)
+
+	// The cache expires
+	issuer.cfg.StateSyncCacheTTL = time.Nanosecond
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, &merkletree.HashZero, false)
+	require.Nil(t, tx.Commit())
+	time.Sleep(time.Millisecond)
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 5, idenPubOnChainCount.getStateCalls)
+
+	// The cache is not shared with other IdenPubOnChainers, and the
+	// expired entries are removed
+	issuer.cfg.StateSyncCacheTTL = time.Minute
+	issuer.idenPubOnChain = idenPubOnChainCountOther
+	time.Sleep(time.Millisecond)
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, 1, idenPubOnChainCountOther.getStateCalls)
+	stateSyncCache.Lock()
+	_, ok := stateSyncCache.entries[stateSyncCacheKey{idenPubOnChain: idenPubOnChainCount, id: *issuer.ID()}]
+	stateSyncCache.Unlock()
+	assert.False(t, ok)
+}
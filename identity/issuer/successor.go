@@ -0,0 +1,72 @@
+package issuer
+
+import (
+	"errors"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+var (
+	claimSuccessorOfTag = claims.HashString("iden3.successorof")
+	claimSuccessorTag   = claims.HashString("iden3.successor")
+)
+
+// NewClaimSuccessorOf returns the claim that a successor identity has in its
+// genesis to link back to the identity id that it succeeds.
+func NewClaimSuccessorOf(id *core.ID) *claims.ClaimOtherIden {
+	var indexSlot [claims.IndexSubjectSlotLen]byte
+	copy(indexSlot[:], claimSuccessorOfTag[:])
+	return claims.NewClaimOtherIden(id, indexSlot, [claims.ValueSlotLen]byte{})
+}
+
+// NewClaimSuccessor returns the claim that an identity issues to link
+// forward to its successor identity id.
+func NewClaimSuccessor(id *core.ID) *claims.ClaimOtherIden {
+	var indexSlot [claims.IndexSubjectSlotLen]byte
+	copy(indexSlot[:], claimSuccessorTag[:])
+	return claims.NewClaimOtherIden(id, indexSlot, [claims.ValueSlotLen]byte{})
+}
+
+// CreateSuccessor creates in storage a new Issuer with the operational key
+// newKOp and the same configuration as the current one, and links both
+// identities.  The genesis of the successor contains a NewClaimSuccessorOf
+// claim with the current identity ID, and the current Issuer issues a
+// NewClaimSuccessor claim with the successor ID.  Returns the successor ID.
+// The successor genesis claims get consecutive nonces even if the current
+// Issuer was created with CreateWithNonces.
+//
+// The successor ID only depends on its genesis, so the NewClaimSuccessor
+// claim is issued before the successor is created in storage.  If creating
+// it fails, calling CreateSuccessor again with the same newKOp creates the
+// same successor, keeping the claim already issued.
+//
+// Trust model: anyone can create an identity whose genesis claims to succeed
+// another one, so the link in the successor genesis alone must not be
+// trusted.  A verifier must only accept the succession once it has a valid
+// credential of the NewClaimSuccessor claim issued by the old identity,
+// which requires the current state (with the claim) to be published.  The
+// old identity stays valid after the succession: its operational key is not
+// revoked, so it's up to the owner to stop using (and revoke) it.
+func (is *Issuer) CreateSuccessor(newKOp *babyjub.PublicKeyComp, storage db.Storage) (*core.ID, error) {
+	if is.genesisOnly() {
+		return nil, ErrIdenGenesisOnly
+	}
+	is.rw.RLock()
+	cfg := is.cfg
+	is.rw.RUnlock()
+	cfg.DeterministicNonces = false
+	id, err := Create(cfg, newKOp, []claims.Claimer{NewClaimSuccessorOf(is.ID())},
+		db.NewMemoryStorage(), is.signer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := is.IssueClaim(NewClaimSuccessor(id)); err != nil &&
+		!errors.Is(err, ErrClaimAlreadyIssued) {
+		return nil, err
+	}
+	return Create(cfg, newKOp, []claims.Claimer{NewClaimSuccessorOf(is.ID())},
+		storage, is.signer)
+}
@@ -0,0 +1,112 @@
+package issuer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuerCreateSuccessor(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	newKOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	storage := db.NewMemoryStorage()
+	id, err := issuer.CreateSuccessor(newKOp, storage)
+	require.Nil(t, err)
+	assert.NotEqual(t, issuer.ID(), id)
+
+	// The successor genesis contains the link to the current identity.
+	clt, err := merkletree.NewMerkleTree(storage.WithPrefix(dbPrefixClaimsTree),
+		issuer.cfg.MaxLevelsClaimsTree)
+	require.Nil(t, err)
+	hi, err := NewClaimSuccessorOf(issuer.ID()).Entry().HIndex()
+	require.Nil(t, err)
+	_, err = clt.GetDataByIndex(hi)
+	assert.Nil(t, err)
+	rot, err := merkletree.NewMerkleTree(storage.WithPrefix(dbPrefixRootsTree),
+		issuer.cfg.MaxLevelsRootsTree)
+	require.Nil(t, err)
+	idenState := core.IdenState(clt.RootKey(), &merkletree.HashZero, rot.RootKey())
+	assert.Equal(t, core.IdGenesisFromIdenState(idenState), id)
+
+	// The current identity issued the link to the successor.
+	hi, err = NewClaimSuccessor(id).Entry().HIndex()
+	require.Nil(t, err)
+	_, err = issuer.claimsTree.GetDataByIndex(hi)
+	assert.Nil(t, err)
+}
+
+func TestIssuerCreateSuccessorWithNonces(t *testing.T) {
+	cfg := ConfigDefault
+	cfg.DeterministicNonces = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOp, pass))
+	_, err = CreateWithNonces(cfg, kOp, 7, []claims.Claimer{}, []uint32{}, storage, keyStore)
+	require.Nil(t, err)
+	issuer, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+
+	newKOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	storageSuccessor := db.NewMemoryStorage()
+	id, err := issuer.CreateSuccessor(newKOp, storageSuccessor)
+	require.Nil(t, err)
+	successor, err := Load(storageSuccessor, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	assert.Equal(t, id, successor.ID())
+	assert.False(t, successor.cfg.DeterministicNonces)
+}
+
+// storageNoTx is a Storage that fails to create transactions.
+type storageNoTx struct {
+	db.Storage
+}
+
+func (s *storageNoTx) NewTx() (db.Tx, error) {
+	return nil, fmt.Errorf("storage unavailable")
+}
+
+func (s *storageNoTx) WithPrefix(prefix []byte) db.Storage {
+	return &storageNoTx{s.Storage.WithPrefix(prefix)}
+}
+
+func TestIssuerCreateSuccessorRetry(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	newKOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	_, err = issuer.CreateSuccessor(newKOp, &storageNoTx{db.NewMemoryStorage()})
+	require.NotNil(t, err)
+	cs, err := issuer.PendingClaims()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(cs))
+
+	// Retrying creates the successor that the issued claim links to.
+	storage := db.NewMemoryStorage()
+	id, err := issuer.CreateSuccessor(newKOp, storage)
+	require.Nil(t, err)
+	hi, err := NewClaimSuccessor(id).Entry().HIndex()
+	require.Nil(t, err)
+	hiPending, err := cs[0].Entry().HIndex()
+	require.Nil(t, err)
+	assert.Equal(t, hi, hiPending)
+	cs, err = issuer.PendingClaims()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(cs))
+	successor, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	assert.Equal(t, id, successor.ID())
+}
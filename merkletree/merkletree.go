@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/iden3/go-iden3-core/common"
 	common3 "github.com/iden3/go-iden3-core/common"
 	"github.com/iden3/go-iden3-core/db"
@@ -38,6 +39,15 @@ func NewElemBytesFromBigInt(v *big.Int) (e ElemBytes) {
 	return e
 }
 
+// NewElemBytesChecked returns the ElemBytes of v, or ErrElemNotInField if v is
+// negative or not below the finite field modulus.
+func NewElemBytesChecked(v *big.Int) (ElemBytes, error) {
+	if v.Sign() == -1 || !cryptoUtils.CheckBigIntInField(v) {
+		return ElemBytes{}, ErrElemNotInField
+	}
+	return NewElemBytesFromBigInt(v), nil
+}
+
 func (e *ElemBytes) BigInt() *big.Int {
 	return new(big.Int).SetBytes(common3.SwapEndianness(e[:]))
 }
@@ -82,6 +92,37 @@ func (d1 *Data) Equal(d2 *Data) bool {
 		bytes.Equal(d1[2][:], d2[2][:]) && bytes.Equal(d1[3][:], d2[3][:])
 }
 
+// Slot returns the element i of the Data, or returns ErrSlotOutOfRange if i
+// is not in [0, DataLen).
+func (d *Data) Slot(i int) (ElemBytes, error) {
+	if i < 0 || i >= DataLen {
+		return ElemBytes{}, ErrSlotOutOfRange
+	}
+	return d[i], nil
+}
+
+// SetSlot sets the element i of the Data to e, or returns ErrSlotOutOfRange
+// if i is not in [0, DataLen).
+func (d *Data) SetSlot(i int, e ElemBytes) error {
+	if i < 0 || i >= DataLen {
+		return ErrSlotOutOfRange
+	}
+	d[i] = e
+	return nil
+}
+
+// IndexSlots returns the IndexLen elements of the Data that form the index of
+// the Entry.  The returned slice shares the Data memory.
+func (d *Data) IndexSlots() []ElemBytes {
+	return d[:IndexLen]
+}
+
+// ValueSlots returns the DataLen-IndexLen elements of the Data that form the
+// value of the Entry.  The returned slice shares the Data memory.
+func (d *Data) ValueSlots() []ElemBytes {
+	return d[IndexLen:]
+}
+
 func (d Data) MarshalText() ([]byte, error) {
 	dataBytes := d.Bytes()
 	return []byte(common3.HexEncode(dataBytes[:])), nil
@@ -124,6 +165,15 @@ var (
 	ErrNotWritable = errors.New("Merkle Tree not writable")
 	// ErrEntryDataNotMatch is used when the entry data doesn't match the expected one.
 	ErrEntryDataNotMatch = errors.New("Entry data doesn't match the expected one")
+	// ErrElemNotInField is used when a value doesn't fit in a finite field
+	// element.
+	ErrElemNotInField = errors.New("value is not inside the finite field")
+	// ErrHashBadSize is used when a serialized hash doesn't have
+	// ElemBytesLen bytes.
+	ErrHashBadSize = errors.New("hash has incorrect size")
+	// ErrSlotOutOfRange is used when a Data element is accessed with an
+	// index out of [0, DataLen).
+	ErrSlotOutOfRange = errors.New("data slot index out of range")
 
 	// HashZero is a hash value of zeros, and is the key of an empty node.
 	HashZero = Hash{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
@@ -149,11 +199,11 @@ type Entrier interface {
 }
 
 func (e *Entry) Index() []ElemBytes {
-	return e.Data[:IndexLen]
+	return e.Data.IndexSlots()
 }
 
 func (e *Entry) Value() []ElemBytes {
-	return e.Data[IndexLen:]
+	return e.Data.ValueSlots()
 }
 
 // HIndex calculates the hash of the Index of the Entry, used to find the path
@@ -190,6 +240,40 @@ func (e *Entry) HiHv() (*Hash, *Hash, error) {
 	return hi, hv, nil
 }
 
+func hasherOrDefault(hasher Hasher) Hasher {
+	if hasher == nil {
+		return DefaultHasher
+	}
+	return hasher
+}
+
+// entryHIndex returns the HIndex of the Entry calculated with the hasher.  If
+// hasher is nil, the cached HIndex calculated with the DefaultHasher is used.
+func entryHIndex(hasher Hasher, e *Entry) (*Hash, error) {
+	if hasher == nil {
+		return e.HIndex()
+	}
+	return hashElems(hasher, e.Index()...)
+}
+
+// entryHiHv returns the HIndex and HValue of the Entry calculated with the
+// hasher.  If hasher is nil, the cached hashes calculated with the
+// DefaultHasher are used.
+func entryHiHv(hasher Hasher, e *Entry) (*Hash, *Hash, error) {
+	if hasher == nil {
+		return e.HiHv()
+	}
+	hi, err := hashElems(hasher, e.Index()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	hv, err := hashElems(hasher, e.Value()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hi, hv, nil
+}
+
 func (e *Entry) Bytes() []byte {
 	b := e.Data.Bytes()
 	return b[:]
@@ -199,6 +283,18 @@ func (e1 *Entry) Equal(e2 *Entry) bool {
 	return e1.Data.Equal(&e2.Data)
 }
 
+// Equals returns true if both entries have the same index and value, unlike
+// Equal, which only compares the first elements of the Data.
+func (e1 *Entry) Equals(e2 *Entry) bool {
+	return e1.Data == e2.Data
+}
+
+// Key returns the bytes of the entry Data as an array, so that it can be
+// used as a map key.  Entries with the same Key are Equals.
+func (e *Entry) Key() [DataLen * ElemBytesLen]byte {
+	return e.Data.Bytes()
+}
+
 func (e Entry) MarshalText() ([]byte, error) {
 	return []byte(common3.HexEncode(e.Bytes())), nil
 }
@@ -223,6 +319,13 @@ type MerkleTree struct {
 	maxLevels int
 	// writable indicates if the Merkle Tree allows to write or only to read
 	writable bool
+	// nodeCache is an optional LRU cache of the nodes fetched from the
+	// storage.  Nodes are addressed by their key, so cached entries are never
+	// stale.
+	nodeCache *lru.Cache
+	// hasher is the hash function of the Merkle Tree.  If it's nil, the
+	// DefaultHasher is used.
+	hasher Hasher
 }
 
 // NewMerkleTree generates a new Merkle Tree
@@ -251,6 +354,47 @@ func NewMerkleTree(storage db.Storage, maxLevels int) (*MerkleTree, error) {
 	return &mt, nil
 }
 
+// NewMerkleTreeWithHasher generates a new Merkle Tree that uses hasher
+// instead of the DefaultHasher.  The proofs of the Merkle Tree must be
+// verified with VerifyProofWithHasher, and the hashes of its entries must be
+// calculated with HashEntry.
+func NewMerkleTreeWithHasher(storage db.Storage, maxLevels int, hasher Hasher) (*MerkleTree, error) {
+	mt, err := NewMerkleTree(storage, maxLevels)
+	if err != nil {
+		return nil, err
+	}
+	mt.hasher = hasher
+	return mt, nil
+}
+
+// HashEntry returns the HIndex and HValue of the Entry calculated with the
+// hasher of the Merkle Tree.
+func (mt *MerkleTree) HashEntry(e *Entry) (*Hash, *Hash, error) {
+	return entryHiHv(mt.hasher, e)
+}
+
+// NewMerkleTreeWithNodeCache generates a new Merkle Tree that keeps up to
+// nodeCacheSize of the nodes fetched from the storage in an LRU cache, so that
+// the tree can be traversed without loading it all in memory nor reading the
+// most used nodes from the storage every time.  A nodeCacheSize of 0 disables
+// the cache.
+func NewMerkleTreeWithNodeCache(storage db.Storage, maxLevels, nodeCacheSize int) (*MerkleTree, error) {
+	mt, err := NewMerkleTree(storage, maxLevels)
+	if err != nil {
+		return nil, err
+	}
+	if nodeCacheSize > 0 {
+		if mt.nodeCache, err = lru.New(nodeCacheSize); err != nil {
+			return nil, err
+		}
+	}
+	return mt, nil
+}
+
+// Snapshot returns a read-only view of the MerkleTree pinned at rootKey,
+// which can be any root of the MerkleTree history that is in the storage.
+// The RootKey of the snapshot doesn't change when the MerkleTree is updated,
+// and its write functions return ErrNotWritable.
 func (mt *MerkleTree) Snapshot(rootKey *Hash) (*MerkleTree, error) {
 	mt.RLock()
 	defer mt.RUnlock()
@@ -258,7 +402,21 @@ func (mt *MerkleTree) Snapshot(rootKey *Hash) (*MerkleTree, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MerkleTree{storage: mt.storage, maxLevels: mt.maxLevels, rootKey: rootKey, writable: false}, nil
+	return &MerkleTree{storage: mt.storage, maxLevels: mt.maxLevels, rootKey: rootKey, writable: false,
+		nodeCache: mt.nodeCache, hasher: mt.hasher}, nil
+}
+
+// Clone returns a read-only copy of the MerkleTree pinned at its current
+// root, like Snapshot(mt.RootKey()).  The clone has its own lock and root,
+// and shares with the MerkleTree the storage and the node cache, which it
+// only reads.  Nodes are addressed by their key and never overwritten, so
+// proofs can be generated from the clone from multiple goroutines, and
+// concurrently with writes to the MerkleTree, without contending on the
+// MerkleTree lock.  This holds as long as the storage is safe for concurrent
+// use (like db.MemoryStorage and db.LevelDbStorage) and the nodes of the
+// clone root are not deleted from it.
+func (mt *MerkleTree) Clone() (*MerkleTree, error) {
+	return mt.Snapshot(mt.RootKey())
 }
 
 // Storage returns the MT storage
@@ -292,12 +450,14 @@ func (mt *MerkleTree) GetDataByIndex(hIndex *Hash) (*Data, error) {
 		case NodeTypeEmpty:
 			return nil, ErrEntryIndexNotFound
 		case NodeTypeLeaf:
-			hi, err := n.Entry.HIndex()
+			hi, err := entryHIndex(mt.hasher, n.Entry)
 			if err != nil {
 				return nil, err
 			}
 			if bytes.Equal(hIndex[:], hi[:]) {
-				return &n.Entry.Data, nil
+				// Return a copy, as the node may be shared by the node cache.
+				data := n.Entry.Data
+				return &data, nil
 			} else {
 				return nil, ErrEntryIndexNotFound
 			}
@@ -314,6 +474,26 @@ func (mt *MerkleTree) GetDataByIndex(hIndex *Hash) (*Data, error) {
 	return nil, ErrEntryIndexNotFound
 }
 
+// GetEntryByIndex returns the entry from the MT in the position of the hash of
+// the index (hIndex).
+func (mt *MerkleTree) GetEntryByIndex(hIndex *Hash) (*Entry, error) {
+	data, err := mt.GetDataByIndex(hIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Data: *data}, nil
+}
+
+// GetEntryByIndexAtRoot returns the entry in the position of the hash of the
+// index (hIndex) of the MT with the given rootKey.
+func (mt *MerkleTree) GetEntryByIndexAtRoot(hIndex, rootKey *Hash) (*Entry, error) {
+	mt, err := mt.Snapshot(rootKey)
+	if err != nil {
+		return nil, err
+	}
+	return mt.GetEntryByIndex(hIndex)
+}
+
 // EntryExists checks if a given entry is in the merkle tree starting from the
 // rootKey.  If rootKey is nil, the current merkle tree root is used.
 func (mt *MerkleTree) EntryExists(entry *Entry, rootKey *Hash) error {
@@ -324,15 +504,14 @@ func (mt *MerkleTree) EntryExists(entry *Entry, rootKey *Hash) error {
 			return err
 		}
 	}
-	hi, err := entry.HIndex()
+	hi, err := entryHIndex(mt.hasher, entry)
 	if err != nil {
 		return err
 	}
-	data, err := mt.GetDataByIndex(hi)
+	foundEntry, err := mt.GetEntryByIndex(hi)
 	if err != nil {
 		return err
 	}
-	foundEntry := &Entry{Data: *data}
 	if !foundEntry.Equal(entry) {
 		return ErrEntryDataNotMatch
 	}
@@ -360,11 +539,11 @@ func (mt *MerkleTree) pushLeaf(tx db.Tx, newLeaf *Node, oldLeaf *Node,
 		}
 		return mt.addNode(tx, newNodeMiddle)
 	} else {
-		oldLeafKey, err := oldLeaf.Key()
+		oldLeafKey, err := oldLeaf.keyHasher(mt.hasher)
 		if err != nil {
 			return nil, err
 		}
-		newLeafKey, err := newLeaf.Key()
+		newLeafKey, err := newLeaf.keyHasher(mt.hasher)
 		if err != nil {
 			return nil, err
 		}
@@ -401,12 +580,12 @@ func (mt *MerkleTree) addLeaf(tx db.Tx, newLeaf *Node, key *Hash,
 		return mt.addNode(tx, newLeaf)
 	case NodeTypeLeaf:
 		// TODO: delete old node n???  Make this optional???
-		hIndex, err := n.Entry.HIndex()
+		hIndex, err := entryHIndex(mt.hasher, n.Entry)
 		if err != nil {
 			return nil, err
 		}
 		// Check if leaf node found contains the leaf node we are trying to add
-		newLeafHi, err := newLeaf.Entry.HIndex()
+		newLeafHi, err := entryHIndex(mt.hasher, newLeaf.Entry)
 		if err != nil {
 			return nil, err
 		}
@@ -448,8 +627,22 @@ func (mt *MerkleTree) AddClaim(e Entrier) error {
 	return mt.AddEntry(e.Entry())
 }
 
+// AddClaimWithTx adds the Claim that fullfills the Entrier interface to the
+// MerkleTree committing the writes of atx in the same transaction, so that
+// either both are stored or none is.  atx is closed.
+func (mt *MerkleTree) AddClaimWithTx(e Entrier, atx db.Tx) error {
+	defer atx.Close()
+	return mt.addEntry(e.Entry(), atx)
+}
+
 // AddEntry adds the Entry to the MerkleTree
 func (mt *MerkleTree) AddEntry(e *Entry) error {
+	return mt.addEntry(e, nil)
+}
+
+// addEntry adds the Entry to the MerkleTree, adding the writes of atx to the
+// transaction if atx is not nil.
+func (mt *MerkleTree) addEntry(e *Entry, atx db.Tx) error {
 	// verify that the MerkleTree is writable
 	if !mt.writable {
 		return ErrNotWritable
@@ -466,25 +659,313 @@ func (mt *MerkleTree) AddEntry(e *Entry) error {
 	defer mt.Unlock()
 
 	newNodeLeaf := NewNodeLeaf(e)
-	hIndex, err := e.HIndex()
+	hIndex, err := entryHIndex(mt.hasher, e)
 	if err != nil {
 		return err
 	}
 	path := getPath(mt.maxLevels, hIndex)
 
-	newRootKey, err := mt.addLeaf(tx, newNodeLeaf, mt.rootKey, 0, path)
+	rootKey, err := mt.txRootKey(tx)
+	if err != nil {
+		return err
+	}
+	newRootKey, err := mt.addLeaf(tx, newNodeLeaf, rootKey, 0, path)
 	if err != nil {
 		return err
 	}
+	mt.dbInsert(tx, rootNodeValue, DBEntryTypeRoot, newRootKey[:])
+	if atx != nil {
+		tx.Add(atx)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Only update the root once the commit succeeds, so that the
+	// MerkleTree stays consistent with the storage on failure.
 	mt.rootKey = newRootKey
-	mt.dbInsert(tx, rootNodeValue, DBEntryTypeRoot, mt.rootKey[:])
+	return nil
+}
+
+// txRootKey returns the root stored in the storage, read in tx so that the
+// commit fails with db.ErrTxConflict if the tree is concurrently updated.
+// The stored root is used instead of mt.rootKey because it may have been
+// updated by another MerkleTree on the same storage.
+func (mt *MerkleTree) txRootKey(tx db.Tx) (*Hash, error) {
+	v, err := tx.Get(rootNodeValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 1+ElemBytesLen {
+		return nil, ErrInvalidDBValue
+	}
+	rootKey := &Hash{}
+	copy(rootKey[:], v[1:])
+	return rootKey, nil
+}
+
+// AddEntries adds the entries of the Entriers to the MerkleTree in a single
+// transaction, so that either all are added or none is.  The leafs are
+// inserted together, splitting them by their path at each level, so that
+// each updated middle node is hashed and stored only once instead of once per
+// entry as with repeated calls to AddEntry.  The resulting tree is the same as
+// adding the entries one by one.
+func (mt *MerkleTree) AddEntries(entries []Entrier) error {
+	return mt.addEntries(entries, nil)
+}
+
+// AddEntriesWithTx is like AddEntries but it commits the writes of atx in the
+// same transaction, so that either all are stored or none is.  atx is closed.
+func (mt *MerkleTree) AddEntriesWithTx(entries []Entrier, atx db.Tx) error {
+	defer atx.Close()
+	return mt.addEntries(entries, atx)
+}
+
+// addEntries adds the entries to the MerkleTree, adding the writes of atx to
+// the transaction if atx is not nil.
+func (mt *MerkleTree) addEntries(entries []Entrier, atx db.Tx) error {
+	// verify that the MerkleTree is writable
+	if !mt.writable {
+		return ErrNotWritable
+	}
+	if len(entries) == 0 {
+		if atx != nil {
+			return atx.Commit()
+		}
+		return nil
+	}
+	leafs := make([]*pathLeaf, len(entries))
+	hIndexes := make(map[Hash]bool, len(entries))
+	for i, entrier := range entries {
+		e := entrier.Entry()
+		// verfy that the ElemBytes are valid and fit inside the mimc7 field.
+		if !CheckEntryInField(*e) {
+			return errors.New("Elements not inside the Finite Field over R")
+		}
+		hIndex, err := entryHIndex(mt.hasher, e)
+		if err != nil {
+			return err
+		}
+		if hIndexes[*hIndex] {
+			return ErrEntryIndexAlreadyExists
+		}
+		hIndexes[*hIndex] = true
+		leafs[i] = &pathLeaf{node: NewNodeLeaf(e), hIndex: hIndex,
+			path: getPath(mt.maxLevels, hIndex)}
+	}
+	tx, err := mt.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	mt.Lock()
+	defer mt.Unlock()
 
+	rootKey, err := mt.txRootKey(tx)
+	if err != nil {
+		return err
+	}
+	newRootKey, err := mt.addLeafs(tx, leafs, rootKey, 0)
+	if err != nil {
+		return err
+	}
+	mt.dbInsert(tx, rootNodeValue, DBEntryTypeRoot, newRootKey[:])
+	if atx != nil {
+		tx.Add(atx)
+	}
 	if err := tx.Commit(); err != nil {
 		return err
 	}
+	mt.rootKey = newRootKey
 	return nil
 }
 
+// pathLeaf is a leaf node with its hIndex and path, to be placed in the tree
+// by addLeafs.  stored is true if the leaf is already in the tree.
+type pathLeaf struct {
+	node   *Node
+	hIndex *Hash
+	path   []bool
+	stored bool
+}
+
+// splitLeafs splits the leafs in the ones that go left and the ones that go
+// right at level lvl.
+func splitLeafs(leafs []*pathLeaf, lvl int) ([]*pathLeaf, []*pathLeaf) {
+	var left, right []*pathLeaf
+	for _, l := range leafs {
+		if l.path[lvl] {
+			right = append(right, l)
+		} else {
+			left = append(left, l)
+		}
+	}
+	return left, right
+}
+
+// addLeafs recursively adds the leafs under the node with key at level lvl
+// while updating the path, like addLeaf does for a single leaf.
+func (mt *MerkleTree) addLeafs(tx db.Tx, leafs []*pathLeaf, key *Hash, lvl int) (*Hash, error) {
+	if lvl > mt.maxLevels-1 {
+		return nil, ErrReachedMaxLevel
+	}
+	n, err := mt.GetNode(key)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Type {
+	case NodeTypeEmpty:
+		return mt.addLeafsEmpty(tx, leafs, lvl)
+	case NodeTypeLeaf:
+		hIndex, err := entryHIndex(mt.hasher, n.Entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range leafs {
+			if bytes.Equal(hIndex[:], l.hIndex[:]) {
+				return nil, ErrEntryIndexAlreadyExists
+			}
+		}
+		// The old leaf is pushed down together with the new leafs.
+		oldLeaf := &pathLeaf{node: n, hIndex: hIndex, path: getPath(mt.maxLevels, hIndex), stored: true}
+		return mt.addLeafsEmpty(tx, append(leafs[:len(leafs):len(leafs)], oldLeaf), lvl)
+	case NodeTypeMiddle:
+		left, right := splitLeafs(leafs, lvl)
+		childL, childR := n.ChildL, n.ChildR
+		if len(left) > 0 {
+			if childL, err = mt.addLeafs(tx, left, n.ChildL, lvl+1); err != nil {
+				return nil, err
+			}
+		}
+		if len(right) > 0 {
+			if childR, err = mt.addLeafs(tx, right, n.ChildR, lvl+1); err != nil {
+				return nil, err
+			}
+		}
+		return mt.addNode(tx, NewNodeMiddle(childL, childR))
+	default:
+		return nil, ErrInvalidNodeFound
+	}
+}
+
+// addLeafsEmpty builds the subtree with the leafs in place of an empty node at
+// level lvl, and returns its key.
+func (mt *MerkleTree) addLeafsEmpty(tx db.Tx, leafs []*pathLeaf, lvl int) (*Hash, error) {
+	if len(leafs) == 1 {
+		if leafs[0].stored {
+			return leafs[0].node.keyHasher(mt.hasher)
+		}
+		return mt.addNode(tx, leafs[0].node)
+	}
+	if lvl > mt.maxLevels-2 {
+		return nil, ErrReachedMaxLevel
+	}
+	left, right := splitLeafs(leafs, lvl)
+	childL, childR := &HashZero, &HashZero
+	var err error
+	if len(left) > 0 {
+		if childL, err = mt.addLeafsEmpty(tx, left, lvl+1); err != nil {
+			return nil, err
+		}
+	}
+	if len(right) > 0 {
+		if childR, err = mt.addLeafsEmpty(tx, right, lvl+1); err != nil {
+			return nil, err
+		}
+	}
+	return mt.addNode(tx, NewNodeMiddle(childL, childR))
+}
+
+// UpdateEntry replaces the value of the Entry in the MerkleTree that has the
+// same index as e.  It returns ErrEntryIndexNotFound if there is no Entry
+// with that index.
+func (mt *MerkleTree) UpdateEntry(e *Entry) error {
+	// verify that the MerkleTree is writable
+	if !mt.writable {
+		return ErrNotWritable
+	}
+	// verfy that the ElemBytes are valid and fit inside the mimc7 field.
+	if !CheckEntryInField(*e) {
+		return errors.New("Elements not inside the Finite Field over R")
+	}
+	tx, err := mt.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	mt.Lock()
+	defer mt.Unlock()
+
+	hIndex, err := entryHIndex(mt.hasher, e)
+	if err != nil {
+		return err
+	}
+	path := getPath(mt.maxLevels, hIndex)
+
+	rootKey, err := mt.txRootKey(tx)
+	if err != nil {
+		return err
+	}
+	newRootKey, err := mt.updateLeaf(tx, NewNodeLeaf(e), rootKey, 0, path)
+	if err != nil {
+		return err
+	}
+	mt.dbInsert(tx, rootNodeValue, DBEntryTypeRoot, newRootKey[:])
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	mt.rootKey = newRootKey
+	return nil
+}
+
+// updateLeaf recursively replaces the leaf with the same index as newLeaf
+// while updating the path.
+func (mt *MerkleTree) updateLeaf(tx db.Tx, newLeaf *Node, key *Hash,
+	lvl int, path []bool) (*Hash, error) {
+	if lvl > mt.maxLevels-1 {
+		return nil, ErrReachedMaxLevel
+	}
+	n, err := mt.GetNode(key)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Type {
+	case NodeTypeEmpty:
+		return nil, ErrEntryIndexNotFound
+	case NodeTypeLeaf:
+		hIndex, err := entryHIndex(mt.hasher, n.Entry)
+		if err != nil {
+			return nil, err
+		}
+		newLeafHi, err := entryHIndex(mt.hasher, newLeaf.Entry)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hIndex[:], newLeafHi[:]) {
+			return nil, ErrEntryIndexNotFound
+		}
+		return mt.addNode(tx, newLeaf)
+	case NodeTypeMiddle:
+		var newNodeMiddle *Node
+		if path[lvl] {
+			nextKey, err := mt.updateLeaf(tx, newLeaf, n.ChildR, lvl+1, path) // go right
+			if err != nil {
+				return nil, err
+			}
+			newNodeMiddle = NewNodeMiddle(n.ChildL, nextKey)
+		} else {
+			nextKey, err := mt.updateLeaf(tx, newLeaf, n.ChildL, lvl+1, path) // go left
+			if err != nil {
+				return nil, err
+			}
+			newNodeMiddle = NewNodeMiddle(nextKey, n.ChildR)
+		}
+		return mt.addNode(tx, newNodeMiddle)
+	default:
+		return nil, ErrInvalidNodeFound
+	}
+}
+
 // walk is a helper recursive function to iterate over all tree branches
 func (mt *MerkleTree) walk(key *Hash, f func(*Node)) error {
 	n, err := mt.GetNode(key)
@@ -523,6 +1004,18 @@ func (mt *MerkleTree) Walk(rootKey *Hash, f func(*Node)) error {
 	return err
 }
 
+// WalkLeafs iterates over all the leafs of a MerkleTree with the given rootKey
+// (or the current RootKey if rootKey is nil) from left to right, and calls f
+// with a copy of the Entry of each leaf.  rootKey can be any root of the
+// MerkleTree history that is in the storage.
+func (mt *MerkleTree) WalkLeafs(rootKey *Hash, f func(*Entry)) error {
+	return mt.Walk(rootKey, func(n *Node) {
+		if n.Type == NodeTypeLeaf {
+			f(n.Entry.Clone())
+		}
+	})
+}
+
 // GraphViz uses Walk function to generate a string GraphViz representation of the
 // tree and writes it to w
 func (mt *MerkleTree) GraphViz(w io.Writer, rootKey *Hash) error {
@@ -532,7 +1025,7 @@ node [fontname=Monospace,fontsize=10,shape=box]
 	cnt := 0
 	var errIn error
 	err := mt.Walk(rootKey, func(n *Node) {
-		k, err := n.Key()
+		k, err := n.keyHasher(mt.hasher)
 		if err != nil {
 			errIn = err
 		}
@@ -590,7 +1083,7 @@ func (mt *MerkleTree) DumpTree(w io.Writer, rootKey *Hash) error {
 	var errS error
 	err := mt.Walk(rootKey, func(n *Node) {
 		if n.Type != NodeTypeEmpty {
-			k, err := n.Key()
+			k, err := n.keyHasher(mt.hasher)
 			if err != nil {
 				errS = err
 			}
@@ -677,6 +1170,7 @@ func (mt *MerkleTree) ImportTree(i io.Reader) error {
 	mt.Lock()
 	defer mt.Unlock()
 
+	var rootKey *Hash
 	r := bufio.NewReader(i)
 	for {
 		k, v, err := deserializeKV(r)
@@ -685,19 +1179,26 @@ func (mt *MerkleTree) ImportTree(i io.Reader) error {
 		} else if err != nil {
 			return err
 		}
+		if bytes.Equal(k, rootNodeValue) {
+			// The root is dumped without the entry type.
+			if len(v) != ElemBytesLen {
+				return ErrInvalidDBValue
+			}
+			rootKey = &Hash{}
+			copy(rootKey[:], v)
+			mt.dbInsert(tx, rootNodeValue, DBEntryTypeRoot, rootKey[:])
+			continue
+		}
 		tx.Put(k, v)
 	}
-
-	v, err := tx.Get(rootNodeValue)
-	if err != nil {
-		return err
+	if rootKey == nil {
+		return db.ErrNotFound
 	}
 
 	if err := tx.Commit(); err != nil {
 		return err
 	}
-	mt.rootKey = &Hash{}
-	copy(mt.rootKey[:], v)
+	mt.rootKey = rootKey
 
 	return nil
 }
@@ -856,6 +1357,26 @@ func (p *Proof) UnmarshalJSON(bs []byte) error {
 	return nil
 }
 
+// MarshalBinary serializes the Proof in the compressed format of Bytes: a
+// flags byte (non-existence and node aux), the depth, the bitmap of non-empty
+// siblings, the non-empty siblings and the node aux if present.
+func (p Proof) MarshalBinary() ([]byte, error) {
+	return p.Bytes(), nil
+}
+
+// UnmarshalBinary deserializes a Proof serialized by MarshalBinary.
+func (p *Proof) UnmarshalBinary(bs []byte) error {
+	proof, err := NewProofFromBytes(bs)
+	if err != nil {
+		return err
+	}
+	if len(proof.Bytes()) != len(bs) {
+		return ErrInvalidProofBytes
+	}
+	*p = *proof
+	return nil
+}
+
 // String outputs a multiline string representation of the Proof.
 func (p Proof) String() string {
 	buf := bytes.NewBufferString("{")
@@ -945,7 +1466,7 @@ func (mt *MerkleTree) GenerateProof(hIndex *Hash, rootKey *Hash) (*Proof, error)
 		case NodeTypeEmpty:
 			return p, nil
 		case NodeTypeLeaf:
-			nHi, nHv, err := n.Entry.HiHv()
+			nHi, nHv, err := entryHiHv(mt.hasher, n.Entry)
 			if err != nil {
 				return nil, err
 			}
@@ -976,9 +1497,36 @@ func (mt *MerkleTree) GenerateProof(hIndex *Hash, rootKey *Hash) (*Proof, error)
 	return nil, ErrEntryIndexNotFound
 }
 
+// ProofFromLeaves builds an ephemeral in memory Merkle Tree with the given
+// leaves and returns the proof for hIndex in it together with the tree root.
+// Nothing is written to any persistent storage.
+func ProofFromLeaves(leaves []*Entry, hIndex *Hash, maxLevels int) (*Proof, *Hash, error) {
+	mt, err := NewMerkleTree(db.NewMemoryStorage(), maxLevels)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer mt.Storage().Close()
+	for _, leaf := range leaves {
+		if err := mt.AddEntry(leaf); err != nil {
+			return nil, nil, err
+		}
+	}
+	proof, err := mt.GenerateProof(hIndex, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, mt.RootKey(), nil
+}
+
 // VerifyProof verifies the Merkle Proof for the entry and root.
 func VerifyProof(rootKey *Hash, proof *Proof, hIndex, hValue *Hash) bool {
-	rootFromProof, err := RootFromProof(proof, hIndex, hValue)
+	return VerifyProofWithHasher(DefaultHasher, rootKey, proof, hIndex, hValue)
+}
+
+// VerifyProofWithHasher verifies the Merkle Proof for the entry and root of a
+// Merkle Tree that uses hasher.
+func VerifyProofWithHasher(hasher Hasher, rootKey *Hash, proof *Proof, hIndex, hValue *Hash) bool {
+	rootFromProof, err := RootFromProofWithHasher(hasher, proof, hIndex, hValue)
 	if err != nil {
 		return false
 	}
@@ -989,11 +1537,17 @@ func VerifyProof(rootKey *Hash, proof *Proof, hIndex, hValue *Hash) bool {
 // siblings are the ones in the proof with the claim hashing to hIndex and
 // hValue.
 func RootFromProof(proof *Proof, hIndex, hValue *Hash) (*Hash, error) {
+	return RootFromProofWithHasher(DefaultHasher, proof, hIndex, hValue)
+}
+
+// RootFromProofWithHasher calculates the root like RootFromProof for a Merkle
+// Tree that uses hasher.
+func RootFromProofWithHasher(hasher Hasher, proof *Proof, hIndex, hValue *Hash) (*Hash, error) {
 	sibIdx := len(proof.Siblings) - 1
 	var err error
 	var midKey *Hash
 	if proof.Existence {
-		midKey, err = LeafKey(hIndex, hValue)
+		midKey, err = leafKey(hasher, hIndex, hValue)
 		if err != nil {
 			return nil, err
 		}
@@ -1004,7 +1558,7 @@ func RootFromProof(proof *Proof, hIndex, hValue *Hash) (*Hash, error) {
 			if bytes.Equal(hIndex[:], proof.NodeAux.HIndex[:]) {
 				return nil, fmt.Errorf("Non-existence proof being checked against hIndex equal to nodeAux")
 			}
-			midKey, err = LeafKey(proof.NodeAux.HIndex, proof.NodeAux.HValue)
+			midKey, err = leafKey(hasher, proof.NodeAux.HIndex, proof.NodeAux.HValue)
 			if err != nil {
 				return nil, err
 			}
@@ -1020,12 +1574,12 @@ func RootFromProof(proof *Proof, hIndex, hValue *Hash) (*Hash, error) {
 			siblingKey = &HashZero
 		}
 		if path[lvl] {
-			midKey, err = NewNodeMiddle(siblingKey, midKey).Key()
+			midKey, err = NewNodeMiddle(siblingKey, midKey).keyHasher(hasher)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			midKey, err = NewNodeMiddle(midKey, siblingKey).Key()
+			midKey, err = NewNodeMiddle(midKey, siblingKey).keyHasher(hasher)
 			if err != nil {
 				return nil, err
 			}
@@ -1040,11 +1594,52 @@ func (mt *MerkleTree) GetNode(key *Hash) (*Node, error) {
 	if bytes.Equal(key[:], HashZero[:]) {
 		return NewNodeEmpty(), nil
 	}
+	if mt.nodeCache != nil {
+		if n, ok := mt.nodeCache.Get(*key); ok {
+			return n.(*Node), nil
+		}
+	}
 	nBytes, err := mt.storage.Get(key[:])
 	if err != nil {
 		return nil, err
 	}
-	return NewNodeFromBytes(nBytes)
+	n, err := NewNodeFromBytes(nBytes)
+	if err != nil {
+		return nil, err
+	}
+	if mt.nodeCache != nil {
+		// Set the key and the cached entry hashes so that the shared
+		// cached node is never written when they are requested.
+		n.key = &Hash{}
+		copy(n.key[:], key[:])
+		if n.Type == NodeTypeLeaf && mt.hasher == nil {
+			if _, _, err := n.Entry.HiHv(); err != nil {
+				return nil, err
+			}
+		}
+		mt.nodeCache.Add(*n.key, n)
+	}
+	return n, nil
+}
+
+// EvictNodeCache removes the nodes with keys from the node cache.  It must be
+// called after deleting the nodes from the storage, so that they are not
+// returned from the cache anymore.
+func (mt *MerkleTree) EvictNodeCache(keys []Hash) {
+	if mt.nodeCache == nil {
+		return
+	}
+	for _, key := range keys {
+		mt.nodeCache.Remove(key)
+	}
+}
+
+// NodeCacheLen returns the number of nodes in the node cache.
+func (mt *MerkleTree) NodeCacheLen() int {
+	if mt.nodeCache == nil {
+		return 0
+	}
+	return mt.nodeCache.Len()
 }
 
 // addNode adds a node into the MT.  Empty nodes are not stored in the tree;
@@ -1055,9 +1650,9 @@ func (mt *MerkleTree) addNode(tx db.Tx, n *Node) (*Hash, error) {
 		return nil, ErrNotWritable
 	}
 	if n.Type == NodeTypeEmpty {
-		return n.Key()
+		return n.keyHasher(mt.hasher)
 	}
-	k, err := n.Key()
+	k, err := n.keyHasher(mt.hasher)
 	if err != nil {
 		return nil, err
 	}
@@ -5,8 +5,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"strconv"
+	"sync"
 
 	//"strconv"
 	"testing"
@@ -88,6 +90,24 @@ func TestEntry(t *testing.T) {
 	testgen.CheckTestValue(t, "TestEntry0", hex.EncodeToString(hi[:]))
 }
 
+func TestEntryEqualsKey(t *testing.T) {
+	e0 := NewEntryFromInts(1, 2, 3, 4, 5, 6, 7, 8)
+	e1 := NewEntryFromInts(1, 2, 3, 4, 5, 6, 7, 8)
+	e2 := NewEntryFromInts(1, 2, 3, 4, 5, 6, 7, 9)
+	_, err := e1.HIndex()
+	require.Nil(t, err)
+	assert.True(t, e0.Equals(&e1))
+	assert.False(t, e0.Equals(&e2))
+	assert.True(t, e0.Equal(&e2))
+
+	set := make(map[[DataLen * ElemBytesLen]byte]*Entry)
+	for _, e := range []*Entry{&e0, &e1, &e2} {
+		set[e.Key()] = e
+	}
+	assert.Equal(t, 2, len(set))
+	assert.Equal(t, &e2, set[e2.Key()])
+}
+
 func TestData(t *testing.T) {
 	in := interfaceToInt64Array(testgen.GetTestValue("EntryInts0"))
 	data := IntArrayToData(in)
@@ -95,6 +115,29 @@ func TestData(t *testing.T) {
 	assert.Equal(t, data, *dataParsed)
 }
 
+func TestDataSlots(t *testing.T) {
+	e := NewEntryFromInts(1, 2, 3, 4, 5, 6, 7, 8)
+	data := e.Data
+	slot, err := data.Slot(0)
+	require.Nil(t, err)
+	assert.Equal(t, NewElemBytesFromBigInt(big.NewInt(1)), slot)
+	slot, err = data.Slot(DataLen - 1)
+	require.Nil(t, err)
+	assert.Equal(t, NewElemBytesFromBigInt(big.NewInt(8)), slot)
+	_, err = data.Slot(DataLen)
+	assert.Equal(t, ErrSlotOutOfRange, err)
+	_, err = data.Slot(-1)
+	assert.Equal(t, ErrSlotOutOfRange, err)
+	assert.Equal(t, e.Index(), data.IndexSlots())
+	assert.Equal(t, e.Value(), data.ValueSlots())
+
+	elem := NewElemBytesFromBigInt(big.NewInt(42))
+	require.Nil(t, data.SetSlot(IndexLen, elem))
+	assert.Equal(t, elem, data.ValueSlots()[0])
+	assert.Equal(t, ErrSlotOutOfRange, data.SetSlot(DataLen, elem))
+	assert.Equal(t, ErrSlotOutOfRange, data.SetSlot(-1, elem))
+}
+
 func TestAddEntry1(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -147,6 +190,286 @@ func TestAddEntry16(t *testing.T) {
 	testgen.CheckTestValue(t, "TestAddEntry16", mt1.RootKey().Hex())
 }
 
+func TestNodeCache(t *testing.T) {
+	mt1 := newTestingMerkle(t, 140)
+	defer mt1.Storage().Close()
+	mt2, err := NewMerkleTreeWithNodeCache(db.NewMemoryStorage(), 140, 8)
+	require.Nil(t, err)
+	defer mt2.Storage().Close()
+	for i := 0; i < 32; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt1.AddEntry(&e))
+		require.Nil(t, mt2.AddEntry(&e))
+	}
+	assert.Equal(t, mt1.RootKey(), mt2.RootKey())
+	assert.Equal(t, 8, mt2.NodeCacheLen())
+	assert.Equal(t, 0, mt1.NodeCacheLen())
+
+	for i := 0; i < 32; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		hIndex, err := e.HIndex()
+		require.Nil(t, err)
+		proof1, err := mt1.GenerateProof(hIndex, nil)
+		require.Nil(t, err)
+		proof2, err := mt2.GenerateProof(hIndex, nil)
+		require.Nil(t, err)
+		assert.Equal(t, proof1.Bytes(), proof2.Bytes())
+	}
+	assert.Equal(t, 8, mt2.NodeCacheLen())
+
+	// The evicted nodes deleted from the storage are not found.
+	tx, err := mt2.Storage().NewTx()
+	require.Nil(t, err)
+	tx.Delete(mt2.RootKey()[:])
+	require.Nil(t, tx.Commit())
+	_, err = mt2.GetNode(mt2.RootKey())
+	require.Nil(t, err)
+	mt2.EvictNodeCache([]Hash{*mt2.RootKey()})
+	_, err = mt2.GetNode(mt2.RootKey())
+	assert.Equal(t, db.ErrNotFound, err)
+	assert.Equal(t, 7, mt2.NodeCacheLen())
+}
+
+func TestUpdateEntry(t *testing.T) {
+	mt1 := newTestingMerkle(t, 140)
+	defer mt1.Storage().Close()
+	mt2 := newTestingMerkle(t, 140)
+	defer mt2.Storage().Close()
+	for i := 0; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt1.AddEntry(&e))
+		if i == 5 {
+			e = NewEntryFromInts(int64(i), 0, 0, 0, 42, 0, 0, 0)
+		}
+		require.Nil(t, mt2.AddEntry(&e))
+	}
+	e := NewEntryFromInts(5, 0, 0, 0, 42, 0, 0, 0)
+	require.Nil(t, mt1.UpdateEntry(&e))
+	assert.Equal(t, mt2.RootKey(), mt1.RootKey())
+
+	hIndex, err := e.HIndex()
+	require.Nil(t, err)
+	data, err := mt1.GetDataByIndex(hIndex)
+	require.Nil(t, err)
+	assert.Equal(t, e.Data, *data)
+
+	e = NewEntryFromInts(16, 0, 0, 0, 16, 0, 0, 0)
+	assert.Equal(t, ErrEntryIndexNotFound, mt1.UpdateEntry(&e))
+}
+
+func TestAddEntries(t *testing.T) {
+	mt1 := newTestingMerkle(t, 140)
+	defer mt1.Storage().Close()
+	mt2 := newTestingMerkle(t, 140)
+	defer mt2.Storage().Close()
+
+	// Add to an empty tree and to a tree with leafs and middle nodes.
+	for _, r := range [][2]int{{0, 1}, {1, 3}, {3, 40}, {40, 64}} {
+		entries := []Entrier{}
+		for i := r[0]; i < r[1]; i++ {
+			e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+			require.Nil(t, mt1.AddEntry(&e))
+			entries = append(entries, &testClaim{E: &e})
+		}
+		require.Nil(t, mt2.AddEntries(entries))
+		assert.Equal(t, mt1.RootKey(), mt2.RootKey())
+	}
+	require.Nil(t, mt2.AddEntries(nil))
+	assert.Equal(t, mt1.RootKey(), mt2.RootKey())
+
+	// Repeated indexes are rejected without adding any entry.
+	root := mt2.RootKey()
+	e0 := NewEntryFromInts(64, 0, 0, 0, 64, 0, 0, 0)
+	e1 := NewEntryFromInts(5, 0, 0, 0, 42, 0, 0, 0)
+	assert.Equal(t, ErrEntryIndexAlreadyExists, mt2.AddEntries([]Entrier{&testClaim{E: &e0}, &testClaim{E: &e1}}))
+	assert.Equal(t, ErrEntryIndexAlreadyExists, mt2.AddEntries([]Entrier{&testClaim{E: &e0}, &testClaim{E: &e0}}))
+	assert.Equal(t, root, mt2.RootKey())
+	hIndex0, err := e0.HIndex()
+	require.Nil(t, err)
+	_, err = mt2.GetDataByIndex(hIndex0)
+	assert.Equal(t, ErrEntryIndexNotFound, err)
+}
+
+func TestAddEntriesWithTx(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+	storage := mt.Storage().WithPrefix([]byte("other"))
+	e0 := NewEntryFromInts(0, 0, 0, 0, 0, 0, 0, 0)
+	e1 := NewEntryFromInts(1, 0, 0, 0, 1, 0, 0, 0)
+
+	atx, err := storage.NewTx()
+	require.Nil(t, err)
+	atx.Put([]byte("k"), []byte("v0"))
+	require.Nil(t, mt.AddEntriesWithTx([]Entrier{&testClaim{E: &e0}, &testClaim{E: &e1}}, atx))
+	v, err := storage.Get([]byte("k"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("v0"), v)
+
+	// The writes of atx are discarded if the entries are not added.
+	root := mt.RootKey()
+	atx, err = storage.NewTx()
+	require.Nil(t, err)
+	atx.Put([]byte("k"), []byte("v1"))
+	assert.Equal(t, ErrEntryIndexAlreadyExists, mt.AddEntriesWithTx([]Entrier{&testClaim{E: &e1}}, atx))
+	v, err = storage.Get([]byte("k"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("v0"), v)
+	assert.Equal(t, root, mt.RootKey())
+}
+
+func TestSnapshot(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+	e0 := NewEntryFromInts(0, 0, 0, 0, 0, 0, 0, 0)
+	require.Nil(t, mt.AddEntry(&e0))
+	root0 := mt.RootKey()
+	hIndex0, err := e0.HIndex()
+	require.Nil(t, err)
+	proof0, err := mt.GenerateProof(hIndex0, nil)
+	require.Nil(t, err)
+
+	snapshot, err := mt.Snapshot(root0)
+	require.Nil(t, err)
+	e1 := NewEntryFromInts(1, 0, 0, 0, 1, 0, 0, 0)
+	require.Nil(t, mt.AddEntry(&e1))
+	assert.NotEqual(t, root0, mt.RootKey())
+
+	// The snapshot keeps the old root and generates proofs for it.
+	assert.Equal(t, root0, snapshot.RootKey())
+	proof, err := snapshot.GenerateProof(hIndex0, nil)
+	require.Nil(t, err)
+	assert.Equal(t, proof0, proof)
+	assert.Equal(t, ErrNotWritable, snapshot.AddEntry(&e1))
+	assert.Equal(t, ErrNotWritable, snapshot.UpdateEntry(&e0))
+
+	_, err = mt.Snapshot(NewHashFromBigInt(big.NewInt(42)))
+	assert.Equal(t, db.ErrNotFound, err)
+}
+
+func TestTwoInstancesSameStorage(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	mt1, err := NewMerkleTree(storage, 140)
+	require.Nil(t, err)
+	mt2, err := NewMerkleTree(storage, 140)
+	require.Nil(t, err)
+
+	e1 := NewEntryFromInts(1, 0, 0, 0, 1, 0, 0, 0)
+	e2 := NewEntryFromInts(2, 0, 0, 0, 2, 0, 0, 0)
+	require.Nil(t, mt1.AddEntry(&e1))
+	// mt2 builds on the root stored by mt1 instead of its stale one.
+	require.Nil(t, mt2.AddEntry(&e2))
+
+	// Same for batches.
+	e3 := NewEntryFromInts(3, 0, 0, 0, 3, 0, 0, 0)
+	e4 := NewEntryFromInts(4, 0, 0, 0, 4, 0, 0, 0)
+	require.Nil(t, mt1.AddEntries([]Entrier{&testClaim{E: &e3}}))
+	require.Nil(t, mt2.AddEntries([]Entrier{&testClaim{E: &e4}}))
+
+	// Same for updates.
+	e1Updated := NewEntryFromInts(1, 0, 0, 0, 3, 0, 0, 0)
+	require.Nil(t, mt1.UpdateEntry(&e1Updated))
+	e2Updated := NewEntryFromInts(2, 0, 0, 0, 4, 0, 0, 0)
+	require.Nil(t, mt2.UpdateEntry(&e2Updated))
+
+	mt, err := NewMerkleTree(storage, 140)
+	require.Nil(t, err)
+	assert.Equal(t, mt2.RootKey(), mt.RootKey())
+	for _, e := range []Entry{e1Updated, e2Updated, e3, e4} {
+		hIndex, err := e.HIndex()
+		require.Nil(t, err)
+		data, err := mt.GetDataByIndex(hIndex)
+		require.Nil(t, err)
+		assert.Equal(t, e.Data, *data)
+	}
+}
+
+func TestClone(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+	var hIndexes []*Hash
+	for i := 0; i < 8; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt.AddEntry(&e))
+		hIndex, err := e.HIndex()
+		require.Nil(t, err)
+		hIndexes = append(hIndexes, hIndex)
+	}
+	clone, err := mt.Clone()
+	require.Nil(t, err)
+	assert.Equal(t, mt.RootKey(), clone.RootKey())
+	root := clone.RootKey()
+
+	// Proofs are generated from the clone while the MerkleTree is updated.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(hIndexes))
+	for _, hIndex := range hIndexes {
+		wg.Add(1)
+		go func(hIndex *Hash) {
+			defer wg.Done()
+			proof, err := clone.GenerateProof(hIndex, nil)
+			if err == nil && !proof.Existence {
+				err = fmt.Errorf("proof of non existence for %v", hIndex)
+			}
+			errs <- err
+		}(hIndex)
+	}
+	for i := 8; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt.AddEntry(&e))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, root, clone.RootKey())
+	assert.NotEqual(t, root, mt.RootKey())
+	e := NewEntryFromInts(42, 0, 0, 0, 0, 0, 0, 0)
+	assert.Equal(t, ErrNotWritable, clone.AddEntry(&e))
+}
+
+type hasherCount struct {
+	n int
+}
+
+func (h *hasherCount) Hash(inputs []*big.Int) (*big.Int, error) {
+	h.n++
+	return HasherMiMC7{}.Hash(inputs)
+}
+
+func TestMerkleTreeWithHasher(t *testing.T) {
+	mt1 := newTestingMerkle(t, 140)
+	defer mt1.Storage().Close()
+	hasher := &hasherCount{}
+	mt2, err := NewMerkleTreeWithHasher(db.NewMemoryStorage(), 140, hasher)
+	require.Nil(t, err)
+	defer mt2.Storage().Close()
+	mt3, err := NewMerkleTreeWithHasher(db.NewMemoryStorage(), 140, HasherMiMC7{})
+	require.Nil(t, err)
+	defer mt3.Storage().Close()
+	for i := 0; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt1.AddEntry(&e))
+		// The hashes cached in the entry by mt1 are not used by mt2.
+		require.Nil(t, mt2.AddEntry(&e))
+		e = NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt3.AddEntry(&e))
+	}
+	assert.NotEqual(t, 0, hasher.n)
+	assert.NotEqual(t, mt1.RootKey(), mt2.RootKey())
+	assert.Equal(t, mt3.RootKey(), mt2.RootKey())
+
+	e := NewEntryFromInts(5, 0, 0, 0, 5, 0, 0, 0)
+	hi, hv, err := mt2.HashEntry(&e)
+	require.Nil(t, err)
+	proof, err := mt2.GenerateProof(hi, nil)
+	require.Nil(t, err)
+	assert.True(t, proof.Existence)
+	assert.True(t, VerifyProofWithHasher(HasherMiMC7{}, mt2.RootKey(), proof, hi, hv))
+	assert.False(t, VerifyProof(mt2.RootKey(), proof, hi, hv))
+	require.Nil(t, mt2.EntryExists(&e, nil))
+}
+
 func TestAddEntryRepeatIndex(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -211,6 +534,32 @@ func TestGetEntry2(t *testing.T) {
 	}
 }
 
+func TestGetEntryByIndex(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+
+	e0 := NewEntryFromInts(1, 0, 0, 0, 10, 0, 0, 0)
+	require.Nil(t, mt.AddEntry(&e0))
+	root0 := mt.RootKey()
+	hi, err := e0.HIndex()
+	require.Nil(t, err)
+	e1 := NewEntryFromInts(1, 0, 0, 0, 11, 0, 0, 0)
+	require.Nil(t, mt.UpdateEntry(&e1))
+
+	entry, err := mt.GetEntryByIndex(hi)
+	require.Nil(t, err)
+	assert.Equal(t, e1.Data, entry.Data)
+	entry, err = mt.GetEntryByIndexAtRoot(hi, root0)
+	require.Nil(t, err)
+	assert.Equal(t, e0.Data, entry.Data)
+
+	e2 := NewEntryFromInts(2, 0, 0, 0, 10, 0, 0, 0)
+	hi2, err := e2.HIndex()
+	require.Nil(t, err)
+	_, err = mt.GetEntryByIndex(hi2)
+	assert.Equal(t, ErrEntryIndexNotFound, err)
+}
+
 func TestGenerateProof1(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -318,6 +667,40 @@ func TestVerifyProof1(t *testing.T) {
 	testgen.CheckTestValue(t, "TestVerifyProof1", hex.EncodeToString(proof.Bytes()))
 }
 
+func TestProofFromLeaves(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+
+	leaves := []*Entry{}
+	for i := 0; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, 0, 0, 0, 0)
+		if err := mt.AddEntry(&e); err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, &e)
+	}
+
+	e := NewEntryFromInts(int64(4), 0, 0, 0, 0, 0, 0, 0)
+	hi, hv, err := e.HiHv()
+	assert.Nil(t, err)
+	proof, err := mt.GenerateProof(hi, nil)
+	assert.Nil(t, err)
+
+	proofFromLeaves, root, err := ProofFromLeaves(leaves, hi, 140)
+	assert.Nil(t, err)
+	assert.Equal(t, mt.RootKey(), root)
+	assert.Equal(t, proof.Bytes(), proofFromLeaves.Bytes())
+	assert.True(t, VerifyProof(root, proofFromLeaves, hi, hv))
+
+	// Proof of non existence
+	e = NewEntryFromInts(int64(42), 0, 0, 0, 0, 0, 0, 0)
+	hi, err = e.HIndex()
+	assert.Nil(t, err)
+	proofFromLeaves, _, err = ProofFromLeaves(leaves, hi, 140)
+	assert.Nil(t, err)
+	assert.False(t, proofFromLeaves.Existence)
+}
+
 func TestVerifyProofEmpty(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -450,6 +833,16 @@ func TestVerifyProofFalse(t *testing.T) {
 	assert.Nil(t, err)
 	proof.NodeAux = &NodeAux{HIndex: hi, HValue: hv}
 	assert.True(t, !VerifyProof(mt.RootKey(), proof, hi, hv))
+
+	// Invalid existence proof (tampered sibling)
+	proof, err = mt.GenerateProof(hi, nil)
+	require.Nil(t, err)
+	require.True(t, VerifyProof(mt.RootKey(), proof, hi, hv))
+	require.NotEqual(t, 0, len(proof.Siblings))
+	sibling := *proof.Siblings[0]
+	sibling[0] ^= 0x01
+	proof.Siblings[0] = &sibling
+	assert.True(t, !VerifyProof(mt.RootKey(), proof, hi, hv))
 }
 
 func TestProofFromBytesSmall(t *testing.T) {
@@ -485,6 +878,42 @@ func TestProofFromBytesSmall(t *testing.T) {
 	assert.Equal(t, proof2, proof2Parsed)
 }
 
+func TestProofMarshalBinary(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+
+	for i := 0; i < 8; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, 0, 0, 0, 0)
+		require.Nil(t, mt.AddEntry(&e))
+	}
+
+	// Existence, non-existence with empty aux and non-existence with node aux
+	for _, tc := range []struct {
+		i         int64
+		existence bool
+		nodeAux   bool
+	}{{4, true, false}, {13, false, false}, {10, false, true}} {
+		e := NewEntryFromInts(tc.i, 0, 0, 0, 0, 0, 0, 0)
+		hi, hv, err := e.HiHv()
+		require.Nil(t, err)
+		proof, err := mt.GenerateProof(hi, nil)
+		require.Nil(t, err)
+		assert.Equal(t, tc.existence, proof.Existence)
+		assert.Equal(t, tc.nodeAux, proof.NodeAux != nil)
+
+		proofBytes, err := proof.MarshalBinary()
+		require.Nil(t, err)
+		assert.Equal(t, proof.Bytes(), proofBytes)
+		var proofLoad Proof
+		require.Nil(t, proofLoad.UnmarshalBinary(proofBytes))
+		assert.Equal(t, proof, &proofLoad)
+		assert.True(t, VerifyProof(mt.RootKey(), &proofLoad, hi, hv))
+
+		assert.Equal(t, ErrInvalidProofBytes, proofLoad.UnmarshalBinary(append(proofBytes, 0)))
+		assert.Equal(t, ErrInvalidProofBytes, proofLoad.UnmarshalBinary(proofBytes[:len(proofBytes)-1]))
+	}
+}
+
 func TestProofFromBytesBig(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -533,6 +962,42 @@ func TestProofFromBytesBig(t *testing.T) {
 	assert.Equal(t, proof2, proof2Parsed)
 }
 
+// benchmarkEntriers returns n Entriers with different indexes.
+func benchmarkEntriers(n int) []Entrier {
+	entries := make([]Entrier, n)
+	for i := range entries {
+		// Keep each int below 256, as they are copied into the elements
+		// without padding.
+		e := NewEntryFromInts(int64(i%256), int64(i/256), 0, 0, int64(i), 0, 0, 0)
+		entries[i] = &testClaim{E: &e}
+	}
+	return entries
+}
+
+func BenchmarkAddEntry10k(b *testing.B) {
+	entries := benchmarkEntriers(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mt := newTestingMerkle(b, 140)
+		for _, e := range entries {
+			if err := mt.AddClaim(e); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkAddEntries10k(b *testing.B) {
+	entries := benchmarkEntriers(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mt := newTestingMerkle(b, 140)
+		if err := mt.AddEntries(entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 // BenchmarkAddEntry populates a merkletree and then performs benchmarks adding multiple times an Entry
 // To generate the output for the flamegraph:
 // go test -run BenchmarkAddEntry -bench=BenchmarkAddEntry -cpuprofile=addentry-benchmark.out
@@ -701,6 +1166,49 @@ func TestMTWalk(t *testing.T) {
 	}
 }
 
+func TestMTWalkLeafs(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+
+	entries := []Entry{}
+	for i := 0; i < 8; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, 0, 0, 0, 0)
+		require.Nil(t, mt.AddEntry(&e))
+		entries = append(entries, e)
+	}
+	oldRoot := mt.RootKey()
+	for i := 8; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, 0, 0, 0, 0)
+		require.Nil(t, mt.AddEntry(&e))
+	}
+
+	walkLeafs := func(rootKey *Hash) []*Entry {
+		leafs := []*Entry{}
+		require.Nil(t, mt.WalkLeafs(rootKey, func(e *Entry) {
+			leafs = append(leafs, e)
+		}))
+		return leafs
+	}
+	assert.Equal(t, 16, len(walkLeafs(nil)))
+	// The order is deterministic
+	assert.Equal(t, walkLeafs(nil), walkLeafs(mt.RootKey()))
+
+	// Walking an old root returns the entries of that root
+	leafsOld := walkLeafs(oldRoot)
+	require.Equal(t, len(entries), len(leafsOld))
+	for _, e := range entries {
+		found := false
+		for _, l := range leafsOld {
+			if e.Data == l.Data {
+				found = true
+			}
+		}
+		assert.True(t, found)
+	}
+
+	assert.Equal(t, 0, len(walkLeafs(&HashZero)))
+}
+
 func TestMTWalkGraphViz(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -777,6 +1285,13 @@ func TestDumpTreeImportTree(t *testing.T) {
 	assert.Nil(t, err)
 	dumpedTree2 := w.Bytes()
 	assert.Equal(t, dumpedTree, dumpedTree2)
+
+	// The imported root is stored like the one of a new tree.
+	rmt, err := NewMerkleTree(imt.Storage(), 140)
+	require.Nil(t, err)
+	assert.Equal(t, mt.RootKey(), rmt.RootKey())
+	e := NewEntryFromInts(42, 0, 0, 0, 0, 0, 0, 0)
+	assert.Nil(t, imt.AddEntry(&e))
 }
 
 func TestDumpClaimsIoWriter(t *testing.T) {
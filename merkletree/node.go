@@ -84,29 +84,39 @@ func NewNodeFromBytes(b []byte) (*Node, error) {
 // LeafKey computes the key of a leaf node given the hIndex and hValue of the
 // entry of the leaf.
 func LeafKey(hIndex, hValue *Hash) (*Hash, error) {
+	return leafKey(DefaultHasher, hIndex, hValue)
+}
+
+func leafKey(hasher Hasher, hIndex, hValue *Hash) (*Hash, error) {
 	// return HashElems(ElemBytesOne, ElemBytes(*hIndex), ElemBytes(*hValue))
-	return HashElemsKey(big.NewInt(1), ElemBytes(*hIndex), ElemBytes(*hValue))
+	return hashElemsKey(hasher, big.NewInt(1), ElemBytes(*hIndex), ElemBytes(*hValue))
 }
 
 // Key computes the key of the node by hashing the content in a specific way
 // for each type of node.  This key is used as the hash of the merklee tree for
 // each node.
 func (n *Node) Key() (*Hash, error) {
+	return n.keyHasher(nil)
+}
+
+// keyHasher computes the key of the node with the hasher.  If hasher is nil,
+// the DefaultHasher and the cached hashes of the entry are used.
+func (n *Node) keyHasher(hasher Hasher) (*Hash, error) {
 	if n.key == nil { // Cache the key to avoid repeated hash computations.
 		// NOTE: We are not using the type to calculate the hash!
 		switch n.Type {
 		case NodeTypeMiddle: // H(ChildL || ChildR)
 			var err error
-			n.key, err = HashElems(ElemBytes(*n.ChildL), ElemBytes(*n.ChildR))
+			n.key, err = hashElems(hasherOrDefault(hasher), ElemBytes(*n.ChildL), ElemBytes(*n.ChildR))
 			if err != nil {
 				return nil, err
 			}
 		case NodeTypeLeaf: // H(Data...)
-			hi, hv, err := n.Entry.HiHv()
+			hi, hv, err := entryHiHv(hasher, n.Entry)
 			if err != nil {
 				return nil, err
 			}
-			n.key, err = LeafKey(hi, hv)
+			n.key, err = leafKey(hasherOrDefault(hasher), hi, hv)
 			if err != nil {
 				return nil, err
 			}
@@ -7,9 +7,11 @@ import (
 	// "fmt"
 	"bytes"
 	"math/big"
+	"sort"
 
 	"github.com/iden3/go-iden3-core/common"
 	common3 "github.com/iden3/go-iden3-core/common"
+	"github.com/iden3/go-iden3-crypto/mimc7"
 	"github.com/iden3/go-iden3-crypto/poseidon"
 )
 
@@ -49,10 +51,52 @@ func (h *Hash) UnmarshalText(bs []byte) error {
 	return common3.HexDecodeInto(h[:], bs)
 }
 
+// MarshalBinary returns the bytes of the Hash.
+func (h Hash) MarshalBinary() ([]byte, error) {
+	return h.Bytes(), nil
+}
+
+// UnmarshalBinary sets the Hash from its bytes, returning ErrHashBadSize if
+// bs doesn't have ElemBytesLen bytes.
+func (h *Hash) UnmarshalBinary(bs []byte) error {
+	return h.SetBytes(bs)
+}
+
+// SetBytes sets the Hash to a copy of b, which is in the same byte order
+// returned by Bytes.  It returns ErrHashBadSize if b doesn't have
+// ElemBytesLen bytes, so that a truncated or corrupted stored hash is
+// detected.
+func (h *Hash) SetBytes(b []byte) error {
+	if len(b) != ElemBytesLen {
+		return fmt.Errorf("%w: %v bytes", ErrHashBadSize, len(b))
+	}
+	copy(h[:], b)
+	return nil
+}
+
 func (h1 *Hash) Equals(h2 *Hash) bool {
 	return bytes.Equal(h1[:], h2[:])
 }
 
+// Cmp compares the integers represented by h1 and h2, comparing their bytes
+// in big-endian order (the Hash bytes are little-endian).  It returns -1 if
+// h1 < h2, 0 if h1 == h2 and +1 if h1 > h2.
+func (h1 *Hash) Cmp(h2 *Hash) int {
+	for i := len(h1) - 1; i >= 0; i-- {
+		if h1[i] < h2[i] {
+			return -1
+		} else if h1[i] > h2[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// SortHashes sorts hs in increasing order by Cmp.
+func SortHashes(hs []*Hash) {
+	sort.Slice(hs, func(i, j int) bool { return hs[i].Cmp(hs[j]) < 0 })
+}
+
 func ElemBytesToBigInts(elems ...ElemBytes) []*big.Int {
 	ints := make([]*big.Int, len(elems))
 	for i, elem := range elems {
@@ -71,45 +115,114 @@ func ElemBytesToPoseidonInput(elems ...ElemBytes) ([poseidon.T]*big.Int, error)
 	return b, nil
 }
 
-// HashElems performs a poseidon hash over the array of ElemBytes.
-// Uses poseidon.PoseidonHash to be compatible with the circom circuits
-// implementations.
-// The maxim slice input size is poseidon.T
+// Hasher is the hash function used to compute the keys of the Merkle Tree
+// nodes and the hashes of the entries.
+type Hasher interface {
+	Hash(inputs []*big.Int) (*big.Int, error)
+}
+
+// HasherPoseidon is a Hasher that uses poseidon.PoseidonHash to be compatible
+// with the circom circuits implementations.  The inputs are padded with zeros
+// to poseidon.T elements.
+type HasherPoseidon struct{}
+
+// Hash implements the Hasher interface.
+func (HasherPoseidon) Hash(inputs []*big.Int) (*big.Int, error) {
+	if len(inputs) > poseidon.T {
+		return nil, fmt.Errorf("poseidon input can not be bigger than %v", poseidon.T)
+	}
+	var b [poseidon.T]*big.Int
+	for i := range b {
+		b[i] = big.NewInt(0)
+	}
+	copy(b[:], inputs)
+	return poseidon.PoseidonHash(b)
+}
+
+// HasherMiMC7 is a Hasher that uses mimc7.Hash.
+type HasherMiMC7 struct{}
+
+// Hash implements the Hasher interface.
+func (HasherMiMC7) Hash(inputs []*big.Int) (*big.Int, error) {
+	return mimc7.Hash(inputs, nil)
+}
+
+// DefaultHasher is the Hasher used by HashElems, HashElemsKey, the Entry and
+// Node hash methods and the Merkle Trees created without a Hasher.  It must
+// not be changed while there are Merkle Trees in use.
+var DefaultHasher Hasher = HasherPoseidon{}
+
+// HashElems performs a hash with the DefaultHasher over the array of
+// ElemBytes.  The maxim slice input size is poseidon.T.  See HashElemsSafe.
 func HashElems(elems ...ElemBytes) (*Hash, error) {
+	return HashElemsSafe(elems...)
+}
+
+// HashElemsKey performs a hash with the DefaultHasher over the array of
+// ElemBytes followed by the key.  See HashElemsKeySafe.
+func HashElemsKey(key *big.Int, elems ...ElemBytes) (*Hash, error) {
+	return HashElemsKeySafe(key, elems...)
+}
+
+// HashElemsSafe performs a hash with the DefaultHasher over the array of
+// ElemBytes, returning an error instead of panicking if there are more than
+// poseidon.T elements or any of them is not inside the finite field, so it
+// can be used with ElemBytes from untrusted sources.
+func HashElemsSafe(elems ...ElemBytes) (*Hash, error) {
 	if len(elems) > poseidon.T {
 		return nil, fmt.Errorf("HashElems input can not be bigger than %v", poseidon.T)
 	}
+	if err := checkElemsInField(elems); err != nil {
+		return nil, err
+	}
+	return hashElems(DefaultHasher, elems...)
+}
 
-	bi, err := ElemBytesToPoseidonInput(elems...)
-	if err != nil {
+// HashElemsKeySafe is like HashElemsSafe but the key is hashed after the
+// ElemBytes, so there can be up to poseidon.T-1 of them.
+func HashElemsKeySafe(key *big.Int, elems ...ElemBytes) (*Hash, error) {
+	if len(elems) > poseidon.T-1 {
+		return nil, fmt.Errorf("HashElemsKey input can not be bigger than %v", poseidon.T-1)
+	}
+	if err := checkElemsInField(elems); err != nil {
 		return nil, err
 	}
+	if key != nil {
+		if _, err := NewElemBytesChecked(key); err != nil {
+			return nil, fmt.Errorf("key: %w", err)
+		}
+	}
+	return hashElemsKey(DefaultHasher, key, elems...)
+}
+
+// checkElemsInField returns ErrElemNotInField if any of the elems is not
+// inside the finite field.
+func checkElemsInField(elems []ElemBytes) error {
+	for i := range elems {
+		if _, err := NewElemBytesChecked(elems[i].BigInt()); err != nil {
+			return fmt.Errorf("element %v: %w", i, err)
+		}
+	}
+	return nil
+}
 
-	poseidonHash, err := poseidon.PoseidonHash(bi)
+func hashElems(hasher Hasher, elems ...ElemBytes) (*Hash, error) {
+	h, err := hasher.Hash(ElemBytesToBigInts(elems...))
 	if err != nil {
 		return nil, err
 	}
-	return NewHashFromBigInt(poseidonHash), nil
+	return NewHashFromBigInt(h), nil
 }
 
-// HashElemsKey performs a poseidon hash over the array of ElemBytes.
-func HashElemsKey(key *big.Int, elems ...ElemBytes) (*Hash, error) {
-	if len(elems) > poseidon.T-1 {
-		return nil, fmt.Errorf("HashElemsKey input can not be bigger than %v", poseidon.T-1)
-	}
+func hashElemsKey(hasher Hasher, key *big.Int, elems ...ElemBytes) (*Hash, error) {
 	if key == nil {
 		key = new(big.Int).SetInt64(0)
 	}
-	bi, err := ElemBytesToPoseidonInput(elems...)
-	if err != nil {
-		return nil, err
-	}
-	copy(bi[len(elems):], []*big.Int{key})
-	poseidonHash, err := poseidon.PoseidonHash(bi)
+	h, err := hasher.Hash(append(ElemBytesToBigInts(elems...), key))
 	if err != nil {
 		return nil, err
 	}
-	return NewHashFromBigInt(poseidonHash), nil
+	return NewHashFromBigInt(h), nil
 }
 
 // getPath returns the binary path, from the root to the leaf.
@@ -161,6 +274,22 @@ func NewEntryFromBytes(b []byte) (*Entry, error) {
 	return &Entry{Data: *NewDataFromBytes(data)}, nil
 }
 
+// NewEntryFromBytesChecked is like NewEntryFromBytes but it returns
+// ErrElemNotInField if any of the elements of the entry is not inside the
+// finite field.
+func NewEntryFromBytesChecked(b []byte) (*Entry, error) {
+	e, err := NewEntryFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	for i := range e.Data {
+		if _, err := NewElemBytesChecked(e.Data[i].BigInt()); err != nil {
+			return nil, fmt.Errorf("element %v: %w", i, err)
+		}
+	}
+	return e, nil
+}
+
 func NewEntryFromIntArray(a []int64) Entry {
 	return NewEntryFromInts(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7])
 }
@@ -1,13 +1,19 @@
 package merkletree
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
 	"testing"
 
 	"github.com/iden3/go-iden3-core/common"
 	"github.com/iden3/go-iden3-core/testgen"
+	"github.com/iden3/go-iden3-crypto/constants"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetSetBitmap(t *testing.T) {
@@ -89,3 +95,92 @@ func BenchmarkHashElems(b *testing.B) {
 		HashElems(ds[i][:]...) //nolint:errcheck
 	}
 }
+
+func TestHashElemsSafe(t *testing.T) {
+	d := IntsToData(1, 2, 3, 4, 5, 6, 7, 8)
+	h, err := HashElems(d[:4]...)
+	require.Nil(t, err)
+	hSafe, err := HashElemsSafe(d[:4]...)
+	require.Nil(t, err)
+	assert.Equal(t, h, hSafe)
+
+	q := NewElemBytesFromBigInt(constants.Q)
+	_, err = HashElemsSafe(d[0], q)
+	assert.True(t, errors.Is(err, ErrElemNotInField))
+	_, err = HashElems(d[0], q)
+	assert.True(t, errors.Is(err, ErrElemNotInField))
+	_, err = HashElemsKeySafe(big.NewInt(1), d[0], q)
+	assert.True(t, errors.Is(err, ErrElemNotInField))
+	_, err = HashElemsKeySafe(constants.Q, d[0])
+	assert.True(t, errors.Is(err, ErrElemNotInField))
+	_, err = HashElemsSafe(d[:]...)
+	assert.NotNil(t, err)
+}
+
+func TestNewEntryFromBytesChecked(t *testing.T) {
+	_, err := NewElemBytesChecked(big.NewInt(-1))
+	assert.Equal(t, ErrElemNotInField, err)
+	_, err = NewElemBytesChecked(constants.Q)
+	assert.Equal(t, ErrElemNotInField, err)
+	qMinus1 := new(big.Int).Sub(constants.Q, big.NewInt(1))
+	e, err := NewElemBytesChecked(qMinus1)
+	require.Nil(t, err)
+	assert.Equal(t, qMinus1, e.BigInt())
+
+	entry := NewEntryFromInts(1, 2, 3, 4, 5, 6, 7, 8)
+	entryChecked, err := NewEntryFromBytesChecked(entry.Bytes())
+	require.Nil(t, err)
+	assert.Equal(t, entry.Data, entryChecked.Data)
+
+	entryBytes := entry.Bytes()
+	q := NewElemBytesFromBigInt(constants.Q)
+	copy(entryBytes[5*ElemBytesLen:], q[:])
+	_, err = NewEntryFromBytesChecked(entryBytes)
+	assert.True(t, errors.Is(err, ErrElemNotInField))
+	_, err = NewEntryFromBytes(entryBytes)
+	assert.Nil(t, err)
+}
+
+func TestHashMarshalBinary(t *testing.T) {
+	h := NewHashFromBigInt(big.NewInt(1234))
+	var buf bytes.Buffer
+	require.Nil(t, gob.NewEncoder(&buf).Encode(h))
+	var hDec Hash
+	require.Nil(t, gob.NewDecoder(&buf).Decode(&hDec))
+	assert.Equal(t, *h, hDec)
+
+	hBytes, err := h.MarshalBinary()
+	require.Nil(t, err)
+	assert.Equal(t, h[:], hBytes)
+	err = hDec.UnmarshalBinary(hBytes[1:])
+	assert.True(t, errors.Is(err, ErrHashBadSize))
+	err = hDec.UnmarshalBinary(append(hBytes, 0))
+	assert.True(t, errors.Is(err, ErrHashBadSize))
+}
+
+func TestHashSetBytes(t *testing.T) {
+	h := NewHashFromBigInt(big.NewInt(1234))
+	var hSet Hash
+	require.Nil(t, hSet.SetBytes(h.Bytes()))
+	assert.Equal(t, *h, hSet)
+	assert.True(t, errors.Is(hSet.SetBytes(h.Bytes()[:ElemBytesLen-1]), ErrHashBadSize))
+	assert.True(t, errors.Is(hSet.SetBytes(nil), ErrHashBadSize))
+	assert.Equal(t, *h, hSet)
+}
+
+func TestHashCmp(t *testing.T) {
+	h1 := NewHashFromBigInt(big.NewInt(1))
+	h256 := NewHashFromBigInt(big.NewInt(256))
+	h257 := NewHashFromBigInt(big.NewInt(257))
+	assert.Equal(t, 0, h1.Cmp(NewHashFromBigInt(big.NewInt(1))))
+	assert.Equal(t, -1, h1.Cmp(h256))
+	assert.Equal(t, 1, h257.Cmp(h256))
+	assert.Equal(t, -1, HashZero.Cmp(h1))
+
+	hs := []*Hash{h257, &HashZero, h1, h256}
+	SortHashes(hs)
+	assert.Equal(t, []*Hash{&HashZero, h1, h256, h257}, hs)
+	for i := 1; i < len(hs); i++ {
+		assert.Equal(t, -1, hs[i-1].BigInt().Cmp(hs[i].BigInt()))
+	}
+}
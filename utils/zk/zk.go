@@ -222,6 +222,8 @@ type ZkFilesBasename struct {
 }
 
 // ZkFiles allows convenient access to the files required for zk proving and verifying.
+// The loaded files are cached under a mutex, so a ZkFiles can be used
+// concurrently, for example to generate proofs from multiple goroutines.
 type ZkFiles struct {
 	Url                 string
 	Path                string
@@ -1,10 +1,17 @@
 package zk
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path"
+	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,3 +24,47 @@ func TestPubSignals(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, p0, p1)
 }
+
+func TestZkFilesConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	wasm := []byte("circuit wasm")
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, "circuit.wasm"), wasm, 0600))
+	hash := sha256.Sum256(wasm)
+	// The file exists, so it's not downloaded from the url.
+	zkFiles := NewZkFiles("http://127.0.0.1:1", dir, ProvingKeyFormatJSON,
+		ZkFilesHashes{WitnessCalcWASM: hex.EncodeToString(hash[:])}, true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wasmLoad, err := zkFiles.WitnessCalcWASM()
+			assert.Nil(t, err)
+			assert.Equal(t, wasm, wasmLoad)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestZkFilesVerificationKeyError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The file doesn't exist and can't be downloaded.
+	zkFiles := NewZkFiles("http://127.0.0.1:1", dir, ProvingKeyFormatJSON, ZkFilesHashes{}, true)
+	_, err = zkFiles.VerificationKey()
+	assert.NotNil(t, err)
+
+	// The file is corrupt.
+	vkJSON := []byte("{\"protocol\": ")
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, "verification_key.json"), vkJSON, 0600))
+	hash := sha256.Sum256(vkJSON)
+	zkFiles = NewZkFiles("http://127.0.0.1:1", dir, ProvingKeyFormatJSON,
+		ZkFilesHashes{VerificationKey: hex.EncodeToString(hash[:])}, true)
+	_, err = zkFiles.VerificationKey()
+	assert.NotNil(t, err)
+}